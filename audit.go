@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+
+	"github.com/rfjakob/gocryptfs/internal/audit"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// openAuditLog opens the "-audit-log" file and records the mount.
+func openAuditLog(args *argContainer) *audit.Log {
+	l, err := audit.Open(args.auditlog)
+	if err != nil {
+		tlog.Fatal.Printf("-audit-log: %v", err)
+		os.Exit(exitcodes.AuditLog)
+	}
+	err = l.Write(audit.Record{
+		Op:     "mount",
+		Path:   args.cipherdir,
+		Arg:    args.mountpoint,
+		UID:    uint32(os.Getuid()),
+		GID:    uint32(os.Getgid()),
+		PID:    uint32(os.Getpid()),
+		Status: "OK",
+	})
+	if err != nil {
+		tlog.Fatal.Printf("-audit-log: %v", err)
+		os.Exit(exitcodes.AuditLog)
+	}
+	return l
+}
+
+// closeAuditLog records the unmount and prints the last hash. Keep it
+// somewhere else to be able to detect that records have been cut off the
+// end of the log.
+func closeAuditLog(l *audit.Log) {
+	err := l.Write(audit.Record{
+		Op:     "unmount",
+		UID:    uint32(os.Getuid()),
+		GID:    uint32(os.Getgid()),
+		PID:    uint32(os.Getpid()),
+		Status: "OK",
+	})
+	if err != nil {
+		tlog.Warn.Printf("-audit-log: %v", err)
+	}
+	seq, hash := l.Last()
+	if err = l.Close(); err != nil {
+		tlog.Warn.Printf("-audit-log: %v", err)
+	}
+	tlog.Info.Printf("audit log: last record %d, hash %s", seq, hash)
+}
+
+// verifyAudit handles "gocryptfs -verify-audit LOGFILE".
+func verifyAudit(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		tlog.Fatal.Printf("-verify-audit: %v", err)
+		os.Exit(exitcodes.AuditLog)
+	}
+	defer f.Close()
+	n, last, err := audit.Verify(f)
+	if err != nil {
+		tlog.Fatal.Printf("-verify-audit: %s: %v", path, err)
+		tlog.Fatal.Printf("-verify-audit: the first %d records are intact", n)
+		os.Exit(exitcodes.AuditLog)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"audit log is intact: %d records, last record %d, hash %s"+tlog.ColorReset,
+		n, n-1, last)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -12,6 +13,7 @@ import (
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
 	"github.com/rfjakob/gocryptfs/internal/prefer_openssl"
 	"github.com/rfjakob/gocryptfs/internal/readpassword"
 	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
@@ -24,25 +26,62 @@ type argContainer struct {
 	plaintextnames, quiet, nosyslog, wpanic,
 	longnames, allow_other, reverse, aessiv, nonempty, raw64,
 	noprealloc, speed, hkdf, serialize_reads, forcedecode, hh, info,
-	sharedstorage, devrandom, fsck, trezor bool
+	sharedstorage, devrandom, fsck, trezor, compare, lowmem, flushonclose, preservexattronrename, skipselftest, derivefilekey,
+	encfsquirks, nolongname, force, rekeymaster, burnafterreading, requiremlock, importdir, json,
+	strictatime, tar, verifyaudit, skipcorrupt, fix, prewarm, plaintextcontent, writeverify, odirectdontneed, migrate,
+	debugxattr, requirelocal, requirenetwork, xattrsidecar, recovery, snapshot, xattrsync, noescapesymlinks, unmountonbackingloss, xts, showkdfprogress, deterministic, nowriteholes bool
 	// Mount options with opposites
 	dev, nodev, suid, nosuid, exec, noexec, rw, ro bool
 	masterkey, mountpoint, cipherdir, cpuprofile, extpass,
-	memprofile, ko, passfile, ctlsock, fsname, force_owner, trace string
+	memprofile, ko, passfile, ctlsock, fsname, force_owner, trace, lowerdir, normalizenames,
+	exportmanifest, verifymanifest, ctllisten, ctltlscert, ctltlskey, ctltokenfile, lockdir,
+	label, setlabel, since, fsckstate, fsckondirty,
+	dirextpass, reversepatternsfile, passthroughext, auditlog, namesuffix, premountcmd, postmountcmd, tmpdir, seed, subtype string
 	// For reverse mode, --exclude is available. It can be specified multiple times.
 	exclude multipleStrings
+	// Directories to unlock with "-unlock-dir". Can be specified multiple times.
+	unlockdir multipleStrings
+	// Per-file plaintext size limit for "-max-file-size"
+	maxfilesize byteSize
+	// Largest FUSE requests, "-max-write" and "-max-read"
+	maxwrite, maxread byteSize
+	// Bandwidth limits in bytes per second, "-read-limit" and "-write-limit"
+	readlimit, writelimit byteSize
 	// Configuration file name override
-	config             string
-	notifypid, scryptn int
+	config                                                       string
+	notifypid, scryptn, ioretries, workers, maxdepth, minscryptn int
 	// Idle time before autounmount
 	idle time.Duration
+	// Maximum random delay for reads and writes, "-timing-jitter"
+	timingjitter time.Duration
+	// How often to fsync files that are open for writing, "-flush-interval"
+	flushinterval time.Duration
+	// How long one pass of the background scrubber takes, "-scrub-interval"
+	scrubinterval time.Duration
+	// "-shutdown-timeout"
+	shutdowntimeout time.Duration
 	// Helper variables that are NOT cli options all start with an underscore
 	// _configCustom is true when the user sets a custom config file name.
 	_configCustom bool
 	// _ctlsockFd stores the control socket file descriptor (ctlsock stores the path)
 	_ctlsockFd net.Listener
+	// _ctlListenFd is the TLS listener for "-ctl-listen", and _ctlToken
+	// the token read from "-ctl-token-file"
+	_ctlListenFd net.Listener
+	_ctlToken    string
+	// _mountID identifies the filesystem, see cryptocore.MountID
+	_mountID string
+	// _label is the label from the config file, see configfile.CheckLabel
+	_label string
+	// _since is the parsed "-since" time, or the time from "-fsck-state"
+	_since time.Time
+	// _mountLock is the locked "gocryptfs.mnt.lock" file of a read-write
+	// mount, see lockCipherdir
+	_mountLock *os.File
 	// _forceOwner is, if non-nil, a parsed, validated Owner (as opposed to the string above)
 	_forceOwner *fuse.Owner
+	// _passthroughExt is the parsed "-passthrough-ext" list
+	_passthroughExt []string
 }
 
 type multipleStrings []string
@@ -57,6 +96,35 @@ func (s *multipleStrings) Set(val string) error {
 	return nil
 }
 
+// byteSize is a flag.Value for sizes like "4096", "100M" or "1G". The
+// suffixes K, M, G and T are powers of 1024.
+type byteSize uint64
+
+func (b *byteSize) String() string {
+	return strconv.FormatUint(uint64(*b), 10)
+}
+
+func (b *byteSize) Set(val string) error {
+	units := "KMGT"
+	mult := uint64(1)
+	s := strings.TrimSuffix(strings.ToUpper(val), "B")
+	if len(s) > 0 {
+		if i := strings.IndexByte(units, s[len(s)-1]); i >= 0 {
+			mult = 1 << (10 * uint(i+1))
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size %q", val)
+	}
+	if n > ^uint64(0)/mult {
+		return fmt.Errorf("size %q is too large", val)
+	}
+	*b = byteSize(n * mult)
+	return nil
+}
+
 var flagSet *flag.FlagSet
 
 // prefixOArgs transform options passed via "-o foo,bar" into regular options
@@ -134,11 +202,16 @@ func parseCliOpts() (args argContainer) {
 	flagSet.BoolVar(&args.fg, "fg", false, "Stay in the foreground")
 	flagSet.BoolVar(&args.version, "version", false, "Print version and exit")
 	flagSet.BoolVar(&args.plaintextnames, "plaintextnames", false, "Do not encrypt file names")
+	flagSet.BoolVar(&args.xattrsidecar, "xattr-sidecar", false, "Store xattrs in sidecar files, for backing filesystems without xattr support")
+	flagSet.BoolVar(&args.plaintextcontent, "plaintextcontent", false, "Do not encrypt file contents, only file names. INSECURE.")
+	flagSet.BoolVar(&args.xts, "xts", false, "Encrypt file contents with AES-XTS. No integrity protection.")
 	flagSet.BoolVar(&args.quiet, "q", false, "")
 	flagSet.BoolVar(&args.quiet, "quiet", false, "Quiet - silence informational messages")
+	flagSet.BoolVar(&args.showkdfprogress, "show-kdf-progress", false, "Show a progress indicator while the password is hashed")
 	flagSet.BoolVar(&args.nosyslog, "nosyslog", false, "Do not redirect output to syslog when running in the background")
 	flagSet.BoolVar(&args.wpanic, "wpanic", false, "When encountering a warning, panic and exit immediately")
 	flagSet.BoolVar(&args.longnames, "longnames", true, "Store names longer than 176 bytes in extra files")
+	flagSet.BoolVar(&args.nolongname, "no-longname", false, "Disable long name support (with -init)")
 	flagSet.BoolVar(&args.allow_other, "allow_other", false, "Allow other users to access the filesystem. "+
 		"Only works if user_allow_other is set in /etc/fuse.conf.")
 	flagSet.BoolVar(&args.reverse, "reverse", false, "Reverse mode")
@@ -146,7 +219,23 @@ func parseCliOpts() (args argContainer) {
 	flagSet.BoolVar(&args.nonempty, "nonempty", false, "Allow mounting over non-empty directories")
 	flagSet.BoolVar(&args.raw64, "raw64", true, "Use unpadded base64 for file names")
 	flagSet.BoolVar(&args.noprealloc, "noprealloc", false, "Disable preallocation before writing")
+	flagSet.BoolVar(&args.noprealloc, "no-prealloc", false, "Alias for -noprealloc")
+	flagSet.BoolVar(&args.nowriteholes, "no-write-holes", false, "Write encrypted zero blocks instead of file holes when writing past the end of a file")
+	flagSet.BoolVar(&args.requiremlock, "require-mlock", false, "Refuse to mount if the keys cannot be locked into memory")
+	flagSet.BoolVar(&args.requirelocal, "require-local", false, "Refuse to mount if CIPHERDIR is on a network filesystem")
+	flagSet.BoolVar(&args.requirenetwork, "require-network", false, "Refuse to mount if CIPHERDIR is not on a network filesystem")
+	flagSet.BoolVar(&args.strictatime, "strict-atime", false, "Update the atime of the backing file on every read")
+	flagSet.BoolVar(&args.writeverify, "write-verify", false, "Re-read and authenticate the blocks written to a file when it is closed")
+	flagSet.BoolVar(&args.debugxattr, "debug-xattr", false, "Expose the encrypted value of each xattr NAME as user.gocryptfs.raw.NAME")
+	flagSet.BoolVar(&args.odirectdontneed, "odirect-dontneed", false, "Drop the backing pages of files opened with O_DIRECT from the page cache")
+	flagSet.BoolVar(&args.prewarm, "prewarm", false, "Walk the directory tree in the background after mounting to fill the caches")
+	flagSet.BoolVar(&args.recovery, "recovery", false, "Read-only salvage mount: return zeros for corrupt blocks, skip corrupt names")
+	flagSet.BoolVar(&args.snapshot, "snapshot", false, "Mount a read-only copy-on-write snapshot of CIPHERDIR (needs reflink support)")
+	flagSet.BoolVar(&args.skipcorrupt, "skip-corrupt", false, "List directories even if some names fail to decrypt")
+	flagSet.BoolVar(&args.tar, "tar", false, "Write the decrypted contents of CIPHERDIR to stdout as a tar archive")
+	flagSet.BoolVar(&args.verifyaudit, "verify-audit", false, "Check the hash chain of the audit log LOGFILE")
 	flagSet.BoolVar(&args.speed, "speed", false, "Run crypto speed test")
+	flagSet.BoolVar(&args.json, "json", false, "Print the -speed results as JSON")
 	flagSet.BoolVar(&args.hkdf, "hkdf", true, "Use HKDF as an additional key derivation step")
 	flagSet.BoolVar(&args.serialize_reads, "serialize_reads", false, "Try to serialize read operations")
 	flagSet.BoolVar(&args.forcedecode, "forcedecode", false, "Force decode of files even if integrity check fails."+
@@ -154,8 +243,28 @@ func parseCliOpts() (args argContainer) {
 	flagSet.BoolVar(&args.hh, "hh", false, "Show this long help text")
 	flagSet.BoolVar(&args.info, "info", false, "Display information about CIPHERDIR")
 	flagSet.BoolVar(&args.sharedstorage, "sharedstorage", false, "Make concurrent access to a shared CIPHERDIR safer")
+	flagSet.BoolVar(&args.force, "force", false, "Mount even if CIPHERDIR is already mounted read-write, or nested with the mountpoint")
+	flagSet.BoolVar(&args.burnafterreading, "burn-after-reading", false, "Delete files marked with the user.burn-after-reading xattr after they have been read completely")
 	flagSet.BoolVar(&args.devrandom, "devrandom", false, "Use /dev/random for generating master key")
+	flagSet.BoolVar(&args.deterministic, "deterministic", false, "With -init: derive the master key and all other random values from -seed. INSECURE, for testing only")
+	flagSet.StringVar(&args.seed, "seed", "", "Hex seed for -deterministic")
+	flagSet.BoolVar(&args.fix, "fix", false, "With -fsck: quarantine directories with a corrupt gocryptfs.diriv, delete orphaned longname files")
 	flagSet.BoolVar(&args.fsck, "fsck", false, "Run a filesystem check on CIPHERDIR")
+	flagSet.StringVar(&args.since, "since", "", "With -fsck: only check the contents of files changed since this time (RFC 3339 or YYYY-MM-DD)")
+	flagSet.StringVar(&args.fsckondirty, "fsck-on-dirty", "warn", "What to do if the last read-write mount did not end cleanly: warn, fsck or off")
+	flagSet.StringVar(&args.fsckstate, "fsck-state", "", "With -fsck: only check the contents of files changed since the last clean check recorded in FILE")
+	flagSet.BoolVar(&args.compare, "compare", false, "Compare the decrypted contents of two CIPHERDIRs")
+	flagSet.BoolVar(&args.rekeymaster, "rekey-master", false, "Re-encrypt the contents of a CIPHERDIR into a new CIPHERDIR with a new master key")
+	flagSet.BoolVar(&args.importdir, "import", false, "Encrypt a plaintext directory into a CIPHERDIR without mounting it")
+	flagSet.BoolVar(&args.derivefilekey, "derive-filekey", false, "Print the file ID and content key of an encrypted file (requires -masterkey)")
+	flagSet.BoolVar(&args.encfsquirks, "encfs-quirks", false, "Behave like encfs where this eases migration (refuse long names)")
+	flagSet.BoolVar(&args.lowmem, "low-mem", false, "Reduce memory usage at the cost of throughput")
+	flagSet.BoolVar(&args.flushonclose, "flush-on-close", false, "Fsync files opened for writing when they are closed")
+	flagSet.BoolVar(&args.xattrsync, "xattr-sync", false, "Fsync files whose xattrs have changed when they are closed")
+	flagSet.BoolVar(&args.skipselftest, "skip-selftest", false, "Do not run the crypto self-test on startup")
+	flagSet.BoolVar(&args.preservexattronrename, "preserve-xattr-on-rename", false, "Copy xattrs of a file overwritten by rename to the new file")
+	flagSet.BoolVar(&args.unmountonbackingloss, "unmount-on-backing-loss", false, "Unmount when CIPHERDIR disappears, for example because the USB stick has been pulled")
+	flagSet.BoolVar(&args.noescapesymlinks, "no-escape-symlinks", false, "Refuse to create or read symlinks that point outside the mount")
 	if readpassword.TrezorSupport {
 		flagSet.BoolVar(&args.trezor, "trezor", false, "Protect the masterkey using a SatoshiLabs Trezor instead of a password")
 	}
@@ -178,22 +287,57 @@ func parseCliOpts() (args argContainer) {
 	flagSet.StringVar(&args.passfile, "passfile", "", "Read password from file")
 	flagSet.StringVar(&args.ko, "ko", "", "Pass additional options directly to the kernel, comma-separated list")
 	flagSet.StringVar(&args.ctlsock, "ctlsock", "", "Create control socket at specified path")
+	flagSet.StringVar(&args.ctllisten, "ctl-listen", "", "Serve the control socket protocol over TLS on host:port")
+	flagSet.StringVar(&args.ctltlscert, "ctl-tls-cert", "", "TLS certificate file for -ctl-listen")
+	flagSet.StringVar(&args.ctltlskey, "ctl-tls-key", "", "TLS private key file for -ctl-listen")
+	flagSet.StringVar(&args.ctltokenfile, "ctl-token-file", "", "Read the -ctl-listen authentication token from this file")
 	flagSet.StringVar(&args.fsname, "fsname", "", "Override the filesystem name")
+	flagSet.StringVar(&args.subtype, "subtype", "", "Override the filesystem subtype (shown as fuse.SUBTYPE)")
 	flagSet.StringVar(&args.force_owner, "force_owner", "", "uid:gid pair to coerce ownership")
 	flagSet.StringVar(&args.trace, "trace", "", "Write execution trace to file")
+	flagSet.StringVar(&args.lowerdir, "lowerdir", "", "Read-only CIPHERDIR to use as the lower layer of a union mount")
+	flagSet.StringVar(&args.normalizenames, "normalize-names", "", "Normalize file names to Unicode form \"nfc\" or \"nfd\". Only works with -init")
+	flagSet.StringVar(&args.exportmanifest, "export-manifest", "", "Write an encrypted manifest of all files, their metadata and content hashes to FILE")
+	flagSet.StringVar(&args.verifymanifest, "verify-manifest", "", "Check the filesystem against the manifest in FILE")
 
 	// -e, --exclude
 	flagSet.Var(&args.exclude, "e", "Alias for -exclude")
 	flagSet.Var(&args.exclude, "exclude", "Exclude relative path from reverse view")
+	flagSet.StringVar(&args.passthroughext, "passthrough-ext", "", "Comma-separated list of file extensions whose content is not encrypted (reverse mode)")
+	flagSet.StringVar(&args.reversepatternsfile, "reverse-patterns-file", "", "Exclude paths matching the gitignore-style patterns in per-directory files of this name (reverse mode)")
+	flagSet.Var(&args.unlockdir, "unlock-dir", "Unlock a directory locked with -lock-dir. Can be passed multiple times")
+	flagSet.Var(&args.maxwrite, "max-write", "Largest write request the kernel may send (default 128K)")
+	flagSet.Var(&args.maxread, "max-read", "Largest read request the kernel may send (default 128K)")
+	flagSet.Var(&args.readlimit, "read-limit", "Limit reads to this many bytes per second (example: 50M)")
+	flagSet.Var(&args.writelimit, "write-limit", "Limit writes to this many bytes per second (example: 50M)")
+	flagSet.Var(&args.maxfilesize, "max-file-size", "Fail writes that would grow a file past this size (example: 1G) with EFBIG")
+	flagSet.StringVar(&args.namesuffix, "name-suffix", "", "Append this suffix to all file names in the mount, for example \".pdf\"")
+	flagSet.StringVar(&args.auditlog, "audit-log", "", "Append a hash-chained log of all opens and modifications to FILE")
+	flagSet.StringVar(&args.premountcmd, "premount-cmd", "", "Shell command to run before the password is read. Mounting is aborted if it fails.")
+	flagSet.StringVar(&args.postmountcmd, "postmount-cmd", "", "Shell command to run once the filesystem is mounted")
+	flagSet.StringVar(&args.lockdir, "lock-dir", "", "Give an empty directory its own key and password")
+	flagSet.StringVar(&args.label, "label", "", "Human-readable name of the filesystem, stored in the config file by -init")
+	flagSet.BoolVar(&args.migrate, "migrate", false, "Update an old config file to the current format before mounting, where the on-disk format allows it")
+	flagSet.StringVar(&args.setlabel, "set-label", "", "Change the label of the filesystem")
+	flagSet.StringVar(&args.dirextpass, "dir-extpass", "", "Use external program for the -lock-dir and -unlock-dir passwords")
+	flagSet.StringVar(&args.tmpdir, "tmpdir", "", "Create temporary files in this directory. Must be on the same filesystem as CIPHERDIR and the config file")
 
 	flagSet.IntVar(&args.notifypid, "notifypid", 0, "Send USR1 to the specified process after "+
 		"successful mount - used internally for daemonization")
 	flagSet.IntVar(&args.scryptn, "scryptn", configfile.ScryptDefaultLogN, "scrypt cost parameter logN. Possible values: 10-28. "+
 		"A lower value speeds up mounting and reduces its memory needs, but makes the password susceptible to brute-force attacks")
+	flagSet.IntVar(&args.ioretries, "io-retries", 0, "Retry reads and writes on the backing files N times on transient errors")
+	flagSet.IntVar(&args.minscryptn, "min-scrypt-n", 0, "Refuse to unlock filesystems whose scrypt parameter N is below this value (example: 65536)")
+	flagSet.IntVar(&args.maxdepth, "max-depth", fusefrontend.DefaultMaxDepth, "Fail with ELOOP on paths with more than N components")
+	flagSet.IntVar(&args.workers, "workers", runtime.NumCPU(), "Number of files to encrypt in parallel with -import")
 
 	flagSet.DurationVar(&args.idle, "i", 0, "Alias for -idle")
 	flagSet.DurationVar(&args.idle, "idle", 0, "Auto-unmount after specified idle duration (ignored in reverse mode). "+
 		"Durations are specified like \"500s\" or \"2h45m\". 0 means stay mounted indefinitely.")
+	flagSet.DurationVar(&args.shutdowntimeout, "shutdown-timeout", 10*time.Second, "On SIGINT/SIGTERM, wait this long for running operations before forcing the unmount")
+	flagSet.DurationVar(&args.flushinterval, "flush-interval", 0, "Fsync modified files that are open for writing this often (example: 5s)")
+	flagSet.DurationVar(&args.scrubinterval, "scrub-interval", 0, "Read and authenticate all files in the background once per interval (example: 24h)")
+	flagSet.DurationVar(&args.timingjitter, "timing-jitter", 0, "Delay each read and write by a random time up to this long (experimental, example: 2ms)")
 
 	var dummyString string
 	flagSet.StringVar(&dummyString, "o", "", "For compatibility with mount(1), options can be also passed as a comma-separated list to -o on the end.")
@@ -243,6 +387,30 @@ func parseCliOpts() (args argContainer) {
 		args.allow_other = false
 		args.ko = "noexec"
 	}
+	// "-recovery" combines the tolerant behaviors for salvaging data from a
+	// damaged CIPHERDIR, and makes sure we do not write to it.
+	if args.recovery {
+		if args.reverse || args.rw || args.forcedecode || args.migrate || args.strictatime {
+			tlog.Fatal.Printf("-recovery cannot be used together with -reverse, -rw, -forcedecode, -migrate or -strict-atime")
+			os.Exit(exitcodes.Usage)
+		}
+		args.ro = true
+		args.skipcorrupt = true
+	}
+	// "-snapshot" is for backups. Changes to the snapshot would be lost.
+	if args.snapshot {
+		if args.rw {
+			tlog.Fatal.Printf("-snapshot cannot be used together with -rw")
+			os.Exit(exitcodes.Usage)
+		}
+		args.ro = true
+	}
+	// "-migrate" rewrites the config file. Checked after the options above,
+	// which imply "-ro".
+	if args.migrate && args.ro {
+		tlog.Fatal.Printf("-migrate cannot be used together with -ro, -forcedecode or -snapshot")
+		os.Exit(exitcodes.Usage)
+	}
 	// '-passfile FILE' is a shortcut for -extpass='/bin/cat -- FILE'
 	if args.passfile != "" {
 		args.extpass = "/bin/cat -- " + args.passfile
@@ -259,6 +427,18 @@ func parseCliOpts() (args argContainer) {
 		tlog.Fatal.Printf("Idle timeout cannot be less than 0")
 		os.Exit(exitcodes.Usage)
 	}
+	if args.ioretries < 0 {
+		tlog.Fatal.Printf("-io-retries cannot be less than 0")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.maxdepth < 1 {
+		tlog.Fatal.Printf("-max-depth must be at least 1")
+		os.Exit(exitcodes.Usage)
+	}
+	if n := args.minscryptn; n != 0 && (n < 1<<10 || n > 1<<28 || n&(n-1) != 0) {
+		tlog.Fatal.Printf("-min-scrypt-n must be a power of two between %d and %d", 1<<10, 1<<28)
+		os.Exit(exitcodes.Usage)
+	}
 	return args
 }
 
@@ -285,5 +465,32 @@ func countOpFlags(args *argContainer) int {
 	if args.fsck {
 		count++
 	}
+	if args.compare {
+		count++
+	}
+	if args.derivefilekey {
+		count++
+	}
+	if args.exportmanifest != "" {
+		count++
+	}
+	if args.verifymanifest != "" {
+		count++
+	}
+	if args.rekeymaster {
+		count++
+	}
+	if args.importdir {
+		count++
+	}
+	if args.lockdir != "" {
+		count++
+	}
+	if args.tar {
+		count++
+	}
+	if args.setlabel != "" {
+		count++
+	}
 	return count
 }
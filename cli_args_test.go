@@ -88,3 +88,51 @@ func TestStringSlice(t *testing.T) {
 		t.Errorf("Wrong string representation: want=%q have=%q", want, have)
 	}
 }
+
+func TestByteSize(t *testing.T) {
+	testcases := []struct {
+		in   string
+		want uint64
+		err  bool
+	}{
+		{"0", 0, false},
+		{"4096", 4096, false},
+		{"1k", 1024, false},
+		{"100M", 100 << 20, false},
+		{"1G", 1 << 30, false},
+		{"2GB", 2 << 30, false},
+		{"1T", 1 << 40, false},
+		{"", 0, true},
+		{"G", 0, true},
+		{"-1", 0, true},
+		{"1.5G", 0, true},
+		{"99999999999T", 0, true},
+	}
+	for _, tc := range testcases {
+		var b byteSize
+		err := b.Set(tc.in)
+		if (err != nil) != tc.err || (err == nil && uint64(b) != tc.want) {
+			t.Errorf("Set(%q): want %d err=%v, got %d err=%v", tc.in, tc.want, tc.err, b, err)
+		}
+	}
+}
+
+func TestClampReqSize(t *testing.T) {
+	testcases := []struct {
+		in   byteSize
+		want byteSize
+	}{
+		{0, 0},
+		{1, 4096},
+		{4096, 4096},
+		{5000, 4096},
+		{64 << 10, 64 << 10},
+		{128 << 10, 128 << 10},
+		{1 << 20, 128 << 10},
+	}
+	for _, tc := range testcases {
+		if have := clampReqSize("-max-write", tc.in); have != tc.want {
+			t.Errorf("clampReqSize(%d): want %d, got %d", tc.in, tc.want, have)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// compareMaxReported is the number of differing paths that "-compare"
+// prints before it only counts them.
+const compareMaxReported = 20
+
+type compareObj struct {
+	a, b *fusefrontend.FS
+	// Cipherdirs of a and b, for printing
+	dirA, dirB string
+	// Number of differences found
+	nDiffs int
+}
+
+// report records a difference at "path" and prints it if we have not printed
+// too many already.
+func (c *compareObj) report(path string, format string, v ...interface{}) {
+	c.nDiffs++
+	if c.nDiffs > compareMaxReported {
+		return
+	}
+	if path == "" {
+		path = "/"
+	}
+	fmt.Printf("compare: %q: %s\n", path, fmt.Sprintf(format, v...))
+}
+
+// listDir returns the sorted entries of dir "path", without "." and "..".
+func listDir(fs *fusefrontend.FS, path string) ([]fuse.DirEntry, fuse.Status) {
+	entries, status := fs.OpenDir(path, nil)
+	if !status.Ok() {
+		return nil, status
+	}
+	var out []fuse.DirEntry
+	for _, e := range entries {
+		if e.Name == "." || e.Name == ".." {
+			continue
+		}
+		out = append(out, e)
+	}
+	sort.Sort(sortableDirEntries(out))
+	return out, fuse.OK
+}
+
+// Recursively compare the directory at "path" in both filesystems
+func (c *compareObj) dir(path string) {
+	tlog.Debug.Printf("compare.dir %q\n", path)
+	entriesA, statusA := listDir(c.a, path)
+	entriesB, statusB := listDir(c.b, path)
+	if !statusA.Ok() || !statusB.Ok() {
+		c.report(path, "error opening dir: %v / %v", statusA, statusB)
+		return
+	}
+	// Both lists are sorted, walk them in lockstep.
+	i, j := 0, 0
+	for i < len(entriesA) || j < len(entriesB) {
+		if j >= len(entriesB) || (i < len(entriesA) && entriesA[i].Name < entriesB[j].Name) {
+			c.report(filepath.Join(path, entriesA[i].Name), "only in %s", c.dirA)
+			i++
+			continue
+		}
+		if i >= len(entriesA) || entriesB[j].Name < entriesA[i].Name {
+			c.report(filepath.Join(path, entriesB[j].Name), "only in %s", c.dirB)
+			j++
+			continue
+		}
+		c.entry(filepath.Join(path, entriesA[i].Name))
+		i++
+		j++
+	}
+}
+
+// Compare the metadata of "path", and its content if it is not a directory
+func (c *compareObj) entry(path string) {
+	attrA, statusA := c.a.GetAttr(path, nil)
+	attrB, statusB := c.b.GetAttr(path, nil)
+	if !statusA.Ok() || !statusB.Ok() {
+		c.report(path, "error stating: %v / %v", statusA, statusB)
+		return
+	}
+	if attrA.Mode != attrB.Mode {
+		c.report(path, "mode differs: %#o / %#o", attrA.Mode, attrB.Mode)
+		return
+	}
+	switch attrA.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		c.dir(path)
+	case syscall.S_IFREG:
+		if attrA.Size != attrB.Size {
+			c.report(path, "size differs: %d / %d", attrA.Size, attrB.Size)
+			return
+		}
+		hashA, statusA := hashFile(c.a, path)
+		hashB, statusB := hashFile(c.b, path)
+		if !statusA.Ok() || !statusB.Ok() {
+			c.report(path, "error reading: %v / %v", statusA, statusB)
+			return
+		}
+		if !bytes.Equal(hashA, hashB) {
+			c.report(path, "content differs")
+		}
+	case syscall.S_IFLNK:
+		targetA, statusA := c.a.Readlink(path, nil)
+		targetB, statusB := c.b.Readlink(path, nil)
+		if !statusA.Ok() || !statusB.Ok() {
+			c.report(path, "error reading symlink: %v / %v", statusA, statusB)
+			return
+		}
+		if targetA != targetB {
+			c.report(path, "symlink target differs: %q / %q", targetA, targetB)
+		}
+	}
+}
+
+// hashFile calculates the SHA256 of the plaintext content of "path".
+// The file is read in MAX_KERNEL_WRITE-sized chunks, so it never has to be
+// held in memory as a whole.
+func hashFile(fs *fusefrontend.FS, path string) ([]byte, fuse.Status) {
+	f, status := fs.Open(path, syscall.O_RDONLY, nil)
+	if !status.Ok() {
+		return nil, status
+	}
+	defer f.Release()
+	h := sha256.New()
+	buf := make([]byte, fuse.MAX_KERNEL_WRITE)
+	var off int64
+	for {
+		result, status := f.Read(buf, off)
+		if !status.Ok() {
+			return nil, status
+		}
+		data, status := result.Bytes(buf)
+		if !status.Ok() {
+			return nil, status
+		}
+		// EOF
+		if len(data) == 0 {
+			return h.Sum(nil), fuse.OK
+		}
+		h.Write(data)
+		off += int64(len(data))
+	}
+}
+
+// initCompareFS sets up a forward filesystem for "cipherdir". The user is
+// prompted for the password of this directory.
+func initCompareFS(args argContainer, cipherdir string) (fs *fusefrontend.FS, absCipherdir string, wipeKeys func()) {
+	var err error
+	args.cipherdir, err = filepath.Abs(cipherdir)
+	if err == nil {
+		err = isDir(args.cipherdir)
+	}
+	if err != nil {
+		tlog.Fatal.Printf("Invalid cipherdir: %v", err)
+		os.Exit(exitcodes.CipherDir)
+	}
+	args.config = filepath.Join(args.cipherdir, configfile.ConfDefaultName)
+	args.allow_other = false
+	// We read with MAX_KERNEL_WRITE-sized buffers
+	args.lowmem = false
+	tlog.Info.Printf("Unlocking %s", args.cipherdir)
+	pfs, wipeKeys := initFuseFrontend(&args)
+	return pfs.(*fusefrontend.FS), args.cipherdir, wipeKeys
+}
+
+// compare handles "gocryptfs -compare CIPHERDIR1 CIPHERDIR2". It compares
+// the decrypted directory trees of both filesystems.
+func compare(args *argContainer) {
+	if args.reverse {
+		tlog.Fatal.Printf("Running -compare with -reverse is not supported")
+		os.Exit(exitcodes.Usage)
+	}
+	if args._configCustom || args.masterkey != "" || args.zerokey {
+		tlog.Fatal.Printf("-compare cannot be used together with -config, -masterkey or -zerokey")
+		os.Exit(exitcodes.Usage)
+	}
+	fsA, dirA, wipeKeysA := initCompareFS(*args, flagSet.Arg(0))
+	defer wipeKeysA()
+	fsB, dirB, wipeKeysB := initCompareFS(*args, flagSet.Arg(1))
+	defer wipeKeysB()
+	c := compareObj{a: fsA, b: fsB, dirA: dirA, dirB: dirB}
+	c.dir("")
+	if c.nDiffs == 0 {
+		tlog.Info.Printf("compare summary: no differences found\n")
+		return
+	}
+	if c.nDiffs > compareMaxReported {
+		fmt.Printf("compare: ... (%d more not shown)\n", c.nDiffs-compareMaxReported)
+	}
+	fmt.Printf("compare summary: %d differences\n", c.nDiffs)
+	wipeKeysA()
+	wipeKeysB()
+	exitcodes.Exit(exitcodes.NewErr("compare found differences", exitcodes.CompareMismatch))
+}
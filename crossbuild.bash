@@ -10,5 +10,8 @@ GOOS=linux  GOARCH=arm   $B
 GOOS=linux  GOARCH=arm64 $B
 GOOS=darwin GOARCH=amd64 $B
 
+# There is no Windows frontend, but the crypto packages should stay portable
+GOOS=windows GOARCH=amd64 $B ./internal/cryptocore ./internal/contentenc ./internal/configfile
+
 # The cross-built binary is not useful on the compile host.
 rm gocryptfs
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// initCtlListen opens the TLS listener for "-ctl-listen" and reads the
+// token. Plaintext TCP is not supported, so the certificate, key and token
+// are mandatory.
+func initCtlListen(args *argContainer) {
+	if args.ctltlscert == "" || args.ctltlskey == "" || args.ctltokenfile == "" {
+		tlog.Fatal.Printf("-ctl-listen requires -ctl-tls-cert, -ctl-tls-key and -ctl-token-file")
+		os.Exit(exitcodes.Usage)
+	}
+	cert, err := tls.LoadX509KeyPair(args.ctltlscert, args.ctltlskey)
+	if err != nil {
+		tlog.Fatal.Printf("ctl-listen: %v", err)
+		os.Exit(exitcodes.CtlSock)
+	}
+	token, err := ioutil.ReadFile(args.ctltokenfile)
+	if err != nil {
+		tlog.Fatal.Printf("ctl-listen: %v", err)
+		os.Exit(exitcodes.CtlSock)
+	}
+	args._ctlToken = strings.TrimSpace(string(token))
+	if args._ctlToken == "" {
+		tlog.Fatal.Printf("ctl-listen: token file %q is empty", args.ctltokenfile)
+		os.Exit(exitcodes.CtlSock)
+	}
+	sock, err := net.Listen("tcp", args.ctllisten)
+	if err != nil {
+		tlog.Fatal.Printf("ctl-listen: %v", err)
+		os.Exit(exitcodes.CtlSock)
+	}
+	args._ctlListenFd = tls.NewListener(sock, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	})
+}
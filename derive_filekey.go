@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// deriveFilekey handles
+// "gocryptfs -derive-filekey -masterkey=KEY CIPHERDIR ENCRYPTED_PATH".
+// It prints the file ID and the content key that are needed to decrypt the
+// encrypted file independently of gocryptfs.
+//
+// The output consists of "Key: value" lines. The keys and the format of
+// their values are stable and documented in the man page. New keys may be
+// appended in later versions.
+func deriveFilekey(args *argContainer) {
+	if args.masterkey == "" {
+		tlog.Fatal.Printf("-derive-filekey requires the master key, pass it via -masterkey")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.reverse {
+		tlog.Fatal.Printf("Running -derive-filekey with -reverse is not supported")
+		os.Exit(exitcodes.Usage)
+	}
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		os.Exit(exitcodes.LoadConf)
+	}
+	// The content key printed below only decrypts files encrypted with
+	// AES-GCM or AES-SIV under the master key
+	if cf.IsFeatureFlagSet(configfile.FlagXTS) {
+		tlog.Fatal.Printf("-derive-filekey does not support filesystems that use XTS content encryption")
+		os.Exit(exitcodes.Usage)
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagPlaintextContent) {
+		tlog.Fatal.Printf("-derive-filekey: the file contents in this filesystem are not encrypted (PlaintextContent)")
+		os.Exit(exitcodes.Usage)
+	}
+	fromStdin := false
+	if args.masterkey == "stdin" {
+		args.masterkey = string(readpassword.Once("", "Masterkey"))
+		fromStdin = true
+	}
+	masterkey := parseMasterKey(args.masterkey, fromStdin)
+	// Reproduce the settings that mounting this filesystem would use
+	backend := cryptocore.BackendGoGCM
+	cipherName := "AES-256-GCM"
+	if cf.IsFeatureFlagSet(configfile.FlagAESSIV) {
+		backend = cryptocore.BackendAESSIV
+		cipherName = "AES-SIV-512"
+	}
+	ivBits := contentenc.DefaultIVBits
+	if !cf.IsFeatureFlagSet(configfile.FlagGCMIV128) {
+		ivBits = 96
+	}
+	useHKDF := cf.IsFeatureFlagSet(configfile.FlagHKDF)
+	kdfName := "none"
+	if useHKDF {
+		kdfName = "HKDF-SHA256"
+	}
+	contentKey := cryptocore.ContentKey(masterkey, backend, useHKDF)
+	cc := cryptocore.New(masterkey, backend, ivBits, useHKDF, false)
+	defer cc.Wipe()
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	ce := contentenc.New(cc, contentenc.DefaultBS, false)
+
+	path, _ := filepath.Abs(flagSet.Arg(1))
+	if cf.IsFeatureFlagSet(configfile.FlagDirKeys) && inLockedDir(args.cipherdir, path) {
+		tlog.Fatal.Printf("-derive-filekey: %q is inside a directory locked with -lock-dir, "+
+			"it is not encrypted with the master key", path)
+		os.Exit(exitcodes.Usage)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open encrypted file: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil || !st.Mode().IsRegular() {
+		tlog.Fatal.Printf("%q is not a regular file", path)
+		os.Exit(exitcodes.Usage)
+	}
+	fileID := "-"
+	var blocks uint64
+	block0 := "-"
+	if st.Size() > 0 {
+		buf := make([]byte, contentenc.HeaderLen+ce.CipherBS())
+		n, err := f.ReadAt(buf, 0)
+		if err != nil && err != io.EOF {
+			tlog.Fatal.Printf("Reading encrypted file failed: %v", err)
+			os.Exit(exitcodes.Other)
+		}
+		buf = buf[:n]
+		if len(buf) < contentenc.HeaderLen {
+			tlog.Fatal.Printf("Encrypted file is too short for a file header: %d bytes", len(buf))
+			os.Exit(exitcodes.Other)
+		}
+		h, err := contentenc.ParseHeader(buf[:contentenc.HeaderLen])
+		if err != nil {
+			tlog.Fatal.Printf("Invalid file header: %v", err)
+			os.Exit(exitcodes.Other)
+		}
+		fileID = hex.EncodeToString(h.ID)
+		blocks = ce.CipherOffToBlockNo(uint64(st.Size()-1)) + 1
+		// Decrypting the first block proves that the key belongs to
+		// this file
+		block0 = "ok"
+		if len(buf) > contentenc.HeaderLen {
+			_, err = ce.DecryptBlock(buf[contentenc.HeaderLen:], 0, h.ID)
+			if err != nil {
+				block0 = "FAILED"
+			}
+		}
+	}
+	tlog.Warn.Printf("WARNING: The output contains the content key, which decrypts ALL files in this filesystem")
+	fmt.Printf("Path:          %s\n", path)
+	fmt.Printf("FormatVersion: %d\n", contentenc.CurrentVersion)
+	fmt.Printf("FileID:        %s\n", fileID)
+	fmt.Printf("Size:          %d\n", ce.CipherSizeToPlainSize(uint64(st.Size())))
+	fmt.Printf("Blocks:        %d\n", blocks)
+	fmt.Printf("BlockSize:     %d\n", ce.PlainBS())
+	fmt.Printf("ContentCipher: %s\n", cipherName)
+	fmt.Printf("NonceBits:     %d\n", ivBits)
+	fmt.Printf("KeyDerivation: %s\n", kdfName)
+	fmt.Printf("ContentKey:    %s\n", hex.EncodeToString(contentKey))
+	fmt.Printf("Block0:        %s\n", block0)
+	for i := range contentKey {
+		contentKey[i] = 0
+	}
+	if block0 == "FAILED" {
+		tlog.Fatal.Printf("Block 0 failed to decrypt. The master key does not belong to this file, or the file is corrupt.")
+		os.Exit(exitcodes.MasterKey)
+	}
+}
+
+// inLockedDir returns true if the ciphertext file "path" is inside a
+// directory of "cipherdir" that was locked with "-lock-dir".
+func inLockedDir(cipherdir string, path string) bool {
+	for d := filepath.Dir(path); strings.HasPrefix(d, cipherdir+"/"); d = filepath.Dir(d) {
+		if _, err := os.Lstat(filepath.Join(d, configfile.DirKeyName)); err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -3,12 +3,14 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
@@ -28,6 +30,21 @@ type fsckObj struct {
 	watchDone chan struct{}
 	// Inode numbers of hard-linked files (Nlink > 1) that we have already checked
 	seenInodes map[uint64]struct{}
+	// Number of problems that were fixed automatically
+	repaired int
+	// Number of directories with a corrupt gocryptfs.diriv
+	dirIVCorrupt int
+	// "-fix": move directories with a corrupt gocryptfs.diriv out of the way
+	// and delete orphaned longname files
+	fix bool
+	// "-since", "-fsck-state": do not read the contents of files that have
+	// not changed since then. Zero means check everything.
+	since time.Time
+	// Number of files whose contents were not checked because of "since"
+	unchanged int
+	// "-max-depth": do not descend further. Protects against directory
+	// loops, for example bind mounts, in CIPHERDIR.
+	maxDepth int
 }
 
 func (ck *fsckObj) markCorrupt(path string) {
@@ -53,6 +70,10 @@ func (ck *fsckObj) watchMitigatedCorruptionsOpenDir(path string) {
 func (ck *fsckObj) dir(path string) {
 	tlog.Debug.Printf("ck.dir %q\n", path)
 	ck.xattrs(path)
+	if err := ck.fs.CheckDirIV(path); err != nil {
+		ck.corruptDirIV(path, err)
+		return
+	}
 	// Run OpenDir and catch transparently mitigated corruptions
 	go ck.watchMitigatedCorruptionsOpenDir(path)
 	entries, status := ck.fs.OpenDir(path, nil)
@@ -63,6 +84,7 @@ func (ck *fsckObj) dir(path string) {
 		fmt.Printf("fsck: error opening dir %q: %v\n", path, status)
 		return
 	}
+	ck.orphanedLongNames(path)
 	// Sort alphabetically
 	sort.Sort(sortableDirEntries(entries))
 	for _, entry := range entries {
@@ -70,6 +92,11 @@ func (ck *fsckObj) dir(path string) {
 			continue
 		}
 		nextPath := filepath.Join(path, entry.Name)
+		if fusefrontend.PathDepth(nextPath) > ck.maxDepth {
+			ck.markCorrupt(nextPath)
+			fmt.Printf("fsck: %q is more than %d levels deep (-max-depth), not checking it\n", nextPath, ck.maxDepth)
+			continue
+		}
 		filetype := entry.Mode & syscall.S_IFMT
 		//fmt.Printf("  %q %x\n", entry.Name, entry.Mode)
 		switch filetype {
@@ -87,6 +114,44 @@ func (ck *fsckObj) dir(path string) {
 	}
 }
 
+// Report a directory with a corrupt gocryptfs.diriv and quarantine it with
+// "-fix". Writing a new diriv would not help: the names in the directory are
+// encrypted with the old one, and would stay undecryptable.
+func (ck *fsckObj) corruptDirIV(path string, err error) {
+	ck.markCorrupt(path)
+	ck.dirIVCorrupt++
+	fmt.Printf("fsck: dir %q: corrupt gocryptfs.diriv: %v\n", path, err)
+	if !ck.fix {
+		return
+	}
+	qPath, err := ck.fs.QuarantineDir(path)
+	if err != nil {
+		fmt.Printf("fsck: dir %q: could not quarantine: %v\n", path, err)
+		return
+	}
+	fmt.Printf("fsck: dir %q: moved to %q in CIPHERDIR, it needs manual recovery\n", path, qPath)
+}
+
+// Report longname sidecar files without content in dir "path", and delete
+// them with "-fix"
+func (ck *fsckObj) orphanedLongNames(path string) {
+	orphans, err := ck.fs.OrphanedLongNames(path, ck.fix)
+	for _, cName := range orphans {
+		if ck.fix {
+			fmt.Printf("fsck: dir %q: removed orphaned %q\n", path, cName)
+		} else {
+			fmt.Printf("fsck: dir %q: orphaned %q, run with -fix to remove it\n", path, cName)
+		}
+	}
+	if ck.fix {
+		ck.repaired += len(orphans)
+	}
+	if err != nil {
+		ck.markCorrupt(path)
+		fmt.Printf("fsck: error removing orphaned longname files in dir %q: %v\n", path, err)
+	}
+}
+
 func (ck *fsckObj) symlink(path string) {
 	_, status := ck.fs.Readlink(path, nil)
 	if !status.Ok() {
@@ -126,7 +191,17 @@ func (ck *fsckObj) file(path string) {
 		ck.seenInodes[attr.Ino] = struct{}{}
 	}
 	ck.xattrs(path)
-	f, status := ck.fs.Open(path, syscall.O_RDONLY, nil)
+	// ctime as well, so that a file whose mtime has been set back is
+	// checked
+	if !ck.since.IsZero() &&
+		time.Unix(int64(attr.Mtime), int64(attr.Mtimensec)).Before(ck.since) &&
+		time.Unix(int64(attr.Ctime), int64(attr.Ctimensec)).Before(ck.since) {
+		tlog.Debug.Printf("ck.file: skipping %q, unchanged\n", path)
+		ck.unchanged++
+		return
+	}
+	// Checking a file must not burn it ("-burn-after-reading")
+	f, status := ck.fs.OpenInternal(path)
 	if !status.Ok() {
 		ck.markCorrupt(path)
 		fmt.Printf("fsck: error opening file %q: %v\n", path, status)
@@ -156,8 +231,7 @@ func (ck *fsckObj) file(path string) {
 		// data section.
 		if bytes.Equal(buf, allZero) {
 			tlog.Debug.Printf("ck.file: trying to skip file hole\n")
-			f2 := f.(*fusefrontend.File)
-			nextOff, err := f2.SeekData(off)
+			nextOff, err := f.SeekData(off)
 			if err == nil {
 				off = nextOff
 			}
@@ -205,22 +279,137 @@ func fsck(args *argContainer) {
 		os.Exit(exitcodes.Usage)
 	}
 	args.allow_other = false
+	// We read with MAX_KERNEL_WRITE-sized buffers
+	args.lowmem = false
+	// Corrupt names must be reported, not make the whole directory fail
+	args.skipcorrupt = true
 	pfs, wipeKeys := initFuseFrontend(args)
-	fs := pfs.(*fusefrontend.FS)
+	start := time.Now()
+	ck := fsckFS(pfs.(*fusefrontend.FS), args, args._since)
+	wipeKeys()
+	if ck.repaired > 0 {
+		tlog.Info.Printf("fsck: repaired %d problems\n", ck.repaired)
+	}
+	if ck.unchanged > 0 {
+		tlog.Info.Printf("fsck: skipped the contents of %d files unchanged since %s\n",
+			ck.unchanged, ck.since.Format(time.RFC3339))
+	}
+	if len(ck.corruptList) == 0 {
+		tlog.Info.Printf("fsck summary: no problems found\n")
+		// Only a clean check is recorded. Otherwise, the next run would skip
+		// the corrupt files if they have not been touched.
+		if args.fsckstate != "" {
+			if err := writeFsckState(args.fsckstate, start); err != nil {
+				tlog.Fatal.Printf("-fsck-state: %v", err)
+				os.Exit(exitcodes.Other)
+			}
+		}
+		return
+	}
+	fmt.Printf("fsck summary: %d corrupt files\n", len(ck.corruptList))
+	if ck.dirIVCorrupt > 0 {
+		fmt.Printf("fsck summary: %d directories have a corrupt gocryptfs.diriv\n", ck.dirIVCorrupt)
+		exitcodes.Exit(exitcodes.NewErr("fsck found corrupt diriv files", exitcodes.DirIVCorrupt))
+	}
+	exitcodes.Exit(exitcodes.NewErr("fsck found errors", exitcodes.FsckErrors))
+}
+
+// fsckFS checks the filesystem "fs". The contents of files that have not
+// changed since "since" are not read, zero means everything.
+func fsckFS(fs *fusefrontend.FS, args *argContainer, since time.Time) *fsckObj {
 	fs.MitigatedCorruptions = make(chan string)
-	ck := fsckObj{
+	defer func() { fs.MitigatedCorruptions = nil }()
+	ck := &fsckObj{
 		fs:         fs,
 		watchDone:  make(chan struct{}),
 		seenInodes: make(map[uint64]struct{}),
+		fix:        args.fix,
+		since:      since,
+		maxDepth:   args.maxdepth,
 	}
 	ck.dir("")
-	wipeKeys()
-	if len(ck.corruptList) == 0 {
-		tlog.Info.Printf("fsck summary: no problems found\n")
+	return ck
+}
+
+// parseFsckSince sets args._since from "-since" or from the "-fsck-state"
+// file. A state file that does not exist yet means that everything is
+// checked.
+// Calls os.Exit on errors.
+func parseFsckSince(args *argContainer) {
+	if !args.fsck {
+		tlog.Fatal.Printf("-since and -fsck-state only work together with -fsck")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.since != "" && args.fsckstate != "" {
+		tlog.Fatal.Printf("-since and -fsck-state cannot be used together")
+		os.Exit(exitcodes.Usage)
+	}
+	var err error
+	if args.since != "" {
+		args._since, err = parseSince(args.since)
+		if err != nil {
+			tlog.Fatal.Printf("Invalid \"-since\" setting: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
 		return
 	}
-	fmt.Printf("fsck summary: %d corrupt files\n", len(ck.corruptList))
-	os.Exit(exitcodes.FsckErrors)
+	args.fsckstate, _ = filepath.Abs(args.fsckstate)
+	args._since, err = readFsckState(args.fsckstate)
+	if err != nil {
+		tlog.Fatal.Printf("-fsck-state: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	if args._since.IsZero() {
+		tlog.Info.Printf("-fsck-state: %q does not exist yet, checking everything", args.fsckstate)
+	}
+}
+
+// parseSince parses a "-since" value, either RFC 3339 or a date in local time
+func parseSince(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// readFsckState returns the time stored in the "-fsck-state" file, or the
+// zero time if the file does not exist.
+func readFsckState(path string) (time.Time, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(content)))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q: %v", path, err)
+	}
+	return t, nil
+}
+
+// writeFsckState atomically replaces the "-fsck-state" file with one that
+// contains "t". "t" must be the time the check started, so that files
+// that were changed while it ran are checked again next time.
+func writeFsckState(path string, t time.Time) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp.")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.WriteString(t.Format(time.RFC3339Nano) + "\n")
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err2 := tmp.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
 }
 
 type sortableDirEntries []fuse.DirEntry
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseSince(t *testing.T) {
+	s, err := parseSince("2019-03-01")
+	if err != nil || !s.Equal(time.Date(2019, 3, 1, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("date: %v %v", s, err)
+	}
+	s, err = parseSince("2019-03-01T12:00:00+01:00")
+	if err != nil || s.Unix() != 1551438000 {
+		t.Errorf("RFC 3339: %v %v", s, err)
+	}
+	if _, err = parseSince("yesterday"); err == nil {
+		t.Error("garbage was accepted")
+	}
+}
+
+func TestFsckStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestFsckStateFile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/state"
+	// Not existing yet: check everything
+	if s, err := readFsckState(path); err != nil || !s.IsZero() {
+		t.Errorf("want zero time, got %v %v", s, err)
+	}
+	now := time.Now()
+	if err = writeFsckState(path, now); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := readFsckState(path); err != nil || !s.Equal(now) {
+		t.Errorf("want %v, got %v %v", now, s, err)
+	}
+	// No temporary files are left behind
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("want only the state file, got %d entries", len(entries))
+	}
+	if err = ioutil.WriteFile(path, []byte("garbage\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = readFsckState(path); err == nil {
+		t.Error("garbage state file was accepted")
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -64,6 +65,9 @@ func dumpMasterKey(fn string) {
 	masterkey, _, err := configfile.LoadAndDecrypt(fn, pw)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
+		if errors.Is(err, configfile.ErrWrongPassword) {
+			os.Exit(exitcodes.PasswordIncorrect)
+		}
 		exitcodes.Exit(err)
 	}
 	fmt.Println(hex.EncodeToString(masterkey))
@@ -8,6 +8,13 @@ import (
 
 const tUsage = "" +
 	"Usage: " + tlog.ProgramName + " -init|-passwd|-info [OPTIONS] CIPHERDIR\n" +
+	"  or   " + tlog.ProgramName + " -compare [OPTIONS] CIPHERDIR1 CIPHERDIR2\n" +
+	"  or   " + tlog.ProgramName + " -rekey-master [OPTIONS] SRC DST\n" +
+	"  or   " + tlog.ProgramName + " -import [OPTIONS] SRC CIPHERDIR\n" +
+	"  or   " + tlog.ProgramName + " -tar [OPTIONS] CIPHERDIR > FILE.tar\n" +
+	"  or   " + tlog.ProgramName + " -export-manifest|-verify-manifest FILE [OPTIONS] CIPHERDIR\n" +
+	"  or   " + tlog.ProgramName + " -verify-audit LOGFILE\n" +
+	"  or   " + tlog.ProgramName + " -derive-filekey -masterkey=KEY CIPHERDIR ENCRYPTED_PATH\n" +
 	"  or   " + tlog.ProgramName + " [OPTIONS] CIPHERDIR MOUNTPOINT\n"
 
 // helpShort is what gets displayed when passed "-h" or on syntax error.
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// runHook runs the "-premount-cmd" or "-postmount-cmd" shell command. The
+// mountpoint is passed as "$1" and, like CIPHERDIR, in the environment.
+// The mount ID is only known after the key has been unlocked, so only the
+// "-postmount-cmd" hook gets it.
+func runHook(cmdline string, args *argContainer) error {
+	cmd := exec.Command("/bin/sh", "-c", cmdline, "sh", args.mountpoint)
+	cmd.Env = append(os.Environ(),
+		"GOCRYPTFS_CIPHERDIR="+args.cipherdir,
+		"GOCRYPTFS_MOUNTPOINT="+args.mountpoint)
+	if args._mountID != "" {
+		cmd.Env = append(cmd.Env, "GOCRYPTFS_MOUNT_ID="+args._mountID)
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+type importObj struct {
+	// Plaintext source directory
+	src string
+	dst *fusefrontend.FS
+	// Number of paths that could not be imported. Accessed atomically.
+	nErrors uint64
+	// Number of files imported. Accessed atomically.
+	nFiles uint64
+}
+
+// report records a path that could not be imported and prints why.
+// Safe to call from multiple goroutines.
+func (im *importObj) report(path string, format string, v ...interface{}) {
+	atomic.AddUint64(&im.nErrors, 1)
+	tlog.Warn.Printf("import: %q: %s", path, fmt.Sprintf(format, v...))
+}
+
+// file encrypts regular file "path" (relative to im.src) into the
+// destination.
+func (im *importObj) file(path string, attr *fuse.Attr) {
+	in, err := os.Open(filepath.Join(im.src, path))
+	if err != nil {
+		im.report(path, "%v", err)
+		return
+	}
+	defer in.Close()
+	out, status := im.dst.Create(path, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL, 0600, nil)
+	if !status.Ok() {
+		im.report(path, "error creating: %v", status)
+		return
+	}
+	defer out.Release()
+	buf := make([]byte, fuse.MAX_KERNEL_WRITE)
+	var off int64
+	for {
+		n, err := in.Read(buf)
+		if n > 0 {
+			_, status = out.Write(buf[:n], off)
+			if !status.Ok() {
+				im.report(path, "error writing: %v", status)
+				return
+			}
+			off += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			im.report(path, "error reading: %v", err)
+			return
+		}
+	}
+	if status = out.Flush(); !status.Ok() {
+		im.report(path, "error writing: %v", status)
+		return
+	}
+	atomic.AddUint64(&im.nFiles, 1)
+	im.setAttr(path, attr)
+}
+
+// symlink copies symlink "path" into the destination.
+func (im *importObj) symlink(path string, attr *fuse.Attr) {
+	target, err := os.Readlink(filepath.Join(im.src, path))
+	if err != nil {
+		im.report(path, "%v", err)
+		return
+	}
+	status := im.dst.Symlink(target, path, nil)
+	if !status.Ok() {
+		im.report(path, "error creating symlink: %v", status)
+		return
+	}
+	im.setAttr(path, attr)
+}
+
+// setAttr copies owner, permissions and timestamps of "path" from "attr".
+func (im *importObj) setAttr(path string, attr *fuse.Attr) {
+	// Only root can give files to other users
+	if os.Getuid() == 0 {
+		status := im.dst.Chown(path, attr.Owner.Uid, attr.Owner.Gid, nil)
+		if !status.Ok() {
+			im.report(path, "error setting owner: %v", status)
+		}
+	}
+	if attr.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+		// Symlinks have no permissions and Utimens would follow them
+		return
+	}
+	status := im.dst.Chmod(path, attr.Mode&07777, nil)
+	if !status.Ok() {
+		im.report(path, "error setting permissions: %v", status)
+	}
+	atime := time.Unix(int64(attr.Atime), int64(attr.Atimensec))
+	mtime := time.Unix(int64(attr.Mtime), int64(attr.Mtimensec))
+	status = im.dst.Utimens(path, &atime, &mtime, nil)
+	if !status.Ok() {
+		im.report(path, "error setting timestamps: %v", status)
+	}
+}
+
+type importJob struct {
+	path string
+	attr *fuse.Attr
+}
+
+// run walks im.src. Directories are created right away, so they exist
+// before their contents, files and symlinks are handed to "workers"
+// goroutines. The attributes of the directories are set at the end because
+// creating files inside changes the mtime.
+func (im *importObj) run(workers int) {
+	jobs := make(chan importJob, workers*4)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if j.attr.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+					im.symlink(j.path, j.attr)
+				} else {
+					im.file(j.path, j.attr)
+				}
+			}
+		}()
+	}
+	var dirs []importJob
+	filepath.Walk(im.src, func(absPath string, fi os.FileInfo, err error) error {
+		path, err2 := filepath.Rel(im.src, absPath)
+		if err2 != nil {
+			im.report(absPath, "%v", err2)
+			return nil
+		}
+		if path == "." {
+			path = ""
+		}
+		if err != nil {
+			im.report(path, "%v", err)
+			return nil
+		}
+		attr := fuse.ToAttr(fi)
+		switch {
+		case fi.IsDir():
+			// The attributes of the root directory of CIPHERDIR are
+			// left alone
+			if path == "" {
+				return nil
+			}
+			// Make sure we can create the entries, the real permissions
+			// are set at the end.
+			status := im.dst.Mkdir(path, 0700, nil)
+			if status == fuse.Status(syscall.EEXIST) {
+				// Merge into the existing directory
+				status = im.dst.Chmod(path, 0700, nil)
+			}
+			if !status.Ok() {
+				im.report(path, "error creating dir: %v", status)
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, importJob{path, attr})
+		case fi.Mode().IsRegular() || fi.Mode()&os.ModeSymlink != 0:
+			jobs <- importJob{path, attr}
+		default:
+			im.report(path, "skipping unsupported file type %v", fi.Mode()&os.ModeType)
+		}
+		return nil
+	})
+	close(jobs)
+	wg.Wait()
+	// Innermost directories first
+	for i := len(dirs) - 1; i >= 0; i-- {
+		im.setAttr(dirs[i].path, dirs[i].attr)
+	}
+}
+
+// importDir handles "gocryptfs -import SRC CIPHERDIR". It encrypts the
+// plaintext directory tree SRC into CIPHERDIR without going through a FUSE
+// mount, using "-workers" goroutines. SRC is copied into the root directory
+// of CIPHERDIR. Existing directories are merged, existing files are not
+// overwritten.
+func importDir(args *argContainer) {
+	if args.reverse {
+		tlog.Fatal.Printf("Running -import with -reverse is not supported")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.workers < 1 {
+		tlog.Fatal.Printf("-workers must be at least 1")
+		os.Exit(exitcodes.Usage)
+	}
+	src, err := filepath.Abs(flagSet.Arg(0))
+	if err == nil {
+		err = isDir(src)
+	}
+	if err != nil {
+		tlog.Fatal.Printf("Invalid source directory: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	dst, dstDir, wipeKeys := initCompareFS(*args, flagSet.Arg(1))
+	defer wipeKeys()
+	if src == dstDir || strings.HasPrefix(src, dstDir+"/") || strings.HasPrefix(dstDir, src+"/") {
+		tlog.Fatal.Printf("Source and destination must not contain each other")
+		os.Exit(exitcodes.Usage)
+	}
+	dstArgs := *args
+	dstArgs.cipherdir = dstDir
+	if lockFile := lockCipherdir(&dstArgs); lockFile != nil {
+		defer lockFile.Close()
+	}
+	im := importObj{src: src, dst: dst}
+	t0 := time.Now()
+	im.run(args.workers)
+	if im.nErrors == 0 {
+		tlog.Info.Printf(tlog.ColorGreen+"import: %d files imported into %s in %v"+tlog.ColorReset,
+			im.nFiles, dstDir, time.Since(t0).Round(time.Millisecond))
+		return
+	}
+	fmt.Printf("import summary: %d files imported, %d errors\n", im.nFiles, im.nErrors)
+	wipeKeys()
+	exitcodes.Exit(exitcodes.NewErr("import incomplete", exitcodes.ImportIncomplete))
+}
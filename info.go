@@ -36,6 +36,9 @@ func info(filename string) {
 	}
 	// Pretty-print
 	fmt.Printf("Creator:      %s\n", cf.Creator)
+	if cf.Label != "" {
+		fmt.Printf("Label:        %s\n", cf.Label)
+	}
 	fmt.Printf("FeatureFlags: %s\n", strings.Join(cf.FeatureFlags, " "))
 	fmt.Printf("EncryptedKey: %dB\n", len(cf.EncryptedKey))
 	s := cf.ScryptObject
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -44,6 +45,35 @@ func isDir(dir string) error {
 	return nil
 }
 
+// initDeterministic handles "-init -deterministic": all random values that
+// -init generates are derived from "-seed" from now on. With the same seed,
+// password and options, the CIPHERDIR is identical on every run.
+func initDeterministic(args *argContainer) {
+	if args.devrandom || args.trezor {
+		tlog.Fatal.Printf("-deterministic cannot be used together with -devrandom or -trezor")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.seed == "" {
+		tlog.Fatal.Printf("-deterministic needs a -seed")
+		os.Exit(exitcodes.Usage)
+	}
+	seed, err := hex.DecodeString(args.seed)
+	if err != nil || len(seed) == 0 {
+		tlog.Fatal.Printf("-seed: must be a non-empty hex string")
+		os.Exit(exitcodes.Usage)
+	}
+	tlog.Warn.Printf(`
+########################################################################
+#
+#   -deterministic: THIS FILESYSTEM IS INSECURE. DO NOT USE IT FOR REAL DATA.
+#
+#   The master key is derived from the seed. Everybody who knows the
+#   seed can decrypt the files, no matter how good the password is.
+#
+########################################################################`)
+	cryptocore.SetDeterministicRand(seed)
+}
+
 // initDir handles "gocryptfs -init". It prepares a directory for use as a
 // gocryptfs storage directory.
 // In forward mode, this means creating the gocryptfs.conf and gocryptfs.diriv
@@ -52,6 +82,49 @@ func isDir(dir string) error {
 // not need to be empty.
 func initDir(args *argContainer) {
 	var err error
+	// Check the label before asking for the password
+	if err = configfile.CheckLabel(args.label); err != nil {
+		tlog.Fatal.Printf("-label: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.nolongname && (args.plaintextnames || args.reverse) {
+		tlog.Fatal.Printf("-no-longname cannot be used together with -plaintextnames or -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.plaintextcontent {
+		if args.plaintextnames || args.reverse || args.aessiv {
+			tlog.Fatal.Printf("-plaintextcontent cannot be used together with -plaintextnames, -reverse or -aessiv")
+			os.Exit(exitcodes.Usage)
+		}
+		tlog.Warn.Printf("-plaintextcontent: file contents will be stored UNENCRYPTED and without integrity protection. Only the file names are protected.")
+	}
+	if args.xts {
+		if args.plaintextcontent || args.reverse || args.aessiv {
+			tlog.Fatal.Printf("-xts cannot be used together with -plaintextcontent, -reverse or -aessiv")
+			os.Exit(exitcodes.Usage)
+		}
+		tlog.Warn.Printf("-xts: file contents will be encrypted WITHOUT integrity protection.")
+	}
+	if args.xattrsidecar && (args.plaintextnames || args.reverse) {
+		tlog.Fatal.Printf("-xattr-sidecar cannot be used together with -plaintextnames or -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.normalizenames != "" {
+		if args.normalizenames != "nfc" && args.normalizenames != "nfd" {
+			tlog.Fatal.Printf("Invalid -normalize-names value %q, must be \"nfc\" or \"nfd\"", args.normalizenames)
+			os.Exit(exitcodes.Usage)
+		}
+		if args.plaintextnames || args.reverse {
+			tlog.Fatal.Printf("-normalize-names cannot be used together with -plaintextnames or -reverse")
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.deterministic {
+		initDeterministic(args)
+	} else if args.seed != "" {
+		tlog.Fatal.Printf("-seed only works together with -deterministic")
+		os.Exit(exitcodes.Usage)
+	}
 	if args.reverse {
 		_, err = os.Stat(args.config)
 		if err == nil {
@@ -82,8 +155,22 @@ func initDir(args *argContainer) {
 			readpassword.CheckTrailingGarbage()
 		}
 		creator := tlog.ProgramName + " " + GitVersion
-		err = configfile.Create(args.config, password, args.plaintextnames,
-			args.scryptn, creator, args.aessiv, args.devrandom, trezorPayload)
+		err = configfile.Create(&configfile.CreateArgs{
+			Filename:         args.config,
+			Password:         password,
+			PlaintextNames:   args.plaintextnames,
+			LogN:             args.scryptn,
+			Creator:          creator,
+			AESSIV:           args.aessiv,
+			Devrandom:        args.devrandom,
+			TrezorPayload:    trezorPayload,
+			NoLongNames:      args.nolongname,
+			NormalizeNames:   args.normalizenames,
+			PlaintextContent: args.plaintextcontent,
+			Label:            args.label,
+			XAttrSidecar:     args.xattrsidecar,
+			XTS:              args.xts,
+		})
 		if err != nil {
 			tlog.Fatal.Println(err)
 			os.Exit(exitcodes.WriteConf)
@@ -0,0 +1,145 @@
+package audit
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// FS wraps a pathfs.FileSystem and records every open and every
+// modification in the audit log. Lookups, stat and directory listings are not
+// recorded.
+type FS struct {
+	// Operations we do not record go straight to the wrapped filesystem
+	pathfs.FileSystem
+	log *Log
+}
+
+var _ pathfs.FileSystem = &FS{} // Verify that interface is implemented.
+
+// NewFS returns "fs" with all opens and modifications logged to "log".
+func NewFS(fs pathfs.FileSystem, log *Log) *FS {
+	return &FS{FileSystem: fs, log: log}
+}
+
+// record writes one record. Failing to write the log does not fail the
+// operation, which has already happened, but is reported loudly.
+func (fs *FS) record(op string, path string, arg string, context *fuse.Context, status fuse.Status) {
+	r := Record{Op: op, Path: path, Arg: arg, Status: status.String()}
+	if context != nil {
+		r.UID, r.GID, r.PID = context.Uid, context.Gid, context.Pid
+	}
+	if err := fs.log.Write(r); err != nil {
+		tlog.Warn.Printf("audit log: could not record %s %q: %v", op, path, err)
+	}
+}
+
+// Chmod - FUSE call
+func (fs *FS) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.Chmod(name, mode, context)
+	fs.record("chmod", name, fmt.Sprintf("%#o", mode), context, status)
+	return status
+}
+
+// Chown - FUSE call
+func (fs *FS) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.Chown(name, uid, gid, context)
+	fs.record("chown", name, fmt.Sprintf("%d:%d", uid, gid), context, status)
+	return status
+}
+
+// Utimens - FUSE call
+func (fs *FS) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.Utimens(name, atime, mtime, context)
+	fs.record("utimens", name, "", context, status)
+	return status
+}
+
+// Truncate - FUSE call
+func (fs *FS) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.Truncate(name, size, context)
+	fs.record("truncate", name, fmt.Sprintf("%d", size), context, status)
+	return status
+}
+
+// Link - FUSE call
+func (fs *FS) Link(oldName string, newName string, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.Link(oldName, newName, context)
+	fs.record("link", newName, oldName, context, status)
+	return status
+}
+
+// Mkdir - FUSE call
+func (fs *FS) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.Mkdir(name, mode, context)
+	fs.record("mkdir", name, fmt.Sprintf("%#o", mode), context, status)
+	return status
+}
+
+// Mknod - FUSE call
+func (fs *FS) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.Mknod(name, mode, dev, context)
+	fs.record("mknod", name, fmt.Sprintf("%#o", mode), context, status)
+	return status
+}
+
+// Rename - FUSE call
+func (fs *FS) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.Rename(oldName, newName, context)
+	fs.record("rename", oldName, newName, context, status)
+	return status
+}
+
+// Rmdir - FUSE call
+func (fs *FS) Rmdir(name string, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.Rmdir(name, context)
+	fs.record("rmdir", name, "", context, status)
+	return status
+}
+
+// Unlink - FUSE call
+func (fs *FS) Unlink(name string, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.Unlink(name, context)
+	fs.record("unlink", name, "", context, status)
+	return status
+}
+
+// RemoveXAttr - FUSE call
+func (fs *FS) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.RemoveXAttr(name, attr, context)
+	fs.record("removexattr", name, attr, context, status)
+	return status
+}
+
+// SetXAttr - FUSE call
+func (fs *FS) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.SetXAttr(name, attr, data, flags, context)
+	fs.record("setxattr", name, attr, context, status)
+	return status
+}
+
+// Open - FUSE call
+func (fs *FS) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	file, status := fs.FileSystem.Open(name, flags, context)
+	fs.record("open", name, fmt.Sprintf("%#o", flags), context, status)
+	return file, status
+}
+
+// Create - FUSE call
+func (fs *FS) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	file, status := fs.FileSystem.Create(name, flags, mode, context)
+	fs.record("create", name, fmt.Sprintf("%#o", mode), context, status)
+	return file, status
+}
+
+// Symlink - FUSE call
+func (fs *FS) Symlink(target string, linkName string, context *fuse.Context) fuse.Status {
+	status := fs.FileSystem.Symlink(target, linkName, context)
+	fs.record("symlink", linkName, target, context, status)
+	return status
+}
@@ -0,0 +1,183 @@
+// Package audit writes a tamper-evident log of the operations on a mounted
+// filesystem ("-audit-log").
+//
+// The log is a text file with one JSON record per line. Every record
+// contains the hash of the record before it, so the records form a chain:
+// modifying, inserting, reordering or deleting a record breaks all hashes
+// after it. The first record of a new log is the genesis record. It has
+// sequence number 0 and GenesisPrev as the previous hash.
+//
+// The chain uses plain SHA-256, not a key. Somebody who can write the log
+// can recompute the whole chain after editing it, and can cut records off
+// the end. To detect that, keep a copy of the last hash somewhere else. It is
+// printed when the filesystem is unmounted and by Verify.
+package audit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// GenesisPrev is the previous hash of the genesis record.
+var GenesisPrev = hex.EncodeToString(make([]byte, sha256.Size))
+
+// tailSize is how much of an existing log we read to find the last record.
+// Records are much smaller than that.
+const tailSize = 64 * 1024
+
+// Record is one line of the audit log.
+type Record struct {
+	// Position in the chain, starting at 0
+	Seq uint64 `json:"seq"`
+	// RFC3339 timestamp with nanoseconds
+	Time string `json:"time"`
+	// Operation, for example "create" or "rename"
+	Op string `json:"op"`
+	// Plaintext path relative to the mountpoint
+	Path string `json:"path,omitempty"`
+	// Second path for "rename", "link" and "symlink", or details like the
+	// open flags or the new mode
+	Arg string `json:"arg,omitempty"`
+	// Caller
+	UID uint32 `json:"uid"`
+	GID uint32 `json:"gid"`
+	PID uint32 `json:"pid"`
+	// "OK" or the error returned to the caller
+	Status string `json:"status"`
+	// Hash of the previous record
+	Prev string `json:"prev"`
+	// Hash of this record: SHA-256 over the JSON encoding of the record
+	// with the "hash" field left out.
+	Hash string `json:"hash,omitempty"`
+}
+
+// hash computes the hash of "r", ignoring r.Hash.
+func (r Record) hash() string {
+	r.Hash = ""
+	j, err := json.Marshal(r)
+	if err != nil {
+		panic(err)
+	}
+	h := sha256.Sum256(j)
+	return hex.EncodeToString(h[:])
+}
+
+// Log is an open audit log. It is safe for concurrent use. All records go
+// through one mutex, so there is exactly one chain, in the order the records
+// have been written.
+type Log struct {
+	sync.Mutex
+	f *os.File
+	// Sequence number and hash of the last record written
+	seq  uint64
+	prev string
+}
+
+// Open opens the audit log "path" for appending, or creates it and writes
+// the genesis record. An existing log is continued from its last record.
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{f: f}
+	last, err := lastRecord(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if last == nil {
+		err = l.write(Record{Op: "genesis", Status: "OK"}, true)
+	} else {
+		l.seq, l.prev = last.Seq, last.Hash
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// lastRecord returns the last record in "f", or nil if "f" is empty.
+func lastRecord(f *os.File) (*Record, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() == 0 {
+		return nil, nil
+	}
+	off := fi.Size() - tailSize
+	if off < 0 {
+		off = 0
+	}
+	buf := make([]byte, fi.Size()-off)
+	if _, err = f.ReadAt(buf, off); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if buf[len(buf)-1] != '\n' {
+		return nil, fmt.Errorf("last record is incomplete, check the log with -verify-audit")
+	}
+	buf = buf[:len(buf)-1]
+	line := buf[bytes.LastIndexByte(buf, '\n')+1:]
+	var r Record
+	if err = json.Unmarshal(line, &r); err != nil || r.Hash == "" {
+		return nil, fmt.Errorf("last record is corrupt, check the log with -verify-audit")
+	}
+	return &r, nil
+}
+
+// write appends "r" to the chain. The caller must hold the lock, except for
+// the genesis record.
+func (l *Log) write(r Record, genesis bool) error {
+	if genesis {
+		r.Seq = 0
+		r.Prev = GenesisPrev
+	} else {
+		r.Seq = l.seq + 1
+		r.Prev = l.prev
+	}
+	r.Time = time.Now().Format(time.RFC3339Nano)
+	r.Hash = r.hash()
+	j, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err = l.f.Write(append(j, '\n')); err != nil {
+		return err
+	}
+	l.seq, l.prev = r.Seq, r.Hash
+	return nil
+}
+
+// Write appends "r" to the log. Seq, Time, Prev and Hash are filled in.
+func (l *Log) Write(r Record) error {
+	l.Lock()
+	defer l.Unlock()
+	return l.write(r, false)
+}
+
+// Last returns the sequence number and the hash of the last record.
+func (l *Log) Last() (seq uint64, hash string) {
+	l.Lock()
+	defer l.Unlock()
+	return l.seq, l.prev
+}
+
+// Close syncs and closes the log.
+func (l *Log) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	err := l.f.Sync()
+	if err2 := l.f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+package audit
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// writeTestLog creates a log with the genesis record and "n" more records,
+// written from several goroutines, and returns its path.
+func writeTestLog(t *testing.T, dir string, n int) string {
+	path := filepath.Join(dir, "audit.log")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := l.Write(Record{Op: "open", Path: fmt.Sprintf("file%d", i), Status: "OK"}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err = l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func verifyFile(path string) (uint64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	return Verify(f)
+}
+
+func TestChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestChain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeTestLog(t, dir, 100)
+	n, last, err := verifyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 101 {
+		t.Errorf("want 101 records, got %d", n)
+	}
+	// Reopening continues the chain, it does not start a new one
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq, hash := l.Last(); seq != 100 || hash != last {
+		t.Errorf("reopened log is at %d %s, want 100 %s", seq, hash, last)
+	}
+	l.Write(Record{Op: "unlink", Path: "x", Status: "OK"})
+	l.Close()
+	if n, _, err = verifyFile(path); err != nil || n != 102 {
+		t.Errorf("after reopening: n=%d err=%v", n, err)
+	}
+}
+
+func TestTamper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestTamper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeTestLog(t, dir, 5)
+	orig, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(orig, []byte("\n"))
+	lines = lines[:len(lines)-1]
+	join := func(l ...[]byte) []byte {
+		return bytes.Join(l, nil)
+	}
+	testcases := map[string][]byte{
+		"modified":    bytes.Replace(orig, []byte(`"file`), []byte(`"fi1e`), 1),
+		"deleted":     join(lines[0], lines[1], lines[3], lines[4], lines[5]),
+		"reordered":   join(lines[0], lines[2], lines[1], lines[3], lines[4], lines[5]),
+		"no genesis":  join(lines[1:]...),
+		"extra field": bytes.Replace(orig, []byte(`"op":`), []byte(`"x":1,"op":`), 1),
+		"truncated":   orig[:len(orig)-10],
+	}
+	for name, content := range testcases {
+		if err = ioutil.WriteFile(path, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = verifyFile(path); err == nil {
+			t.Errorf("%s: tampering not detected", name)
+		}
+	}
+	// A log with an incomplete last record must not be extended
+	if err = ioutil.WriteFile(path, testcases["truncated"], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Open(path); err == nil {
+		t.Error("Open accepted an incomplete last record")
+	}
+}
@@ -0,0 +1,57 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Verify checks the hash chain of the audit log read from "r". It returns
+// the number of records and the hash of the last one, or an error that
+// names the first broken record.
+func Verify(r io.Reader) (n uint64, last string, err error) {
+	br := bufio.NewReader(r)
+	prev := GenesisPrev
+	for lineNo := 1; ; lineNo++ {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err == io.EOF {
+			return n, prev, fmt.Errorf("line %d: incomplete record", lineNo)
+		}
+		if err != nil {
+			return n, prev, err
+		}
+		line = line[:len(line)-1]
+		var rec Record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return n, prev, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		if n == 0 && rec.Op != "genesis" {
+			return n, prev, fmt.Errorf("line %d: the log does not start with a genesis record", lineNo)
+		}
+		if rec.Seq != n {
+			return n, prev, fmt.Errorf("line %d: sequence number %d, expected %d: records are missing or reordered", lineNo, rec.Seq, n)
+		}
+		if rec.Prev != prev {
+			return n, prev, fmt.Errorf("line %d: the previous hash does not match: a record has been removed or modified", lineNo)
+		}
+		if rec.hash() != rec.Hash {
+			return n, prev, fmt.Errorf("line %d: hash mismatch: the record has been modified", lineNo)
+		}
+		// Fields we do not know about would not be covered by the hash
+		canonical, _ := json.Marshal(rec)
+		if !bytes.Equal(canonical, line) {
+			return n, prev, fmt.Errorf("line %d: the record has been modified", lineNo)
+		}
+		prev = rec.Hash
+		n++
+	}
+	if n == 0 {
+		return 0, "", fmt.Errorf("empty log")
+	}
+	return n, prev, nil
+}
@@ -8,6 +8,9 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"path/filepath"
+	"strings"
+	"unicode"
 
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
@@ -49,6 +52,9 @@ type ConfFile struct {
 	// a Trezor security module. The randomness makes sure that a unique unlock
 	// value is used for each gocryptfs filesystem.
 	TrezorPayload []byte `json:",omitempty"`
+	// Label is an optional human-readable name for the filesystem. It is not
+	// secret and not used for anything cryptographic.
+	Label string `json:",omitempty"`
 	// Filename is the name of the config file. Not exported to JSON.
 	filename string
 }
@@ -68,38 +74,115 @@ func randBytesDevRandom(n int) []byte {
 	return b
 }
 
+// CreateArgs exists because the argument list to Create became too long.
+type CreateArgs struct {
+	Filename       string
+	Password       []byte
+	PlaintextNames bool
+	LogN           int
+	Creator        string
+	AESSIV         bool
+	Devrandom      bool
+	TrezorPayload  []byte
+	// NoLongNames disables long name support
+	NoLongNames bool
+	// NormalizeNames is the Unicode normalization form for file names,
+	// "nfc" or "nfd". Empty means no normalization.
+	NormalizeNames string
+	// PlaintextContent stores file contents unencrypted
+	PlaintextContent bool
+	// Label is the human-readable name of the filesystem, see CheckLabel
+	Label string
+	// XAttrSidecar stores xattrs in sidecar files
+	XAttrSidecar bool
+	// XTS encrypts file contents with AES-XTS
+	XTS bool
+}
+
+// MaxLabelLen is the maximum length of ConfFile.Label in bytes
+const MaxLabelLen = 255
+
+// CheckLabel returns an error if "label" cannot be used as a filesystem
+// label. The label ends up in log lines, so control characters are not
+// allowed.
+func CheckLabel(label string) error {
+	if len(label) > MaxLabelLen {
+		return fmt.Errorf("label is too long (%d bytes, max %d)", len(label), MaxLabelLen)
+	}
+	for _, r := range label {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("label contains control character %q", r)
+		}
+	}
+	return nil
+}
+
 // Create - create a new config with a random key encrypted with
-// "password" and write it to "filename".
-// Uses scrypt with cost parameter logN.
-func Create(filename string, password []byte, plaintextNames bool,
-	logN int, creator string, aessiv bool, devrandom bool, trezorPayload []byte) error {
+// "Password" and write it to "Filename".
+// Uses scrypt with cost parameter "LogN".
+func Create(args *CreateArgs) error {
 	var cf ConfFile
-	cf.filename = filename
-	cf.Creator = creator
+	cf.filename = args.Filename
+	cf.Creator = args.Creator
 	cf.Version = contentenc.CurrentVersion
+	if err := CheckLabel(args.Label); err != nil {
+		return err
+	}
+	cf.Label = args.Label
 
 	// Set feature flags
 	cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagGCMIV128])
 	cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagHKDF])
-	if plaintextNames {
+	if args.PlaintextNames {
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagPlaintextNames])
 	} else {
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagDirIV])
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagEMENames])
-		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagLongNames])
+		if args.NoLongNames {
+			cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagNoLongNames])
+		} else {
+			cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagLongNames])
+		}
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagRaw64])
 	}
-	if aessiv {
+	if args.AESSIV {
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagAESSIV])
 	}
-	if len(trezorPayload) > 0 {
+	if args.PlaintextContent {
+		if args.PlaintextNames || args.AESSIV {
+			return fmt.Errorf("PlaintextContent cannot be combined with PlaintextNames or AESSIV")
+		}
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagPlaintextContent])
+	}
+	if args.XTS {
+		if args.PlaintextContent || args.AESSIV {
+			return fmt.Errorf("XTS cannot be combined with PlaintextContent or AESSIV")
+		}
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagXTS])
+	}
+	if args.XAttrSidecar {
+		if args.PlaintextNames {
+			return fmt.Errorf("XAttrSidecar cannot be combined with PlaintextNames")
+		}
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagXAttrSidecar])
+	}
+	if len(args.TrezorPayload) > 0 {
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagTrezor])
-		cf.TrezorPayload = trezorPayload
+		cf.TrezorPayload = args.TrezorPayload
+	}
+	switch args.NormalizeNames {
+	case "":
+	case "nfc":
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagNormalizeNFC])
+	case "nfd":
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagNormalizeNFD])
+	default:
+		return fmt.Errorf("unknown normalization form %q", args.NormalizeNames)
 	}
 	{
 		// Generate new random master key
 		var key []byte
-		if devrandom {
+		if args.Devrandom {
 			key = randBytesDevRandom(cryptocore.KeyLen)
 		} else {
 			key = cryptocore.RandBytes(cryptocore.KeyLen)
@@ -108,7 +191,7 @@ func Create(filename string, password []byte, plaintextNames bool,
 		// Encrypt it using the password
 		// This sets ScryptObject and EncryptedKey
 		// Note: this looks at the FeatureFlags, so call it AFTER setting them.
-		cf.EncryptKey(key, password, logN)
+		cf.EncryptKey(key, args.Password, args.LogN)
 		for i := range key {
 			key[i] = 0
 		}
@@ -148,49 +231,43 @@ func LoadAndDecrypt(filename string, password []byte) ([]byte, *ConfFile, error)
 
 // Load loads and parses the config file at "filename".
 func Load(filename string) (*ConfFile, error) {
-	var cf ConfFile
-	cf.filename = filename
-
-	// Read from disk
-	js, err := ioutil.ReadFile(filename)
+	cf, err := loadRaw(filename)
 	if err != nil {
 		return nil, err
 	}
-	if len(js) == 0 {
-		return nil, fmt.Errorf("Config file is empty")
+
+	if cf.Version != contentenc.CurrentVersion {
+		return nil, &configError{ErrUnsupportedVersion, fmt.Errorf("Unsupported on-disk format %d", cf.Version)}
 	}
 
-	// Unmarshal
-	err = json.Unmarshal(js, &cf)
-	if err != nil {
-		tlog.Warn.Printf("Failed to unmarshal config file")
-		return nil, err
+	// Check that all set feature flags are known. Collect all unknown ones so
+	// the user sees everything a newer gocryptfs version has enabled.
+	if unknownFlags := cf.unknownFeatureFlags(); len(unknownFlags) > 0 {
+		return nil, &configError{ErrUnsupportedVersion, fmt.Errorf(
+			"filesystem requires unsupported features: %s; upgrade gocryptfs",
+			strings.Join(unknownFlags, ", "))}
 	}
 
-	if cf.Version != contentenc.CurrentVersion {
-		return nil, fmt.Errorf("Unsupported on-disk format %d", cf.Version)
+	// Nothing would be encrypted
+	if cf.IsFeatureFlagSet(FlagPlaintextContent) && cf.IsFeatureFlagSet(FlagPlaintextNames) {
+		return nil, &configError{ErrCorruptConfig, fmt.Errorf("PlaintextContent and PlaintextNames are both set")}
 	}
 
-	// Check that all set feature flags are known
-	for _, flag := range cf.FeatureFlags {
-		if !cf.isFeatureFlagKnown(flag) {
-			return nil, fmt.Errorf("Unsupported feature flag %q", flag)
-		}
+	// Contents cannot be both unencrypted and XTS-encrypted
+	if cf.IsFeatureFlagSet(FlagXTS) && cf.IsFeatureFlagSet(FlagPlaintextContent) {
+		return nil, &configError{ErrCorruptConfig, fmt.Errorf("XTS and PlaintextContent are both set")}
 	}
 
-	// Check that all required feature flags are set
-	var requiredFlags []flagIota
-	if cf.IsFeatureFlagSet(FlagPlaintextNames) {
-		requiredFlags = requiredFlagsPlaintextNames
-	} else {
-		requiredFlags = requiredFlagsNormal
+	// Sidecar file names could collide with plaintext names
+	if cf.IsFeatureFlagSet(FlagXAttrSidecar) && cf.IsFeatureFlagSet(FlagPlaintextNames) {
+		return nil, &configError{ErrCorruptConfig, fmt.Errorf("XAttrSidecar and PlaintextNames are both set")}
 	}
+
+	// Check that all required feature flags are set
 	deprecatedFs := false
-	for _, i := range requiredFlags {
-		if !cf.IsFeatureFlagSet(i) {
-			fmt.Fprintf(os.Stderr, "Required feature flag %q is missing\n", knownFlags[i])
-			deprecatedFs = true
-		}
+	for _, i := range cf.missingRequiredFlags() {
+		fmt.Fprintf(os.Stderr, "Required feature flag %q is missing\n", knownFlags[i])
+		deprecatedFs = true
 	}
 	if deprecatedFs {
 		fmt.Fprintf(os.Stderr, tlog.ColorYellow+`
@@ -208,9 +285,61 @@ func Load(filename string) (*ConfFile, error) {
 	}
 
 	// All good
+	return cf, nil
+}
+
+// loadRaw reads and unmarshals the config file at "filename" without
+// checking its content.
+func loadRaw(filename string) (*ConfFile, error) {
+	var cf ConfFile
+	cf.filename = filename
+
+	// Read from disk
+	js, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, &configError{ErrConfigNotFound, err}
+	} else if err != nil {
+		return nil, err
+	}
+	if len(js) == 0 {
+		return nil, &configError{ErrCorruptConfig, fmt.Errorf("Config file is empty")}
+	}
+
+	// Unmarshal
+	err = json.Unmarshal(js, &cf)
+	if err != nil {
+		tlog.Warn.Printf("Failed to unmarshal config file")
+		return nil, &configError{ErrCorruptConfig, err}
+	}
 	return &cf, nil
 }
 
+// unknownFeatureFlags returns the feature flags that this version of
+// gocryptfs does not know.
+func (cf *ConfFile) unknownFeatureFlags() (unknown []string) {
+	for _, flag := range cf.FeatureFlags {
+		if !cf.isFeatureFlagKnown(flag) {
+			unknown = append(unknown, flag)
+		}
+	}
+	return unknown
+}
+
+// missingRequiredFlags returns the required feature flags that are not set.
+// Filesystems that lack any of them are deprecated.
+func (cf *ConfFile) missingRequiredFlags() (missing []flagIota) {
+	requiredFlags := requiredFlagsNormal
+	if cf.IsFeatureFlagSet(FlagPlaintextNames) {
+		requiredFlags = requiredFlagsPlaintextNames
+	}
+	for _, i := range requiredFlags {
+		if !cf.IsFeatureFlagSet(i) {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
 // DecryptMasterKey decrypts the masterkey stored in cf.EncryptedKey using
 // password.
 func (cf *ConfFile) DecryptMasterKey(password []byte) (masterkey []byte, err error) {
@@ -226,7 +355,7 @@ func (cf *ConfFile) DecryptMasterKey(password []byte) (masterkey []byte, err err
 	tlog.Warn.Enabled = true
 	if err != nil {
 		tlog.Warn.Printf("failed to unlock master key: %s", err.Error())
-		return nil, exitcodes.NewErr("Password incorrect.", exitcodes.PasswordIncorrect)
+		return nil, &configError{ErrWrongPassword, fmt.Errorf("Password incorrect.")}
 	}
 	return masterkey, nil
 }
@@ -249,35 +378,43 @@ func (cf *ConfFile) EncryptKey(key []byte, password []byte, logN int) {
 	}
 }
 
+// TmpDir is where WriteFile creates its temporary file, "-tmpdir". It must
+// be on the same filesystem as the config file. Empty means next to the
+// config file.
+var TmpDir string
+
 // WriteFile - write out config in JSON format to file "filename.tmp"
 // then rename over "filename".
 // This way a password change atomically replaces the file.
 func (cf *ConfFile) WriteFile() error {
 	tmp := cf.filename + ".tmp"
+	if TmpDir != "" {
+		// Several filesystems may share TmpDir, make the name unique
+		tmp = filepath.Join(TmpDir, fmt.Sprintf("%s.tmp.%d", filepath.Base(cf.filename), cryptocore.RandUint64()))
+	}
 	// 0400 permissions: gocryptfs.conf should be kept secret and never be written to.
 	fd, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
 	if err != nil {
 		return err
 	}
 	js, err := json.MarshalIndent(cf, "", "\t")
-	if err != nil {
-		return err
+	if err == nil {
+		// For convenience for the user, add a newline at the end.
+		js = append(js, '\n')
+		_, err = fd.Write(js)
 	}
-	// For convenience for the user, add a newline at the end.
-	js = append(js, '\n')
-	_, err = fd.Write(js)
-	if err != nil {
-		return err
+	if err == nil {
+		err = fd.Sync()
 	}
-	err = fd.Sync()
-	if err != nil {
-		return err
+	if err2 := fd.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmp, cf.filename)
 	}
-	err = fd.Close()
 	if err != nil {
-		return err
+		os.Remove(tmp)
 	}
-	err = os.Rename(tmp, cf.filename)
 	return err
 }
 
@@ -2,6 +2,9 @@ package configfile
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -61,8 +64,21 @@ func TestLoadV2StrangeFeature(t *testing.T) {
 	}
 }
 
+// TestLoadV2FutureFeatures checks that all unknown feature flags are listed
+// in the error message, not just the first one.
+func TestLoadV2FutureFeatures(t *testing.T) {
+	_, err := Load("config_test/FutureFeatures.conf")
+	if err == nil {
+		t.Fatal("Loading unknown features must fail but it didn't")
+	}
+	want := "filesystem requires unsupported features: FutureFlagOne, FutureFlagTwo; upgrade gocryptfs"
+	if err.Error() != want {
+		t.Errorf("wrong error message:\nwant: %s\n got: %s", want, err.Error())
+	}
+}
+
 func TestCreateConfDefault(t *testing.T) {
-	err := Create("config_test/tmp.conf", testPw, false, 10, "test", false, false, nil)
+	err := Create(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test"})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -83,14 +99,14 @@ func TestCreateConfDefault(t *testing.T) {
 }
 
 func TestCreateConfDevRandom(t *testing.T) {
-	err := Create("config_test/tmp.conf", testPw, false, 10, "test", false, true, nil)
+	err := Create(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test", Devrandom: true})
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
 func TestCreateConfPlaintextnames(t *testing.T) {
-	err := Create("config_test/tmp.conf", testPw, true, 10, "test", false, false, nil)
+	err := Create(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, PlaintextNames: true, LogN: 10, Creator: "test"})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -111,7 +127,7 @@ func TestCreateConfPlaintextnames(t *testing.T) {
 
 // Reverse mode uses AESSIV
 func TestCreateConfFileAESSIV(t *testing.T) {
-	err := Create("config_test/tmp.conf", testPw, false, 10, "test", true, false, nil)
+	err := Create(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test", AESSIV: true})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -124,6 +140,24 @@ func TestCreateConfFileAESSIV(t *testing.T) {
 	}
 }
 
+func TestCreateConfNormalizeNames(t *testing.T) {
+	err := Create(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test", NormalizeNames: "nfc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagNormalizeNFC) || c.IsFeatureFlagSet(FlagNormalizeNFD) {
+		t.Errorf("wrong feature flags: %v", c.FeatureFlags)
+	}
+	err = Create(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test", NormalizeNames: "nfkc"})
+	if err == nil {
+		t.Error("unknown normalization form should be rejected")
+	}
+}
+
 func TestIsFeatureFlagKnown(t *testing.T) {
 	// Test a few hardcoded values
 	testKnownFlags := []string{"DirIV", "PlaintextNames", "EMENames", "GCMIV128", "LongNames", "AESSIV"}
@@ -145,3 +179,136 @@ func TestIsFeatureFlagKnown(t *testing.T) {
 		t.Errorf("flag %q should be NOT known", f)
 	}
 }
+
+func TestCreateConfNoLongNames(t *testing.T) {
+	err := Create(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test", NoLongNames: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagNoLongNames) || c.IsFeatureFlagSet(FlagLongNames) {
+		t.Errorf("wrong feature flags: %v", c.FeatureFlags)
+	}
+}
+
+func TestCreateConfPlaintextContent(t *testing.T) {
+	err := Create(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test", PlaintextContent: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagPlaintextContent) || !c.IsFeatureFlagSet(FlagEMENames) {
+		t.Errorf("wrong feature flags: %v", c.FeatureFlags)
+	}
+	// Nothing would be encrypted
+	err = Create(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test", PlaintextContent: true, PlaintextNames: true})
+	if err == nil {
+		t.Error("PlaintextContent together with PlaintextNames should be rejected")
+	}
+	c.FeatureFlags = append(c.FeatureFlags, knownFlags[FlagPlaintextNames])
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = LoadAndDecrypt("config_test/tmp.conf", testPw); err == nil {
+		t.Error("a config file with PlaintextContent and PlaintextNames should be rejected")
+	}
+}
+
+func TestCreateConfXTS(t *testing.T) {
+	err := Create(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test", XTS: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagXTS) {
+		t.Errorf("wrong feature flags: %v", c.FeatureFlags)
+	}
+	err = Create(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test", XTS: true, AESSIV: true})
+	if err == nil {
+		t.Error("XTS together with AESSIV should be rejected")
+	}
+	c.FeatureFlags = append(c.FeatureFlags, knownFlags[FlagPlaintextContent])
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = LoadAndDecrypt("config_test/tmp.conf", testPw); err == nil {
+		t.Error("a config file with XTS and PlaintextContent should be rejected")
+	}
+}
+
+func TestCreateConfLabel(t *testing.T) {
+	label := "Photos Backup 2024 📷"
+	err := Create(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test", Label: label})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load("config_test/tmp.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Label != label {
+		t.Errorf("want label %q, got %q", label, c.Label)
+	}
+	// Changing the label does not need the password
+	c.Label = "Photos"
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	_, c, err = LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Label != "Photos" {
+		t.Errorf("want label %q, got %q", "Photos", c.Label)
+	}
+	for _, bad := range []string{"new\nline", strings.Repeat("x", MaxLabelLen+1)} {
+		if CheckLabel(bad) == nil {
+			t.Errorf("label %q was accepted", bad)
+		}
+	}
+}
+
+func TestWriteFileTmpDir(t *testing.T) {
+	// Must be on the same filesystem as config_test/
+	dir, err := ioutil.TempDir("config_test", "tmpdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	TmpDir = dir
+	defer func() { TmpDir = "" }()
+	err = Create(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = LoadAndDecrypt("config_test/tmp.conf", testPw); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat("config_test/tmp.conf"); fi.Mode().Perm() != 0400 {
+		t.Errorf("wrong permissions %v", fi.Mode())
+	}
+	if leftover, _ := ioutil.ReadDir(dir); len(leftover) != 0 {
+		t.Errorf("temporary file was not renamed: %s", leftover[0].Name())
+	}
+	// A failed write removes the temporary file
+	cf, err := Load("config_test/tmp.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf.filename = "config_test/nonexisting/tmp.conf"
+	if cf.WriteFile() == nil {
+		t.Fatal("writing into a nonexisting directory should fail")
+	}
+	if leftover, _ := ioutil.ReadDir(dir); len(leftover) != 0 {
+		t.Errorf("temporary file was not removed: %s", leftover[0].Name())
+	}
+}
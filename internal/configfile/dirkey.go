@@ -0,0 +1,104 @@
+package configfile
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// DirKeyName is the name of the key slot file that "-lock-dir" places into
+// the ciphertext directory of a locked directory. Like ConfDefaultName, it
+// cannot clash with an encrypted file name.
+const DirKeyName = "gocryptfs.dirkey"
+
+// DirKeySlot is the content of a DirKeyName file. It stores the random key
+// of a locked directory, encrypted with a key derived from the directory
+// password. The master key of the filesystem is not involved, so it
+// cannot unlock the directory.
+type DirKeySlot struct {
+	// KeyID identifies the directory key. It is random and 16 bytes long.
+	KeyID []byte
+	// EncryptedKey is the directory key, encrypted using the scrypt hash of
+	// the directory password. KeyID is authenticated as well.
+	EncryptedKey []byte
+	// ScryptObject stores the scrypt parameters
+	ScryptObject ScryptKDF
+}
+
+// CreateDirKey generates a new random directory key, encrypts it with
+// "password" and writes the key slot into ciphertext directory "dir".
+// Fails if "dir" already has a key slot.
+func CreateDirKey(dir string, password []byte, logN int) error {
+	key := cryptocore.RandBytes(cryptocore.KeyLen)
+	s := DirKeySlot{
+		KeyID:        cryptocore.RandBytes(16),
+		ScryptObject: NewScryptKDF(logN),
+	}
+	scryptHash := s.ScryptObject.DeriveKey(password)
+	ce := getKeyEncrypter(scryptHash, true)
+	s.EncryptedKey = ce.EncryptBlock(key, 0, s.KeyID)
+	for i := range scryptHash {
+		scryptHash[i] = 0
+	}
+	for i := range key {
+		key[i] = 0
+	}
+	js, err := json.MarshalIndent(&s, "", "\t")
+	if err != nil {
+		return err
+	}
+	js = append(js, '\n')
+	// 0400 permissions like gocryptfs.conf: the key slot is never modified
+	fd, err := os.OpenFile(filepath.Join(dir, DirKeyName), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(js)
+	if err == nil {
+		err = fd.Sync()
+	}
+	if err2 := fd.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// LoadDirKey reads the key slot in ciphertext directory "dir".
+// Returns an *os.PathError if there is none.
+func LoadDirKey(dir string) (*DirKeySlot, error) {
+	js, err := ioutil.ReadFile(filepath.Join(dir, DirKeyName))
+	if err != nil {
+		return nil, err
+	}
+	var s DirKeySlot
+	err = json.Unmarshal(js, &s)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.KeyID) != 16 {
+		return nil, exitcodes.NewErr("key slot "+filepath.Join(dir, DirKeyName)+" is corrupt", exitcodes.LoadConf)
+	}
+	return &s, nil
+}
+
+// DecryptKey decrypts the directory key using "password".
+func (s *DirKeySlot) DecryptKey(password []byte) ([]byte, error) {
+	scryptHash := s.ScryptObject.DeriveKey(password)
+	ce := getKeyEncrypter(scryptHash, true)
+	tlog.Warn.Enabled = false // Silence DecryptBlock() error messages on incorrect password
+	key, err := ce.DecryptBlock(s.EncryptedKey, 0, s.KeyID)
+	tlog.Warn.Enabled = true
+	for i := range scryptHash {
+		scryptHash[i] = 0
+	}
+	if err != nil {
+		return nil, &configError{ErrWrongPassword, errors.New("Directory password incorrect.")}
+	}
+	return key, nil
+}
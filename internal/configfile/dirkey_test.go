@@ -0,0 +1,50 @@
+package configfile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDirKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestDirKey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err = LoadDirKey(dir); !os.IsNotExist(err) {
+		t.Errorf("LoadDirKey on a directory without key slot should fail with ENOENT, got %v", err)
+	}
+	err = CreateDirKey(dir, testPw, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Creating a second key slot must fail
+	if err = CreateDirKey(dir, testPw, 10); err == nil {
+		t.Errorf("CreateDirKey overwrote an existing key slot")
+	}
+	s, err := LoadDirKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key1, err := s.DecryptKey(testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, err := s.DecryptKey(testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key1, key2) || len(key1) != 32 {
+		t.Errorf("inconsistent key: %x vs %x", key1, key2)
+	}
+	if _, err = s.DecryptKey([]byte("wrong")); err == nil {
+		t.Errorf("incorrect password was accepted")
+	}
+	// The KeyID is authenticated
+	s.KeyID[0] ^= 1
+	if _, err = s.DecryptKey(testPw); err == nil {
+		t.Errorf("modified KeyID was not detected")
+	}
+}
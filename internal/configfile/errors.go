@@ -0,0 +1,42 @@
+package configfile
+
+import (
+	"errors"
+)
+
+// Errors returned by Load, LoadAndDecrypt and DecryptMasterKey. Check for
+// them using errors.Is. The error messages are more specific than these.
+var (
+	// ErrConfigNotFound means that the config file does not exist
+	ErrConfigNotFound = errors.New("config file not found")
+	// ErrWrongPassword means that the master key could not be decrypted
+	// using the password
+	ErrWrongPassword = errors.New("password incorrect")
+	// ErrUnsupportedVersion means that the config file has been created by
+	// a different gocryptfs version that uses a different on-disk format
+	ErrUnsupportedVersion = errors.New("unsupported on-disk format")
+	// ErrCorruptConfig means that the config file could not be parsed
+	ErrCorruptConfig = errors.New("corrupt config file")
+)
+
+// configError is an error of one of the kinds above. It prints the
+// message of "err" and matches "kind" in errors.Is.
+type configError struct {
+	kind error
+	err  error
+}
+
+func (e *configError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the underlying error, for example the *os.PathError for
+// ErrConfigNotFound.
+func (e *configError) Unwrap() error {
+	return e.err
+}
+
+// Is is used by errors.Is
+func (e *configError) Is(target error) bool {
+	return target == e.kind
+}
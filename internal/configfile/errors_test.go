@@ -0,0 +1,63 @@
+package configfile
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+func TestErrorTypes(t *testing.T) {
+	if !testing.Verbose() {
+		tlog.Warn.Enabled = false
+		defer func() { tlog.Warn.Enabled = true }()
+	}
+	dir, err := ioutil.TempDir("", "TestErrorTypes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	empty := dir + "/empty.conf"
+	garbage := dir + "/garbage.conf"
+	ioutil.WriteFile(empty, nil, 0600)
+	ioutil.WriteFile(garbage, []byte("{not json"), 0600)
+
+	testCases := []struct {
+		file string
+		want error
+		msg  string
+	}{
+		{"config_test/doesnotexist.conf", ErrConfigNotFound,
+			"open config_test/doesnotexist.conf: no such file or directory"},
+		{empty, ErrCorruptConfig, "Config file is empty"},
+		{garbage, ErrCorruptConfig, ""},
+		{"config_test/v1.conf", ErrUnsupportedVersion, "Unsupported on-disk format 1"},
+		{"config_test/StrangeFeature.conf", ErrUnsupportedVersion, "filesystem requires unsupported features: StrangeFeatureFlag; upgrade gocryptfs"},
+	}
+	all := []error{ErrConfigNotFound, ErrWrongPassword, ErrUnsupportedVersion, ErrCorruptConfig}
+	for _, tc := range testCases {
+		_, err := Load(tc.file)
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%s: want %v, got %v", tc.file, tc.want, err)
+		}
+		for _, other := range all {
+			if other != tc.want && errors.Is(err, other) {
+				t.Errorf("%s: %v should not match %v", tc.file, err, other)
+			}
+		}
+		if tc.msg != "" && err.Error() != tc.msg {
+			t.Errorf("%s: message changed: %q", tc.file, err.Error())
+		}
+	}
+	// The underlying error is still accessible
+	_, err = Load("config_test/doesnotexist.conf")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ErrConfigNotFound should wrap os.ErrNotExist: %v", err)
+	}
+	_, _, err = LoadAndDecrypt("config_test/v2.conf", []byte("wrongpassword"))
+	if !errors.Is(err, ErrWrongPassword) || err.Error() != "Password incorrect." {
+		t.Errorf("want ErrWrongPassword, got %v", err)
+	}
+}
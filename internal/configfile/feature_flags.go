@@ -28,19 +28,50 @@ const (
 	// FlagTrezor means that "-trezor" was used when creating the filesystem.
 	// The masterkey is protected using a Trezor device instead of a password.
 	FlagTrezor
+	// FlagNormalizeNFC means that file names are converted to Unicode
+	// Normalization Form C before they are encrypted.
+	FlagNormalizeNFC
+	// FlagNormalizeNFD is like FlagNormalizeNFC, but for Normalization Form D.
+	FlagNormalizeNFD
+	// FlagNoLongNames disables long name support. Names whose encrypted form
+	// does not fit into the backing filesystem cannot be created.
+	// FlagLongNames is not set in this case, but the absence of FlagLongNames
+	// alone is not enough because old filesystems created without it were
+	// always mounted with long names enabled.
+	FlagNoLongNames
+	// FlagDirKeys means that "-lock-dir" has been used and some directories
+	// contain a DirKeyName file. Files in these directories are encrypted
+	// with their own key.
+	FlagDirKeys
+	// FlagPlaintextContent means that file contents are stored unencrypted.
+	// Only the names are encrypted.
+	FlagPlaintextContent
+	// FlagXAttrSidecar means that extended attributes are stored in
+	// "gocryptfs.xattr.*" sidecar files instead of backing xattrs.
+	FlagXAttrSidecar
+	// FlagXTS means that file contents are encrypted with AES-XTS. There is
+	// no file header and no integrity protection.
+	FlagXTS
 )
 
 // knownFlags stores the known feature flags and their string representation
 var knownFlags = map[flagIota]string{
-	FlagPlaintextNames: "PlaintextNames",
-	FlagDirIV:          "DirIV",
-	FlagEMENames:       "EMENames",
-	FlagGCMIV128:       "GCMIV128",
-	FlagLongNames:      "LongNames",
-	FlagAESSIV:         "AESSIV",
-	FlagRaw64:          "Raw64",
-	FlagHKDF:           "HKDF",
-	FlagTrezor:         "Trezor",
+	FlagPlaintextNames:   "PlaintextNames",
+	FlagDirIV:            "DirIV",
+	FlagEMENames:         "EMENames",
+	FlagGCMIV128:         "GCMIV128",
+	FlagLongNames:        "LongNames",
+	FlagAESSIV:           "AESSIV",
+	FlagRaw64:            "Raw64",
+	FlagHKDF:             "HKDF",
+	FlagTrezor:           "Trezor",
+	FlagNormalizeNFC:     "NormalizeNFC",
+	FlagNormalizeNFD:     "NormalizeNFD",
+	FlagNoLongNames:      "NoLongNames",
+	FlagDirKeys:          "DirKeys",
+	FlagPlaintextContent: "PlaintextContent",
+	FlagXAttrSidecar:     "XAttrSidecar",
+	FlagXTS:              "XTS",
 }
 
 // Filesystems that do not have these feature flags set are deprecated.
@@ -66,6 +97,15 @@ func (cf *ConfFile) isFeatureFlagKnown(flag string) bool {
 	return false
 }
 
+// SetFeatureFlag enables the feature flag "flag". Call WriteFile to store
+// the change.
+func (cf *ConfFile) SetFeatureFlag(flag flagIota) {
+	if cf.IsFeatureFlagSet(flag) {
+		return
+	}
+	cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[flag])
+}
+
 // IsFeatureFlagSet returns true if the feature flag "flagWant" is enabled.
 func (cf *ConfFile) IsFeatureFlagSet(flagWant flagIota) bool {
 	flagString := knownFlags[flagWant]
@@ -0,0 +1,56 @@
+package configfile
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+)
+
+// Migrate brings the config file at "filename" up to date, as far as this
+// is possible without touching the encrypted files ("-migrate"). The
+// encrypted master key is not changed. Returns a description of every
+// change, or nothing if the config file is already current.
+//
+// Features that change the on-disk format (like 128-bit GCM IVs, EME or
+// Raw64 file names, HKDF) cannot be enabled this way, the files would have
+// to be re-encrypted. Filesystems that lack required features are refused
+// with ErrUnsupportedVersion.
+func Migrate(filename string) (changes []string, err error) {
+	cf, err := loadRaw(filename)
+	if err != nil {
+		return nil, err
+	}
+	if cf.Version != contentenc.CurrentVersion {
+		return nil, &configError{ErrUnsupportedVersion, fmt.Errorf(
+			"on-disk format %d cannot be migrated to %d in place; copy the files into a new filesystem",
+			cf.Version, contentenc.CurrentVersion)}
+	}
+	if unknownFlags := cf.unknownFeatureFlags(); len(unknownFlags) > 0 {
+		return nil, &configError{ErrUnsupportedVersion, fmt.Errorf(
+			"filesystem requires unsupported features: %s; upgrade gocryptfs",
+			strings.Join(unknownFlags, ", "))}
+	}
+	if missing := cf.missingRequiredFlags(); len(missing) > 0 {
+		var names []string
+		for _, i := range missing {
+			names = append(names, knownFlags[i])
+		}
+		return nil, &configError{ErrUnsupportedVersion, fmt.Errorf(
+			"required features %s change the on-disk format and cannot be added in place; "+
+				"upgrade the filesystem using gocryptfs v0.11, "+
+				"see https://github.com/rfjakob/gocryptfs/wiki/Upgrading",
+			strings.Join(names, ", "))}
+	}
+	// Filesystems created before gocryptfs v0.9 do not have the LongNames
+	// flag, but have always been mounted with long name support.
+	if !cf.IsFeatureFlagSet(FlagPlaintextNames) && !cf.IsFeatureFlagSet(FlagLongNames) &&
+		!cf.IsFeatureFlagSet(FlagNoLongNames) {
+		cf.SetFeatureFlag(FlagLongNames)
+		changes = append(changes, "set feature flag "+knownFlags[FlagLongNames])
+	}
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	return changes, cf.WriteFile()
+}
@@ -0,0 +1,83 @@
+package configfile
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeConf writes a synthetic config file into "dir"
+func writeConf(t *testing.T, dir string, js string) string {
+	path := filepath.Join(dir, "gocryptfs.conf")
+	os.Remove(path)
+	if err := ioutil.WriteFile(path, []byte(js), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestMigrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// gocryptfs v0.7 config without the LongNames flag
+	js, err := ioutil.ReadFile("config_test/v0.7.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeConf(t, dir, string(js))
+	keyBefore, _, err := LoadAndDecrypt(path, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := Migrate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 {
+		t.Errorf("want one change, got %v", changes)
+	}
+	keyAfter, cf, err := LoadAndDecrypt(path, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsFeatureFlagSet(FlagLongNames) {
+		t.Error("LongNames flag not set")
+	}
+	if !bytes.Equal(keyBefore, keyAfter) {
+		t.Error("master key has changed")
+	}
+	// Second run: nothing to do
+	if changes, err = Migrate(path); err != nil || len(changes) != 0 {
+		t.Errorf("second run: %v %v", changes, err)
+	}
+}
+
+// Filesystems whose on-disk format differs must be refused
+func TestMigrateIncompatible(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestMigrateIncompatible")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testcases := []string{
+		// gocryptfs v0.5: no 128-bit IVs, no EME
+		`{"EncryptedKey": "", "Version": 2, "FeatureFlags": ["DirIV"]}`,
+		// Old file header format
+		`{"EncryptedKey": "", "Version": 1, "FeatureFlags": ["GCMIV128", "DirIV", "EMENames"]}`,
+	}
+	for _, js := range testcases {
+		path := writeConf(t, dir, js)
+		if _, err = Migrate(path); !errors.Is(err, ErrUnsupportedVersion) {
+			t.Errorf("%s: want ErrUnsupportedVersion, got %v", js, err)
+		}
+		if after, _ := ioutil.ReadFile(path); string(after) != js {
+			t.Errorf("%s: config file has been modified", js)
+		}
+	}
+}
@@ -60,9 +60,19 @@ func NewScryptKDF(logN int) ScryptKDF {
 	return s
 }
 
+// KDFProgress, if set, is called when a password hash is computed, with the
+// name of the KDF. The returned function is called when the hash is done.
+// This lets the caller tell the user that we are busy. The callback only
+// learns when the computation starts and ends, which does not depend on the
+// password.
+var KDFProgress func(kdf string) (done func())
+
 // DeriveKey returns a new key from a supplied password.
 func (s *ScryptKDF) DeriveKey(pw []byte) []byte {
 	s.validateParams()
+	if KDFProgress != nil {
+		defer KDFProgress("scrypt")()
+	}
 
 	k, err := scrypt.Key(pw, s.Salt, s.N, s.R, s.P, s.KeyLen)
 	if err != nil {
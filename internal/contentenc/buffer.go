@@ -0,0 +1,77 @@
+package contentenc
+
+// In-memory encryption and decryption of whole files, for testing and interop
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+// newDefaultContentEnc returns a ContentEnc using the settings of a
+// filesystem created by "gocryptfs -init" without special options:
+// AES-256-GCM, 128-bit IVs, HKDF and 4096-byte blocks.
+func newDefaultContentEnc(masterkey []byte) (*cryptocore.CryptoCore, *ContentEnc) {
+	cc := cryptocore.New(masterkey, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	return cc, New(cc, DefaultBS, false)
+}
+
+// EncryptFile encrypts "plaintext" exactly like gocryptfs stores a file
+// with this content in CIPHERDIR: file header followed by the encrypted
+// blocks. The filesystem settings are the defaults of "gocryptfs -init"
+// (AES-256-GCM with HKDF key derivation). "masterkey" must be 32 bytes long.
+// An empty plaintext yields an empty ciphertext, like an empty file.
+//
+// The output format is the on-disk format version CurrentVersion and is
+// stable: files encrypted with this function can be read by every
+// gocryptfs version that supports this format, and vice versa.
+func EncryptFile(plaintext []byte, masterkey []byte) []byte {
+	if len(plaintext) == 0 {
+		return nil
+	}
+	cc, ce := newDefaultContentEnc(masterkey)
+	defer cc.Wipe()
+	header := RandomHeader()
+	out := bytes.NewBuffer(header.Pack())
+	var blockNo uint64
+	for len(plaintext) > 0 {
+		n := int(MinUint64(uint64(len(plaintext)), ce.plainBS))
+		out.Write(ce.EncryptBlock(plaintext[:n], blockNo, header.ID))
+		plaintext = plaintext[n:]
+		blockNo++
+	}
+	return out.Bytes()
+}
+
+// DecryptFile is the inverse of EncryptFile. It decrypts the contents of a
+// file from CIPHERDIR, given the master key of the filesystem. An error is
+// returned if the header is invalid or a block fails the integrity check.
+func DecryptFile(ciphertext []byte, masterkey []byte) ([]byte, error) {
+	if len(ciphertext) == 0 {
+		return nil, nil
+	}
+	if len(ciphertext) < HeaderLen {
+		return nil, fmt.Errorf("DecryptFile: ciphertext too short for header: %d bytes", len(ciphertext))
+	}
+	header, err := ParseHeader(ciphertext[:HeaderLen])
+	if err != nil {
+		return nil, err
+	}
+	ciphertext = ciphertext[HeaderLen:]
+	cc, ce := newDefaultContentEnc(masterkey)
+	defer cc.Wipe()
+	out := bytes.NewBuffer(make([]byte, 0, ce.CipherSizeToPlainSize(uint64(len(ciphertext)+HeaderLen))))
+	var blockNo uint64
+	for len(ciphertext) > 0 {
+		n := int(MinUint64(uint64(len(ciphertext)), ce.cipherBS))
+		block, err := ce.DecryptBlock(ciphertext[:n], blockNo, header.ID)
+		if err != nil {
+			return nil, fmt.Errorf("DecryptFile: block #%d: %v", blockNo, err)
+		}
+		out.Write(block)
+		ciphertext = ciphertext[n:]
+		blockNo++
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,62 @@
+package contentenc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+// testVectorKey returns the master key 000102...1f
+func testVectorKey() []byte {
+	key := make([]byte, cryptocore.KeyLen)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	return key
+}
+
+func TestEncryptDecryptFile(t *testing.T) {
+	key := testVectorKey()
+	for _, n := range []int{0, 1, DefaultBS - 1, DefaultBS, DefaultBS + 1, 10*DefaultBS + 123} {
+		plaintext := cryptocore.RandBytes(n)
+		ciphertext := EncryptFile(plaintext, key)
+		if n > 0 && len(ciphertext) != HeaderLen+n+(n+DefaultBS-1)/DefaultBS*32 {
+			t.Errorf("n=%d: wrong ciphertext length %d", n, len(ciphertext))
+		}
+		plaintext2, err := DecryptFile(ciphertext, key)
+		if err != nil {
+			t.Fatalf("n=%d: %v", n, err)
+		}
+		if !bytes.Equal(plaintext, plaintext2) {
+			t.Errorf("n=%d: round trip failed", n)
+		}
+	}
+}
+
+// TestDecryptFileVector decrypts a known-good ciphertext, as it would be
+// stored on disk by gocryptfs, for master key 000102...1f.
+func TestDecryptFileVector(t *testing.T) {
+	ciphertext, _ := hex.DecodeString("0002dfe12dff50797ee613243121b3184ee0eff9a0c03e8985021888a1132b17" +
+		"cfb90fa13cb7990418c647ce14b00e6a0640a688ba65779156a6681a36bf65de9251")
+	want := "hello gocryptfs\n"
+	plaintext, err := DecryptFile(ciphertext, testVectorKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != want {
+		t.Errorf("want=%q have=%q", want, string(plaintext))
+	}
+	// Flip a bit in the last byte, which is part of the GCM tag
+	ciphertext[len(ciphertext)-1] ^= 1
+	_, err = DecryptFile(ciphertext, testVectorKey())
+	if err == nil {
+		t.Errorf("corrupt ciphertext was accepted")
+	}
+	// Truncated header
+	_, err = DecryptFile(ciphertext[:HeaderLen-1], testVectorKey())
+	if err == nil {
+		t.Errorf("truncated header was accepted")
+	}
+}
@@ -10,8 +10,6 @@ import (
 	"runtime"
 	"sync"
 
-	"github.com/hanwen/go-fuse/fuse"
-
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
@@ -28,6 +26,10 @@ const (
 	// master key in the config file is encrypted with a 96-bit IV for
 	// gocryptfs v1.2 and earlier. v1.3 switched to 128 bit.
 	DefaultIVBits = 128
+	// MaxKernelWrite is the largest read or write request the kernel sends
+	// us. This is the same as fuse.MAX_KERNEL_WRITE, duplicated so
+	// contentenc does not depend on go-fuse.
+	MaxKernelWrite = 128 * 1024
 
 	_ = iota // skip zero
 	// RandomNonce chooses a random nonce.
@@ -41,6 +43,14 @@ const (
 
 // ContentEnc is used to encipher and decipher file content.
 type ContentEnc struct {
+	// Number of random nonces used so far, see CountNonces. Accessed
+	// atomically and kept first for 64-bit alignment on 32-bit platforms.
+	noncesUsed uint64
+	// Maximum for noncesUsed. Zero means no limit.
+	nonceLimit uint64
+	// Set to 1 once the warnings in CountNonces have been logged
+	nonceLimitWarned     uint32
+	nonceNearLimitWarned uint32
 	// Cryptographic primitives
 	cryptoCore *cryptocore.CryptoCore
 	// Plaintext block size
@@ -53,6 +63,8 @@ type ContentEnc struct {
 	allZeroNonce []byte
 	// Force decode even if integrity check fails (openSSL only)
 	forceDecode bool
+	// Largest read or write request (in plaintext bytes) we can handle
+	maxReqSize int
 
 	// Ciphertext block "sync.Pool" pool. Always returns cipherBS-sized byte
 	// slices (usually 4128 bytes).
@@ -61,27 +73,36 @@ type ContentEnc struct {
 	// (usually 4096 bytes).
 	pBlockPool bPool
 	// Ciphertext request data pool. Always returns byte slices of size
-	// fuse.MAX_KERNEL_WRITE + encryption overhead.
+	// maxReqSize + encryption overhead.
 	// Used by Read() to temporarily store the ciphertext as it is read from
 	// disk.
 	CReqPool bPool
-	// Plaintext request data pool. Slice have size fuse.MAX_KERNEL_WRITE.
+	// Plaintext request data pool. Slice have size maxReqSize.
 	PReqPool bPool
+	// File content cipher if the "XTS" feature flag is set, see EnableXTS
+	xts *XTS
 }
 
-// New returns an initialized ContentEnc instance.
+// New returns an initialized ContentEnc instance that can handle requests
+// of up to MaxKernelWrite bytes.
 func New(cc *cryptocore.CryptoCore, plainBS uint64, forceDecode bool) *ContentEnc {
-	if fuse.MAX_KERNEL_WRITE%plainBS != 0 {
-		log.Panicf("unaligned MAX_KERNEL_WRITE=%d", fuse.MAX_KERNEL_WRITE)
+	return NewWithMaxReqSize(cc, plainBS, MaxKernelWrite, forceDecode)
+}
+
+// NewWithMaxReqSize is like New but sizes the request buffer pools for
+// requests of up to "maxReqSize" bytes. Smaller values save memory.
+func NewWithMaxReqSize(cc *cryptocore.CryptoCore, plainBS uint64, maxReqSize int, forceDecode bool) *ContentEnc {
+	if maxReqSize <= 0 || maxReqSize > MaxKernelWrite || uint64(maxReqSize)%plainBS != 0 {
+		log.Panicf("invalid maxReqSize=%d", maxReqSize)
 	}
 	cipherBS := plainBS + uint64(cc.IVLen) + cryptocore.AuthTagLen
 	// Take IV and GHASH overhead into account.
-	cReqSize := int(fuse.MAX_KERNEL_WRITE / plainBS * cipherBS)
+	cReqSize := int(uint64(maxReqSize) / plainBS * cipherBS)
 	// Unaligned reads (happens during fsck, could also happen with O_DIRECT?)
 	// touch one additional ciphertext and plaintext block. Reserve space for the
 	// extra block.
 	cReqSize += int(cipherBS)
-	pReqSize := fuse.MAX_KERNEL_WRITE + int(plainBS)
+	pReqSize := maxReqSize + int(plainBS)
 	c := &ContentEnc{
 		cryptoCore:   cc,
 		plainBS:      plainBS,
@@ -89,11 +110,13 @@ func New(cc *cryptocore.CryptoCore, plainBS uint64, forceDecode bool) *ContentEn
 		allZeroBlock: make([]byte, cipherBS),
 		allZeroNonce: make([]byte, cc.IVLen),
 		forceDecode:  forceDecode,
+		maxReqSize:   maxReqSize,
 		cBlockPool:   newBPool(int(cipherBS)),
 		CReqPool:     newBPool(cReqSize),
 		pBlockPool:   newBPool(int(plainBS)),
 		PReqPool:     newBPool(pReqSize),
 	}
+	c.initNonceLimit()
 	return c
 }
 
@@ -102,6 +125,12 @@ func (be *ContentEnc) PlainBS() uint64 {
 	return be.plainBS
 }
 
+// MaxReqSize returns the largest read or write request size (in plaintext
+// bytes) the buffer pools are sized for
+func (be *ContentEnc) MaxReqSize() int {
+	return be.maxReqSize
+}
+
 // CipherBS returns the ciphertext block size
 func (be *ContentEnc) CipherBS() uint64 {
 	return be.cipherBS
@@ -131,6 +160,34 @@ func (be *ContentEnc) DecryptBlocks(ciphertext []byte, firstBlockNo uint64, file
 	return pBuf.Bytes(), err
 }
 
+// DecryptBlocksZeroFill is like DecryptBlocks, but blocks that fail to
+// decrypt are replaced by zeros of the plaintext length the block would have
+// had, and decryption continues with the next block. "onError" is called for
+// every failed block. Used by "-recovery".
+func (be *ContentEnc) DecryptBlocksZeroFill(ciphertext []byte, firstBlockNo uint64, fileID []byte,
+	onError func(blockNo uint64, err error)) []byte {
+	cBuf := bytes.NewBuffer(ciphertext)
+	pBuf := bytes.NewBuffer(be.PReqPool.Get()[:0])
+	blockNo := firstBlockNo
+	for cBuf.Len() > 0 {
+		cBlock := cBuf.Next(int(be.cipherBS))
+		pBlock, err := be.DecryptBlock(cBlock, blockNo, fileID)
+		if err != nil {
+			onError(blockNo, err)
+			var pLen uint64
+			if uint64(len(cBlock)) > be.BlockOverhead() {
+				pLen = uint64(len(cBlock)) - be.BlockOverhead()
+			}
+			pBuf.Write(make([]byte, pLen))
+		} else {
+			pBuf.Write(pBlock)
+			be.pBlockPool.Put(pBlock)
+		}
+		blockNo++
+	}
+	return pBuf.Bytes()
+}
+
 // concatAD concatenates the block number and the file ID to a byte blob
 // that can be passed to AES-GCM as associated data (AD).
 // Result is: aData = [blockNo.bigEndian fileID].
@@ -3,6 +3,8 @@ package contentenc
 import (
 	"testing"
 
+	"github.com/hanwen/go-fuse/fuse"
+
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 )
 
@@ -94,3 +96,78 @@ func TestBlockNo(t *testing.T) {
 		t.Errorf("actual: %d", b)
 	}
 }
+
+// Encrypt and decrypt a request of the maximum size with smaller-than-default
+// buffer pools, as used by "-low-mem". This would panic if a pool was too small.
+func TestSmallMaxReqSize(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	maxReqSize := 8 * int(DefaultBS)
+	f := NewWithMaxReqSize(cc, DefaultBS, maxReqSize, false)
+	if f.MaxReqSize() != maxReqSize {
+		t.Fatalf("wrong MaxReqSize: have=%d want=%d", f.MaxReqSize(), maxReqSize)
+	}
+	fileID := make([]byte, DefaultIVBits/8)
+	var blocks [][]byte
+	for i := 0; i < maxReqSize/int(DefaultBS); i++ {
+		blocks = append(blocks, make([]byte, DefaultBS))
+	}
+	ciphertext := f.EncryptBlocks(blocks, 0, fileID)
+	plaintext, err := f.DecryptBlocks(ciphertext, 0, fileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plaintext) != maxReqSize {
+		t.Errorf("wrong plaintext length: have=%d want=%d", len(plaintext), maxReqSize)
+	}
+	f.CReqPool.Put(ciphertext)
+	f.PReqPool.Put(plaintext)
+}
+
+// MaxKernelWrite must stay in sync with go-fuse
+func TestMaxKernelWrite(t *testing.T) {
+	if MaxKernelWrite != fuse.MAX_KERNEL_WRITE {
+		t.Errorf("MaxKernelWrite=%d, but fuse.MAX_KERNEL_WRITE=%d", MaxKernelWrite, fuse.MAX_KERNEL_WRITE)
+	}
+}
+
+// TestSizeConversion checks CipherSizeToPlainSize and PlainSizeToCipherSize
+// at and around block boundaries. GetAttr reports the plaintext size, and the
+// kernel uses it for SEEK_END, so it must be exact.
+func TestSizeConversion(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	f := New(cc, DefaultBS, false)
+	bs := uint64(DefaultBS)
+	overhead := f.BlockOverhead()
+	for _, blocks := range []uint64{0, 1, 2, 100} {
+		for _, plainSize := range []uint64{blocks*bs - 1, blocks * bs, blocks*bs + 1} {
+			if blocks == 0 && plainSize != 1 {
+				// Skip the underflow and the trivial zero case, tested below
+				continue
+			}
+			cipherSize := f.PlainSizeToCipherSize(plainSize)
+			fullBlocks := (plainSize + bs - 1) / bs
+			if want := plainSize + HeaderLen + fullBlocks*overhead; cipherSize != want {
+				t.Errorf("PlainSizeToCipherSize(%d) = %d, want %d", plainSize, cipherSize, want)
+			}
+			if back := f.CipherSizeToPlainSize(cipherSize); back != plainSize {
+				t.Errorf("CipherSizeToPlainSize(%d) = %d, want %d", cipherSize, back, plainSize)
+			}
+		}
+	}
+	if f.PlainSizeToCipherSize(0) != 0 || f.CipherSizeToPlainSize(0) != 0 {
+		t.Error("zero-sized files must stay zero-sized")
+	}
+	// A truncated trailing block that holds no plaintext must not eat into
+	// the previous, complete block.
+	full := f.PlainSizeToCipherSize(2 * bs)
+	for _, extra := range []uint64{1, overhead - 1, overhead} {
+		if s := f.CipherSizeToPlainSize(full + extra); s != 2*bs {
+			t.Errorf("CipherSizeToPlainSize(%d+%d) = %d, want %d", full, extra, s, 2*bs)
+		}
+	}
+	if s := f.CipherSizeToPlainSize(full + overhead + 1); s != 2*bs+1 {
+		t.Errorf("CipherSizeToPlainSize(%d) = %d, want %d", full+overhead+1, s, 2*bs+1)
+	}
+}
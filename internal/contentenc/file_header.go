@@ -41,6 +41,17 @@ func (h *FileHeader) Pack() []byte {
 
 }
 
+// UnsupportedVersionError is returned by ParseHeader for a file that has been
+// written in a content format version we do not support, usually by a newer
+// gocryptfs.
+type UnsupportedVersionError struct {
+	Version uint16
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("file uses content format version %d, unsupported (want %d)", e.Version, CurrentVersion)
+}
+
 // allZeroFileID is preallocated to quickly check if the data read from disk is all zero
 var allZeroFileID = make([]byte, headerIDLen)
 
@@ -52,7 +63,7 @@ func ParseHeader(buf []byte) (*FileHeader, error) {
 	var h FileHeader
 	h.Version = binary.BigEndian.Uint16(buf[0:headerVersionLen])
 	if h.Version != CurrentVersion {
-		return nil, fmt.Errorf("ParseHeader: invalid version, want=%d have=%d", CurrentVersion, h.Version)
+		return nil, &UnsupportedVersionError{h.Version}
 	}
 	h.ID = buf[headerVersionLen:]
 	if bytes.Equal(h.ID, allZeroFileID) {
@@ -0,0 +1,23 @@
+package contentenc
+
+import (
+	"testing"
+)
+
+func TestParseHeaderVersion(t *testing.T) {
+	buf := RandomHeader().Pack()
+	if _, err := ParseHeader(buf); err != nil {
+		t.Fatal(err)
+	}
+	// A file written by a future content format version
+	buf[1] = CurrentVersion + 1
+	_, err := ParseHeader(buf)
+	verr, ok := err.(*UnsupportedVersionError)
+	if !ok {
+		t.Fatalf("want an UnsupportedVersionError, got %v", err)
+	}
+	if verr.Version != CurrentVersion+1 {
+		t.Errorf("wrong version %d", verr.Version)
+	}
+	t.Log(err)
+}
@@ -0,0 +1,55 @@
+package contentenc
+
+import (
+	"sync/atomic"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// nonceLimit returns how many random nonces of "nonceBits" bits can be
+// used with one key until the probability that two of them collide reaches
+// 2^-32 (birthday bound: q^2 / 2^(nonceBits+1) <= 2^-32).
+//
+// For the 96-bit nonces of old filesystems, the limit is 2^32 blocks
+// (16 TiB of data), which is also the limit NIST SP 800-38D sets for GCM with
+// random nonces. For 128-bit nonces, it is 2^48 blocks (1 EiB).
+func nonceLimit(nonceBits int) uint64 {
+	return 1 << uint((nonceBits-32)/2)
+}
+
+// CountNonces must be called before encrypting "n" blocks with random
+// nonces. It logs a warning when 90 % and when 100 % of the nonce limit of
+// the key have been used.
+//
+// All files share the same content key, so the limit applies to the whole
+// filesystem, not to individual files. The count starts at zero for every
+// mount because it is not stored on disk, so it only catches what a single
+// mount writes, not the lifetime usage of the key. Writing is therefore not
+// refused, the warnings are advisory.
+// AES-SIV stays secure when nonces repeat and has no limit.
+func (be *ContentEnc) CountNonces(n int) {
+	if be.nonceLimit == 0 || n <= 0 {
+		return
+	}
+	used := atomic.AddUint64(&be.noncesUsed, uint64(n))
+	if used > be.nonceLimit {
+		if atomic.CompareAndSwapUint32(&be.nonceLimitWarned, 0, 1) {
+			tlog.Warn.Printf("This mount has encrypted %d blocks with this key, more than the safe limit "+
+				"of %d random nonces. Copy the files to a new gocryptfs filesystem, which has a new key.",
+				used, be.nonceLimit)
+		}
+		return
+	}
+	if used > be.nonceLimit/10*9 && atomic.CompareAndSwapUint32(&be.nonceNearLimitWarned, 0, 1) {
+		tlog.Warn.Printf("This mount has used %d of %d safe random nonces for this key", used, be.nonceLimit)
+	}
+}
+
+// initNonceLimit sets the nonce limit for the crypto backend used by "be".
+func (be *ContentEnc) initNonceLimit() {
+	if be.cryptoCore.AEADBackend == cryptocore.BackendAESSIV {
+		return
+	}
+	be.nonceLimit = nonceLimit(be.cryptoCore.IVLen * 8)
+}
@@ -0,0 +1,50 @@
+package contentenc
+
+import (
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+func TestNonceLimitValues(t *testing.T) {
+	if l := nonceLimit(96); l != 1<<32 {
+		t.Errorf("96 bits: have %d", l)
+	}
+	if l := nonceLimit(128); l != 1<<48 {
+		t.Errorf("128 bits: have %d", l)
+	}
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendAESSIV, DefaultIVBits, true, false)
+	if l := New(cc, DefaultBS, false).nonceLimit; l != 0 {
+		t.Errorf("AES-SIV should have no limit, have %d", l)
+	}
+}
+
+// Simulate running up to the limit by pretending the nonces are only 40
+// bits long, which gives a limit of 16 blocks. Writing is never refused, but
+// both warnings are logged once.
+func TestCountNonces(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	be := New(cc, DefaultBS, false)
+	be.nonceLimit = nonceLimit(40)
+	if be.nonceLimit != 16 {
+		t.Fatalf("unexpected limit %d", be.nonceLimit)
+	}
+	be.CountNonces(10)
+	if be.nonceNearLimitWarned != 0 || be.nonceLimitWarned != 0 {
+		t.Errorf("warned too early")
+	}
+	be.CountNonces(5)
+	if be.nonceNearLimitWarned != 1 || be.nonceLimitWarned != 0 {
+		t.Errorf("want only the 90 %% warning")
+	}
+	be.CountNonces(2)
+	if be.nonceLimitWarned != 1 {
+		t.Errorf("want the limit warning")
+	}
+	be.CountNonces(0)
+	if be.noncesUsed != 17 {
+		t.Errorf("want 17 nonces used, have %d", be.noncesUsed)
+	}
+}
@@ -33,6 +33,9 @@ func (be *ContentEnc) BlockNoToPlainOff(blockNo uint64) uint64 {
 
 // CipherSizeToPlainSize calculates the plaintext size from a ciphertext size
 func (be *ContentEnc) CipherSizeToPlainSize(cipherSize uint64) uint64 {
+	if be.xts != nil {
+		return xtsCipherSizeToPlainSize(cipherSize)
+	}
 	// Zero-sized files stay zero-sized
 	if cipherSize == 0 {
 		return 0
@@ -53,18 +56,27 @@ func (be *ContentEnc) CipherSizeToPlainSize(cipherSize uint64) uint64 {
 	blockNo := be.CipherOffToBlockNo(cipherSize - 1)
 	blockCount := blockNo + 1
 
-	overhead := be.BlockOverhead()*blockCount + HeaderLen
-
-	if overhead > cipherSize {
-		tlog.Warn.Printf("cipherSize %d < overhead %d: corrupt file\n", cipherSize, overhead)
-		return 0
+	// A trailing fragment that is not longer than the block overhead
+	// cannot contain any plaintext. Without this check, the overhead of the
+	// missing block would be subtracted from the previous, complete block,
+	// and the size would end up inside that block.
+	lastLen := cipherSize - be.BlockNoToCipherOff(blockNo)
+	if lastLen <= be.BlockOverhead() {
+		if lastLen < be.BlockOverhead() {
+			tlog.Warn.Printf("cipherSize %d: last block is only %d bytes: corrupt file\n", cipherSize, lastLen)
+		}
+		return be.BlockNoToPlainOff(blockNo)
 	}
 
+	overhead := be.BlockOverhead()*blockCount + HeaderLen
 	return cipherSize - overhead
 }
 
 // PlainSizeToCipherSize calculates the ciphertext size from a plaintext size
 func (be *ContentEnc) PlainSizeToCipherSize(plainSize uint64) uint64 {
+	if be.xts != nil {
+		return xtsPlainSizeToCipherSize(plainSize)
+	}
 	// Zero-sized files stay zero-sized
 	if plainSize == 0 {
 		return 0
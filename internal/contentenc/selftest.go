@@ -0,0 +1,44 @@
+package contentenc
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+// selfTestBlocks is the number of blocks SelfTest encrypts and decrypts
+const selfTestBlocks = 4
+
+// SelfTest encrypts a few blocks of random data, decrypts them again and
+// compares the result. It also checks that a corrupted block is rejected.
+// This catches broken crypto backends (or broken hardware) before we
+// store any data. Returns nil on success.
+func (be *ContentEnc) SelfTest() error {
+	fileID := cryptocore.RandBytes(headerIDLen)
+	plaintextBlocks := make([][]byte, selfTestBlocks)
+	for i := range plaintextBlocks {
+		plaintextBlocks[i] = cryptocore.RandBytes(int(be.plainBS))
+	}
+	ciphertext := be.EncryptBlocks(plaintextBlocks, 0, fileID)
+	defer be.CReqPool.Put(ciphertext)
+	if uint64(len(ciphertext)) != selfTestBlocks*be.cipherBS {
+		return errors.New("self-test: wrong ciphertext length")
+	}
+	plaintext, err := be.DecryptBlocks(ciphertext, 0, fileID)
+	if err != nil {
+		return errors.New("self-test: decryption failed: " + err.Error())
+	}
+	defer be.PReqPool.Put(plaintext)
+	if !bytes.Equal(plaintext, bytes.Join(plaintextBlocks, nil)) {
+		return errors.New("self-test: decrypted data does not match")
+	}
+	// Flip a bit in the ciphertext of the first block. Decryption must fail.
+	cBlock := append([]byte{}, ciphertext[:be.cipherBS]...)
+	cBlock[len(cBlock)-1] ^= 1
+	_, err = be.DecryptBlock(cBlock, 0, fileID)
+	if err == nil {
+		return errors.New("self-test: corrupted block was not detected")
+	}
+	return nil
+}
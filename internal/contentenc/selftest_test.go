@@ -0,0 +1,24 @@
+package contentenc
+
+import (
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
+)
+
+func TestSelfTest(t *testing.T) {
+	backends := []cryptocore.AEADTypeEnum{cryptocore.BackendGoGCM, cryptocore.BackendAESSIV}
+	if !stupidgcm.BuiltWithoutOpenssl {
+		backends = append(backends, cryptocore.BackendOpenSSL)
+	}
+	key := make([]byte, cryptocore.KeyLen)
+	for _, b := range backends {
+		cc := cryptocore.New(key, b, DefaultIVBits, true, false)
+		ce := New(cc, DefaultBS, false)
+		err := ce.SelfTest()
+		if err != nil {
+			t.Errorf("backend %d: %v", b, err)
+		}
+	}
+}
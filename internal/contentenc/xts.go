@@ -0,0 +1,265 @@
+package contentenc
+
+// AES-XTS file content encryption ("XTS" feature flag).
+//
+// XTS is the mode used for disk encryption. Every 4096-byte sector of
+// plaintext turns into 4096 bytes of ciphertext, so overwriting a part of a
+// file only re-encrypts the sectors it touches. Files have the usual file
+// header, and the backing file is HeaderLen bytes larger than the plaintext.
+// There is no authentication tag. Modified ciphertext decrypts to random
+// garbage instead of failing with an error, and an attacker who can write to
+// CIPHERDIR can roll back single sectors to an earlier version without being
+// noticed. Only confidentiality is protected.
+//
+// The sectors are encrypted with golang.org/x/crypto/xts. The tweak key is
+// derived from the file ID in the header, so the tweak depends on the file
+// and on the sector number, and identical data in two files gives unrelated
+// ciphertext. Within a file, XTS is deterministic: writing the same 16-byte
+// block to the same offset again gives the same ciphertext.
+//
+// Units of encryption that are not a multiple of 16 bytes use ciphertext
+// stealing (IEEE P1619), which needs at least 16 bytes:
+//
+//   - A last sector shorter than 16 bytes is merged with the sector before
+//     it into one unit of 4097 to 4111 bytes.
+//   - A file shorter than 16 bytes has no sector before. Its file ID and its
+//     data form one unit of 17 to 31 bytes that is stored in place of the
+//     file ID. It is encrypted with the tweak key of the filesystem and the
+//     tweak xtsTinySectorNo. The file ID is regenerated on every write, so
+//     the stolen bytes of the encrypted ID are random every time.
+
+import (
+	"crypto/aes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/xts"
+)
+
+const (
+	// XTSKeyLen is the length of the XTS content key: two AES-256 keys
+	XTSKeyLen = 64
+	// XTSSectorSize is the size of an XTS sector, the unit of encryption
+	XTSSectorSize = 4096
+	// XTSMinUnit is the shortest unit that can be encrypted
+	XTSMinUnit   = 16
+	xtsBlockSize = 16
+	// xtsTinySectorNo is the tweak for files shorter than XTSMinUnit
+	xtsTinySectorNo = math.MaxUint64
+	// hkdfInfoXTSTweak is the HKDF "info" prefix for the per-file tweak keys
+	hkdfInfoXTSTweak = "AES-XTS tweak key"
+)
+
+// XTS encrypts and decrypts file contents with AES-XTS.
+type XTS struct {
+	// key is the data key followed by the tweak key of the filesystem. The
+	// per-file tweak keys are derived from the latter.
+	key []byte
+	// tiny encrypts files shorter than XTSMinUnit
+	tiny *xts.Cipher
+}
+
+// NewXTS returns an XTS instance for the XTSKeyLen-byte key "key".
+func NewXTS(key []byte) *XTS {
+	if len(key) != XTSKeyLen {
+		log.Panicf("NewXTS: wrong key length %d", len(key))
+	}
+	tiny, err := xts.NewCipher(aes.NewCipher, key)
+	if err != nil {
+		log.Panic(err)
+	}
+	return &XTS{
+		key:  append([]byte{}, key...),
+		tiny: tiny,
+	}
+}
+
+// XTSFile encrypts and decrypts the sectors of one file.
+type XTSFile struct {
+	c *xts.Cipher
+}
+
+// File returns the XTSFile for the file with ID "fileID". The data key is
+// the same for all files, the tweak key is derived from the file ID.
+func (x *XTS) File(fileID []byte) *XTSFile {
+	key := make([]byte, XTSKeyLen)
+	copy(key, x.key[:XTSKeyLen/2])
+	info := append([]byte(hkdfInfoXTSTweak), fileID...)
+	h := hkdf.New(sha256.New, x.key[XTSKeyLen/2:], nil, info)
+	if _, err := io.ReadFull(h, key[XTSKeyLen/2:]); err != nil {
+		log.Panic(err)
+	}
+	c, err := xts.NewCipher(aes.NewCipher, key)
+	for i := range key {
+		key[i] = 0
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+	return &XTSFile{c: c}
+}
+
+func checkUnitLen(dst, src []byte) {
+	if len(src) < XTSMinUnit || len(src) >= XTSSectorSize+XTSMinUnit || len(dst) < len(src) {
+		log.Panicf("XTS: invalid unit length %d (dst %d)", len(src), len(dst))
+	}
+}
+
+// encryptUnit encrypts "src" with "c" and tweak "sectorNo" to "dst", using
+// ciphertext stealing if len(src) is not a multiple of 16.
+// "dst" and "src" may be the same slice.
+func encryptUnit(c *xts.Cipher, dst, src []byte, sectorNo uint64) {
+	checkUnitLen(dst, src)
+	r := len(src) % xtsBlockSize
+	if r == 0 {
+		c.Encrypt(dst[:len(src)], src, sectorNo)
+		return
+	}
+	full := len(src) - r
+	var tail [xtsBlockSize]byte
+	copy(tail[:], src[full:])
+	c.Encrypt(dst[:full], src[:full], sectorNo)
+	// The last full block "cc" is swapped with the partial block, which is
+	// padded with the end of "cc" and encrypted with the next tweak.
+	// xts.Cipher only encrypts whole sectors, so we get the next tweak by
+	// encrypting one block more than we have.
+	var cc [xtsBlockSize]byte
+	copy(cc[:], dst[full-xtsBlockSize:full])
+	copy(tail[r:], cc[r:])
+	tmp := make([]byte, full+xtsBlockSize)
+	copy(tmp[full:], tail[:])
+	c.Encrypt(tmp, tmp, sectorNo)
+	copy(dst[full-xtsBlockSize:], tmp[full:])
+	copy(dst[full:], cc[:r])
+}
+
+// decryptUnit is the inverse of encryptUnit.
+func decryptUnit(c *xts.Cipher, dst, src []byte, sectorNo uint64) {
+	checkUnitLen(dst, src)
+	r := len(src) % xtsBlockSize
+	if r == 0 {
+		c.Decrypt(dst[:len(src)], src, sectorNo)
+		return
+	}
+	full := len(src) - r
+	// Ciphertext stealing uses the tweaks of the last two blocks in reverse
+	// order. Decrypt the last full block with the next tweak first.
+	tmp := make([]byte, full+xtsBlockSize)
+	copy(tmp[full:], src[full-xtsBlockSize:full])
+	c.Decrypt(tmp, tmp, sectorNo)
+	pp := tmp[full:]
+	var cc [xtsBlockSize]byte
+	copy(cc[:], src[full:])
+	copy(cc[r:], pp[r:])
+	copy(tmp, src[:full-xtsBlockSize])
+	copy(tmp[full-xtsBlockSize:], cc[:])
+	copy(dst[full:], pp[:r])
+	c.Decrypt(dst[:full], tmp[:full], sectorNo)
+}
+
+// EncryptUnit encrypts the unit that starts at sector "sectorNo" from "src"
+// to "dst". A unit is a sector, or the last sector of the file together with
+// a tail of less than XTSMinUnit bytes, so it is XTSMinUnit to
+// XTSSectorSize+XTSMinUnit-1 bytes long. "dst" must be at least as long as
+// "src", and may be the same slice.
+func (xf *XTSFile) EncryptUnit(dst, src []byte, sectorNo uint64) {
+	encryptUnit(xf.c, dst, src, sectorNo)
+}
+
+// DecryptUnit decrypts the unit that starts at sector "sectorNo" from "src" to
+// "dst", see EncryptUnit. A full sector of zeros decrypts to zeros. The
+// backing filesystem returns these for file holes.
+func (xf *XTSFile) DecryptUnit(dst, src []byte, sectorNo uint64) {
+	if len(src) == XTSSectorSize && isAllZero(src) {
+		copy(dst, src)
+		return
+	}
+	decryptUnit(xf.c, dst, src, sectorNo)
+}
+
+// EncryptTiny returns the backing file content for a file whose data "data"
+// is shorter than XTSMinUnit: the version, followed by a new random file ID
+// and the data, encrypted as one unit.
+func (x *XTS) EncryptTiny(data []byte) []byte {
+	if len(data) == 0 || len(data) >= XTSMinUnit {
+		log.Panicf("EncryptTiny: invalid length %d", len(data))
+	}
+	h := RandomHeader()
+	buf := h.Pack()
+	buf = append(buf, data...)
+	unit := buf[headerVersionLen:]
+	encryptUnit(x.tiny, unit, unit, xtsTinySectorNo)
+	return buf
+}
+
+// DecryptTiny is the inverse of EncryptTiny and returns the data.
+func (x *XTS) DecryptTiny(buf []byte) ([]byte, error) {
+	if len(buf) <= HeaderLen || len(buf) >= HeaderLen+XTSMinUnit {
+		return nil, fmt.Errorf("DecryptTiny: invalid length %d", len(buf))
+	}
+	if v := binary.BigEndian.Uint16(buf); v != CurrentVersion {
+		return nil, &UnsupportedVersionError{v}
+	}
+	unit := make([]byte, len(buf)-headerVersionLen)
+	decryptUnit(x.tiny, unit, buf[headerVersionLen:], xtsTinySectorNo)
+	return unit[headerIDLen:], nil
+}
+
+// XTSUnit returns the plaintext range [start, end) of the unit that contains
+// offset "off" of a file with the plaintext size "size". The file must be at
+// least XTSMinUnit bytes long.
+func XTSUnit(off int64, size int64) (start int64, end int64) {
+	start = off / XTSSectorSize * XTSSectorSize
+	if size-start < XTSMinUnit && start > 0 {
+		// A short tail belongs to the sector before
+		start -= XTSSectorSize
+	}
+	end = start + XTSSectorSize
+	if size-end < XTSMinUnit {
+		end = size
+	}
+	return start, end
+}
+
+// xtsCipherSizeToPlainSize and xtsPlainSizeToCipherSize convert between
+// plaintext and backing file sizes. There is only the header.
+func xtsCipherSizeToPlainSize(cipherSize uint64) uint64 {
+	if cipherSize <= HeaderLen {
+		return 0
+	}
+	return cipherSize - HeaderLen
+}
+
+func xtsPlainSizeToCipherSize(plainSize uint64) uint64 {
+	if plainSize == 0 {
+		return 0
+	}
+	return plainSize + HeaderLen
+}
+
+func isAllZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// EnableXTS switches file content encryption to AES-XTS with the
+// XTSKeyLen-byte key "key". Symlinks and xattrs are still encrypted with
+// the AEAD.
+func (be *ContentEnc) EnableXTS(key []byte) {
+	be.xts = NewXTS(key)
+}
+
+// XTS returns the XTS instance for file contents, or nil if they are
+// encrypted with the AEAD.
+func (be *ContentEnc) XTS() *XTS {
+	return be.xts
+}
@@ -0,0 +1,147 @@
+package contentenc
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/crypto/xts"
+)
+
+func testXTS(t *testing.T) *XTS {
+	key := make([]byte, XTSKeyLen)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	return NewXTS(key)
+}
+
+// IEEE P1619 test vector 15, for ciphertext stealing. Uses AES-128.
+func TestXTSStealing(t *testing.T) {
+	c, err := xts.NewCipher(aes.NewCipher, unhex("fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0bfbebdbcbbbab9b8b7b6b5b4b3b2b1b0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := unhex("000102030405060708090a0b0c0d0e0f10")
+	want := unhex("6c1625db4671522d3d7599601de7ca09ed")
+	buf := make([]byte, len(p))
+	encryptUnit(c, buf, p, 0x123456789a)
+	if !bytes.Equal(buf, want) {
+		t.Fatalf("wrong ciphertext %x", buf)
+	}
+	decryptUnit(c, buf, buf, 0x123456789a)
+	if !bytes.Equal(buf, p) {
+		t.Fatalf("wrong plaintext %x", buf)
+	}
+}
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// Every unit length must survive a round trip, in place and out of place
+func TestXTSRoundTrip(t *testing.T) {
+	xf := testXTS(t).File(make([]byte, headerIDLen))
+	for l := XTSMinUnit; l < XTSSectorSize+XTSMinUnit; l++ {
+		if l > 100 && l%97 != 0 && l < XTSSectorSize {
+			continue
+		}
+		p := make([]byte, l)
+		rand.Read(p)
+		c := make([]byte, l)
+		xf.EncryptUnit(c, p, uint64(l))
+		if bytes.Equal(c, p) {
+			t.Fatalf("len=%d: not encrypted", l)
+		}
+		xf.DecryptUnit(c, c, uint64(l))
+		if !bytes.Equal(c, p) {
+			t.Fatalf("len=%d: round trip failed", l)
+		}
+	}
+}
+
+// The same data at the same offset of two files must give unrelated
+// ciphertext
+func TestXTSFileID(t *testing.T) {
+	x := testXTS(t)
+	p := make([]byte, 100)
+	c1 := make([]byte, len(p))
+	c2 := make([]byte, len(p))
+	x.File(bytes.Repeat([]byte{1}, headerIDLen)).EncryptUnit(c1, p, 7)
+	x.File(bytes.Repeat([]byte{2}, headerIDLen)).EncryptUnit(c2, p, 7)
+	for i := 0; i < len(p); i += xtsBlockSize {
+		end := i + xtsBlockSize
+		if end > len(p) {
+			end = len(p)
+		}
+		if bytes.Equal(c1[i:end], c2[i:end]) {
+			t.Errorf("identical ciphertext at offset %d", i)
+		}
+	}
+}
+
+// Files shorter than 16 bytes are encrypted differently every time
+func TestXTSTiny(t *testing.T) {
+	x := testXTS(t)
+	for l := 1; l < XTSMinUnit; l++ {
+		p := make([]byte, l)
+		c1 := x.EncryptTiny(p)
+		c2 := x.EncryptTiny(p)
+		if len(c1) != HeaderLen+l {
+			t.Fatalf("len=%d: wrong ciphertext length %d", l, len(c1))
+		}
+		if bytes.Equal(c1[headerVersionLen:], c2[headerVersionLen:]) {
+			t.Errorf("len=%d: identical ciphertext", l)
+		}
+		for _, c := range [][]byte{c1, c2} {
+			d, err := x.DecryptTiny(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(d, p) {
+				t.Fatalf("len=%d: round trip failed", l)
+			}
+		}
+	}
+}
+
+// A sector of zeros is a file hole and decrypts to zeros
+func TestXTSHole(t *testing.T) {
+	xf := testXTS(t).File(make([]byte, headerIDLen))
+	c := make([]byte, XTSSectorSize)
+	p := make([]byte, len(c))
+	p[0] = 1
+	xf.DecryptUnit(p, c, 2)
+	if !bytes.Equal(p, c) {
+		t.Fatal("holes do not decrypt to zeros")
+	}
+}
+
+func TestXTSUnit(t *testing.T) {
+	testCases := []struct {
+		off, size, start, end int64
+	}{
+		{0, 16, 0, 16},
+		{0, 4096, 0, 4096},
+		{100, 5000, 0, 4096},
+		{4096, 5000, 4096, 5000},
+		// A tail of less than 16 bytes belongs to the sector before
+		{100, 4100, 0, 4100},
+		{4099, 4100, 0, 4100},
+		{8192, 8192 + 15, 4096, 8192 + 15},
+		{8192, 8192 + 16, 8192, 8192 + 16},
+	}
+	for _, tc := range testCases {
+		start, end := XTSUnit(tc.off, tc.size)
+		if start != tc.start || end != tc.end {
+			t.Errorf("XTSUnit(%d, %d) = [%d, %d), want [%d, %d)",
+				tc.off, tc.size, start, end, tc.start, tc.end)
+		}
+	}
+}
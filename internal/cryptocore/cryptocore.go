@@ -87,12 +87,7 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool, forceDec
 	// Initialize an AEAD cipher for file content encryption.
 	var aeadCipher cipher.AEAD
 	if aeadType == BackendOpenSSL || aeadType == BackendGoGCM {
-		var gcmKey []byte
-		if useHKDF {
-			gcmKey = hkdfDerive(key, hkdfInfoGCMContent, KeyLen)
-		} else {
-			gcmKey = append([]byte{}, key...)
-		}
+		gcmKey := ContentKey(key, aeadType, useHKDF)
 		switch aeadType {
 		case BackendOpenSSL:
 			if IVLen != 16 {
@@ -117,17 +112,7 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool, forceDec
 			// SIV supports any nonce size, but we only use 16.
 			log.Panic("AES-SIV must use 16-byte nonces")
 		}
-		// AES-SIV uses 1/2 of the key for authentication, 1/2 for
-		// encryption, so we need a 64-bytes key for AES-256. Derive it from
-		// the 32-byte master key using HKDF, or, for older filesystems, with
-		// SHA256.
-		var key64 []byte
-		if useHKDF {
-			key64 = hkdfDerive(key, hkdfInfoSIVContent, siv_aead.KeyLen)
-		} else {
-			s := sha512.Sum512(key)
-			key64 = s[:]
-		}
+		key64 := ContentKey(key, aeadType, useHKDF)
 		aeadCipher = siv_aead.New(key64)
 		for i := range key64 {
 			key64[i] = 0
@@ -145,6 +130,36 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool, forceDec
 	}
 }
 
+// ContentKey returns the key that is used for file content encryption with
+// backend "aeadType". It is derived from "masterkey", which must be KeyLen
+// bytes long. The same key is used for all files of a filesystem, files
+// are told apart by their file ID.
+// The caller should overwrite the returned slice with zeros when done.
+func ContentKey(masterkey []byte, aeadType AEADTypeEnum, useHKDF bool) []byte {
+	if aeadType == BackendAESSIV {
+		// AES-SIV uses 1/2 of the key for authentication, 1/2 for
+		// encryption, so we need a 64-bytes key for AES-256. Derive it from
+		// the 32-byte master key using HKDF, or, for older filesystems, with
+		// SHA256.
+		if useHKDF {
+			return hkdfDerive(masterkey, hkdfInfoSIVContent, siv_aead.KeyLen)
+		}
+		s := sha512.Sum512(masterkey)
+		return s[:]
+	}
+	if useHKDF {
+		return hkdfDerive(masterkey, hkdfInfoGCMContent, KeyLen)
+	}
+	return append([]byte{}, masterkey...)
+}
+
+// XTSContentKey returns the two AES-256 keys for AES-XTS file content
+// encryption, derived from "masterkey" using HKDF.
+// The caller should overwrite the returned slice with zeros when done.
+func XTSContentKey(masterkey []byte) []byte {
+	return hkdfDerive(masterkey, hkdfInfoXTSContent, 2*KeyLen)
+}
+
 type wiper interface {
 	Wipe()
 }
@@ -1,6 +1,9 @@
 package cryptocore
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	"testing"
 
 	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
@@ -39,3 +42,31 @@ func TestNewPanic(t *testing.T) {
 	key := make([]byte, 16)
 	New(key, BackendOpenSSL, 128, true, false)
 }
+
+// ContentKey must return the key that New() actually uses for content
+// encryption
+func TestContentKey(t *testing.T) {
+	masterkey := RandBytes(KeyLen)
+	for _, useHKDF := range []bool{true, false} {
+		c := New(masterkey, BackendGoGCM, 128, useHKDF, false)
+		key := ContentKey(masterkey, BackendGoGCM, useHKDF)
+		if len(key) != KeyLen {
+			t.Fatalf("wrong key length %d", len(key))
+		}
+		block, _ := aes.NewCipher(key)
+		gcm, _ := cipher.NewGCMWithNonceSize(block, 16)
+		nonce := RandBytes(16)
+		plaintext := []byte("foo")
+		have := c.AEADCipher.Seal(nil, nonce, plaintext, nil)
+		want := gcm.Seal(nil, nonce, plaintext, nil)
+		if !bytes.Equal(have, want) {
+			t.Errorf("useHKDF=%v: ContentKey does not match the key used by New", useHKDF)
+		}
+		if bytes.Equal(key, masterkey) == useHKDF {
+			t.Errorf("useHKDF=%v: unexpected key derivation", useHKDF)
+		}
+	}
+	if len(ContentKey(masterkey, BackendAESSIV, true)) != 64 {
+		t.Errorf("AES-SIV needs a 64-byte key")
+	}
+}
@@ -0,0 +1,43 @@
+package cryptocore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"log"
+	"sync"
+)
+
+// deterministicReader is an AES-256-CTR key stream. The same seed always
+// gives the same bytes.
+type deterministicReader struct {
+	sync.Mutex
+	stream cipher.Stream
+}
+
+func (d *deterministicReader) Read(p []byte) (int, error) {
+	d.Lock()
+	for i := range p {
+		p[i] = 0
+	}
+	d.stream.XORKeyStream(p, p)
+	d.Unlock()
+	return len(p), nil
+}
+
+// SetDeterministicRand makes RandBytes, RandUint64 and the nonce generators
+// return a key stream derived from "seed" instead of random bytes.
+//
+// This is INSECURE and only meant for "-init -deterministic", which creates
+// reproducible CIPHERDIRs for testing. Call it before anything else uses
+// the package from a second goroutine. There is no way back.
+func SetDeterministicRand(seed []byte) {
+	if len(seed) == 0 {
+		log.Panic("SetDeterministicRand: empty seed")
+	}
+	block, err := aes.NewCipher(hkdfDerive(seed, hkdfInfoDeterministicRand, KeyLen))
+	if err != nil {
+		log.Panic(err)
+	}
+	iv := make([]byte, aes.BlockSize)
+	randReader = &deterministicReader{stream: cipher.NewCTR(block, iv)}
+}
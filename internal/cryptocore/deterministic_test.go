@@ -0,0 +1,25 @@
+package cryptocore
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSetDeterministicRand(t *testing.T) {
+	orig := randReader
+	defer func() { randReader = orig }()
+
+	var out [2][]byte
+	for i := range out {
+		SetDeterministicRand([]byte("seed"))
+		n := nonceGenerator{nonceLen: 16}
+		out[i] = append(RandBytes(32), n.Get()...)
+	}
+	if !bytes.Equal(out[0], out[1]) {
+		t.Errorf("same seed gave different bytes:\n%x\n%x", out[0], out[1])
+	}
+	SetDeterministicRand([]byte("other seed"))
+	if bytes.Equal(RandBytes(32), out[0][:32]) {
+		t.Error("different seeds gave the same bytes")
+	}
+}
@@ -2,6 +2,7 @@ package cryptocore
 
 import (
 	"crypto/sha256"
+	"encoding/hex"
 	"log"
 
 	"golang.org/x/crypto/hkdf"
@@ -13,6 +14,11 @@ const (
 	hkdfInfoEMENames   = "EME filename encryption"
 	hkdfInfoGCMContent = "AES-GCM file content encryption"
 	hkdfInfoSIVContent = "AES-SIV file content encryption"
+	hkdfInfoXTSContent = "AES-XTS file content encryption"
+	hkdfInfoMountID    = "mount-id"
+	// Not derived from the master key but from the "-seed" of
+	// "-init -deterministic"
+	hkdfInfoDeterministicRand = "deterministic random stream"
 )
 
 // hkdfDerive derives "outLen" bytes from "masterkey" and "info" using
@@ -27,3 +33,10 @@ func hkdfDerive(masterkey []byte, info string, outLen int) (out []byte) {
 	}
 	return out
 }
+
+// MountID derives a stable identifier for the filesystem from the master key.
+// It is the same on every mount of the same filesystem, on every host, and
+// does not reveal the key.
+func MountID(masterkey []byte) string {
+	return hex.EncodeToString(hkdfDerive(masterkey, hkdfInfoMountID, 16))
+}
@@ -44,3 +44,16 @@ func TestHkdfDerive(t *testing.T) {
 		}
 	}
 }
+
+// TestMountID verifies that the mount ID is stable. Monitoring setups key on
+// it, so it must never change for a given master key.
+func TestMountID(t *testing.T) {
+	master1 := bytes.Repeat([]byte{0x01}, 32)
+	want := "cfdfc3b5fc7530ccb56bd78bb5ce7653"
+	if have := MountID(master1); have != want {
+		t.Errorf("want=%s have=%s", want, have)
+	}
+	if MountID(master1) == MountID(bytes.Repeat([]byte{0x02}, 32)) {
+		t.Error("different keys give the same mount ID")
+	}
+}
@@ -3,13 +3,22 @@ package cryptocore
 import (
 	"crypto/rand"
 	"encoding/binary"
+	"io"
 	"log"
 )
 
+// randReader is where RandBytes gets its random bytes from. Only
+// SetDeterministicRand changes it.
+var randReader io.Reader = rand.Reader
+
 // RandBytes gets "n" random bytes from /dev/urandom or panics
 func RandBytes(n int) []byte {
+	return randBytesFrom(randReader, n)
+}
+
+func randBytesFrom(r io.Reader, n int) []byte {
 	b := make([]byte, n)
-	_, err := rand.Read(b)
+	_, err := io.ReadFull(r, b)
 	if err != nil {
 		log.Panic("Failed to read random bytes: " + err.Error())
 	}
@@ -28,5 +37,9 @@ type nonceGenerator struct {
 
 // Get a random "nonceLen"-byte nonce
 func (n *nonceGenerator) Get() []byte {
+	if randReader != rand.Reader {
+		// The prefetched bytes come from crypto/rand
+		return RandBytes(n.nonceLen)
+	}
 	return randPrefetcher.read(n.nonceLen)
 }
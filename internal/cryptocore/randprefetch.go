@@ -2,6 +2,7 @@ package cryptocore
 
 import (
 	"bytes"
+	"crypto/rand"
 	"log"
 	"sync"
 )
@@ -48,7 +49,9 @@ func (r *randPrefetcherT) read(want int) (out []byte) {
 
 func (r *randPrefetcherT) refillWorker() {
 	for {
-		r.refill <- RandBytes(prefetchN)
+		// Always crypto/rand, the worker runs before SetDeterministicRand
+		// can be called
+		r.refill <- randBytesFrom(rand.Reader, prefetchN)
 	}
 }
 
@@ -1,14 +1,18 @@
 // Package ctlsock implements the control socket interface that can be
-// activated by passing "-ctlsock" on the command line.
+// activated by passing "-ctlsock" (unix socket) or "-ctl-listen" (TLS over
+// TCP) on the command line. Both transports speak the same JSON protocol.
 package ctlsock
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"syscall"
 
 	"github.com/rfjakob/gocryptfs/internal/tlog"
@@ -20,10 +24,87 @@ type Interface interface {
 	DecryptPath(string) (string, error)
 }
 
+// OpenFilesInterface can optionally be implemented by the filesystem to
+// support the OpenFiles request
+type OpenFilesInterface interface {
+	OpenFiles() []OpenFile
+}
+
+// StatusInterface can optionally be implemented by the filesystem to support
+// the Status request
+type StatusInterface interface {
+	Status() Status
+}
+
+// ScrubStatusInterface can optionally be implemented by the filesystem to
+// support the ScrubStatus request. ScrubStatus returns nil if the scrubber
+// is not running.
+type ScrubStatusInterface interface {
+	ScrubStatus() *ScrubStatus
+}
+
+// CipherdirInterface can optionally be implemented by the filesystem to
+// return the absolute backing path in EncryptPath responses
+type CipherdirInterface interface {
+	Cipherdir() string
+}
+
 // RequestStruct is sent by a client
 type RequestStruct struct {
 	EncryptPath string
 	DecryptPath string
+	// OpenFiles requests the list of currently open files
+	OpenFiles bool
+	// Status requests information about the mount
+	Status bool
+	// ScrubStatus requests the progress of the "-scrub-interval" scrubber
+	ScrubStatus bool
+	// Token authenticates the client on "-ctl-listen" connections. It is
+	// not needed on the unix socket.
+	Token string `json:",omitempty"`
+}
+
+// OpenFile describes a file that is currently open
+type OpenFile struct {
+	// Plaintext path of the file at the time it was opened
+	Path string
+	// Count is the number of open file handles
+	Count int
+	// Writers is the number of file handles that were opened for writing
+	Writers int
+}
+
+// Status describes the mount
+type Status struct {
+	// MountID identifies the filesystem. It is derived from the master key
+	// and stays the same across remounts and hosts.
+	MountID string
+	// Label is the human-readable name of the filesystem, if it has one
+	Label string `json:",omitempty"`
+}
+
+// ScrubStatus describes the progress of the background scrubber
+type ScrubStatus struct {
+	// Pass is the number of the current pass, starting at 1
+	Pass int
+	// Running is false while the scrubber waits for the next pass
+	Running bool
+	// FilesTotal is the number of regular files found in this pass.
+	// FilesSkipped of them have not changed since the last complete pass
+	// and are not read again.
+	FilesTotal   int
+	FilesDone    int
+	FilesSkipped int
+	// BytesTotal is the plaintext size of the files that are read in this
+	// pass
+	BytesTotal uint64
+	BytesDone  uint64
+	// Errors is the number of files that failed to authenticate since the
+	// filesystem was mounted
+	Errors int
+	// LastComplete is the time the last complete pass started, in RFC 3339
+	// format
+	LastComplete string `json:",omitempty"`
 }
 
 // ResponseStruct is sent by us as response to a request
@@ -39,15 +120,27 @@ type ResponseStruct struct {
 	// WarnText contains warnings that may have been encountered while
 	// processing the message.
 	WarnText string
+	// OpenFiles is the answer to an OpenFiles request
+	OpenFiles []OpenFile `json:",omitempty"`
+	// Status is the answer to a Status request
+	Status *Status `json:",omitempty"`
+	// ScrubStatus is the answer to a ScrubStatus request
+	ScrubStatus *ScrubStatus `json:",omitempty"`
+	// CipherPath is the absolute path of the backing file or directory, set
+	// on successful EncryptPath requests in forward mode. Result stays
+	// relative to the ciphertext directory.
+	CipherPath string `json:",omitempty"`
 }
 
 type ctlSockHandler struct {
 	fs     Interface
-	socket *net.UnixListener
+	socket net.Listener
+	// If token is set, every request must carry it
+	token string
 }
 
-// Serve serves incoming connections on "sock". This call blocks so you
-// probably want to run it in a new goroutine.
+// Serve serves incoming connections on the unix socket "sock". This call
+// blocks so you probably want to run it in a new goroutine.
 func Serve(sock net.Listener, fs Interface) {
 	handler := ctlSockHandler{
 		fs:     fs,
@@ -56,6 +149,22 @@ func Serve(sock net.Listener, fs Interface) {
 	handler.acceptLoop()
 }
 
+// ServeTLS serves incoming connections on "sock", which must be a TLS
+// listener (see tls.NewListener). Unlike the unix socket, which is protected
+// by file permissions, anybody on the network can connect, so every request
+// must carry "token". Like Serve, this call blocks.
+func ServeTLS(sock net.Listener, fs Interface, token string) {
+	if token == "" {
+		log.Panic("ctlsock: refusing to serve TLS without a token")
+	}
+	handler := ctlSockHandler{
+		fs:     fs,
+		socket: sock,
+		token:  token,
+	}
+	handler.acceptLoop()
+}
+
 func (ch *ctlSockHandler) acceptLoop() {
 	for {
 		conn, err := ch.socket.Accept()
@@ -66,7 +175,7 @@ func (ch *ctlSockHandler) acceptLoop() {
 			tlog.Info.Printf("ctlsock: Accept error: %v", err)
 			break
 		}
-		go ch.handleConnection(conn.(*net.UnixConn))
+		go ch.handleConnection(conn)
 	}
 }
 
@@ -79,7 +188,7 @@ func (ch *ctlSockHandler) acceptLoop() {
 const ReadBufSize = 5000
 
 // handleConnection reads and parses JSON requests from "conn"
-func (ch *ctlSockHandler) handleConnection(conn *net.UnixConn) {
+func (ch *ctlSockHandler) handleConnection(conn net.Conn) {
 	buf := make([]byte, ReadBufSize)
 	for {
 		n, err := conn.Read(buf)
@@ -105,16 +214,43 @@ func (ch *ctlSockHandler) handleConnection(conn *net.UnixConn) {
 			sendResponse(conn, err, "", "")
 			continue
 		}
+		if !ch.checkToken(&in) {
+			tlog.Warn.Printf("ctlsock: wrong token from %v", conn.RemoteAddr())
+			sendResponse(conn, syscall.EACCES, "", "")
+			conn.Close()
+			return
+		}
 		ch.handleRequest(&in, conn)
 		// Restore original size.
 		buf = buf[:cap(buf)]
 	}
 }
 
+// checkToken returns true if the request carries the right token, or if no
+// token is needed.
+func (ch *ctlSockHandler) checkToken(in *RequestStruct) bool {
+	if ch.token == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(in.Token), []byte(ch.token)) == 1
+}
+
 // handleRequest handles an already-unmarshaled JSON request
-func (ch *ctlSockHandler) handleRequest(in *RequestStruct, conn *net.UnixConn) {
+func (ch *ctlSockHandler) handleRequest(in *RequestStruct, conn net.Conn) {
 	var err error
 	var inPath, outPath, clean, warnText string
+	if in.OpenFiles {
+		ch.handleOpenFiles(in, conn)
+		return
+	}
+	if in.Status {
+		ch.handleStatus(in, conn)
+		return
+	}
+	if in.ScrubStatus {
+		ch.handleScrubStatus(in, conn)
+		return
+	}
 	// You cannot perform both decryption and encryption in one request
 	if in.DecryptPath != "" && in.EncryptPath != "" {
 		err = errors.New("Ambiguous")
@@ -150,11 +286,81 @@ func (ch *ctlSockHandler) handleRequest(in *RequestStruct, conn *net.UnixConn) {
 	} else {
 		outPath, err = ch.fs.DecryptPath(clean)
 	}
-	sendResponse(conn, err, outPath, warnText)
+	msg := newResponse(err, outPath, warnText)
+	if in.EncryptPath != "" && err == nil {
+		if fs, ok := ch.fs.(CipherdirInterface); ok {
+			msg.CipherPath = filepath.Join(fs.Cipherdir(), outPath)
+		}
+	}
+	writeResponse(conn, &msg)
+}
+
+// handleOpenFiles handles an OpenFiles request
+func (ch *ctlSockHandler) handleOpenFiles(in *RequestStruct, conn net.Conn) {
+	if in.DecryptPath != "" || in.EncryptPath != "" {
+		sendResponse(conn, errors.New("Ambiguous"), "", "")
+		return
+	}
+	fs, ok := ch.fs.(OpenFilesInterface)
+	if !ok {
+		sendResponse(conn, syscall.ENOTSUP, "", "")
+		return
+	}
+	msg := ResponseStruct{
+		OpenFiles: fs.OpenFiles(),
+	}
+	writeResponse(conn, &msg)
+}
+
+// handleStatus handles a Status request
+func (ch *ctlSockHandler) handleStatus(in *RequestStruct, conn net.Conn) {
+	if in.DecryptPath != "" || in.EncryptPath != "" {
+		sendResponse(conn, errors.New("Ambiguous"), "", "")
+		return
+	}
+	fs, ok := ch.fs.(StatusInterface)
+	if !ok {
+		sendResponse(conn, syscall.ENOTSUP, "", "")
+		return
+	}
+	status := fs.Status()
+	msg := ResponseStruct{
+		Status: &status,
+	}
+	writeResponse(conn, &msg)
+}
+
+// handleScrubStatus handles a ScrubStatus request
+func (ch *ctlSockHandler) handleScrubStatus(in *RequestStruct, conn net.Conn) {
+	if in.DecryptPath != "" || in.EncryptPath != "" {
+		sendResponse(conn, errors.New("Ambiguous"), "", "")
+		return
+	}
+	fs, ok := ch.fs.(ScrubStatusInterface)
+	if !ok {
+		sendResponse(conn, syscall.ENOTSUP, "", "")
+		return
+	}
+	status := fs.ScrubStatus()
+	if status == nil {
+		sendResponse(conn, syscall.ENOTSUP, "", "")
+		return
+	}
+	msg := ResponseStruct{
+		ScrubStatus: status,
+	}
+	writeResponse(conn, &msg)
 }
 
 // sendResponse sends a JSON response message
-func sendResponse(conn *net.UnixConn, err error, result string, warnText string) {
+func sendResponse(conn net.Conn, err error, result string, warnText string) {
+	msg := newResponse(err, result, warnText)
+	writeResponse(conn, &msg)
+}
+
+// newResponse builds a response message, translating "err" into ErrNo and
+// ErrText
+func newResponse(err error, result string, warnText string) ResponseStruct {
 	msg := ResponseStruct{
 		Result:   result,
 		WarnText: warnText,
@@ -167,10 +373,15 @@ func sendResponse(conn *net.UnixConn, err error, result string, warnText string)
 			if se, ok := pe.Err.(syscall.Errno); ok {
 				msg.ErrNo = int32(se)
 			}
-		} else if err == syscall.ENOENT {
-			msg.ErrNo = int32(syscall.ENOENT)
+		} else if se, ok := err.(syscall.Errno); ok {
+			msg.ErrNo = int32(se)
 		}
 	}
+	return msg
+}
+
+// writeResponse marshals "msg" to JSON and sends it
+func writeResponse(conn net.Conn, msg *ResponseStruct) {
 	jsonMsg, err := json.Marshal(msg)
 	if err != nil {
 		tlog.Warn.Printf("ctlsock: Marshal failed: %v", err)
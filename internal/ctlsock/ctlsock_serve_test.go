@@ -0,0 +1,182 @@
+package ctlsock
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type dummyFS struct{}
+
+func (dummyFS) EncryptPath(p string) (string, error) { return "enc:" + p, nil }
+func (dummyFS) DecryptPath(p string) (string, error) { return "dec:" + p, nil }
+
+// selfSignedCert generates a certificate for 127.0.0.1.
+func selfSignedCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gocryptfs test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func request(t *testing.T, conn net.Conn, req RequestStruct) ResponseStruct {
+	buf, _ := json.Marshal(req)
+	_, err := conn.Write(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp ResponseStruct
+	err = json.Unmarshal(line, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestServeTLS(t *testing.T) {
+	cert := selfSignedCert(t)
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := tls.NewListener(tcp, &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer sock.Close()
+	go ServeTLS(sock, dummyFS{}, "secret")
+
+	pool := x509.NewCertPool()
+	parsed, _ := x509.ParseCertificate(cert.Certificate[0])
+	pool.AddCert(parsed)
+	dial := func() net.Conn {
+		conn, err := tls.Dial("tcp", tcp.Addr().String(), &tls.Config{RootCAs: pool})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	// Right token
+	conn := dial()
+	resp := request(t, conn, RequestStruct{Token: "secret", EncryptPath: "foo"})
+	if resp.ErrNo != 0 || resp.Result != "enc:foo" {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+	conn.Close()
+	// Wrong and missing token
+	for _, token := range []string{"wrong", ""} {
+		conn = dial()
+		resp = request(t, conn, RequestStruct{Token: token, EncryptPath: "foo"})
+		if resp.ErrNo != int32(syscall.EACCES) || resp.Result != "" {
+			t.Errorf("token %q: unexpected response: %+v", token, resp)
+		}
+		conn.Close()
+	}
+	// Plaintext connections fail
+	plain, err := net.Dial("tcp", tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	plain.Write([]byte(`{"Token":"secret","EncryptPath":"foo"}`))
+	plain.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 100)
+	n, _ := plain.Read(buf)
+	if json.Unmarshal(buf[:n], &resp) == nil {
+		t.Errorf("plaintext request got a JSON response: %q", buf[:n])
+	}
+}
+
+type dummyCipherdirFS struct{ dummyFS }
+
+func (dummyCipherdirFS) Cipherdir() string { return "/cipher" }
+
+func TestCipherPath(t *testing.T) {
+	for _, fs := range []Interface{dummyFS{}, dummyCipherdirFS{}} {
+		client, server := net.Pipe()
+		ch := ctlSockHandler{fs: fs}
+		go ch.handleConnection(server)
+		resp := request(t, client, RequestStruct{EncryptPath: "foo"})
+		_, hasCipherdir := fs.(CipherdirInterface)
+		if hasCipherdir && resp.CipherPath != "/cipher/enc:foo" {
+			t.Errorf("%T: wrong CipherPath: %+v", fs, resp)
+		} else if !hasCipherdir && resp.CipherPath != "" {
+			t.Errorf("%T: unexpected CipherPath: %+v", fs, resp)
+		}
+		// Only EncryptPath requests get a CipherPath
+		resp = request(t, client, RequestStruct{DecryptPath: "foo"})
+		if resp.CipherPath != "" {
+			t.Errorf("%T: DecryptPath returned CipherPath: %+v", fs, resp)
+		}
+		client.Close()
+	}
+}
+
+type dummyStatusFS struct{ dummyFS }
+
+func (dummyStatusFS) Status() Status { return Status{MountID: "1234"} }
+
+func TestStatus(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	ch := ctlSockHandler{fs: dummyStatusFS{}}
+	go ch.handleConnection(server)
+	resp := request(t, client, RequestStruct{Status: true})
+	if resp.ErrNo != 0 || resp.Status == nil || resp.Status.MountID != "1234" {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+	resp = request(t, client, RequestStruct{Status: true, EncryptPath: "foo"})
+	if resp.ErrNo == 0 || resp.Status != nil {
+		t.Errorf("ambiguous request was accepted: %+v", resp)
+	}
+}
+
+type dummyScrubFS struct {
+	dummyFS
+	status *ScrubStatus
+}
+
+func (fs dummyScrubFS) ScrubStatus() *ScrubStatus { return fs.status }
+
+func TestScrubStatus(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	ch := ctlSockHandler{fs: dummyScrubFS{status: &ScrubStatus{Pass: 3, FilesDone: 7}}}
+	go ch.handleConnection(server)
+	resp := request(t, client, RequestStruct{ScrubStatus: true})
+	if resp.ErrNo != 0 || resp.ScrubStatus == nil || resp.ScrubStatus.Pass != 3 || resp.ScrubStatus.FilesDone != 7 {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+	// Scrubbing is not enabled
+	client2, server2 := net.Pipe()
+	defer client2.Close()
+	ch2 := ctlSockHandler{fs: dummyScrubFS{}}
+	go ch2.handleConnection(server2)
+	resp = request(t, client2, RequestStruct{ScrubStatus: true})
+	if resp.ErrNo != int32(syscall.ENOTSUP) || resp.ScrubStatus != nil {
+		t.Errorf("expected ENOTSUP, got %+v", resp)
+	}
+}
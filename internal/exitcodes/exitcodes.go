@@ -5,6 +5,7 @@ package exitcodes
 import (
 	"fmt"
 	"os"
+	"sync"
 )
 
 const (
@@ -70,6 +71,45 @@ const (
 	TrezorError = 28
 	// ExcludeError - an error occoured while processing "-exclude"
 	ExcludeError = 29
+	// CompareMismatch - "-compare" found differences between the two
+	// filesystems
+	CompareMismatch = 30
+	// SelfTest - the crypto self-test that runs before mounting failed
+	SelfTest = 31
+	// ManifestDrift - "-verify-manifest" found that the filesystem does not
+	// match the manifest
+	ManifestDrift = 32
+	// CipherdirLocked - CIPHERDIR is already mounted read-write by another
+	// gocryptfs process, or the lock file could not be created
+	CipherdirLocked = 33
+	// RekeyIncomplete - "-rekey-master" could not copy everything or the
+	// copy does not match the source. Running it again resumes the copy.
+	RekeyIncomplete = 34
+	// Mlock - "-require-mlock" was passed, but the keys could not be locked
+	// into memory
+	Mlock = 35
+	// ImportIncomplete - "-import" could not copy everything
+	ImportIncomplete = 36
+	// TarIncomplete - "-tar" stopped early because a file could not be read
+	// or decrypted
+	TarIncomplete = 37
+	// AuditLog - the "-audit-log" file could not be opened or written, or
+	// "-verify-audit" found a broken hash chain
+	AuditLog = 38
+	// PremountCmd - the "-premount-cmd" hook failed
+	PremountCmd = 39
+	// DirIVCorrupt - fsck found a gocryptfs.diriv file with the wrong length
+	// or all-zero content
+	DirIVCorrupt = 40
+	// ShutdownForced - on SIGINT or SIGTERM, operations were still running
+	// after "-shutdown-timeout" and the filesystem was unmounted lazily
+	ShutdownForced = 41
+	// Snapshot - "-snapshot" could not create the copy-on-write copy of
+	// CIPHERDIR
+	Snapshot = 42
+	// KDFPolicy - the scrypt parameters in the config file are weaker than
+	// "-min-scrypt-n" allows
+	KDFPolicy = 43
 )
 
 // Err wraps an error with an associated numeric exit code
@@ -87,11 +127,38 @@ func NewErr(msg string, code int) Err {
 }
 
 // Exit extracts the numeric exit code from "err" (if available) and exits the
-// application.
+// application. Functions registered with AtExit are run first.
 func Exit(err error) {
+	RunAtExit()
 	err2, ok := err.(Err)
 	if !ok {
 		os.Exit(Other)
 	}
 	os.Exit(err2.code)
 }
+
+var atExit struct {
+	sync.Mutex
+	funcs []func()
+}
+
+// AtExit registers "f" to be run before the application exits via Exit or
+// RunAtExit. This is used to write out profiles, which would otherwise be
+// lost when os.Exit skips the deferred calls.
+func AtExit(f func()) {
+	atExit.Lock()
+	atExit.funcs = append(atExit.funcs, f)
+	atExit.Unlock()
+}
+
+// RunAtExit runs the functions registered with AtExit in reverse order, like
+// deferred calls. Each function runs only once, even if RunAtExit is called
+// multiple times.
+func RunAtExit() {
+	atExit.Lock()
+	defer atExit.Unlock()
+	for i := len(atExit.funcs) - 1; i >= 0; i-- {
+		atExit.funcs[i]()
+	}
+	atExit.funcs = nil
+}
@@ -0,0 +1,17 @@
+package exitcodes
+
+import (
+	"testing"
+)
+
+func TestRunAtExit(t *testing.T) {
+	var order []int
+	AtExit(func() { order = append(order, 1) })
+	AtExit(func() { order = append(order, 2) })
+	RunAtExit()
+	// Second call must not run the functions again
+	RunAtExit()
+	if len(order) != 2 || order[0] != 2 || order[1] != 1 {
+		t.Errorf("wrong call order: %v", order)
+	}
+}
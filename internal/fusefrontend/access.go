@@ -0,0 +1,127 @@
+package fusefrontend
+
+// FUSE access(2) handling
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// Access - FUSE call. Checks "mode" against the permissions of the backing
+// file for the uid and groups of the calling process, which is not
+// necessarily the user gocryptfs runs as (think "-allow_other").
+// Note that the kernel usually handles access(2) itself when "-allow_other"
+// is set, because this adds the "default_permissions" mount option.
+func (fs *FS) Access(path string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	if fs.isFiltered(path) {
+		return fuse.EPERM
+	}
+	if fs.args.ReadOnly && mode&unix.W_OK != 0 {
+		return fuse.EROFS
+	}
+	cPath, err := fs.getBackingPath(path)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	var st syscall.Stat_t
+	err = syscall.Lstat(cPath, &st)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	if context == nil || mode == unix.F_OK {
+		return fuse.ToStatus(syscall.Access(cPath, mode))
+	}
+	gids := callerGroups(context)
+	if !accessAllowed(&st, mode, context.Uid, gids) {
+		return fuse.EACCES
+	}
+	// The caller has the permission, but gocryptfs has to be able to act on
+	// it as well. Root can always do that.
+	if os.Getuid() != 0 {
+		return fuse.ToStatus(syscall.Access(cPath, mode))
+	}
+	return fuse.OK
+}
+
+// accessAllowed checks the R_OK, W_OK and X_OK bits of "mode" against the
+// permission bits in "st", like the kernel does, for a process running as
+// "uid" that is a member of the groups "gids".
+// Root gets read and write access to everything, and execute access if any
+// execute bit is set or the file is a directory.
+func accessAllowed(st *syscall.Stat_t, mode uint32, uid uint32, gids []uint32) bool {
+	mode &= unix.R_OK | unix.W_OK | unix.X_OK
+	stMode := uint32(st.Mode)
+	if uid == 0 {
+		if mode&unix.X_OK == 0 || stMode&syscall.S_IFMT == syscall.S_IFDIR {
+			return true
+		}
+		return stMode&0111 != 0
+	}
+	// The permission bits are laid out as rwxrwxrwx (owner, group, other),
+	// and R_OK, W_OK, X_OK are 4, 2, 1.
+	var perm uint32
+	if uid == st.Uid {
+		perm = (stMode >> 6) & 7
+	} else if inGroups(st.Gid, gids) {
+		perm = (stMode >> 3) & 7
+	} else {
+		perm = stMode & 7
+	}
+	return perm&mode == mode
+}
+
+func inGroups(gid uint32, gids []uint32) bool {
+	for _, g := range gids {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// procDir is where callerGroups looks for the process status files. Changed
+// by the tests to simulate a system without /proc.
+var procDir = "/proc"
+
+// callerGroups returns the primary and the supplementary groups of the
+// process that made the FUSE request. FUSE only passes the primary group,
+// the supplementary groups are read from /proc. If that fails (the process
+// has already exited, or there is no /proc), only the primary group is
+// returned.
+func callerGroups(context *fuse.Context) []uint32 {
+	gids := []uint32{context.Gid}
+	if context.Pid == 0 {
+		return gids
+	}
+	f, err := os.Open(fmt.Sprintf("%s/%d/status", procDir, context.Pid))
+	if err != nil {
+		return gids
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+		for _, field := range strings.Fields(strings.TrimPrefix(line, "Groups:")) {
+			g, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				tlog.Debug.Printf("callerGroups: cannot parse %q: %v", field, err)
+				continue
+			}
+			gids = append(gids, uint32(g))
+		}
+		break
+	}
+	return gids
+}
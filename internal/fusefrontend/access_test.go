@@ -0,0 +1,114 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"golang.org/x/sys/unix"
+)
+
+func TestAccessAllowed(t *testing.T) {
+	const owner, group, other = 1000, 2000, 3000
+	// File owned by 1000:2000
+	st := syscall.Stat_t{Uid: owner, Gid: group}
+	testCases := []struct {
+		perm uint32
+		uid  uint32
+		gids []uint32
+		mode uint32
+		ok   bool
+	}{
+		{0640, owner, nil, unix.R_OK | unix.W_OK, true},
+		{0640, owner, nil, unix.X_OK, false},
+		{0640, other, []uint32{group}, unix.R_OK, true},
+		{0640, other, []uint32{group}, unix.W_OK, false},
+		// Supplementary group
+		{0640, other, []uint32{other, 5, group}, unix.R_OK, true},
+		{0640, other, []uint32{other}, unix.R_OK, false},
+		{0604, other, []uint32{other}, unix.R_OK, true},
+		// The owner bits apply to the owner even if "other" allows more
+		{0407, owner, nil, unix.W_OK, false},
+		{0751, other, nil, unix.X_OK, true},
+		{0751, other, nil, unix.R_OK | unix.X_OK, false},
+		// Root
+		{0000, 0, nil, unix.R_OK | unix.W_OK, true},
+		{0644, 0, nil, unix.X_OK, false},
+		{0744, 0, nil, unix.X_OK, true},
+	}
+	for i, tc := range testCases {
+		st.Mode = syscall.S_IFREG | tc.perm
+		if ok := accessAllowed(&st, tc.mode, tc.uid, tc.gids); ok != tc.ok {
+			t.Errorf("case %d: perm=%#o uid=%d mode=%d: want %v, got %v", i, tc.perm, tc.uid, tc.mode, tc.ok, ok)
+		}
+	}
+	// Root can always enter directories
+	st.Mode = syscall.S_IFDIR | 0600
+	if !accessAllowed(&st, unix.X_OK, 0, nil) {
+		t.Errorf("root should be able to enter a directory without x bits")
+	}
+}
+
+// TestAccessOtherUid checks FS.Access for a caller that is not the owner of
+// the backing file.
+func TestAccessOtherUid(t *testing.T) {
+	fs := newTestFS()
+	dir, err := ioutil.TempDir("", "TestAccessOtherUid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs.args.Cipherdir = dir
+	fs.args.PlaintextNames = true
+	err = ioutil.WriteFile(dir+"/file", nil, 0604)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the file permissions are not affected by the umask
+	os.Chmod(dir+"/file", 0604)
+	uid := uint32(os.Getuid())
+	ctx := &fuse.Context{Owner: fuse.Owner{Uid: uid + 1, Gid: uint32(os.Getgid()) + 1}}
+	if s := fs.Access("file", unix.R_OK, ctx); !s.Ok() {
+		t.Errorf("R_OK: want OK, got %v", s)
+	}
+	if s := fs.Access("file", unix.W_OK, ctx); s != fuse.EACCES {
+		t.Errorf("W_OK: want EACCES, got %v", s)
+	}
+	if s := fs.Access("file", unix.X_OK, ctx); s != fuse.EACCES {
+		t.Errorf("X_OK: want EACCES, got %v", s)
+	}
+	// The owner can write, but not read
+	os.Chmod(dir+"/file", 0204)
+	ctx.Uid = uid
+	if s := fs.Access("file", unix.W_OK, ctx); !s.Ok() {
+		t.Errorf("owner W_OK: want OK, got %v", s)
+	}
+	if uid != 0 {
+		if s := fs.Access("file", unix.R_OK, ctx); s != fuse.EACCES {
+			t.Errorf("owner R_OK: want EACCES, got %v", s)
+		}
+	}
+}
+
+// TestCallerGroupsNoProc checks that Access keeps working on systems
+// without /proc (minimal containers), using only the primary group.
+func TestCallerGroupsNoProc(t *testing.T) {
+	ctx := &fuse.Context{Owner: fuse.Owner{Uid: 1000, Gid: 2000}, Pid: uint32(os.Getpid())}
+	oldProcDir := procDir
+	defer func() { procDir = oldProcDir }()
+	procDir = "/nonexistent/proc"
+	gids := callerGroups(ctx)
+	if len(gids) != 1 || gids[0] != 2000 {
+		t.Errorf("want only the primary group [2000], got %v", gids)
+	}
+	procDir = oldProcDir
+	if _, err := os.Stat(procDir); err != nil {
+		t.Skip("no /proc on this system")
+	}
+	gids = callerGroups(ctx)
+	if len(gids) == 0 || gids[0] != 2000 {
+		t.Errorf("primary group must come first, got %v", gids)
+	}
+}
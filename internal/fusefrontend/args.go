@@ -1,6 +1,9 @@
 package fusefrontend
 
 import (
+	"strings"
+	"time"
+
 	"github.com/hanwen/go-fuse/fuse"
 )
 
@@ -24,12 +27,120 @@ type Args struct {
 	// location. If it is false, reverse mode maps ".gocryptfs.reverse.conf"
 	// to "gocryptfs.conf" in the plaintext dir.
 	ConfigCustom bool
+	// ReadOnly makes all operations that would modify CIPHERDIR fail with
+	// EROFS, "-ro". The kernel already blocks writes to a read-only mount,
+	// this makes sure we never write even if it did not.
+	ReadOnly bool
+	// BurnAfterReading deletes files marked with BurnXattr once they have
+	// been read completely, "-burn-after-reading"
+	BurnAfterReading bool
+	// DirKeys is set if the filesystem may contain directories that are
+	// locked with their own key ("-lock-dir")
+	DirKeys bool
 	// NoPrealloc disables automatic preallocation before writing
 	NoPrealloc bool
+	// NoWriteHoles makes writes and truncates past the end of a file write
+	// encrypted zero blocks instead of leaving a file hole, "-no-write-holes"
+	NoWriteHoles bool
 	// Try to serialize read operations, "-serialize_reads"
 	SerializeReads bool
 	// Force decode even if integrity check fails (openSSL only)
 	ForceDecode bool
 	// Exclude is a list of paths to make inaccessible
 	Exclude []string
+	// PatternsFile is the name of the per-directory files that contain
+	// gitignore-style exclude patterns, "-reverse-patterns-file"
+	PatternsFile string
+	// PassthroughExt is the list of lower-case file extensions, including
+	// the leading dot, whose content is not encrypted in reverse mode,
+	// "-passthrough-ext"
+	PassthroughExt []string
+	// FlushOnClose makes Flush() fsync files that have been opened for
+	// writing, "-flush-on-close"
+	FlushOnClose bool
+	// XattrSync makes changed xattrs durable: files that are open are
+	// fsync'ed on Flush(), files that are not are fsync'ed right away,
+	// "-xattr-sync"
+	XattrSync bool
+	// TmpDir is where temporary files are created before they are renamed
+	// into CIPHERDIR, "-tmpdir". Empty means next to the target.
+	TmpDir string
+	// NoEscapeSymlinks makes Symlink() and Readlink() fail with EPERM for
+	// symlinks whose target is outside the mount, "-no-escape-symlinks"
+	NoEscapeSymlinks bool
+	// PreserveXattrOnRename makes Rename() copy the xattrs of a file that is
+	// overwritten to the file that replaces it, "-preserve-xattr-on-rename"
+	PreserveXattrOnRename bool
+	// IORetries is the number of times a read or write on the backing file
+	// is retried after a transient error (EINTR, EAGAIN), "-io-retries"
+	IORetries int
+	// MaxDepth is the maximum number of components of a path, "-max-depth".
+	// Deeper paths fail with ELOOP. Zero means no limit.
+	MaxDepth int
+	// StrictAtime makes every read update the atime of the backing file,
+	// "-strict-atime"
+	StrictAtime bool
+	// PlaintextContent means that file contents are stored unencrypted,
+	// only the names are encrypted
+	PlaintextContent bool
+	// Recovery replaces blocks that fail to decrypt with zeros instead of
+	// failing the read with EIO, "-recovery". Implies ReadOnly and SkipCorrupt.
+	Recovery bool
+	// SkipCorrupt makes OpenDir skip entries whose names fail to decrypt
+	// instead of failing with EIO, "-skip-corrupt"
+	SkipCorrupt bool
+	// ODirectDontNeed makes reads and writes on files opened with O_DIRECT
+	// drop the backing pages from the page cache, "-odirect-dontneed"
+	ODirectDontNeed bool
+	// MountID identifies the filesystem, see cryptocore.MountID
+	MountID string
+	// Label is the human-readable name of the filesystem from the config
+	// file. May be empty.
+	Label string
+	// XAttrSidecar stores xattrs in "gocryptfs.xattr.*" sidecar files instead
+	// of backing xattrs ("XAttrSidecar" feature flag)
+	XAttrSidecar bool
+	// DebugXattr makes the encrypted value of every xattr NAME readable as
+	// "user.gocryptfs.raw.NAME", "-debug-xattr"
+	DebugXattr bool
+	// WriteVerify makes Release() re-read and authenticate the blocks that
+	// have been written through the file handle, "-write-verify"
+	WriteVerify bool
+	// MaxFileSize is the largest plaintext size in bytes that Write and
+	// Truncate may grow a file to, "-max-file-size". Zero means no limit.
+	MaxFileSize uint64
+	// ReadLimit and WriteLimit cap the read and write bandwidth in bytes
+	// per second, "-read-limit" and "-write-limit". Zero means unlimited.
+	ReadLimit  uint64
+	WriteLimit uint64
+	// TimingJitter is the maximum random delay added to each read and
+	// write, "-timing-jitter". Zero disables it.
+	TimingJitter time.Duration
+	// FlushInterval is how often the backing files of modified files that
+	// are open for writing are fsync'ed, "-flush-interval". Zero disables
+	// it.
+	FlushInterval time.Duration
+	// ScrubInterval is how long one pass of the background scrubber that
+	// reads and authenticates all files takes, "-scrub-interval". Zero
+	// disables it.
+	ScrubInterval time.Duration
+}
+
+// DefaultMaxDepth is the default for "-max-depth". Even with one-character
+// names, a path of this depth is about half of PATH_MAX.
+const DefaultMaxDepth = 1024
+
+// PathDepth returns the number of components of the relative path "relPath".
+func PathDepth(relPath string) int {
+	if relPath == "" {
+		return 0
+	}
+	return strings.Count(relPath, "/") + 1
+}
+
+// TooDeep returns true if "relPath" is deeper than "-max-depth" allows.
+// Deeply nested or looping directories in a malicious or corrupt CIPHERDIR
+// would otherwise make every operation walk thousands of levels.
+func (a *Args) TooDeep(relPath string) bool {
+	return a.MaxDepth > 0 && PathDepth(relPath) > a.MaxDepth
 }
@@ -0,0 +1,100 @@
+package fusefrontend
+
+// Detection of a CIPHERDIR that has disappeared during the mount, like a
+// USB stick that has been pulled.
+//
+// Errors like ENOENT or ENODEV from the backing filesystem make us check
+// CIPHERDIR itself. If it is gone, or has been replaced by a different
+// directory (the empty mountpoint of the removed media), all further
+// operations fail with EIO.
+
+import (
+	"errors"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// backingCheckInterval limits how often CIPHERDIR is checked. ENOENT is a
+// common error, and most of the time it just means that a file does not
+// exist.
+const backingCheckInterval = 100 * time.Millisecond
+
+type backingState struct {
+	// Device and inode number of CIPHERDIR at mount time. Zero if it could
+	// not be stat'ed, which disables the check.
+	dev, ino uint64
+	// lost is set to 1 when CIPHERDIR has disappeared. Accessed atomically.
+	lost uint32
+	// lastCheck is the time of the last check in UnixNano. Accessed
+	// atomically.
+	lastCheck int64
+}
+
+// initBackingState records the identity of CIPHERDIR
+func (fs *FS) initBackingState() {
+	var st syscall.Stat_t
+	if err := syscall.Stat(fs.args.Cipherdir, &st); err != nil {
+		tlog.Debug.Printf("initBackingState: %v", err)
+		return
+	}
+	fs.backing.dev = uint64(st.Dev)
+	fs.backing.ino = uint64(st.Ino)
+}
+
+// isBackingLossErrno returns true for the errors that the backing filesystem
+// returns when it has disappeared.
+func isBackingLossErrno(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	switch errno {
+	case syscall.ENOENT, syscall.ENXIO, syscall.ENODEV, syscall.EIO, syscall.ESTALE, syscall.ENOTCONN:
+		return true
+	}
+	return false
+}
+
+// backingLost returns true if CIPHERDIR has disappeared
+func (fs *FS) backingLost() bool {
+	return atomic.LoadUint32(&fs.backing.lost) == 1
+}
+
+// checkBackingErr is called with the errors of operations on the backing
+// files. If "err" suggests that CIPHERDIR is gone, it is checked, and EIO is
+// returned if it is. Otherwise, "err" is returned unchanged.
+func (fs *FS) checkBackingErr(err error) error {
+	if err == nil || fs.backing.ino == 0 || !isBackingLossErrno(err) {
+		return err
+	}
+	if fs.backingLost() {
+		return syscall.EIO
+	}
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&fs.backing.lastCheck)
+	if now-last < int64(backingCheckInterval) || !atomic.CompareAndSwapInt64(&fs.backing.lastCheck, last, now) {
+		return err
+	}
+	var st syscall.Stat_t
+	statErr := syscall.Stat(fs.args.Cipherdir, &st)
+	if statErr == nil && uint64(st.Dev) == fs.backing.dev && uint64(st.Ino) == fs.backing.ino {
+		return err
+	}
+	if !atomic.CompareAndSwapUint32(&fs.backing.lost, 0, 1) {
+		return syscall.EIO
+	}
+	if statErr != nil {
+		tlog.Warn.Printf("Backing storage disappeared: CIPHERDIR %q: %v. Failing all operations with EIO.",
+			fs.args.Cipherdir, statErr)
+	} else {
+		tlog.Warn.Printf("Backing storage disappeared: CIPHERDIR %q has been replaced by a different directory. "+
+			"Failing all operations with EIO.", fs.args.Cipherdir)
+	}
+	if fs.OnBackingLoss != nil {
+		go fs.OnBackingLoss()
+	}
+	return syscall.EIO
+}
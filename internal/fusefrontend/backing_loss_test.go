@@ -0,0 +1,107 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// testBackingLoss creates a file in a new CIPHERDIR, runs "pull" to make
+// the CIPHERDIR disappear and checks that the operations fail with EIO.
+func testBackingLoss(t *testing.T, pull func(dir string)) {
+	dir, err := ioutil.TempDir("", "TestBackingLoss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	fs.args.PlaintextNames = true
+	fs.initBackingState()
+	var unmounts uint32
+	done := make(chan struct{})
+	fs.OnBackingLoss = func() {
+		atomic.AddUint32(&unmounts, 1)
+		close(done)
+	}
+	f, status := fs.Create("foo", syscall.O_RDWR, 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	if _, status = f.Write([]byte("hello"), 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	pull(dir)
+	// Detects the loss
+	if _, status = fs.GetAttr("foo", nil); status.Ok() {
+		t.Fatal("GetAttr succeeded on a vanished CIPHERDIR")
+	}
+	if !fs.backingLost() {
+		t.Fatal("backing loss not detected")
+	}
+	<-done
+	// Fails everything with EIO from now on
+	if _, status = fs.GetAttr("", nil); status != fuse.EIO {
+		t.Errorf("GetAttr root: want EIO, got %v", status)
+	}
+	if _, status = fs.OpenDir("", nil); status != fuse.EIO {
+		t.Errorf("OpenDir: want EIO, got %v", status)
+	}
+	if _, status = fs.Create("bar", syscall.O_RDWR, 0600, nil); status != fuse.EIO {
+		t.Errorf("Create: want EIO, got %v", status)
+	}
+	buf := make([]byte, 10)
+	if _, status = f.Read(buf, 0); status != fuse.EIO {
+		t.Errorf("Read: want EIO, got %v", status)
+	}
+	if _, status = f.Write([]byte("x"), 0); status != fuse.EIO {
+		t.Errorf("Write: want EIO, got %v", status)
+	}
+	if n := atomic.LoadUint32(&unmounts); n != 1 {
+		t.Errorf("OnBackingLoss called %d times", n)
+	}
+}
+
+func TestBackingLossRemoved(t *testing.T) {
+	testBackingLoss(t, func(dir string) {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// Looks like unmounted media: the mountpoint is an empty directory
+func TestBackingLossReplaced(t *testing.T) {
+	testBackingLoss(t, func(dir string) {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Mkdir(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// A file that does not exist is not a backing loss
+func TestBackingLossENOENT(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestBackingLossENOENT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	fs.args.PlaintextNames = true
+	fs.initBackingState()
+	if _, status := fs.GetAttr("nonexisting", nil); status != fuse.ENOENT {
+		t.Errorf("want ENOENT, got %v", status)
+	}
+	if fs.backingLost() {
+		t.Error("ENOENT was taken for a backing loss")
+	}
+}
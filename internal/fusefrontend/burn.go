@@ -0,0 +1,118 @@
+package fusefrontend
+
+// "-burn-after-reading": delete files once they have been read completely
+
+import (
+	"os"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// BurnXattr marks a file for deletion after it has been read. The value
+// does not matter. Like all xattrs, it is stored encrypted.
+const BurnXattr = "user.burn-after-reading"
+
+// isBurnFile returns true if "-burn-after-reading" is active and "path"
+// carries the BurnXattr marker.
+func (fs *FS) isBurnFile(path string) bool {
+	if !fs.args.BurnAfterReading {
+		return false
+	}
+	_, status := fs.GetXAttr(path, BurnXattr, nil)
+	return status.Ok()
+}
+
+// openBurnFile prepares "f" (opened as "path") for burn-after-reading, if
+// the file is marked. The file is opened with direct I/O so that kernel
+// read-ahead cannot read more than the application asked for.
+func (fs *FS) openBurnFile(f *File, path string) nodefs.File {
+	if !fs.isBurnFile(path) {
+		return f
+	}
+	f.burn = true
+	return &nodefs.WithFlags{
+		File:      f,
+		FuseFlags: fuse.FOPEN_DIRECT_IO,
+	}
+}
+
+// trackBurnRead records that a Read() at offset "off" for "requested" bytes
+// returned "n" bytes. Once every byte from zero up to EOF has been read, the
+// file is marked for deletion when the last handle is released.
+// Reads that skip parts of the file do not count.
+func (f *File) trackBurnRead(off int64, n int, requested int) {
+	f.burnLock.Lock()
+	defer f.burnLock.Unlock()
+	end := off + int64(n)
+	if off <= f.burnReadUpTo && end > f.burnReadUpTo {
+		f.burnReadUpTo = end
+	}
+	// A short read means we hit EOF
+	if n < requested && end <= f.burnReadUpTo {
+		atomic.StoreUint32(&f.fileTableEntry.Burn, 1)
+	}
+}
+
+// burnFile overwrites the backing file of "path" with zeros and deletes it.
+// The file is only deleted if "path" still refers to the inode "qi", which
+// is not the case if it has been renamed or replaced in the meantime.
+// Files with more than one hard link are only unlinked.
+func (fs *FS) burnFile(path string, qi openfiletable.QIno) {
+	defer fs.attrCache.invalidate()
+	cPath, err := fs.getBackingPath(path)
+	if err != nil {
+		tlog.Warn.Printf("burn-after-reading %q: %v", path, err)
+		return
+	}
+	fd, err := os.OpenFile(cPath, os.O_WRONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		tlog.Warn.Printf("burn-after-reading %q: %v", path, err)
+		return
+	}
+	defer fd.Close()
+	var st syscall.Stat_t
+	err = syscall.Fstat(int(fd.Fd()), &st)
+	if err != nil {
+		tlog.Warn.Printf("burn-after-reading %q: %v", path, err)
+		return
+	}
+	if openfiletable.QInoFromStat(&st) != qi {
+		tlog.Warn.Printf("burn-after-reading %q: file has been replaced, not deleting", path)
+		return
+	}
+	if st.Nlink > 1 {
+		// The data is still reachable through the other hard links.
+		// Overwriting it would destroy them as well.
+		tlog.Warn.Printf("burn-after-reading %q: file has %d hard links, "+
+			"only deleting this name, the data is not overwritten", path, st.Nlink)
+		if status := fs.Unlink(path, nil); !status.Ok() {
+			tlog.Warn.Printf("burn-after-reading %q: unlink failed: %v", path, status)
+		}
+		return
+	}
+	zeros := make([]byte, 128*1024)
+	for off := int64(0); off < st.Size; off += int64(len(zeros)) {
+		buf := zeros
+		if st.Size-off < int64(len(buf)) {
+			buf = buf[:st.Size-off]
+		}
+		_, err = fd.WriteAt(buf, off)
+		if err != nil {
+			tlog.Warn.Printf("burn-after-reading %q: overwrite failed: %v", path, err)
+			break
+		}
+	}
+	fd.Sync()
+	status := fs.Unlink(path, nil)
+	if !status.Ok() {
+		tlog.Warn.Printf("burn-after-reading %q: unlink failed: %v", path, status)
+		return
+	}
+	tlog.Info.Printf("burn-after-reading: deleted %q", path)
+}
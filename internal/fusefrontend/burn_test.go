@@ -0,0 +1,55 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+)
+
+// A file with more than one hard link must only lose the burned name, the
+// data stays intact for the other names.
+func TestBurnHardLink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestBurnHardLink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	fs.args.PlaintextNames = true
+	f, status := fs.Create("secret", syscall.O_WRONLY, 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, status = f.Write([]byte("foo"), 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+	if status = fs.Link("secret", "other", nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	before, err := ioutil.ReadFile(filepath.Join(dir, "other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st syscall.Stat_t
+	if err = syscall.Stat(filepath.Join(dir, "secret"), &st); err != nil {
+		t.Fatal(err)
+	}
+	fs.burnFile("secret", openfiletable.QInoFromStat(&st))
+	if _, err = os.Stat(filepath.Join(dir, "secret")); !os.IsNotExist(err) {
+		t.Errorf("burned name still exists: %v", err)
+	}
+	after, err := ioutil.ReadFile(filepath.Join(dir, "other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Errorf("data of the other hard link has been overwritten")
+	}
+}
@@ -9,7 +9,26 @@ import (
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
 )
 
-var _ ctlsock.Interface = &FS{} // Verify that interface is implemented.
+var _ ctlsock.Interface = &FS{}            // Verify that interface is implemented.
+var _ ctlsock.OpenFilesInterface = &FS{}   // Verify that interface is implemented.
+var _ ctlsock.CipherdirInterface = &FS{}   // Verify that interface is implemented.
+var _ ctlsock.StatusInterface = &FS{}      // Verify that interface is implemented.
+var _ ctlsock.ScrubStatusInterface = &FS{} // Verify that interface is implemented.
+
+// OpenFiles implements ctlsock.OpenFilesInterface
+func (fs *FS) OpenFiles() []ctlsock.OpenFile {
+	return fs.openPaths.list()
+}
+
+// Status implements ctlsock.StatusInterface
+func (fs *FS) Status() ctlsock.Status {
+	return ctlsock.Status{MountID: fs.args.MountID, Label: fs.args.Label}
+}
+
+// Cipherdir implements ctlsock.CipherdirInterface
+func (fs *FS) Cipherdir() string {
+	return fs.args.Cipherdir
+}
 
 // EncryptPath implements ctlsock.Backend
 func (fs *FS) EncryptPath(plainPath string) (string, error) {
@@ -24,12 +43,17 @@ func (fs *FS) DecryptPath(cipherPath string) (string, error) {
 	plainPath := ""
 	parts := strings.Split(cipherPath, "/")
 	wd := fs.args.Cipherdir
+	cWD := ""
 	for _, part := range parts {
 		dirIV, err := nametransform.ReadDirIV(wd)
 		if err != nil {
 			fmt.Printf("ReadDirIV: %v\n", err)
 			return "", err
 		}
+		k, err := fs.keysFor(cWD)
+		if err != nil {
+			return "", err
+		}
 		longPart := part
 		if nametransform.IsLongContent(part) {
 			longPart, err = nametransform.ReadLongName(wd + "/" + part)
@@ -38,13 +62,14 @@ func (fs *FS) DecryptPath(cipherPath string) (string, error) {
 				return "", err
 			}
 		}
-		name, err := fs.nameTransform.DecryptName(longPart, dirIV)
+		name, err := k.nameTransform.DecryptName(longPart, dirIV)
 		if err != nil {
 			fmt.Printf("DecryptName: %v\n", err)
 			return "", err
 		}
-		plainPath = path.Join(plainPath, name)
+		plainPath = path.Join(plainPath, fs.nameTransform.AddSuffix(name))
 		wd = path.Join(wd, part)
+		cWD = path.Join(cWD, part)
 	}
 	return plainPath, nil
 }
@@ -0,0 +1,213 @@
+package fusefrontend
+
+// "-lock-dir": directories whose contents are encrypted with their own key
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/rfjakob/eme"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// dirKey holds the encryption helpers of one key domain: the master key, or
+// the key of a locked directory. Everything inside a locked directory - file
+// contents, file names, symlink targets and xattrs - is encrypted with the
+// directory key.
+type dirKey struct {
+	contentEnc    *contentenc.ContentEnc
+	nameTransform *nametransform.NameTransform
+}
+
+// masterKey returns the helpers for everything outside of locked
+// directories.
+func (fs *FS) masterKey() dirKey {
+	return dirKey{contentEnc: fs.contentEnc, nameTransform: fs.nameTransform}
+}
+
+// AddDirKey makes the directories locked with "keyID" accessible, using "ce"
+// for content encryption and "e" for name encryption. Must be called before
+// the filesystem is mounted.
+func (fs *FS) AddDirKey(keyID []byte, ce *contentenc.ContentEnc, e *eme.EMECipher) {
+	if fs.dirKeys == nil {
+		fs.dirKeys = make(map[string]dirKey)
+	}
+	fs.dirKeys[string(keyID)] = dirKey{
+		contentEnc:    ce,
+		nameTransform: fs.nameTransform.WithCipher(e),
+	}
+}
+
+// lockedDirsMax is the number of entries after which the lockedDirCache is
+// cleared, to bound its memory usage.
+const lockedDirsMax = 1000
+
+// lockedDirCache remembers which ciphertext directories are locked. A
+// directory that is not locked is stored with a nil KeyID.
+type lockedDirCache struct {
+	sync.Mutex
+	m map[string][]byte
+}
+
+// ClearDirCaches drops the cached directory IVs and key domains. Called after
+// directories have been created, deleted, moved or locked.
+func (fs *FS) ClearDirCaches() {
+	fs.nameTransform.DirIVCache.Clear()
+	fs.lockedDirs.Lock()
+	fs.lockedDirs.m = nil
+	fs.lockedDirs.Unlock()
+}
+
+// lockedDir returns the KeyID if "cPath" (relative ciphertext path) is a
+// locked directory, and nil otherwise.
+func (fs *FS) lockedDir(cPath string) ([]byte, error) {
+	fs.lockedDirs.Lock()
+	keyID, ok := fs.lockedDirs.m[cPath]
+	fs.lockedDirs.Unlock()
+	if ok {
+		return keyID, nil
+	}
+	cAbsPath := filepath.Join(fs.args.Cipherdir, cPath)
+	var st syscall.Stat_t
+	if err := syscall.Lstat(cAbsPath, &st); err != nil {
+		// Does not exist (yet), so it cannot be locked. Don't cache this.
+		return nil, nil
+	}
+	if st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		slot, err := configfile.LoadDirKey(cAbsPath)
+		if err == nil {
+			keyID = slot.KeyID
+		} else if !os.IsNotExist(err) {
+			tlog.Warn.Printf("lockedDir %q: %v", cPath, err)
+			return nil, syscall.EIO
+		}
+	}
+	fs.lockedDirs.Lock()
+	if fs.lockedDirs.m == nil || len(fs.lockedDirs.m) >= lockedDirsMax {
+		fs.lockedDirs.m = make(map[string][]byte)
+	}
+	fs.lockedDirs.m[cPath] = keyID
+	fs.lockedDirs.Unlock()
+	return keyID, nil
+}
+
+// keyDomain returns the KeyID of the innermost locked directory that
+// contains "cPath" (relative ciphertext path), or nil if "cPath" is not
+// inside a locked directory. A locked directory contains itself.
+func (fs *FS) keyDomain(cPath string) ([]byte, error) {
+	if !fs.args.DirKeys {
+		return nil, nil
+	}
+	for {
+		keyID, err := fs.lockedDir(cPath)
+		if err != nil || keyID != nil {
+			return keyID, err
+		}
+		if cPath == "" {
+			return nil, nil
+		}
+		cPath = nametransform.Dir(cPath)
+	}
+}
+
+// keysFor returns the key domain of "cPath" (relative ciphertext path).
+// The contents of locked directories that have not been unlocked cannot be
+// accessed and get EACCES.
+func (fs *FS) keysFor(cPath string) (dirKey, error) {
+	keyID, err := fs.keyDomain(cPath)
+	if err != nil {
+		return dirKey{}, err
+	}
+	if keyID == nil {
+		return fs.masterKey(), nil
+	}
+	k, ok := fs.dirKeys[string(keyID)]
+	if !ok {
+		tlog.Debug.Printf("keysFor %q: directory is locked", cPath)
+		return dirKey{}, syscall.EACCES
+	}
+	return k, nil
+}
+
+// keysForPath is like keysFor, but takes a relative plaintext path.
+func (fs *FS) keysForPath(path string) (dirKey, fuse.Status) {
+	cPath, err := fs.encryptPath(path)
+	if err != nil {
+		return dirKey{}, fuse.ToStatus(err)
+	}
+	k, err := fs.keysFor(cPath)
+	return k, fuse.ToStatus(err)
+}
+
+// nameTransformFor implements nametransform.NameTransform.ForDir.
+func (fs *FS) nameTransformFor(cDir string) (*nametransform.NameTransform, error) {
+	k, err := fs.keysFor(cDir)
+	if err != nil {
+		return nil, err
+	}
+	return k.nameTransform, nil
+}
+
+// contentEncFor returns the content encryption helper for file "path".
+func (fs *FS) contentEncFor(path string) (*contentenc.ContentEnc, fuse.Status) {
+	k, status := fs.keysForPath(nametransform.Dir(path))
+	return k.contentEnc, status
+}
+
+// writeLongName creates the ".name" file for the long name "cName" of "path"
+// in "dirfd", encrypting the name with the key of the directory.
+func (fs *FS) writeLongName(dirfd int, cName string, path string) error {
+	cDir, err := fs.encryptPath(nametransform.Dir(path))
+	if err != nil {
+		return err
+	}
+	k, err := fs.keysFor(cDir)
+	if err != nil {
+		return err
+	}
+	return k.nameTransform.WriteLongName(dirfd, cName, path)
+}
+
+// checkKeyDomains returns EXDEV if moving or linking "oldPath" to "newPath"
+// would move a file into a different key domain, where its name and content
+// could no longer be decrypted. "mv" falls back to copying in this case, which
+// re-encrypts the file with the right key. Locked directories themselves
+// take their key domain with them and can be moved freely.
+func (fs *FS) checkKeyDomains(oldPath string, newPath string) fuse.Status {
+	if !fs.args.DirKeys {
+		return fuse.OK
+	}
+	cPath, err := fs.encryptPath(oldPath)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	if keyID, err := fs.lockedDir(cPath); err != nil {
+		return fuse.ToStatus(err)
+	} else if keyID != nil {
+		return fuse.OK
+	}
+	oldDomain, err := fs.keyDomain(nametransform.Dir(cPath))
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	cNewDir, err := fs.encryptPath(nametransform.Dir(newPath))
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	newDomain, err := fs.keyDomain(cNewDir)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	if !bytes.Equal(oldDomain, newDomain) {
+		return fuse.Status(syscall.EXDEV)
+	}
+	return fuse.OK
+}
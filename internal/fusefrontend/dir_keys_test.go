@@ -0,0 +1,98 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// TestLockedDirNames checks that names and symlink targets inside a locked
+// directory are encrypted with the directory key, not the master key, and
+// that the directory cannot be used before it is unlocked.
+func TestLockedDirNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestLockedDirNames")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = nametransform.WriteDirIV(-1, dir); err != nil {
+		t.Fatal(err)
+	}
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	fs.args.DirKeys = true
+	fs.nameTransform.ForDir = fs.nameTransformFor
+	if status := fs.Mkdir("private", 0700, nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	cDir, err := fs.encryptPath("private")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cAbsDir := filepath.Join(dir, cDir)
+	if err = configfile.CreateDirKey(cAbsDir, []byte("secret"), 10); err != nil {
+		t.Fatal(err)
+	}
+	fs.ClearDirCaches()
+	// Locked, not unlocked
+	if _, status := fs.Create("private/file", syscall.O_WRONLY, 0600, nil); status != fuse.EACCES {
+		t.Errorf("Create: want EACCES, got %v", status)
+	}
+	if _, status := fs.OpenDir("private", nil); status != fuse.EACCES {
+		t.Errorf("OpenDir: want EACCES, got %v", status)
+	}
+	// Unlock
+	slot, err := configfile.LoadDirKey(cAbsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := slot.DecryptKey([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cCore := cryptocore.New(key, cryptocore.BackendGoGCM, contentenc.DefaultIVBits, true, false)
+	fs.AddDirKey(slot.KeyID, contentenc.New(cCore, contentenc.DefaultBS, false), cCore.EMECipher)
+	f, status := fs.Create("private/file", syscall.O_WRONLY, 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+	if status = fs.Symlink("target", "private/link", nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	entries, status := fs.OpenDir("private", nil)
+	if !status.Ok() || len(entries) != 2 {
+		t.Fatalf("OpenDir: %v %v", entries, status)
+	}
+	if target, status := fs.Readlink("private/link", nil); target != "target" {
+		t.Errorf("Readlink: %q %v", target, status)
+	}
+	// The master key can decrypt neither the names nor the symlink target
+	iv, err := nametransform.ReadDirIV(cAbsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cPath, err := fs.encryptPath("private/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, err := fs.masterKey().nameTransform.DecryptName(filepath.Base(cPath), iv); err == nil && name == "link" {
+		t.Errorf("name is encrypted with the master key")
+	}
+	cTarget, err := os.Readlink(filepath.Join(dir, cPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.masterKey().decryptSymlinkTarget(cTarget); err == nil {
+		t.Errorf("symlink target is encrypted with the master key")
+	}
+}
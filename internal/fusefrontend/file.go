@@ -9,9 +9,12 @@ import (
 	"log"
 	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"golang.org/x/sys/unix"
+
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 
@@ -40,6 +43,12 @@ type File struct {
 	fdLock sync.RWMutex
 	// Content encryption helper
 	contentEnc *contentenc.ContentEnc
+	// plain is set if the content is stored unencrypted or with XTS, see
+	// isPlainContent()
+	plain bool
+	// dropCache is set if the file was opened with O_DIRECT and
+	// "-odirect-dontneed" is active
+	dropCache bool
 	// Device and inode number uniquely identify the backing file
 	qIno openfiletable.QIno
 	// Entry in the open file table
@@ -53,6 +62,25 @@ type File struct {
 	lastOpCount uint64
 	// Parent filesystem
 	fs *FS
+	// Plaintext path the file was opened as, and if it was opened for writing.
+	// Used by openPathTable.
+	openPath     string
+	openForWrite bool
+	// "-burn-after-reading": burn is set if the file is marked with
+	// BurnXattr. burnReadUpTo is the end of the contiguous range that has
+	// been read starting at offset zero.
+	burn         bool
+	burnReadUpTo int64
+	burnLock     sync.Mutex
+	// internal is set for files opened by OpenInternal. Reads do not
+	// update the atime.
+	internal bool
+	// written records the blocks written through this handle, for
+	// "-write-verify". Protected by fileTableEntry.ContentLock.
+	written blockRanges
+	// dirty is set to 1 when the file has been modified and reset by
+	// flushDirty ("-flush-interval"). Accessed atomically.
+	dirty uint32
 	// We embed a nodefs.NewDefaultFile() that returns ENOSYS for every operation we
 	// have not implemented. This prevents build breakage when the go-fuse library
 	// adds new methods to the nodefs.File interface.
@@ -95,7 +123,7 @@ func (f *File) readFileID() ([]byte, error) {
 	// This makes File ID poisoning more difficult.
 	readLen := contentenc.HeaderLen + 1
 	buf := make([]byte, readLen)
-	n, err := f.fd.ReadAt(buf, 0)
+	n, err := syscallcompat.ReadAtRetry(f.fd, buf, 0, f.fs.args.IORetries)
 	if err != nil {
 		if err == io.EOF && n != 0 {
 			tlog.Warn.Printf("readFileID %d: incomplete file, got %d instead of %d bytes",
@@ -129,7 +157,7 @@ func (f *File) createHeader() (fileID []byte, err error) {
 		}
 	}
 	// Actually write header
-	_, err = f.fd.WriteAt(buf, 0)
+	_, err = syscallcompat.WriteAtRetry(f.fd, buf, 0, f.fs.args.IORetries)
 	if err != nil {
 		return nil, err
 	}
@@ -162,8 +190,16 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, fuse.Statu
 				// Empty file
 				return nil, fuse.OK
 			}
+			if _, ok := err.(*contentenc.UnsupportedVersionError); ok {
+				tlog.Warn.Printf("doRead %d: %v", f.qIno.Ino, err)
+				return nil, fuse.Status(syscall.EOPNOTSUPP)
+			}
 			if err != nil {
-				tlog.Warn.Printf("doRead %d: corrupt header: %v", f.qIno.Ino, err)
+				if f.fs.args.Recovery {
+					tlog.Warn.Printf("-recovery: %q: corrupt header, the file content cannot be recovered: %v", f.openPath, err)
+				} else {
+					tlog.Warn.Printf("doRead %d: corrupt header: %v", f.qIno.Ino, err)
+				}
 				return nil, fuse.EIO
 			}
 		}
@@ -183,10 +219,10 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, fuse.Statu
 
 	ciphertext := f.fs.contentEnc.CReqPool.Get()
 	ciphertext = ciphertext[:int(alignedLength)]
-	n, err := f.fd.ReadAt(ciphertext, int64(alignedOffset))
+	n, err := syscallcompat.ReadAtRetry(f.fd, ciphertext, int64(alignedOffset), f.fs.args.IORetries)
 	if err != nil && err != io.EOF {
 		tlog.Warn.Printf("read: ReadAt: %s", err.Error())
-		return nil, fuse.ToStatus(err)
+		return nil, fuse.ToStatus(f.fs.checkBackingErr(err))
 	}
 	// The ReadAt came back empty. We can skip all the decryption and return early.
 	if n == 0 {
@@ -201,6 +237,16 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, fuse.Statu
 
 	// Decrypt it
 	plaintext, err := f.contentEnc.DecryptBlocks(ciphertext, firstBlockNo, fileID)
+	if err != nil && f.fs.args.Recovery {
+		f.fs.contentEnc.PReqPool.Put(plaintext)
+		plaintext = f.contentEnc.DecryptBlocksZeroFill(ciphertext, firstBlockNo, fileID,
+			func(blockNo uint64, err error) {
+				tlog.Warn.Printf("-recovery: %q: block #%d (plaintext offset %d) failed to decrypt: %v. Returning zeros.",
+					f.openPath, blockNo, f.contentEnc.BlockNoToPlainOff(blockNo), err)
+				f.fs.reportMitigatedCorruption(fmt.Sprint(f.qIno.Ino))
+			})
+		err = nil
+	}
 	f.fs.contentEnc.CReqPool.Put(ciphertext)
 	if err != nil {
 		if f.fs.args.ForceDecode && err == stupidgcm.ErrAuth {
@@ -232,13 +278,23 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, fuse.Statu
 	return out, fuse.OK
 }
 
-// Read - FUSE call
+// Read - FUSE call.
+// Page faults on mmap()ed files also end up here: the kernel fills its page
+// cache with regular READ requests. This does not work for files opened with
+// FOPEN_DIRECT_IO ("-burn-after-reading"), where the kernel refuses mmap.
 func (f *File) Read(buf []byte, off int64) (resultData fuse.ReadResult, code fuse.Status) {
-	if len(buf) > fuse.MAX_KERNEL_WRITE {
+	if len(buf) > f.contentEnc.MaxReqSize() {
 		// This would crash us due to our fixed-size buffer pool
 		tlog.Warn.Printf("Read: rejecting oversized request with EMSGSIZE, len=%d", len(buf))
 		return nil, fuse.Status(syscall.EMSGSIZE)
 	}
+	if f.fs.backingLost() {
+		return nil, fuse.EIO
+	}
+	// Deferred first, so it runs after the locks have been released
+	defer f.fs.timingJitter()
+	// Wait before taking any locks so that other files are not held up
+	f.fs.readLimit.wait(len(buf))
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
@@ -249,7 +305,13 @@ func (f *File) Read(buf []byte, off int64) (resultData fuse.ReadResult, code fus
 	if f.fs.args.SerializeReads {
 		serialize_reads.Wait(off, len(buf))
 	}
-	out, status := f.doRead(buf[:0], uint64(off), uint64(len(buf)))
+	var out []byte
+	var status fuse.Status
+	if f.plain {
+		out, status = f.plainRead(buf, off)
+	} else {
+		out, status = f.doRead(buf[:0], uint64(off), uint64(len(buf)))
+	}
 	if f.fs.args.SerializeReads {
 		serialize_reads.Done()
 	}
@@ -257,9 +319,52 @@ func (f *File) Read(buf []byte, off int64) (resultData fuse.ReadResult, code fus
 		return nil, status
 	}
 	tlog.Debug.Printf("ino%d: Read: status %v, returning %d bytes", f.qIno.Ino, status, len(out))
+	if f.burn {
+		f.trackBurnRead(off, len(out), len(buf))
+	}
+	if f.fs.args.StrictAtime && !f.internal {
+		f.touchAtime()
+	}
+	if f.dropCache {
+		f.dropPageCache(uint64(off), uint64(len(out)))
+	}
 	return fuse.ReadResultData(out), status
 }
 
+// touchAtime sets the atime of the backing file to the current time, for
+// "-strict-atime". Without it, the backing filesystem decides if a read
+// updates the atime, and with the default "relatime" it usually does not.
+func (f *File) touchAtime() {
+	now := time.Now()
+	// A nil mtime leaves it alone (UTIME_OMIT)
+	status := f.loopbackFile.Utimens(&now, nil)
+	if !status.Ok() {
+		tlog.Debug.Printf("ino%d: touchAtime: %v", f.qIno.Ino, status)
+	}
+}
+
+// dropPageCache drops the backing pages of the plaintext range
+// [off, off+length) from the page cache, for "-odirect-dontneed". This
+// approximates the cache bypass of O_DIRECT, which we cannot pass on to the
+// backing file. Dirty pages are written back first, asynchronously.
+func (f *File) dropPageCache(off uint64, length uint64) {
+	if length == 0 {
+		// A zero length would mean "up to the end of the file"
+		return
+	}
+	cOff, cLen := off, length
+	if f.contentEnc.XTS() != nil {
+		cOff += contentenc.HeaderLen
+	} else if !f.plain {
+		blocks := f.contentEnc.ExplodePlainRange(off, length)
+		cOff, cLen = blocks[0].JointCiphertextRange(blocks)
+	}
+	err := syscallcompat.DropPageCache(f.intFd(), int64(cOff), int64(cLen))
+	if err != nil {
+		tlog.Debug.Printf("ino%d: dropPageCache: %v", f.qIno.Ino, err)
+	}
+}
+
 // doWrite - encrypt "data" and write it to plaintext offset "off"
 //
 // Arguments do not have to be block-aligned, read-modify-write is
@@ -286,6 +391,10 @@ func (f *File) doWrite(data []byte, off int64) (uint32, fuse.Status) {
 			fileID, err = f.createHeader()
 			fileWasEmpty = true
 		}
+		if _, ok := err.(*contentenc.UnsupportedVersionError); ok {
+			tlog.Warn.Printf("doWrite %d: %v", f.qIno.Ino, err)
+			return 0, fuse.Status(syscall.EOPNOTSUPP)
+		}
 		if err != nil {
 			return 0, fuse.ToStatus(err)
 		}
@@ -294,6 +403,7 @@ func (f *File) doWrite(data []byte, off int64) (uint32, fuse.Status) {
 	// Handle payload data
 	dataBuf := bytes.NewBuffer(data)
 	blocks := f.contentEnc.ExplodePlainRange(uint64(off), uint64(len(data)))
+	f.contentEnc.CountNonces(len(blocks))
 	toEncrypt := make([][]byte, len(blocks))
 	for i, b := range blocks {
 		blockData := dataBuf.Next(int(b.Length))
@@ -338,13 +448,16 @@ func (f *File) doWrite(data []byte, off int64) (uint32, fuse.Status) {
 		}
 	}
 	// Write
-	_, err = f.fd.WriteAt(ciphertext, cOff)
+	_, err = syscallcompat.WriteAtRetry(f.fd, ciphertext, cOff, f.fs.args.IORetries)
 	// Return memory to CReqPool
 	f.fs.contentEnc.CReqPool.Put(ciphertext)
 	if err != nil {
 		tlog.Warn.Printf("ino%d fh%d: doWrite: WriteAt off=%d len=%d failed: %v",
 			f.qIno.Ino, f.intFd(), cOff, len(ciphertext), err)
-		return 0, fuse.ToStatus(err)
+		return 0, fuse.ToStatus(f.fs.checkBackingErr(err))
+	}
+	if f.fs.args.WriteVerify {
+		f.written.add(blocks[0].BlockNo, uint64(len(blocks)))
 	}
 	return uint32(len(data)), fuse.OK
 }
@@ -363,11 +476,16 @@ func (f *File) isConsecutiveWrite(off int64) bool {
 //
 // If the write creates a hole, pads the file to the next block boundary.
 func (f *File) Write(data []byte, off int64) (uint32, fuse.Status) {
-	if len(data) > fuse.MAX_KERNEL_WRITE {
+	if len(data) > f.contentEnc.MaxReqSize() {
 		// This would crash us due to our fixed-size buffer pool
 		tlog.Warn.Printf("Write: rejecting oversized request with EMSGSIZE, len=%d", len(data))
 		return 0, fuse.Status(syscall.EMSGSIZE)
 	}
+	if f.fs.backingLost() {
+		return 0, fuse.EIO
+	}
+	defer f.fs.timingJitter()
+	f.fs.writeLimit.wait(len(data))
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 	if f.released {
@@ -377,20 +495,36 @@ func (f *File) Write(data []byte, off int64) (uint32, fuse.Status) {
 	}
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
+	defer f.fs.attrCache.invalidate()
+	defer f.fs.hashCache.invalidate(f.qIno)
+	defer f.fs.genTable.modified(f.qIno)
 	tlog.Debug.Printf("ino%d: FUSE Write: offset=%d length=%d", f.qIno.Ino, off, len(data))
-	// If the write creates a file hole, we have to zero-pad the last block.
-	// But if the write directly follows an earlier write, it cannot create a
-	// hole, and we can save one Stat() call.
-	if !f.isConsecutiveWrite(off) {
-		status := f.writePadHole(off)
-		if !status.Ok() {
-			return 0, status
+	if f.exceedsMaxFileSize(uint64(off) + uint64(len(data))) {
+		return 0, fuse.Status(syscall.EFBIG)
+	}
+	var n uint32
+	var status fuse.Status
+	if f.plain {
+		n, status = f.plainWrite(data, off)
+	} else {
+		// If the write creates a file hole, we have to zero-pad the last block.
+		// But if the write directly follows an earlier write, it cannot create a
+		// hole, and we can save one Stat() call.
+		if !f.isConsecutiveWrite(off) {
+			status = f.writePadHole(off)
+			if !status.Ok() {
+				return 0, status
+			}
 		}
+		n, status = f.doWrite(data, off)
 	}
-	n, status := f.doWrite(data, off)
 	if status.Ok() {
 		f.lastOpCount = openfiletable.WriteOpCount()
 		f.lastWrittenOffset = off + int64(len(data)) - 1
+		atomic.StoreUint32(&f.dirty, 1)
+		if f.dropCache {
+			f.dropPageCache(uint64(off), uint64(n))
+		}
 	}
 	return n, status
 }
@@ -401,11 +535,19 @@ func (f *File) Release() {
 	if f.released {
 		log.Panicf("ino%d fh%d: double release", f.qIno.Ino, f.intFd())
 	}
+	if f.fs.args.WriteVerify {
+		f.verifyWrites()
+	}
 	f.fd.Close()
 	f.released = true
 	f.fdLock.Unlock()
 
-	openfiletable.Unregister(f.qIno)
+	last := openfiletable.Unregister(f.qIno)
+	f.fs.openPaths.unregister(f)
+	// "-burn-after-reading": delete the file once all handles are closed
+	if last && atomic.LoadUint32(&f.fileTableEntry.Burn) == 1 {
+		f.fs.burnFile(f.openPath, f.qIno)
+	}
 }
 
 // Flush - FUSE call
@@ -422,19 +564,58 @@ func (f *File) Flush() fuse.Status {
 		return fuse.ToStatus(err)
 	}
 	err = syscall.Close(newFd)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	// "-xattr-sync": the xattrs have been changed while the file was open.
+	// They live in the inode, which the fsync writes out as well.
+	doSync := f.fs.args.XattrSync && atomic.SwapUint32(&f.fileTableEntry.XattrDirty, 0) == 1
+	if !doSync && f.fs.args.FlushOnClose {
+		// "-flush-on-close": make the data durable before close() returns.
+		// Files opened read-only have nothing to flush.
+		flags, err := unix.FcntlInt(f.fd.Fd(), unix.F_GETFL, 0)
+		if err != nil {
+			return fuse.ToStatus(err)
+		}
+		doSync = flags&syscall.O_ACCMODE != syscall.O_RDONLY
+	}
+	if !doSync {
+		return fuse.OK
+	}
+	err = syncBackingFd(int(f.fd.Fd()), false)
+	if err != nil {
+		tlog.Warn.Printf("ino%d fh%d: Flush: fsync failed: %v", f.qIno.Ino, f.intFd(), err)
+	}
 	return fuse.ToStatus(err)
 }
 
+// FUSE_FSYNC_FDATASYNC is set in the flags of an fsync request when only
+// the data has to be synced, like with fdatasync(2)
+const FUSE_FSYNC_FDATASYNC = 0x01
+
+// syncBackingFd is a variable so that tests can check which call is used
+var syncBackingFd = func(fd int, datasync bool) error {
+	if datasync {
+		return syscallcompat.Fdatasync(fd)
+	}
+	return syscall.Fsync(fd)
+}
+
 // Fsync FUSE call
 func (f *File) Fsync(flags int) (code fuse.Status) {
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
-	return fuse.ToStatus(syscall.Fsync(int(f.fd.Fd())))
+	return fuse.ToStatus(syncBackingFd(f.intFd(), flags&FUSE_FSYNC_FDATASYNC != 0))
 }
 
 // Chmod FUSE call
 func (f *File) Chmod(mode uint32) fuse.Status {
+	if f.fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	defer f.fs.attrCache.invalidate()
+	defer f.fs.genTable.modified(f.qIno)
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
@@ -446,6 +627,11 @@ func (f *File) Chmod(mode uint32) fuse.Status {
 
 // Chown FUSE call
 func (f *File) Chown(uid uint32, gid uint32) fuse.Status {
+	if f.fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	defer f.fs.attrCache.invalidate()
+	defer f.fs.genTable.modified(f.qIno)
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
@@ -464,7 +650,7 @@ func (f *File) GetAttr(a *fuse.Attr) fuse.Status {
 		return fuse.ToStatus(err)
 	}
 	a.FromStat(&st)
-	a.Size = f.contentEnc.CipherSizeToPlainSize(a.Size)
+	a.Size = f.plainSize(a.Size)
 	if f.fs.args.ForceOwner != nil {
 		a.Owner = *f.fs.args.ForceOwner
 	}
@@ -474,6 +660,11 @@ func (f *File) GetAttr(a *fuse.Attr) fuse.Status {
 
 // Utimens FUSE call
 func (f *File) Utimens(a *time.Time, m *time.Time) fuse.Status {
+	if f.fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	defer f.fs.attrCache.invalidate()
+	defer f.fs.genTable.modified(f.qIno)
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 	return f.loopbackFile.Utimens(a, m)
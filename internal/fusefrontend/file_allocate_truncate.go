@@ -6,6 +6,7 @@ package fusefrontend
 import (
 	"log"
 	"sync"
+	"sync/atomic"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/fuse"
@@ -52,6 +53,16 @@ func (f *File) Allocate(off uint64, sz uint64, mode uint32) fuse.Status {
 	}
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
+	defer f.fs.attrCache.invalidate()
+	defer f.fs.hashCache.invalidate(f.qIno)
+	defer f.fs.genTable.modified(f.qIno)
+	if mode == FALLOC_DEFAULT && f.exceedsMaxFileSize(off+sz) {
+		return fuse.Status(syscall.EFBIG)
+	}
+	atomic.StoreUint32(&f.dirty, 1)
+	if f.plain {
+		return f.plainAllocate(off, sz, mode)
+	}
 
 	blocks := f.contentEnc.ExplodePlainRange(off, sz)
 	firstBlock := blocks[0]
@@ -102,6 +113,18 @@ func (f *File) Truncate(newSize uint64) fuse.Status {
 	}
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
+	defer f.fs.attrCache.invalidate()
+	defer f.fs.hashCache.invalidate(f.qIno)
+	defer f.fs.genTable.modified(f.qIno)
+	if f.exceedsMaxFileSize(newSize) {
+		return fuse.Status(syscall.EFBIG)
+	}
+	// A failed truncate may still have modified the file, so always mark
+	// it dirty.
+	atomic.StoreUint32(&f.dirty, 1)
+	if f.plain {
+		return f.plainTruncate(newSize)
+	}
 	var err error
 	// Common case first: Truncate to zero
 	if newSize == 0 {
@@ -169,14 +192,29 @@ func (f *File) statPlainSize() (uint64, error) {
 		tlog.Warn.Printf("ino%d fh%d: statPlainSize: %v", f.qIno.Ino, f.intFd(), err)
 		return 0, err
 	}
-	cipherSz := uint64(fi.Size())
-	plainSz := uint64(f.contentEnc.CipherSizeToPlainSize(cipherSz))
-	return plainSz, nil
+	return f.plainSize(uint64(fi.Size())), nil
+}
+
+// exceedsMaxFileSize returns true if growing the file to "newSize" bytes
+// would take it past the "-max-file-size" limit. Files that are already
+// larger than the limit can still be read and modified below their current
+// size, they just cannot grow any further.
+func (f *File) exceedsMaxFileSize(newSize uint64) bool {
+	limit := f.fs.args.MaxFileSize
+	if limit == 0 || newSize <= limit {
+		return false
+	}
+	oldSize, err := f.statPlainSize()
+	if err != nil {
+		return true
+	}
+	return newSize > oldSize
 }
 
 // truncateGrowFile extends a file using seeking or ftruncate performing RMW on
 // the first and last block as necessary. New blocks in the middle become
-// file holes unless they have been fallocate()'d beforehand.
+// file holes unless they have been fallocate()'d beforehand, or
+// "-no-write-holes" is set.
 func (f *File) truncateGrowFile(oldPlainSz uint64, newPlainSz uint64) fuse.Status {
 	if newPlainSz <= oldPlainSz {
 		log.Panicf("BUG: newSize=%d <= oldSize=%d", newPlainSz, oldPlainSz)
@@ -202,6 +240,9 @@ func (f *File) truncateGrowFile(oldPlainSz uint64, newPlainSz uint64) fuse.Statu
 	if !status.Ok() {
 		return status
 	}
+	if f.fs.args.NoWriteHoles {
+		return f.fillHole(oldPlainSz, newPlainSz)
+	}
 	// The new size is block-aligned. In this case we can do everything ourselves
 	// and avoid the call to doWrite.
 	if newPlainSz%f.contentEnc.PlainBS() == 0 {
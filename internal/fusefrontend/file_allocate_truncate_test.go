@@ -0,0 +1,77 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// TestMaxFileSize checks that Write and Truncate fail with EFBIG when they
+// would grow a file past Args.MaxFileSize, and that a file that is already
+// larger stays usable.
+func TestMaxFileSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestMaxFileSize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	fs.args.PlaintextNames = true
+	// Create a 10000 byte file without a limit
+	f, status := fs.Create("big", syscall.O_RDWR, 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, status = f.Write(make([]byte, 10000), 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+
+	fs.args.MaxFileSize = 5000
+	efbig := fuse.Status(syscall.EFBIG)
+	f, status = fs.Create("small", syscall.O_RDWR, 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	if _, status = f.Write(make([]byte, 5000), 0); !status.Ok() {
+		t.Errorf("write up to the limit: %v", status)
+	}
+	if _, status = f.Write([]byte{1}, 5000); status != efbig {
+		t.Errorf("write past the limit: want EFBIG, got %v", status)
+	}
+	if status = f.Truncate(5001); status != efbig {
+		t.Errorf("truncate past the limit: want EFBIG, got %v", status)
+	}
+	if status = f.Truncate(100); !status.Ok() {
+		t.Errorf("shrinking: %v", status)
+	}
+
+	// The old file can be read, overwritten and shrunk, but not grown
+	f2, status := fs.Open("big", syscall.O_RDWR, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f2.Release()
+	buf := make([]byte, 10000)
+	res, status := f2.Read(buf, 0)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if data, _ := res.Bytes(buf); len(data) != 10000 {
+		t.Errorf("read: want 10000 bytes, got %d", len(data))
+	}
+	if _, status = f2.Write([]byte{1}, 9000); !status.Ok() {
+		t.Errorf("overwrite below the current size: %v", status)
+	}
+	if _, status = f2.Write([]byte{1}, 10000); status != efbig {
+		t.Errorf("growing: want EFBIG, got %v", status)
+	}
+	if status = f2.Truncate(8000); !status.Ok() {
+		t.Errorf("shrinking: %v", status)
+	}
+}
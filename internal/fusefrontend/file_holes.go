@@ -38,6 +38,30 @@ func (f *File) writePadHole(targetOff int64) fuse.Status {
 	if status != fuse.OK {
 		return status
 	}
+	if f.fs.args.NoWriteHoles {
+		return f.fillHole(plainSize, f.contentEnc.BlockNoToPlainOff(targetBlock))
+	}
+	return fuse.OK
+}
+
+// fillHole writes authenticated zero blocks between the plaintext offsets
+// "from" and "to" instead of leaving a file hole, "-no-write-holes".
+// The last block before "from" must already be padded by zeroPad().
+func (f *File) fillHole(from uint64, to uint64) fuse.Status {
+	bs := f.contentEnc.PlainBS()
+	off := (from + bs - 1) / bs * bs
+	zeros := make([]byte, f.contentEnc.MaxReqSize())
+	tlog.Debug.Printf("ino%d: fillHole: writing %d zero bytes", f.qIno.Ino, to-off)
+	for off < to {
+		n := to - off
+		if n > uint64(len(zeros)) {
+			n = uint64(len(zeros))
+		}
+		if _, status := f.doWrite(zeros[:n], int64(off)); !status.Ok() {
+			return status
+		}
+		off += n
+	}
 	return fuse.OK
 }
 
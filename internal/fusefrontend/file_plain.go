@@ -0,0 +1,85 @@
+package fusefrontend
+
+// File operations for files whose content is stored unencrypted
+// ("PlaintextContent" feature flag). There is no header and there are no
+// blocks, so reads, writes and size changes go straight to the backing file.
+//
+// Files encrypted with AES-XTS ("XTS" feature flag) have no blocks either.
+// They take the same code paths, which hand off to the xts* functions in
+// file_xts.go.
+
+import (
+	"io"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// isPlainContent returns true if the content of the file at plaintext path
+// "path" is stored unencrypted or encrypted with XTS, so it has no blocks.
+func (fs *FS) isPlainContent(path string) bool {
+	return fs.args.PlaintextContent || fs.contentEnc.XTS() != nil
+}
+
+// plainSize converts the size of the backing file of "path" to the
+// plaintext size. Unencrypted files have no header, XTS files do.
+func (fs *FS) plainSize(path string, cipherSize uint64) uint64 {
+	if fs.args.PlaintextContent {
+		return cipherSize
+	}
+	return fs.contentEnc.CipherSizeToPlainSize(cipherSize)
+}
+
+// plainSize converts the size of the backing file to the plaintext size
+func (f *File) plainSize(cipherSize uint64) uint64 {
+	if f.plain && f.contentEnc.XTS() == nil {
+		return cipherSize
+	}
+	return f.contentEnc.CipherSizeToPlainSize(cipherSize)
+}
+
+// plainRead reads up to len(buf) bytes at offset "off" into "buf".
+func (f *File) plainRead(buf []byte, off int64) ([]byte, fuse.Status) {
+	if x := f.contentEnc.XTS(); x != nil {
+		return f.xtsRead(x, buf, off)
+	}
+	n, err := syscallcompat.ReadAtRetry(f.fd, buf, off, f.fs.args.IORetries)
+	if err != nil && err != io.EOF {
+		tlog.Warn.Printf("ino%d: plainRead: ReadAt: %v", f.qIno.Ino, err)
+		return nil, fuse.ToStatus(err)
+	}
+	return buf[:n], fuse.OK
+}
+
+// plainWrite writes "data" to offset "off".
+func (f *File) plainWrite(data []byte, off int64) (uint32, fuse.Status) {
+	if x := f.contentEnc.XTS(); x != nil {
+		return f.xtsWrite(x, data, off)
+	}
+	n, err := syscallcompat.WriteAtRetry(f.fd, data, off, f.fs.args.IORetries)
+	if err != nil {
+		tlog.Warn.Printf("ino%d fh%d: plainWrite: WriteAt off=%d len=%d failed: %v",
+			f.qIno.Ino, f.intFd(), off, len(data), err)
+		return uint32(n), fuse.ToStatus(err)
+	}
+	return uint32(n), fuse.OK
+}
+
+// plainTruncate sets the file size to "newSize".
+func (f *File) plainTruncate(newSize uint64) fuse.Status {
+	if x := f.contentEnc.XTS(); x != nil {
+		return f.xtsTruncate(x, newSize)
+	}
+	return fuse.ToStatus(syscall.Ftruncate(f.intFd(), int64(newSize)))
+}
+
+// plainAllocate calls fallocate(2) on the backing file.
+func (f *File) plainAllocate(off uint64, sz uint64, mode uint32) fuse.Status {
+	if x := f.contentEnc.XTS(); x != nil {
+		return f.xtsAllocate(x, off, sz, mode)
+	}
+	return fuse.ToStatus(syscallcompat.Fallocate(f.intFd(), mode, int64(off), int64(sz)))
+}
@@ -0,0 +1,77 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// TestPlaintextContent checks that with PlaintextContent, the name is
+// encrypted on disk, but the backing file contains exactly the plaintext.
+func TestPlaintextContent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestPlaintextContent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = nametransform.WriteDirIV(-1, dir); err != nil {
+		t.Fatal(err)
+	}
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	fs.args.PlaintextContent = true
+	f, status := fs.Create("hello.txt", syscall.O_RDWR, 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	content := bytes.Repeat([]byte("hello world\n"), 1000)
+	if _, status = f.Write(content, 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	// Writing past the end leaves a hole, like on any other filesystem
+	if _, status = f.Write([]byte("end"), 20000); !status.Ok() {
+		t.Fatal(status)
+	}
+	want := append(content, make([]byte, 20000-len(content))...)
+	want = append(want, "end"...)
+
+	cPath, err := fs.getBackingPath("hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(dir + "/hello.txt"); err == nil {
+		t.Error("the name is stored in plaintext")
+	}
+	backing, err := ioutil.ReadFile(cPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(backing, want) {
+		t.Errorf("backing file does not contain the plaintext: len=%d", len(backing))
+	}
+	buf := make([]byte, 100)
+	res, status := f.Read(buf, 20000-50)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if data, _ := res.Bytes(buf); !bytes.Equal(data, want[20000-50:]) {
+		t.Errorf("read: got %q", data)
+	}
+	var a fuse.Attr
+	if status = f.GetAttr(&a); !status.Ok() || a.Size != uint64(len(want)) {
+		t.Errorf("GetAttr: size %d %v", a.Size, status)
+	}
+	if status = f.Truncate(5); !status.Ok() {
+		t.Fatal(status)
+	}
+	if backing, _ = ioutil.ReadFile(cPath); string(backing) != "hello" {
+		t.Errorf("after truncate: %q", backing)
+	}
+}
@@ -0,0 +1,351 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+)
+
+// TestHeaderVersion reads and writes a file whose header has a content
+// format version from the future. Both must fail with EOPNOTSUPP.
+func TestHeaderVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestHeaderVersion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	fs.args.PlaintextNames = true
+	f, status := fs.Create("file", syscall.O_RDWR, 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, status = f.Write([]byte("hello"), 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+	// Bump the low byte of the big-endian version number
+	cFile, err := os.OpenFile(dir+"/file", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cFile.WriteAt([]byte{contentenc.CurrentVersion + 1}, 1); err != nil {
+		t.Fatal(err)
+	}
+	cFile.Close()
+
+	f, status = fs.Open("file", syscall.O_RDWR, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	eopnotsupp := fuse.Status(syscall.EOPNOTSUPP)
+	buf := make([]byte, 10)
+	if _, status = f.Read(buf, 0); status != eopnotsupp {
+		t.Errorf("Read: want EOPNOTSUPP, got %v", status)
+	}
+	if _, status = f.Write([]byte("x"), 0); status != eopnotsupp {
+		t.Errorf("Write: want EOPNOTSUPP, got %v", status)
+	}
+}
+
+// TestODirect opens a file with O_DIRECT. The flag must not reach the
+// backing file, and reads and writes must work as usual.
+func TestODirect(t *testing.T) {
+	if syscallcompat.O_DIRECT == 0 {
+		t.Skip("O_DIRECT is not supported on this platform")
+	}
+	dir, err := ioutil.TempDir("", "TestODirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	fs.args.PlaintextNames = true
+	fs.args.ODirectDontNeed = true
+	if fs.mangleOpenFlags(syscall.O_RDWR|syscallcompat.O_DIRECT)&syscallcompat.O_DIRECT != 0 {
+		t.Error("O_DIRECT was not stripped")
+	}
+	nf, status := fs.Create("file", syscall.O_RDWR|syscallcompat.O_DIRECT, 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer nf.Release()
+	f := nf.(*File)
+	if !f.dropCache {
+		t.Error("dropCache is not set")
+	}
+	// Unaligned on purpose
+	content := bytes.Repeat([]byte("direct"), 1000)
+	if _, status = f.Write(content, 123); !status.Ok() {
+		t.Fatal(status)
+	}
+	buf := make([]byte, len(content))
+	res, status := f.Read(buf, 123)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if data, _ := res.Bytes(buf); !bytes.Equal(data, content) {
+		t.Error("content mismatch")
+	}
+}
+
+// TestRecovery damages a file in different ways and checks that "-recovery"
+// returns zeros for exactly the damaged blocks.
+func TestRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestRecovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	fs.args.PlaintextNames = true
+	plainBS := int(fs.contentEnc.PlainBS())
+	content := bytes.Repeat([]byte("x"), 3*plainBS+100)
+	// write creates "name" with "content" and passes the backing file to
+	// "damage"
+	write := func(name string, damage func(cFile *os.File)) {
+		f, status := fs.Create(name, syscall.O_RDWR, 0600, nil)
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		if _, status = f.Write(content, 0); !status.Ok() {
+			t.Fatal(status)
+		}
+		f.Release()
+		cFile, err := os.OpenFile(dir+"/"+name, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		damage(cFile)
+		cFile.Close()
+	}
+	read := func(name string) ([]byte, fuse.Status) {
+		f, status := fs.Open(name, syscall.O_RDONLY, nil)
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		defer f.Release()
+		buf := make([]byte, len(content))
+		res, status := f.Read(buf, 0)
+		if !status.Ok() {
+			return nil, status
+		}
+		out, _ := res.Bytes(buf)
+		return out, status
+	}
+	flip := func(cFile *os.File, off int64) {
+		b := make([]byte, 1)
+		if _, err := cFile.ReadAt(b, off); err != nil {
+			t.Fatal(err)
+		}
+		b[0] ^= 0xff
+		if _, err := cFile.WriteAt(b, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cOff := func(blockNo uint64) int64 {
+		return int64(fs.contentEnc.BlockNoToCipherOff(blockNo))
+	}
+	zeroed := func(blocks ...int) []byte {
+		want := append([]byte{}, content...)
+		for _, b := range blocks {
+			end := (b + 1) * plainBS
+			if end > len(want) {
+				end = len(want)
+			}
+			copy(want[b*plainBS:end], make([]byte, plainBS))
+		}
+		return want
+	}
+
+	write("flipped", func(cFile *os.File) {
+		flip(cFile, cOff(1)+50)
+	})
+	write("nonce", func(cFile *os.File) {
+		// All-zero nonce in block #2
+		cFile.WriteAt(make([]byte, 16), cOff(2))
+	})
+	write("truncated", func(cFile *os.File) {
+		// Cut off the authentication tag of the last block
+		st, _ := cFile.Stat()
+		cFile.Truncate(st.Size() - 10)
+	})
+	write("header", func(cFile *os.File) {
+		// Damage the file ID, which is part of the authenticated data of
+		// every block
+		flip(cFile, 5)
+	})
+	// Without -recovery, all damaged files fail with EIO
+	for _, name := range []string{"flipped", "nonce", "truncated", "header"} {
+		if _, status := read(name); status != fuse.EIO {
+			t.Errorf("%s: want EIO, got %v", name, status)
+		}
+	}
+	fs.args.Recovery = true
+	testcases := []struct {
+		name string
+		want []byte
+	}{
+		{"flipped", zeroed(1)},
+		{"nonce", zeroed(2)},
+		{"truncated", append(content[:3*plainBS:3*plainBS], make([]byte, 90)...)},
+		{"header", make([]byte, len(content))},
+	}
+	for _, tc := range testcases {
+		out, status := read(tc.name)
+		if !status.Ok() {
+			t.Errorf("%s: %v", tc.name, status)
+			continue
+		}
+		if !bytes.Equal(out, tc.want) {
+			t.Errorf("%s: wrong content, len=%d", tc.name, len(out))
+		}
+	}
+}
+
+// Fsync must use fdatasync when the kernel sets FUSE_FSYNC_FDATASYNC
+func TestFsyncDatasync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestFsyncDatasync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	fs.args.PlaintextNames = true
+	f, status := fs.Create("foo", syscall.O_WRONLY, 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	orig := syncBackingFd
+	defer func() { syncBackingFd = orig }()
+	var calls []bool
+	syncBackingFd = func(fd int, datasync bool) error {
+		calls = append(calls, datasync)
+		return orig(fd, datasync)
+	}
+	if status = f.Fsync(0); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status = f.Fsync(FUSE_FSYNC_FDATASYNC); !status.Ok() {
+		t.Fatal(status)
+	}
+	if len(calls) != 2 || calls[0] || !calls[1] {
+		t.Errorf("wrong calls, want [false true], got %v", calls)
+	}
+}
+
+// With -flush-on-close, Flush must fsync files that are open for writing,
+// and only those
+func TestFlushOnClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestFlushOnClose")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	fs.args.PlaintextNames = true
+	f, status := fs.Create("foo", syscall.O_WRONLY, 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+	orig := syncBackingFd
+	defer func() { syncBackingFd = orig }()
+	calls := 0
+	syncBackingFd = func(fd int, datasync bool) error {
+		calls++
+		return orig(fd, datasync)
+	}
+	testCases := []struct {
+		flushOnClose bool
+		flags        uint32
+		wantCalls    int
+	}{
+		{true, syscall.O_WRONLY, 1},
+		{true, syscall.O_RDWR, 1},
+		{true, syscall.O_RDONLY, 0},
+		{false, syscall.O_WRONLY, 0},
+	}
+	for _, tc := range testCases {
+		fs.args.FlushOnClose = tc.flushOnClose
+		calls = 0
+		f, status := fs.Open("foo", tc.flags, nil)
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		if status = f.Flush(); !status.Ok() {
+			t.Errorf("%+v: Flush: %v", tc, status)
+		}
+		f.Release()
+		if calls != tc.wantCalls {
+			t.Errorf("%+v: want %d fsync calls, got %d", tc, tc.wantCalls, calls)
+		}
+	}
+}
+
+// With -no-write-holes, writes and truncates past the end of the file must
+// write encrypted zero blocks, and leave no all-zero (hole) ciphertext block.
+func TestNoWriteHoles(t *testing.T) {
+	for _, noHoles := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "TestNoWriteHoles")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		fs := newTestFS()
+		fs.args.Cipherdir = dir
+		fs.args.PlaintextNames = true
+		fs.args.NoWriteHoles = noHoles
+		f, status := fs.Create("foo", syscall.O_RDWR, 0600, nil)
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		defer f.Release()
+		if _, status = f.Write([]byte("foo"), 0); !status.Ok() {
+			t.Fatal(status)
+		}
+		if _, status = f.Write([]byte("bar"), 300000); !status.Ok() {
+			t.Fatal(status)
+		}
+		if status = f.Truncate(600000); !status.Ok() {
+			t.Fatal(status)
+		}
+		want := make([]byte, 600000)
+		copy(want, "foo")
+		copy(want[300000:], "bar")
+		if !bytes.Equal(readAll(t, f), want) {
+			t.Errorf("noHoles=%v: wrong content", noHoles)
+		}
+		ct, err := ioutil.ReadFile(dir + "/foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cbs := int(fs.contentEnc.CipherBS())
+		zeroBlock := make([]byte, cbs)
+		var holes int
+		for off := contentenc.HeaderLen; off+cbs <= len(ct); off += cbs {
+			if bytes.Equal(ct[off:off+cbs], zeroBlock) {
+				holes++
+			}
+		}
+		if noHoles && holes != 0 {
+			t.Errorf("found %d holes with -no-write-holes", holes)
+		} else if !noHoles && holes == 0 {
+			t.Errorf("no holes found without -no-write-holes")
+		}
+	}
+}
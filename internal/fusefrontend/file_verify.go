@@ -0,0 +1,126 @@
+package fusefrontend
+
+// "-write-verify": re-read and authenticate written blocks on close
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// blockRange is a run of "n" consecutive blocks starting at block "first"
+type blockRange struct {
+	first uint64
+	n     uint64
+}
+
+// blockRanges records which blocks have been written. Streaming writes
+// extend the last range, so a big file written sequentially costs one entry.
+type blockRanges []blockRange
+
+// add records that blocks [first, first+n) have been written
+func (r *blockRanges) add(first uint64, n uint64) {
+	if l := len(*r); l > 0 {
+		last := &(*r)[l-1]
+		if first >= last.first && first <= last.first+last.n {
+			if end := first + n; end > last.first+last.n {
+				last.n = end - last.first
+			}
+			return
+		}
+	}
+	*r = append(*r, blockRange{first, n})
+}
+
+// merged returns the ranges sorted and with overlaps merged
+func (r blockRanges) merged() blockRanges {
+	sorted := append(blockRanges(nil), r...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].first < sorted[j].first })
+	var out blockRanges
+	for _, b := range sorted {
+		out.add(b.first, b.n)
+	}
+	return out
+}
+
+// verifyWrites reads back the blocks written through this file handle and
+// checks their authentication tags. Failures are logged. Returns the number
+// of blocks that failed.
+// Called by Release() with fdLock held.
+func (f *File) verifyWrites() (bad int) {
+	if len(f.written) == 0 {
+		return 0
+	}
+	f.fileTableEntry.ContentLock.RLock()
+	defer f.fileTableEntry.ContentLock.RUnlock()
+	ranges := f.written.merged()
+	f.written = nil
+
+	fileID, err := f.readFileID()
+	if err == io.EOF {
+		// Truncated to zero in the meantime
+		return 0
+	} else if err != nil {
+		tlog.Warn.Printf("ino%d: -write-verify: cannot read header: %v", f.qIno.Ino, err)
+		return 1
+	}
+	// Make sure we read from the backing storage and not from the page cache
+	fd := f.intFd()
+	if err = syscall.Fsync(fd); err != nil {
+		tlog.Warn.Printf("ino%d: -write-verify: fsync failed: %v", f.qIno.Ino, err)
+	}
+	cBS := f.contentEnc.CipherBS()
+	for _, r := range ranges {
+		cOff := int64(f.contentEnc.BlockNoToCipherOff(r.first))
+		if err = syscallcompat.DropPageCache(fd, cOff, int64(r.n*cBS)); err != nil {
+			tlog.Debug.Printf("ino%d: -write-verify: DropPageCache: %v", f.qIno.Ino, err)
+		}
+	}
+	// Read in chunks of at most MaxReqSize plaintext bytes
+	chunkBlocks := uint64(f.contentEnc.MaxReqSize()) / f.contentEnc.PlainBS()
+	ciphertext := f.fs.contentEnc.CReqPool.Get()
+	defer f.fs.contentEnc.CReqPool.Put(ciphertext)
+	verified := 0
+	for _, r := range ranges {
+		for first := r.first; first < r.first+r.n; first += chunkBlocks {
+			n := r.first + r.n - first
+			if n > chunkBlocks {
+				n = chunkBlocks
+			}
+			cOff := int64(f.contentEnc.BlockNoToCipherOff(first))
+			buf := ciphertext[:n*cBS]
+			m, err := syscallcompat.ReadAtRetry(f.fd, buf, cOff, f.fs.args.IORetries)
+			if err != nil && err != io.EOF {
+				tlog.Warn.Printf("ino%d: -write-verify: read at %d failed: %v", f.qIno.Ino, cOff, err)
+				return bad + 1
+			}
+			buf = buf[:m]
+			for blockNo := first; len(buf) > 0; blockNo++ {
+				l := len(buf)
+				if uint64(l) > cBS {
+					l = int(cBS)
+				}
+				if _, err := f.contentEnc.DecryptBlock(buf[:l], blockNo, fileID); err != nil {
+					tlog.Warn.Printf("ino%d: -write-verify: block #%d failed verification: %v",
+						f.qIno.Ino, blockNo, err)
+					bad++
+				}
+				verified++
+				buf = buf[l:]
+			}
+			if uint64(m) < n*cBS {
+				// The file has been truncated, the rest of the blocks is gone
+				break
+			}
+		}
+	}
+	if bad > 0 {
+		f.fs.reportMitigatedCorruption(fmt.Sprint(f.qIno.Ino))
+	}
+	tlog.Debug.Printf("ino%d: -write-verify: %d blocks verified, %d bad", f.qIno.Ino, verified, bad)
+	return bad
+}
@@ -0,0 +1,79 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestBlockRanges(t *testing.T) {
+	var r blockRanges
+	r.add(0, 2)
+	r.add(2, 3) // extends the last range
+	r.add(1, 1) // already covered
+	r.add(10, 1)
+	r.add(3, 2)
+	want := blockRanges{{0, 5}, {10, 1}, {3, 2}}
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("add: want %v, got %v", want, r)
+	}
+	want = blockRanges{{0, 5}, {10, 1}}
+	if m := r.merged(); !reflect.DeepEqual(m, want) {
+		t.Errorf("merged: want %v, got %v", want, m)
+	}
+}
+
+// TestWriteVerify corrupts one of the written blocks in the backing file
+// and checks that verifyWrites finds exactly that one.
+func TestWriteVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestWriteVerify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	fs.args.PlaintextNames = true
+	fs.args.WriteVerify = true
+	nf, status := fs.Create("file", syscall.O_RDWR, 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer nf.Release()
+	f := nf.(*File)
+	plainBS := int(f.contentEnc.PlainBS())
+	if _, status = f.Write(bytes.Repeat([]byte("x"), 3*plainBS+100), 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	if bad := f.verifyWrites(); bad != 0 {
+		t.Fatalf("%d bad blocks in an intact file", bad)
+	}
+	// Nothing has been written since the last check
+	if len(f.written) != 0 {
+		t.Errorf("written list not reset: %v", f.written)
+	}
+	if _, status = f.Write([]byte("y"), int64(plainBS)); !status.Ok() {
+		t.Fatal(status)
+	}
+	cFile, err := os.OpenFile(dir+"/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flip a byte in block #1
+	cOff := int64(f.contentEnc.BlockNoToCipherOff(1)) + 50
+	b := make([]byte, 1)
+	if _, err = cFile.ReadAt(b, cOff); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err = cFile.WriteAt(b, cOff); err != nil {
+		t.Fatal(err)
+	}
+	cFile.Close()
+	if bad := f.verifyWrites(); bad != 1 {
+		t.Errorf("want 1 bad block, got %d", bad)
+	}
+}
@@ -0,0 +1,314 @@
+package fusefrontend
+
+// File operations for files encrypted with AES-XTS ("XTS" feature flag).
+// The backing file is the file header followed by the encrypted data, which
+// has the plaintext size. Writes re-encrypt the units they touch, see
+// contentenc/xts.go for the format.
+
+import (
+	"io"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+const (
+	xtsSS      = contentenc.XTSSectorSize
+	xtsMinUnit = contentenc.XTSMinUnit
+)
+
+// xtsState is the state of the backing file at the start of an operation
+type xtsState struct {
+	// size is the plaintext size
+	size int64
+	// xf is the cipher of a file that is at least xtsMinUnit bytes long
+	xf *contentenc.XTSFile
+	// tiny is the content of a file that is shorter
+	tiny []byte
+}
+
+// xtsLoad reads the size and the header of the file.
+func (f *File) xtsLoad(x *contentenc.XTS) (st xtsState, status fuse.Status) {
+	size, err := f.statPlainSize()
+	if err != nil {
+		return st, fuse.ToStatus(err)
+	}
+	st.size = int64(size)
+	if st.size == 0 {
+		return st, fuse.OK
+	}
+	readLen := contentenc.HeaderLen
+	if st.size < xtsMinUnit {
+		readLen += int(st.size)
+	}
+	buf := make([]byte, readLen)
+	_, err = syscallcompat.ReadAtRetry(f.fd, buf, 0, f.fs.args.IORetries)
+	if err == nil {
+		if st.size < xtsMinUnit {
+			st.tiny, err = x.DecryptTiny(buf)
+		} else {
+			var h *contentenc.FileHeader
+			h, err = contentenc.ParseHeader(buf)
+			if err == nil {
+				st.xf = x.File(h.ID)
+			}
+		}
+	}
+	if _, ok := err.(*contentenc.UnsupportedVersionError); ok {
+		tlog.Warn.Printf("ino%d: xtsLoad: %v", f.qIno.Ino, err)
+		return st, fuse.Status(syscall.EOPNOTSUPP)
+	} else if err != nil {
+		tlog.Warn.Printf("ino%d: xtsLoad: corrupt header: %v", f.qIno.Ino, err)
+		return st, fuse.EIO
+	}
+	return st, fuse.OK
+}
+
+// xtsReadPlain returns the plaintext in [from, to). The part after the end
+// of the file reads as zeros.
+func (f *File) xtsReadPlain(st *xtsState, from int64, to int64) ([]byte, fuse.Status) {
+	out := make([]byte, to-from)
+	if from >= st.size {
+		return out, fuse.OK
+	}
+	if to > st.size {
+		to = st.size
+	}
+	if st.xf == nil {
+		copy(out, st.tiny[from:to])
+		return out, fuse.OK
+	}
+	// Whole units have to be decrypted
+	start, _ := contentenc.XTSUnit(from, st.size)
+	_, end := contentenc.XTSUnit(to-1, st.size)
+	buf := make([]byte, end-start)
+	_, err := syscallcompat.ReadAtRetry(f.fd, buf, contentenc.HeaderLen+start, f.fs.args.IORetries)
+	if err != nil && err != io.EOF {
+		tlog.Warn.Printf("ino%d: xtsRead: ReadAt off=%d len=%d: %v", f.qIno.Ino, start, len(buf), err)
+		return nil, fuse.ToStatus(f.fs.checkBackingErr(err))
+	}
+	for u := start; u < end; {
+		_, uEnd := contentenc.XTSUnit(u, st.size)
+		unit := buf[u-start : uEnd-start]
+		st.xf.DecryptUnit(unit, unit, uint64(u/xtsSS))
+		u = uEnd
+	}
+	copy(out, buf[from-start:to-start])
+	return out, fuse.OK
+}
+
+// xtsRead reads up to len(buf) bytes at offset "off" into "buf".
+func (f *File) xtsRead(x *contentenc.XTS, buf []byte, off int64) ([]byte, fuse.Status) {
+	st, status := f.xtsLoad(x)
+	if !status.Ok() {
+		return nil, status
+	}
+	if off >= st.size {
+		return buf[:0], fuse.OK
+	}
+	end := off + int64(len(buf))
+	if end > st.size {
+		end = st.size
+	}
+	plain, status := f.xtsReadPlain(&st, off, end)
+	if !status.Ok() {
+		return nil, status
+	}
+	n := copy(buf, plain)
+	return buf[:n], fuse.OK
+}
+
+// xtsWriteAt writes "data" to the backing file at offset "off"
+func (f *File) xtsWriteAt(data []byte, off int64) fuse.Status {
+	_, err := syscallcompat.WriteAtRetry(f.fd, data, off, f.fs.args.IORetries)
+	if err != nil {
+		tlog.Warn.Printf("ino%d fh%d: xtsWrite: WriteAt off=%d len=%d failed: %v",
+			f.qIno.Ino, f.intFd(), off, len(data), err)
+		return fuse.ToStatus(f.fs.checkBackingErr(err))
+	}
+	return fuse.OK
+}
+
+// xtsRange is a plaintext range [start, end) made of whole units
+type xtsRange struct {
+	start, end int64
+	plain      []byte
+}
+
+// xtsWrite writes "data" to offset "off".
+//
+// A unit that is not a multiple of 16 bytes long is encrypted with
+// ciphertext stealing, so it depends on its length. When the file grows,
+// the old last unit is re-encrypted at its new length. The units between the
+// old end and "off" are left as holes.
+func (f *File) xtsWrite(x *contentenc.XTS, data []byte, off int64) (uint32, fuse.Status) {
+	st, status := f.xtsLoad(x)
+	if !status.Ok() {
+		return 0, status
+	}
+	end := off + int64(len(data))
+	newSize := st.size
+	if end > newSize {
+		newSize = end
+	}
+	if newSize < xtsMinUnit {
+		plain, status := f.xtsReadPlain(&st, 0, newSize)
+		if !status.Ok() {
+			return 0, status
+		}
+		copy(plain[off:], data)
+		if status = f.xtsWriteAt(x.EncryptTiny(plain), 0); !status.Ok() {
+			return 0, status
+		}
+		return uint32(len(data)), fuse.OK
+	}
+	// Find the ranges to re-encrypt in the layout of the new size
+	var ranges []xtsRange
+	if newSize != st.size && st.size > 0 {
+		var oldLast int64
+		if st.size >= xtsMinUnit {
+			oldLast, _ = contentenc.XTSUnit(st.size-1, st.size)
+		}
+		a, _ := contentenc.XTSUnit(oldLast, newSize)
+		_, b := contentenc.XTSUnit(st.size-1, newSize)
+		ranges = append(ranges, xtsRange{start: a, end: b})
+	}
+	a, _ := contentenc.XTSUnit(off, newSize)
+	_, b := contentenc.XTSUnit(end-1, newSize)
+	if len(ranges) > 0 && a <= ranges[0].end && ranges[0].start <= b {
+		if a < ranges[0].start {
+			ranges[0].start = a
+		}
+		if b > ranges[0].end {
+			ranges[0].end = b
+		}
+	} else {
+		ranges = append(ranges, xtsRange{start: a, end: b})
+	}
+	// Read everything before writing anything, as the layout of the old
+	// file is needed for decryption
+	for i := range ranges {
+		r := &ranges[i]
+		r.plain, status = f.xtsReadPlain(&st, r.start, r.end)
+		if !status.Ok() {
+			return 0, status
+		}
+		from, to := off, end
+		if from < r.start {
+			from = r.start
+		}
+		if to > r.end {
+			to = r.end
+		}
+		if from < to {
+			copy(r.plain[from-r.start:], data[from-off:to-off])
+		}
+	}
+	// An empty or tiny file gets a new header with the file ID in the clear
+	xf := st.xf
+	var header []byte
+	if xf == nil {
+		h := contentenc.RandomHeader()
+		xf = x.File(h.ID)
+		header = h.Pack()
+	}
+	for _, r := range ranges {
+		for u := r.start; u < r.end; {
+			_, uEnd := contentenc.XTSUnit(u, newSize)
+			unit := r.plain[u-r.start : uEnd-r.start]
+			xf.EncryptUnit(unit, unit, uint64(u/xtsSS))
+			u = uEnd
+		}
+		buf := r.plain
+		cOff := contentenc.HeaderLen + r.start
+		if header != nil && r.start == 0 {
+			// Replace the header of a tiny file in the same write
+			buf = append(header, buf...)
+			cOff = 0
+			header = nil
+		} else if header != nil {
+			// The file was empty
+			if status = f.xtsWriteAt(header, 0); !status.Ok() {
+				return 0, status
+			}
+			header = nil
+		}
+		if status = f.xtsWriteAt(buf, cOff); !status.Ok() {
+			return 0, status
+		}
+	}
+	return uint32(len(data)), fuse.OK
+}
+
+// xtsTruncate sets the file size to "newSize".
+//
+// When the file shrinks, the new last unit is written before the file is
+// cut, so a failed write leaves the file unchanged. Only the last 16 to 31
+// bytes of the unit change, the XTS blocks before do not depend on its
+// length.
+func (f *File) xtsTruncate(x *contentenc.XTS, newSize uint64) fuse.Status {
+	st, status := f.xtsLoad(x)
+	if !status.Ok() {
+		return status
+	}
+	size := int64(newSize)
+	if size == st.size {
+		return fuse.OK
+	}
+	if size > st.size {
+		// Let xtsWrite handle the old and the new last unit
+		_, status := f.xtsWrite(x, make([]byte, 1), size-1)
+		return status
+	}
+	if size > 0 {
+		var buf []byte
+		var cOff int64
+		if size < xtsMinUnit {
+			plain, status := f.xtsReadPlain(&st, 0, size)
+			if !status.Ok() {
+				return status
+			}
+			buf = x.EncryptTiny(plain)
+		} else {
+			start, _ := contentenc.XTSUnit(size-1, size)
+			plain, status := f.xtsReadPlain(&st, start, size)
+			if !status.Ok() {
+				return status
+			}
+			st.xf.EncryptUnit(plain, plain, uint64(start/xtsSS))
+			buf = plain
+			cOff = contentenc.HeaderLen + start
+		}
+		if status = f.xtsWriteAt(buf, cOff); !status.Ok() {
+			return status
+		}
+	}
+	cSize := int64(f.contentEnc.PlainSizeToCipherSize(newSize))
+	err := syscall.Ftruncate(f.intFd(), cSize)
+	if err != nil {
+		tlog.Warn.Printf("ino%d fh%d: xtsTruncate: Ftruncate returned error: %v", f.qIno.Ino, f.intFd(), err)
+		return fuse.ToStatus(err)
+	}
+	return fuse.OK
+}
+
+// xtsAllocate implements Allocate for mode=FALLOC_DEFAULT and
+// mode=FALLOC_FL_KEEP_SIZE.
+func (f *File) xtsAllocate(x *contentenc.XTS, off uint64, sz uint64, mode uint32) fuse.Status {
+	err := syscallcompat.Fallocate(f.intFd(), FALLOC_FL_KEEP_SIZE, int64(off)+contentenc.HeaderLen, int64(sz))
+	if err != nil || mode == FALLOC_FL_KEEP_SIZE {
+		return fuse.ToStatus(err)
+	}
+	oldSize, err := f.statPlainSize()
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	if off+sz <= oldSize {
+		return fuse.OK
+	}
+	return f.xtsTruncate(x, off+sz)
+}
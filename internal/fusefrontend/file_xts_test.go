@@ -0,0 +1,198 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+)
+
+func newTestFSXTS(t *testing.T) (*FS, string) {
+	dir, err := ioutil.TempDir("", "TestXTS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	fs.args.PlaintextNames = true
+	fs.contentEnc.EnableXTS(make([]byte, contentenc.XTSKeyLen))
+	return fs, dir
+}
+
+// readAll reads the whole file through "f"
+func readAll(t *testing.T, f nodefs.File) []byte {
+	var out []byte
+	buf := make([]byte, 128*1024)
+	for off := int64(0); ; {
+		res, status := f.Read(buf, off)
+		if !status.Ok() {
+			t.Fatalf("Read at %d: %v", off, status)
+		}
+		data, _ := res.Bytes(buf)
+		if len(data) == 0 {
+			return out
+		}
+		out = append(out, data...)
+		off += int64(len(data))
+	}
+}
+
+// Random overwrites, truncates and fallocates must give the same content as
+// on a plain in-memory copy, and the backing file must have the same size
+func TestXTSRandomOps(t *testing.T) {
+	fs, dir := newTestFSXTS(t)
+	defer os.RemoveAll(dir)
+	f, status := fs.Create("file", syscall.O_RDWR, 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	var model []byte
+	rng := rand.New(rand.NewSource(1))
+	const maxSize = 10 * contentenc.XTSSectorSize
+	for i := 0; i < 2000; i++ {
+		var desc string
+		switch op := rng.Intn(10); {
+		case op < 7:
+			off := rng.Intn(maxSize)
+			data := make([]byte, 1+rng.Intn(3*contentenc.XTSSectorSize))
+			rng.Read(data)
+			desc = "Write"
+			if _, status = f.Write(data, int64(off)); !status.Ok() {
+				t.Fatalf("#%d Write off=%d len=%d: %v", i, off, len(data), status)
+			}
+			if end := off + len(data); end > len(model) {
+				model = append(model, make([]byte, end-len(model))...)
+			}
+			copy(model[off:], data)
+		case op < 9:
+			sz := rng.Intn(maxSize)
+			if rng.Intn(2) == 0 {
+				// Stay close to the old size to hit the partial sectors
+				sz = len(model) + rng.Intn(40) - 20
+				if sz < 0 {
+					sz = 0
+				}
+			}
+			desc = "Truncate"
+			if status = f.Truncate(uint64(sz)); !status.Ok() {
+				t.Fatalf("#%d Truncate %d: %v", i, sz, status)
+			}
+			if sz > len(model) {
+				model = append(model, make([]byte, sz-len(model))...)
+			}
+			model = model[:sz]
+		default:
+			off := rng.Intn(maxSize)
+			sz := 1 + rng.Intn(contentenc.XTSSectorSize)
+			desc = "Allocate"
+			if status = f.Allocate(uint64(off), uint64(sz), FALLOC_DEFAULT); !status.Ok() {
+				t.Fatalf("#%d Allocate off=%d sz=%d: %v", i, off, sz, status)
+			}
+			if end := off + sz; end > len(model) {
+				model = append(model, make([]byte, end-len(model))...)
+			}
+		}
+		if got := readAll(t, f); !bytes.Equal(got, model) {
+			t.Fatalf("#%d %s: content mismatch, len %d, want %d", i, desc, len(got), len(model))
+		}
+		fi, err := os.Stat(dir + "/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := int64(fs.contentEnc.PlainSizeToCipherSize(uint64(len(model)))); fi.Size() != want {
+			t.Fatalf("#%d %s: backing size %d, want %d", i, desc, fi.Size(), want)
+		}
+	}
+	// The backing file is encrypted
+	c, err := ioutil.ReadFile(dir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(model) > 0 && bytes.Contains(c, model) {
+		t.Error("backing file is not encrypted")
+	}
+}
+
+// Unaligned reads return the right part of the file
+func TestXTSRead(t *testing.T) {
+	fs, dir := newTestFSXTS(t)
+	defer os.RemoveAll(dir)
+	f, status := fs.Create("file", syscall.O_RDWR, 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	data := make([]byte, 3*contentenc.XTSSectorSize+123)
+	rand.Read(data)
+	if _, status = f.Write(data, 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	for _, r := range [][2]int{{0, 1}, {4095, 2}, {5000, 10000}, {len(data) - 5, 100}, {len(data) + 1, 10}} {
+		buf := make([]byte, r[1])
+		res, status := f.Read(buf, int64(r[0]))
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		got, _ := res.Bytes(buf)
+		var want []byte
+		if r[0] < len(data) {
+			want = data[r[0]:]
+			if len(want) > r[1] {
+				want = want[:r[1]]
+			}
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Read off=%d len=%d: wrong data", r[0], r[1])
+		}
+	}
+	var a fuse.Attr
+	if status = f.GetAttr(&a); !status.Ok() || a.Size != uint64(len(data)) {
+		t.Errorf("GetAttr: size %d, %v", a.Size, status)
+	}
+}
+
+// The same content in two files must give different ciphertext, also for
+// files shorter than 16 bytes and for short tails
+func TestXTSTwoFiles(t *testing.T) {
+	fs, dir := newTestFSXTS(t)
+	defer os.RemoveAll(dir)
+	for _, l := range []int{5, 15, 16, 100, contentenc.XTSSectorSize + 7} {
+		data := make([]byte, l)
+		var ct [2][]byte
+		for i, name := range []string{"a", "b"} {
+			f, status := fs.Create(name, syscall.O_RDWR, 0600, nil)
+			if !status.Ok() {
+				t.Fatal(status)
+			}
+			if _, status = f.Write(data, 0); !status.Ok() {
+				t.Fatal(status)
+			}
+			if got := readAll(t, f); !bytes.Equal(got, data) {
+				t.Errorf("len=%d: wrong content", l)
+			}
+			f.Release()
+			c, err := ioutil.ReadFile(dir + "/" + name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ct[i] = c[contentenc.HeaderLen-contentenc.XTSMinUnit:]
+			syscall.Unlink(dir + "/" + name)
+		}
+		if len(ct[0]) != contentenc.XTSMinUnit+l {
+			t.Errorf("len=%d: wrong backing size", l)
+		}
+		for off := 0; off+contentenc.XTSMinUnit <= len(ct[0]); off += contentenc.XTSMinUnit {
+			if bytes.Equal(ct[0][off:off+contentenc.XTSMinUnit], ct[1][off:off+contentenc.XTSMinUnit]) {
+				t.Errorf("len=%d: identical ciphertext at offset %d", l, off)
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package fusefrontend
+
+import (
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// flushLoop runs as a goroutine when "-flush-interval" is set. It calls
+// flushDirty every "interval" to bound the amount of data that a crash can
+// lose, even if applications never call fsync.
+func (fs *FS) flushLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		fs.flushDirty()
+	}
+}
+
+// flushDirty fsyncs the backing files of all files that are open for
+// writing and have been modified since the last call. Returns the number of
+// files it has synced.
+//
+// The fsync runs on a dup()ed file descriptor, without holding any of the
+// locks of the file, so a slow fsync does not delay reads, writes or
+// Release() on the file.
+func (fs *FS) flushDirty() (n int) {
+	for _, f := range fs.openPaths.writableFiles() {
+		if atomic.SwapUint32(&f.dirty, 0) == 0 {
+			continue
+		}
+		fd, err := f.dupFd()
+		if err != nil {
+			// The file has been released in the meantime, Release() closed it
+			// and the kernel flushes it on its own.
+			continue
+		}
+		err = syscall.Fsync(fd)
+		syscall.Close(fd)
+		if err != nil {
+			tlog.Warn.Printf("ino%d: flush-interval: fsync failed: %v", f.qIno.Ino, err)
+			// Try again next time
+			atomic.StoreUint32(&f.dirty, 1)
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+// SyncOpenFiles fsyncs the backing files of all files that are open for
+// writing and have been modified since they were last synced. Called on
+// shutdown. Returns the number of files synced.
+func (fs *FS) SyncOpenFiles() int {
+	return fs.flushDirty()
+}
+
+// dupFd returns a duplicate of the backing file descriptor of "f", or
+// EBADF if the file has already been released. The caller must close it.
+func (f *File) dupFd() (int, error) {
+	f.fdLock.RLock()
+	defer f.fdLock.RUnlock()
+	if f.released {
+		return -1, syscall.EBADF
+	}
+	return syscall.Dup(f.intFd())
+}
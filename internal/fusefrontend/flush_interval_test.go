@@ -0,0 +1,45 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestFlushDirty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestFlushDirty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	fs.args.PlaintextNames = true
+	w, status := fs.Create("file", syscall.O_WRONLY, 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	r, status := fs.Open("file", syscall.O_RDONLY, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer r.Release()
+	if n := fs.flushDirty(); n != 0 {
+		t.Errorf("nothing written yet, but %d files were synced", n)
+	}
+	if _, status = w.Write([]byte("foo"), 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	if n := fs.flushDirty(); n != 1 {
+		t.Errorf("want 1 file synced, got %d", n)
+	}
+	if n := fs.flushDirty(); n != 0 {
+		t.Errorf("file is clean again, but %d files were synced", n)
+	}
+	w.Write([]byte("bar"), 3)
+	w.Release()
+	if n := fs.flushDirty(); n != 0 {
+		t.Errorf("released files must not be synced, got %d", n)
+	}
+}
@@ -6,6 +6,7 @@ package fusefrontend
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -31,6 +32,12 @@ type FS struct {
 	// Readers must RLock() it to prevent them from seeing intermediate
 	// states
 	dirIVLock sync.RWMutex
+	// sidecarLock serializes the read-modify-write cycles on xattr sidecar
+	// files ("XAttrSidecar")
+	sidecarLock sync.Mutex
+	// "-read-limit" and "-write-limit". nil if unlimited.
+	readLimit  *rateLimiter
+	writeLimit *rateLimiter
 	// Filename encryption helper
 	nameTransform *nametransform.NameTransform
 	// Content encryption helper
@@ -52,6 +59,26 @@ type FS struct {
 	// which is called as part of every filesystem operation.
 	// (This flag uses a uint32 so that it can be reset with CompareAndSwapUint32.)
 	AccessedSinceLastCheck uint32
+	// Plaintext paths of open files, for the ctlsock "OpenFiles" request
+	openPaths openPathTable
+	// Encryption helpers for unlocked directories ("-lock-dir"), indexed by
+	// KeyID. Only written before mounting.
+	dirKeys map[string]dirKey
+	// Which ciphertext directories are locked
+	lockedDirs lockedDirCache
+	// Attributes prefetched by OpenDir for READDIRPLUS
+	attrCache attrCache
+	// Content hashes for the "user.gocryptfs.sha256" xattr
+	hashCache hashCache
+	// Generation numbers for the "user.gocryptfs.gen" xattr
+	genTable genTable
+	// Background scrubber for "-scrub-interval", nil if disabled
+	scrub *scrubber
+	// Has CIPHERDIR disappeared?
+	backing backingState
+	// OnBackingLoss is called, in a new goroutine, when CIPHERDIR has
+	// disappeared. Used for "-unmount-on-backing-loss".
+	OnBackingLoss func()
 }
 
 var _ pathfs.FileSystem = &FS{} // Verify that interface is implemented.
@@ -64,12 +91,51 @@ func NewFS(args Args, c *contentenc.ContentEnc, n *nametransform.NameTransform)
 	if len(args.Exclude) > 0 {
 		tlog.Warn.Printf("Forward mode does not support -exclude")
 	}
-	return &FS{
+	fs := &FS{
 		FileSystem:    pathfs.NewLoopbackFileSystem(args.Cipherdir),
 		args:          args,
 		nameTransform: n,
 		contentEnc:    c,
+		readLimit:     newRateLimiter(args.ReadLimit),
+		writeLimit:    newRateLimiter(args.WriteLimit),
 	}
+	if args.DirKeys && n.ForDir == nil {
+		n.ForDir = fs.nameTransformFor
+	}
+	fs.initBackingState()
+	if args.FlushInterval > 0 {
+		go fs.flushLoop(args.FlushInterval)
+	}
+	if args.ScrubInterval > 0 {
+		fs.scrub = newScrubber(fs, args.ScrubInterval)
+		go fs.scrub.loop()
+	}
+	return fs
+}
+
+// CheckCopy returns a read-only instance of "fs" that shares its keys, for
+// checking the filesystem before it is mounted ("-fsck-on-dirty"). Reading
+// through it neither burns files nor updates atimes, and no background
+// goroutines are started.
+func (fs *FS) CheckCopy() *FS {
+	args := fs.args
+	args.ReadOnly = true
+	args.BurnAfterReading = false
+	args.StrictAtime = false
+	args.SerializeReads = false
+	args.ReadLimit = 0
+	args.TimingJitter = 0
+	args.FlushInterval = 0
+	args.ScrubInterval = 0
+	c := NewFS(args, fs.contentEnc, fs.nameTransform)
+	c.dirKeys = fs.dirKeys
+	return c
+}
+
+// ContentEnc returns the content encryption helper of this filesystem.
+// "-export-manifest" uses it to encrypt the manifest.
+func (fs *FS) ContentEnc() *contentenc.ContentEnc {
+	return fs.contentEnc
 }
 
 // GetAttr implements pathfs.Filesystem.
@@ -78,20 +144,44 @@ func (fs *FS) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Stat
 	if fs.isFiltered(name) {
 		return nil, fuse.EPERM
 	}
-	cName, err := fs.encryptPath(name)
-	if err != nil {
-		return nil, fuse.ToStatus(err)
+	var a *fuse.Attr
+	var status fuse.Status
+	// Attributes prefetched by OpenDir are keyed by the plaintext path, the
+	// path only has to be encrypted if there are none
+	if st := fs.attrCache.take(name); st != nil {
+		a = &fuse.Attr{}
+		a.FromStat(st)
+	} else {
+		cName, err := fs.encryptPath(name)
+		if err != nil {
+			return nil, fuse.ToStatus(err)
+		}
+		a, status = fs.FileSystem.GetAttr(cName, context)
+		if !status.Ok() {
+			status = fuse.ToStatus(fs.checkBackingErr(syscall.Errno(status)))
+		}
 	}
-	a, status := fs.FileSystem.GetAttr(cName, context)
 	if a == nil {
 		tlog.Debug.Printf("FS.GetAttr failed: %s", status.String())
 		return a, status
 	}
 	if a.IsRegular() {
-		a.Size = fs.contentEnc.CipherSizeToPlainSize(a.Size)
+		// The plaintext size only depends on the backing size, the header
+		// does not have to be read. The file ID is only needed for reading
+		// and writing, and is cached in the open file table while the file
+		// is open.
+		a.Size = fs.plainSize(name, a.Size)
 	} else if a.IsSymlink() {
 		target, _ := fs.Readlink(name, context)
 		a.Size = uint64(len(target))
+	} else if a.IsDir() && name == "" && !fs.args.PlaintextNames {
+		// The nlink of a directory is 2 plus the number of subdirectories,
+		// and "find" relies on it. The "-fsck -fix" quarantine dir is hidden.
+		var st syscall.Stat_t
+		qPath := filepath.Join(fs.args.Cipherdir, QuarantineDirName)
+		if syscall.Lstat(qPath, &st) == nil && st.Mode&syscall.S_IFMT == syscall.S_IFDIR && a.Nlink > 2 {
+			a.Nlink--
+		}
 	}
 	if fs.args.ForceOwner != nil {
 		a.Owner = *fs.args.ForceOwner
@@ -114,6 +204,8 @@ func (fs *FS) mangleOpenFlags(flags uint32) (newFlags int) {
 	// crypto header, alignment will be off, even if userspace makes aligned
 	// accesses. Running xfstests generic/013 on ext4 used to trigger lots of
 	// EINVAL errors due to missing alignment. Just fall back to buffered IO.
+	// "-odirect-dontneed" approximates the cache bypass, see
+	// File.dropPageCache().
 	newFlags = newFlags &^ syscallcompat.O_DIRECT
 	// We always want O_NOFOLLOW to be safe against symlink races
 	newFlags |= syscall.O_NOFOLLOW
@@ -121,10 +213,55 @@ func (fs *FS) mangleOpenFlags(flags uint32) (newFlags int) {
 }
 
 // Open implements pathfs.Filesystem.
-func (fs *FS) Open(path string, flags uint32, context *fuse.Context) (fuseFile nodefs.File, status fuse.Status) {
+func (fs *FS) Open(path string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	f, status := fs.openFile(path, flags)
+	if !status.Ok() {
+		return nil, status
+	}
+	return fs.openBurnFile(f, path), fuse.OK
+}
+
+// OpenInternal opens "path" read-only for gocryptfs' own use, like the
+// "-scrub-interval" scrubber. Reading through the returned file neither
+// burns it ("-burn-after-reading") nor updates its atime ("-strict-atime").
+func (fs *FS) OpenInternal(path string) (*File, fuse.Status) {
+	f, status := fs.openFile(path, syscall.O_RDONLY)
+	if !status.Ok() {
+		return nil, status
+	}
+	f.internal = true
+	return f, fuse.OK
+}
+
+// openFile opens "path" with "flags" and returns the *File without the
+// burn-after-reading wrapper.
+func (fs *FS) openFile(path string, flags uint32) (*File, fuse.Status) {
+	fuseFile, status := fs.doOpen(path, flags)
+	if !status.Ok() {
+		return nil, status
+	}
+	return fuseFile.(*File), fuse.OK
+}
+
+func (fs *FS) doOpen(path string, flags uint32) (fuseFile nodefs.File, status fuse.Status) {
 	if fs.isFiltered(path) {
 		return nil, fuse.EPERM
 	}
+	if fs.args.ReadOnly && (flags&syscall.O_ACCMODE != syscall.O_RDONLY || flags&syscall.O_TRUNC != 0) {
+		return nil, fuse.EROFS
+	}
+	ce, status := fs.contentEncFor(path)
+	if !status.Ok() {
+		return nil, status
+	}
+	defer func() {
+		if status == fuse.OK {
+			fuseFile.(*File).contentEnc = ce
+			fuseFile.(*File).plain = fs.isPlainContent(path)
+			fuseFile.(*File).dropCache = fs.args.ODirectDontNeed && flags&syscallcompat.O_DIRECT != 0
+			fs.openPaths.register(fuseFile.(*File), path, flags)
+		}
+	}()
 	newFlags := fs.mangleOpenFlags(flags)
 	// Taking this lock makes sure we don't race openWriteOnlyFile()
 	fs.openWriteOnlyLock.RLock()
@@ -202,10 +339,26 @@ func (fs *FS) openWriteOnlyFile(dirfd int, cName string, newFlags int) (fuseFile
 }
 
 // Create implements pathfs.Filesystem.
-func (fs *FS) Create(path string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+func (fs *FS) Create(path string, flags uint32, mode uint32, context *fuse.Context) (fuseFile nodefs.File, status fuse.Status) {
+	if fs.args.ReadOnly {
+		return nil, fuse.EROFS
+	}
+	defer fs.attrCache.invalidate()
 	if fs.isFiltered(path) {
 		return nil, fuse.EPERM
 	}
+	ce, status := fs.contentEncFor(path)
+	if !status.Ok() {
+		return nil, status
+	}
+	defer func() {
+		if status == fuse.OK {
+			fuseFile.(*File).contentEnc = ce
+			fuseFile.(*File).plain = fs.isPlainContent(path)
+			fuseFile.(*File).dropCache = fs.args.ODirectDontNeed && flags&syscallcompat.O_DIRECT != 0
+			fs.openPaths.register(fuseFile.(*File), path, flags)
+		}
+	}()
 	newFlags := fs.mangleOpenFlags(flags)
 	dirfd, cName, err := fs.openBackingDir(path)
 	if err != nil {
@@ -216,7 +369,7 @@ func (fs *FS) Create(path string, flags uint32, mode uint32, context *fuse.Conte
 	// Handle long file name
 	if !fs.args.PlaintextNames && nametransform.IsLongContent(cName) {
 		// Create ".name"
-		err = fs.nameTransform.WriteLongName(dirfd, cName, path)
+		err = fs.writeLongName(dirfd, cName, path)
 		if err != nil {
 			return nil, fuse.ToStatus(err)
 		}
@@ -247,6 +400,10 @@ func (fs *FS) Create(path string, flags uint32, mode uint32, context *fuse.Conte
 
 // Chmod implements pathfs.Filesystem.
 func (fs *FS) Chmod(path string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	if fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	defer fs.attrCache.invalidate()
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
@@ -258,11 +415,18 @@ func (fs *FS) Chmod(path string, mode uint32, context *fuse.Context) (code fuse.
 	// os.Chmod goes through the "syscallMode" translation function that messes
 	// up the suid and sgid bits. So use a syscall directly.
 	err = syscallcompat.Fchmodat(dirfd, cName, mode, unix.AT_SYMLINK_NOFOLLOW)
+	if err == nil {
+		fs.modifiedAt(dirfd, cName)
+	}
 	return fuse.ToStatus(err)
 }
 
 // Chown implements pathfs.Filesystem.
 func (fs *FS) Chown(path string, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
+	if fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	defer fs.attrCache.invalidate()
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
@@ -275,6 +439,7 @@ func (fs *FS) Chown(path string, uid uint32, gid uint32, context *fuse.Context)
 	if !code.Ok() {
 		return code
 	}
+	fs.modifiedAt(dirfd, cName)
 	if !fs.args.PlaintextNames {
 		// When filename encryption is active, every directory contains
 		// a "gocryptfs.diriv" file. This file should also change the owner.
@@ -288,6 +453,10 @@ func (fs *FS) Chown(path string, uid uint32, gid uint32, context *fuse.Context)
 
 // Mknod implements pathfs.Filesystem.
 func (fs *FS) Mknod(path string, mode uint32, dev uint32, context *fuse.Context) (code fuse.Status) {
+	if fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	defer fs.attrCache.invalidate()
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
@@ -298,7 +467,7 @@ func (fs *FS) Mknod(path string, mode uint32, dev uint32, context *fuse.Context)
 	defer syscall.Close(dirfd)
 	// Create ".name" file to store long file name (except in PlaintextNames mode)
 	if !fs.args.PlaintextNames && nametransform.IsLongContent(cName) {
-		err = fs.nameTransform.WriteLongName(dirfd, cName, path)
+		err = fs.writeLongName(dirfd, cName, path)
 		if err != nil {
 			return fuse.ToStatus(err)
 		}
@@ -330,6 +499,10 @@ func (fs *FS) Mknod(path string, mode uint32, dev uint32, context *fuse.Context)
 // While the glibc "truncate" wrapper seems to always use ftruncate, fsstress from
 // xfstests uses this a lot by calling "truncate64" directly.
 func (fs *FS) Truncate(path string, offset uint64, context *fuse.Context) (code fuse.Status) {
+	if fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	defer fs.attrCache.invalidate()
 	file, code := fs.Open(path, uint32(os.O_RDWR), context)
 	if code != fuse.OK {
 		return code
@@ -341,6 +514,10 @@ func (fs *FS) Truncate(path string, offset uint64, context *fuse.Context) (code
 
 // Utimens implements pathfs.Filesystem.
 func (fs *FS) Utimens(path string, a *time.Time, m *time.Time, context *fuse.Context) (code fuse.Status) {
+	if fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	defer fs.attrCache.invalidate()
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
@@ -348,7 +525,11 @@ func (fs *FS) Utimens(path string, a *time.Time, m *time.Time, context *fuse.Con
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
-	return fs.FileSystem.Utimens(cPath, a, m, context)
+	code = fs.FileSystem.Utimens(cPath, a, m, context)
+	if code.Ok() {
+		fs.modifiedPath(filepath.Join(fs.args.Cipherdir, cPath))
+	}
+	return code
 }
 
 // StatFs implements pathfs.Filesystem.
@@ -366,15 +547,15 @@ func (fs *FS) StatFs(path string) *fuse.StatfsOut {
 // decryptSymlinkTarget: "cData64" is base64-decoded and decrypted
 // like file contents (GCM).
 // The empty string decrypts to the empty string.
-func (fs *FS) decryptSymlinkTarget(cData64 string) (string, error) {
+func (k dirKey) decryptSymlinkTarget(cData64 string) (string, error) {
 	if cData64 == "" {
 		return "", nil
 	}
-	cData, err := fs.nameTransform.B64.DecodeString(cData64)
+	cData, err := k.nameTransform.B64.DecodeString(cData64)
 	if err != nil {
 		return "", err
 	}
-	data, err := fs.contentEnc.DecryptBlock([]byte(cData), 0, nil)
+	data, err := k.contentEnc.DecryptBlock([]byte(cData), 0, nil)
 	if err != nil {
 		return "", err
 	}
@@ -392,20 +573,32 @@ func (fs *FS) Readlink(relPath string, context *fuse.Context) (out string, statu
 	if err != nil {
 		return "", fuse.ToStatus(err)
 	}
-	if fs.args.PlaintextNames {
-		return cTarget, fuse.OK
+	target := cTarget
+	if !fs.args.PlaintextNames {
+		// Symlinks are encrypted like file contents (GCM) and base64-encoded
+		k, err := fs.keysFor(nametransform.Dir(cPath))
+		if err != nil {
+			return "", fuse.ToStatus(err)
+		}
+		target, err = k.decryptSymlinkTarget(cTarget)
+		if err != nil {
+			tlog.Warn.Printf("Readlink %q: decrypting target failed: %v", cPath, err)
+			return "", fuse.EIO
+		}
 	}
-	// Symlinks are encrypted like file contents (GCM) and base64-encoded
-	target, err := fs.decryptSymlinkTarget(cTarget)
-	if err != nil {
-		tlog.Warn.Printf("Readlink %q: decrypting target failed: %v", cPath, err)
-		return "", fuse.EIO
+	if fs.args.NoEscapeSymlinks && symlinkEscapes(relPath, target) {
+		tlog.Debug.Printf("Readlink %q: target %q is outside the mount (-no-escape-symlinks)", relPath, target)
+		return "", fuse.EPERM
 	}
-	return string(target), fuse.OK
+	return target, fuse.OK
 }
 
 // Unlink implements pathfs.Filesystem.
 func (fs *FS) Unlink(path string, context *fuse.Context) (code fuse.Status) {
+	if fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	defer fs.attrCache.invalidate()
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
@@ -419,6 +612,7 @@ func (fs *FS) Unlink(path string, context *fuse.Context) (code fuse.Status) {
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
+	fs.sidecarDelete(dirfd, cName)
 	// Delete ".name" file
 	if !fs.args.PlaintextNames && nametransform.IsLongContent(cName) {
 		err = nametransform.DeleteLongName(dirfd, cName)
@@ -432,21 +626,58 @@ func (fs *FS) Unlink(path string, context *fuse.Context) (code fuse.Status) {
 // encryptSymlinkTarget: "data" is encrypted like file contents (GCM)
 // and base64-encoded.
 // The empty string encrypts to the empty string.
-func (fs *FS) encryptSymlinkTarget(data string) (cData64 string) {
+func (k dirKey) encryptSymlinkTarget(data string) (cData64 string) {
 	if data == "" {
 		return ""
 	}
-	cData := fs.contentEnc.EncryptBlock([]byte(data), 0, nil)
-	cData64 = fs.nameTransform.B64.EncodeToString(cData)
+	cData := k.contentEnc.EncryptBlock([]byte(data), 0, nil)
+	cData64 = k.nameTransform.B64.EncodeToString(cData)
 	return cData64
 }
 
+// symlinkEscapes returns true if the target of the symlink at the plaintext
+// path "linkPath" is outside the mount. Absolute targets always are, as we
+// do not know where the mount ends up. Relative targets escape if they go
+// above the root directory at any point, like "../x" in the root directory
+// or "a/../../x" in a subdirectory.
+// Symlinks in the target path are not followed, they are checked on their
+// own when they are read.
+func symlinkEscapes(linkPath string, target string) bool {
+	if filepath.IsAbs(target) {
+		return true
+	}
+	depth := 0
+	if dir := filepath.Dir(linkPath); dir != "." && dir != "" {
+		depth = len(strings.Split(dir, "/"))
+	}
+	for _, c := range strings.Split(target, "/") {
+		switch c {
+		case "", ".":
+		case "..":
+			depth--
+			if depth < 0 {
+				return true
+			}
+		default:
+			depth++
+		}
+	}
+	return false
+}
+
 // Symlink implements pathfs.Filesystem.
 func (fs *FS) Symlink(target string, linkName string, context *fuse.Context) (code fuse.Status) {
+	if fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	defer fs.attrCache.invalidate()
 	tlog.Debug.Printf("Symlink(\"%s\", \"%s\")", target, linkName)
 	if fs.isFiltered(linkName) {
 		return fuse.EPERM
 	}
+	if fs.args.NoEscapeSymlinks && symlinkEscapes(linkName, target) {
+		return fuse.EPERM
+	}
 	dirfd, cName, err := fs.openBackingDir(linkName)
 	if err != nil {
 		return fuse.ToStatus(err)
@@ -455,11 +686,15 @@ func (fs *FS) Symlink(target string, linkName string, context *fuse.Context) (co
 	cTarget := target
 	if !fs.args.PlaintextNames {
 		// Symlinks are encrypted like file contents (GCM) and base64-encoded
-		cTarget = fs.encryptSymlinkTarget(target)
+		k, status := fs.keysForPath(nametransform.Dir(linkName))
+		if !status.Ok() {
+			return status
+		}
+		cTarget = k.encryptSymlinkTarget(target)
 	}
 	// Create ".name" file to store long file name (except in PlaintextNames mode)
 	if !fs.args.PlaintextNames && nametransform.IsLongContent(cName) {
-		err = fs.nameTransform.WriteLongName(dirfd, cName, linkName)
+		err = fs.writeLongName(dirfd, cName, linkName)
 		if err != nil {
 			return fuse.ToStatus(err)
 		}
@@ -488,9 +723,16 @@ func (fs *FS) Symlink(target string, linkName string, context *fuse.Context) (co
 
 // Rename implements pathfs.Filesystem.
 func (fs *FS) Rename(oldPath string, newPath string, context *fuse.Context) (code fuse.Status) {
+	if fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	defer fs.attrCache.invalidate()
 	if fs.isFiltered(newPath) {
 		return fuse.EPERM
 	}
+	if code = fs.checkKeyDomains(oldPath, newPath); !code.Ok() {
+		return code
+	}
 	oldDirfd, oldCName, err := fs.openBackingDir(oldPath)
 	if err != nil {
 		return fuse.ToStatus(err)
@@ -503,15 +745,25 @@ func (fs *FS) Rename(oldPath string, newPath string, context *fuse.Context) (cod
 	defer syscall.Close(newDirfd)
 	// The Rename may cause a directory to take the place of another directory.
 	// That directory may still be in the DirIV cache, clear it.
-	fs.nameTransform.DirIVCache.Clear()
+	fs.ClearDirCaches()
+	// "-preserve-xattr-on-rename": the xattrs of the file that is
+	// overwritten are lost in the rename, read them now
+	var savedXattrs map[string][]byte
+	if fs.args.PreserveXattrOnRename {
+		savedXattrs = fs.overwrittenXattrs(newPath)
+	}
 	// Easy case.
 	if fs.args.PlaintextNames {
-		return fuse.ToStatus(syscallcompat.Renameat(oldDirfd, oldCName, newDirfd, newCName))
+		err = syscallcompat.Renameat(oldDirfd, oldCName, newDirfd, newCName)
+		if err == nil {
+			fs.preserveXattrs(newPath, savedXattrs)
+		}
+		return fuse.ToStatus(err)
 	}
 	// Long destination file name: create .name file
 	nameFileAlreadyThere := false
 	if nametransform.IsLongContent(newCName) {
-		err = fs.nameTransform.WriteLongName(newDirfd, newCName, newPath)
+		err = fs.writeLongName(newDirfd, newCName, newPath)
 		// Failure to write the .name file is expected when the target path already
 		// exists. Since hashes are pretty unique, there is no need to modify the
 		// .name file in this case, and we ignore the error.
@@ -530,8 +782,19 @@ func (fs *FS) Rename(oldPath string, newPath string, context *fuse.Context) (cod
 		// Interestingly, ext4 returns ENOTEMPTY while xfs returns EEXIST.
 		// We handle that by trying to fs.Rmdir() the target directory and trying
 		// again.
+		// A non-empty target directory makes Rmdir fail, and we return the
+		// original error.
 		tlog.Debug.Printf("Rename: Handling ENOTEMPTY")
 		if fs.Rmdir(newPath, context) == fuse.OK {
+			// Rmdir has also deleted the .name file of the target. Recreate it,
+			// otherwise the renamed directory would be left without one.
+			if nametransform.IsLongContent(newCName) {
+				nameFileAlreadyThere = false
+				err = fs.writeLongName(newDirfd, newCName, newPath)
+				if err != nil {
+					return fuse.ToStatus(err)
+				}
+			}
 			err = syscallcompat.Renameat(oldDirfd, oldCName, newDirfd, newCName)
 		}
 	}
@@ -542,17 +805,26 @@ func (fs *FS) Rename(oldPath string, newPath string, context *fuse.Context) (cod
 		}
 		return fuse.ToStatus(err)
 	}
+	fs.sidecarRename(oldDirfd, oldCName, newDirfd, newCName)
 	if nametransform.IsLongContent(oldCName) {
 		nametransform.DeleteLongName(oldDirfd, oldCName)
 	}
+	fs.preserveXattrs(newPath, savedXattrs)
 	return fuse.OK
 }
 
 // Link implements pathfs.Filesystem.
 func (fs *FS) Link(oldPath string, newPath string, context *fuse.Context) (code fuse.Status) {
+	if fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	defer fs.attrCache.invalidate()
 	if fs.isFiltered(newPath) {
 		return fuse.EPERM
 	}
+	if code = fs.checkKeyDomains(oldPath, newPath); !code.Ok() {
+		return code
+	}
 	oldDirFd, cOldName, err := fs.openBackingDir(oldPath)
 	if err != nil {
 		return fuse.ToStatus(err)
@@ -565,32 +837,33 @@ func (fs *FS) Link(oldPath string, newPath string, context *fuse.Context) (code
 	defer syscall.Close(newDirFd)
 	// Handle long file name (except in PlaintextNames mode)
 	if !fs.args.PlaintextNames && nametransform.IsLongContent(cNewName) {
-		err = fs.nameTransform.WriteLongName(newDirFd, cNewName, newPath)
-		if err != nil {
+		nameFileCreated := true
+		err = fs.writeLongName(newDirFd, cNewName, newPath)
+		if err == syscall.EEXIST {
+			// Either the target exists (Linkat below will fail with EEXIST),
+			// or the .name file is an orphan left behind by an interrupted
+			// operation. As the hash is calculated from the encrypted name,
+			// the orphan already contains what we would write, so we can
+			// reuse it. In both cases, the .name file is not ours to delete.
+			nameFileCreated = false
+		} else if err != nil {
 			return fuse.ToStatus(err)
 		}
 		// Create "gocryptfs.longfile." link
 		err = syscallcompat.Linkat(oldDirFd, cOldName, newDirFd, cNewName, 0)
-		if err != nil {
+		if err != nil && nameFileCreated {
 			nametransform.DeleteLongName(newDirFd, cNewName)
 		}
 	} else {
 		// Create regular link
 		err = syscallcompat.Linkat(oldDirFd, cOldName, newDirFd, cNewName, 0)
 	}
-	return fuse.ToStatus(err)
-}
-
-// Access implements pathfs.Filesystem.
-func (fs *FS) Access(path string, mode uint32, context *fuse.Context) (code fuse.Status) {
-	if fs.isFiltered(path) {
-		return fuse.EPERM
+	if err == nil {
+		fs.sidecarLink(oldDirFd, cOldName, newDirFd, cNewName)
+		// The link count has changed
+		fs.modifiedAt(newDirFd, cNewName)
 	}
-	cPath, err := fs.getBackingPath(path)
-	if err != nil {
-		return fuse.ToStatus(err)
-	}
-	return fuse.ToStatus(syscall.Access(cPath, mode))
+	return fuse.ToStatus(err)
 }
 
 // reportMitigatedCorruption is used to report a corruption that was transparently
@@ -23,6 +23,21 @@ import (
 
 const dsStoreName = ".DS_Store"
 
+// isForeignName returns true for names in CIPHERDIR that are not created by
+// gocryptfs and are not ciphertext, but are expected to show up there: the
+// config backup written by "-migrate", "lost+found" when CIPHERDIR is the
+// root of a filesystem, and the ".DS_Store" files of MacOS Finder.
+// OpenDir does not count them as corrupt.
+func isForeignName(dirName string, cName string) bool {
+	if cName == dsStoreName {
+		return true
+	}
+	if dirName != "" {
+		return false
+	}
+	return cName == configfile.ConfDefaultName+".bak" || cName == "lost+found"
+}
+
 // mkdirWithIv - create a new directory and corresponding diriv file. dirfd
 // should be a handle to the parent directory, cName is the name of the new
 // directory and mode specifies the access permissions to use.
@@ -32,14 +47,26 @@ func (fs *FS) mkdirWithIv(dirfd int, cName string, mode uint32) error {
 	// from seeing it.
 	fs.dirIVLock.Lock()
 	// The new directory may take the place of an older one that is still in the cache
-	fs.nameTransform.DirIVCache.Clear()
+	fs.ClearDirCaches()
 	defer fs.dirIVLock.Unlock()
 	err := syscallcompat.Mkdirat(dirfd, cName, mode)
 	if err != nil {
 		return err
 	}
-	// Create gocryptfs.diriv
+	// Create gocryptfs.diriv. O_EXCL makes sure there is only ever one.
 	err = nametransform.WriteDirIV(dirfd, cName)
+	if err == syscall.EEXIST {
+		// Somebody else, for example another mount of the same CIPHERDIR
+		// with -sharedstorage, has created gocryptfs.diriv between Mkdirat
+		// and here. If it is valid, use it, and do not roll back: the
+		// directory may not be ours to delete.
+		err = checkDirIV(dirfd, cName)
+		if err == nil {
+			return nil
+		}
+		tlog.Warn.Printf("mkdirWithIv: existing diriv is invalid: %v", err)
+		return syscall.EEXIST
+	}
 	if err != nil {
 		err2 := syscallcompat.Unlinkat(dirfd, cName, unix.AT_REMOVEDIR)
 		if err2 != nil {
@@ -49,8 +76,24 @@ func (fs *FS) mkdirWithIv(dirfd int, cName string, mode uint32) error {
 	return err
 }
 
+// checkDirIV makes sure that directory "cName" in "dirfd" has a valid
+// gocryptfs.diriv.
+func checkDirIV(dirfd int, cName string) error {
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	_, err = nametransform.ReadDirIVAt(fd)
+	return err
+}
+
 // Mkdir implements pathfs.FileSystem
 func (fs *FS) Mkdir(newPath string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	if fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	defer fs.attrCache.invalidate()
 	if fs.isFiltered(newPath) {
 		return fuse.EPERM
 	}
@@ -79,7 +122,7 @@ func (fs *FS) Mkdir(newPath string, mode uint32, context *fuse.Context) (code fu
 	// Handle long file name
 	if nametransform.IsLongContent(cName) {
 		// Create ".name"
-		err = fs.nameTransform.WriteLongName(dirfd, cName, newPath)
+		err = fs.writeLongName(dirfd, cName, newPath)
 		if err != nil {
 			return fuse.ToStatus(err)
 		}
@@ -129,8 +172,22 @@ func haveDsstore(entries []fuse.DirEntry) bool {
 	return false
 }
 
+// haveDirKey returns true if one of the entries is a "-lock-dir" key slot.
+func haveDirKey(entries []fuse.DirEntry) bool {
+	for _, e := range entries {
+		if e.Name == configfile.DirKeyName {
+			return true
+		}
+	}
+	return false
+}
+
 // Rmdir implements pathfs.FileSystem
 func (fs *FS) Rmdir(path string, context *fuse.Context) (code fuse.Status) {
+	if fs.args.ReadOnly {
+		return fuse.EROFS
+	}
+	defer fs.attrCache.invalidate()
 	cPath, err := fs.getBackingPath(path)
 	if err != nil {
 		return fuse.ToStatus(err)
@@ -210,6 +267,16 @@ retry:
 		tlog.Warn.Printf("Rmdir: had to delete blocking file %q", ds)
 		goto retry
 	}
+	// A locked directory ("-lock-dir") also contains its key slot. Delete it
+	// if there is nothing else.
+	if fs.args.DirKeys && len(children) == 2 && haveDirKey(children) {
+		err = syscallcompat.Unlinkat(dirfd, configfile.DirKeyName, 0)
+		if err != nil {
+			tlog.Warn.Printf("Rmdir: failed to delete key slot: %v", err)
+			return fuse.ToStatus(err)
+		}
+		goto retry
+	}
 	// If the directory is not empty besides gocryptfs.diriv, do not even
 	// attempt the dance around gocryptfs.diriv.
 	if len(children) > 1 {
@@ -246,16 +313,21 @@ retry:
 	if err != nil {
 		tlog.Warn.Printf("Rmdir: Could not clean up %s: %v", tmpName, err)
 	}
+	fs.sidecarDelete(parentDirFd, cName)
 	// Delete .name file
 	if nametransform.IsLongContent(cName) {
 		nametransform.DeleteLongName(parentDirFd, cName)
 	}
 	// The now-deleted directory may have been in the DirIV cache. Clear it.
-	fs.nameTransform.DirIVCache.Clear()
+	fs.ClearDirCaches()
 	return fuse.OK
 }
 
 // OpenDir implements pathfs.FileSystem
+//
+// The entries are returned in the order getdents(2) returned the backing
+// entries, which is often inode order. Applications that read the files in
+// readdir order get the same locality as on the backing filesystem.
 func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
 	tlog.Debug.Printf("OpenDir(%s)", dirName)
 	cDirName, err := fs.encryptPath(dirName)
@@ -278,7 +350,10 @@ func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, f
 	// Get DirIV (stays nil if PlaintextNames is used)
 	var cachedIV []byte
 	if !fs.args.PlaintextNames {
-		cachedIV, _ = fs.nameTransform.DirIVCache.Lookup(dirName)
+		// The cache is indexed by the stored plaintext path, without
+		// "-name-suffix"
+		cacheKey, _ := fs.nameTransform.StripSuffix(dirName)
+		cachedIV, _ = fs.nameTransform.DirIVCache.Lookup(cacheKey)
 		if cachedIV == nil {
 			// Read the DirIV from disk and store it in the cache
 			fs.dirIVLock.RLock()
@@ -293,12 +368,19 @@ func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, f
 				tlog.Warn.Printf("OpenDir %q: could not read gocryptfs.diriv: %v", cDirName, err)
 				return nil, fuse.EIO
 			}
-			fs.nameTransform.DirIVCache.Store(dirName, cachedIV, cDirName)
+			fs.nameTransform.DirIVCache.Store(cacheKey, cachedIV, cDirName)
 			fs.dirIVLock.RUnlock()
 		}
 	}
+	// Names in locked directories are encrypted with the directory key
+	k, err := fs.keysFor(cDirName)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
 	// Decrypted directory entries
 	var plain []fuse.DirEntry
+	// Backing names of the entries in "plain", for attrCache.prefetch()
+	var cNames []string
 	var errorCount int
 	// Filter and decrypt filenames
 	for i := range cipherEntries {
@@ -307,14 +389,31 @@ func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, f
 			// silently ignore "gocryptfs.conf" in the top level dir
 			continue
 		}
+		if dirName == "" && cName == MountLockName {
+			// silently ignore "gocryptfs.mnt.lock" in the top level dir
+			continue
+		}
 		if fs.args.PlaintextNames {
 			plain = append(plain, cipherEntries[i])
+			cNames = append(cNames, cName)
 			continue
 		}
 		if cName == nametransform.DirIVFilename {
 			// silently ignore "gocryptfs.diriv" everywhere if dirIV is enabled
 			continue
 		}
+		if dirName == "" && cName == QuarantineDirName {
+			// silently ignore the "-fsck -fix" quarantine dir in the top level dir
+			continue
+		}
+		if cName == configfile.DirKeyName && fs.args.DirKeys {
+			// silently ignore the "-lock-dir" key slot
+			continue
+		}
+		if fs.args.XAttrSidecar && isSidecarName(cName) {
+			// silently ignore xattr sidecar files
+			continue
+		}
 		// Handle long file name
 		isLong := nametransform.LongNameNone
 		if fs.args.LongNames {
@@ -334,25 +433,33 @@ func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, f
 			// ignore "gocryptfs.longname.*.name"
 			continue
 		}
-		name, err := fs.nameTransform.DecryptName(cName, cachedIV)
+		name, err := k.nameTransform.DecryptName(cName, cachedIV)
 		if err != nil {
+			if isForeignName(dirName, cName) {
+				// Does not warrant returning EIO
+				tlog.Debug.Printf("OpenDir %q: skipping foreign entry %q", cDirName, cName)
+				continue
+			}
 			tlog.Warn.Printf("OpenDir %q: invalid entry %q: %v",
 				cDirName, cName, err)
 			fs.reportMitigatedCorruption(cName)
-			if runtime.GOOS == "darwin" && cName == dsStoreName {
-				// MacOS creates lots of these files. Log the warning but don't
-				// increment errorCount - does not warrant returning EIO.
-				continue
-			}
 			errorCount++
 			continue
 		}
+		cNames = append(cNames, cipherEntries[i].Name)
 		// Override the ciphertext name with the plaintext name but reuse the rest
 		// of the structure
-		cipherEntries[i].Name = name
+		cipherEntries[i].Name = fs.nameTransform.AddSuffix(name)
 		plain = append(plain, cipherEntries[i])
 	}
 
+	if errorCount > 0 && !fs.args.SkipCorrupt {
+		// Don't silently hide files. With "-skip-corrupt", the user gets to
+		// see the rest of the directory.
+		tlog.Warn.Printf("OpenDir %q: %d invalid entries, returning EIO. Mount with -skip-corrupt to list the others.",
+			cDirName, errorCount)
+		return nil, fuse.EIO
+	}
 	if errorCount > 0 && len(plain) == 0 {
 		// Don't let the user stare on an empty directory. Report that things went
 		// wrong.
@@ -360,6 +467,129 @@ func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, f
 			cDirName, errorCount)
 		status = fuse.EIO
 	}
-
+	if status.Ok() {
+		names := make([]string, len(plain))
+		for i := range plain {
+			names[i] = plain[i].Name
+		}
+		fs.attrCache.prefetch(fd, dirName, names, cNames)
+	}
 	return plain, status
 }
+
+// OrphanedLongNames returns the "gocryptfs.longname.*.name" files in the
+// ciphertext directory of "dirName" that have no matching content file.
+// These are left behind when a Create, Link or Rename is interrupted between
+// writing the .name file and creating the content file. As they contain no
+// data, deleting them is safe, which is done if "remove" is set. Used by
+// fsck.
+func (fs *FS) OrphanedLongNames(dirName string, remove bool) ([]string, error) {
+	if fs.args.PlaintextNames || !fs.args.LongNames {
+		return nil, nil
+	}
+	cDirName, err := fs.encryptPath(dirName)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := syscall.Open(filepath.Join(fs.args.Cipherdir, cDirName), syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	cipherEntries, err := syscallcompat.Getdents(fd)
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[string]bool)
+	for _, e := range cipherEntries {
+		present[e.Name] = true
+	}
+	var orphans []string
+	for _, e := range cipherEntries {
+		if nametransform.NameType(e.Name) != nametransform.LongNameFilename {
+			continue
+		}
+		hashName := e.Name[:len(e.Name)-len(nametransform.LongNameSuffix)]
+		if present[hashName] {
+			continue
+		}
+		if remove {
+			err = nametransform.DeleteLongName(fd, hashName)
+			if err != nil {
+				return orphans, err
+			}
+		}
+		orphans = append(orphans, e.Name)
+	}
+	return orphans, nil
+}
+
+// CheckDirIV checks the gocryptfs.diriv file of "dirName". It returns an
+// error if the file has the wrong length or is all-zero, as a crash during
+// Mkdir can leave it. Missing or unreadable diriv files are not reported
+// here, OpenDir fails for them. Used by fsck.
+func (fs *FS) CheckDirIV(dirName string) error {
+	if fs.args.PlaintextNames {
+		return nil
+	}
+	cDirAbsPath, err := fs.getBackingPath(dirName)
+	if err != nil {
+		return nil
+	}
+	_, err = nametransform.ReadDirIV(cDirAbsPath)
+	if _, ok := err.(syscall.Errno); ok {
+		return nil
+	}
+	return err
+}
+
+// QuarantineDir moves the ciphertext directory of "dirName", and the .name
+// file if it has a long name, into QuarantineDirName. The contents stay
+// untouched for manual recovery, but are no longer visible in the mount.
+// Returns the new path relative to CIPHERDIR. Used by "-fsck -fix".
+func (fs *FS) QuarantineDir(dirName string) (string, error) {
+	if dirName == "" {
+		return "", fmt.Errorf("the root directory cannot be quarantined")
+	}
+	dirfd, cName, err := fs.openBackingDir(dirName)
+	if err != nil {
+		return "", err
+	}
+	defer syscall.Close(dirfd)
+	qPath := filepath.Join(fs.args.Cipherdir, QuarantineDirName)
+	err = syscall.Mkdir(qPath, 0700)
+	if err != nil && err != syscall.EEXIST {
+		return "", err
+	}
+	qfd, err := syscall.Open(qPath, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return "", err
+	}
+	defer syscall.Close(qfd)
+	// Directories in different places can have the same ciphertext name
+	target := cName
+	for i := 1; ; i++ {
+		var st unix.Stat_t
+		err = syscallcompat.Fstatat(qfd, target, &st, unix.AT_SYMLINK_NOFOLLOW)
+		if err == syscall.ENOENT {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		target = fmt.Sprintf("%s.%d", cName, i)
+	}
+	err = syscallcompat.Renameat(dirfd, cName, qfd, target)
+	if err != nil {
+		return "", err
+	}
+	if nametransform.IsLongContent(cName) {
+		err = syscallcompat.Renameat(dirfd, cName+nametransform.LongNameSuffix,
+			qfd, target+nametransform.LongNameSuffix)
+		if err != nil {
+			tlog.Warn.Printf("QuarantineDir %q: could not move .name file: %v", cName, err)
+		}
+	}
+	fs.ClearDirCaches()
+	return filepath.Join(QuarantineDirName, target), nil
+}
@@ -0,0 +1,248 @@
+package fusefrontend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+)
+
+// TestMkdirConcurrent creates the same directory from many goroutines on
+// two FS instances that share the CIPHERDIR, like two -sharedstorage mounts.
+// Exactly one Mkdir must win, and the directory must end up with one valid
+// diriv that both instances agree on.
+func TestMkdirConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestMkdirConcurrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = nametransform.WriteDirIV(-1, dir); err != nil {
+		t.Fatal(err)
+	}
+	fs1 := newTestFS()
+	fs1.args.Cipherdir = dir
+	fs2 := newTestFS()
+	fs2.args.Cipherdir = dir
+	for _, name := range []string{"short", strings.Repeat("long", 60)} {
+		var wg sync.WaitGroup
+		var lock sync.Mutex
+		results := make(map[fuse.Status]int)
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(fs *FS) {
+				defer wg.Done()
+				status := fs.Mkdir(name, 0700, nil)
+				lock.Lock()
+				results[status]++
+				lock.Unlock()
+			}([]*FS{fs1, fs2}[i%2])
+		}
+		wg.Wait()
+		if results[fuse.OK] != 1 || results[fuse.Status(syscall.EEXIST)] != 49 {
+			t.Errorf("%.10s: want 1 success and 49 EEXIST, got %v", name, results)
+		}
+		// A file created through one instance shows up in the other
+		f, status := fs1.Create(name+"/file", syscall.O_WRONLY, 0600, nil)
+		if !status.Ok() {
+			t.Fatalf("%.10s: %v", name, status)
+		}
+		f.Release()
+		entries, status := fs2.OpenDir(name, nil)
+		if !status.Ok() || len(entries) != 1 || entries[0].Name != "file" {
+			t.Errorf("%.10s: OpenDir: %v %v", name, entries, status)
+		}
+	}
+}
+
+// TestOpenDirSkipCorrupt lists a directory that contains a name that does not
+// decrypt, with and without "-skip-corrupt".
+func TestOpenDirSkipCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestOpenDirSkipCorrupt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = nametransform.WriteDirIV(-1, dir); err != nil {
+		t.Fatal(err)
+	}
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	for _, name := range []string{"good1", "good2"} {
+		f, status := fs.Create(name, syscall.O_WRONLY, 0600, nil)
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		f.Release()
+	}
+	// Valid base64, but not a valid ciphertext name
+	if err = ioutil.WriteFile(dir+"/AAAAAAAAAAAAAAAAAAAAAA", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	entries, status := fs.OpenDir("", nil)
+	if status != fuse.EIO {
+		t.Errorf("strict: want EIO, got %v %v", entries, status)
+	}
+	fs.args.SkipCorrupt = true
+	entries, status = fs.OpenDir("", nil)
+	if !status.Ok() || len(entries) != 2 {
+		t.Fatalf("-skip-corrupt: %v %v", entries, status)
+	}
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name, "good") {
+			t.Errorf("unexpected entry %q", e.Name)
+		}
+	}
+}
+
+// TestOpenDirForeignNames checks that names that are expected in CIPHERDIR,
+// but are not ciphertext, do not make OpenDir fail.
+func TestOpenDirForeignNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestOpenDirForeignNames")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = nametransform.WriteDirIV(-1, dir); err != nil {
+		t.Fatal(err)
+	}
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	f, status := fs.Create("good", syscall.O_WRONLY, 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+	if err = os.Mkdir(dir+"/lost+found", 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []string{dsStoreName, "gocryptfs.conf.bak"} {
+		if err = ioutil.WriteFile(dir+"/"+n, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, status := fs.OpenDir("", nil)
+	if !status.Ok() || len(entries) != 1 || entries[0].Name != "good" {
+		t.Errorf("want only \"good\", got %v %v", entries, status)
+	}
+}
+
+// TestQuarantineDir truncates the diriv of a directory, which CheckDirIV must
+// detect, and moves the directory out of the way.
+func TestQuarantineDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestQuarantineDir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = nametransform.WriteDirIV(-1, dir); err != nil {
+		t.Fatal(err)
+	}
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	for _, name := range []string{"good", "bad", strings.Repeat("long", 60)} {
+		if status := fs.Mkdir(name, 0700, nil); !status.Ok() {
+			t.Fatal(status)
+		}
+		if err = fs.CheckDirIV(name); err != nil {
+			t.Errorf("%.10s: %v", name, err)
+		}
+	}
+	for _, name := range []string{"bad", strings.Repeat("long", 60)} {
+		cPath, err := fs.getBackingPath(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Truncate(cPath+"/"+nametransform.DirIVFilename, 3); err != nil {
+			t.Fatal(err)
+		}
+		fs.nameTransform.DirIVCache.Clear()
+		if err = fs.CheckDirIV(name); err == nil {
+			t.Errorf("%.10s: truncated diriv not detected", name)
+		}
+		qPath, err := fs.QuarantineDir(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = os.Stat(dir + "/" + qPath + "/" + nametransform.DirIVFilename); err != nil {
+			t.Errorf("%.10s: %v", name, err)
+		}
+	}
+	// The quarantine dir does not show up, and does not make OpenDir fail
+	entries, status := fs.OpenDir("", nil)
+	if !status.Ok() || len(entries) != 1 || entries[0].Name != "good" {
+		t.Errorf("OpenDir: %v %v", entries, status)
+	}
+	if _, err = fs.QuarantineDir(""); err == nil {
+		t.Error("the root directory was quarantined")
+	}
+}
+
+// TestOpenDirOrder checks that OpenDir returns the entries in the order of
+// the backing directory, with long names and the files that are hidden
+// filtered out.
+func TestOpenDirOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestOpenDirOrder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = nametransform.WriteDirIV(-1, dir); err != nil {
+		t.Fatal(err)
+	}
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	fs.args.LongNames = true
+	plain := make(map[string]string)
+	for i := 0; i < 30; i++ {
+		name := fmt.Sprintf("file%02d", i)
+		if i%5 == 0 {
+			name += strings.Repeat("x", 200)
+		}
+		f, status := fs.Create(name, syscall.O_WRONLY, 0600, nil)
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		f.Release()
+		cPath, err := fs.encryptPath(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain[cPath] = name
+	}
+	fd, err := syscall.Open(dir, syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	cEntries, err := syscallcompat.Getdents(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for _, e := range cEntries {
+		if p, ok := plain[e.Name]; ok {
+			want = append(want, p)
+		}
+	}
+	entries, status := fs.OpenDir("", nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Name)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("order differs from the backing directory:\nwant %v\ngot  %v", want, got)
+	}
+}
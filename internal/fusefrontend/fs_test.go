@@ -0,0 +1,106 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+func TestSymlinkEscapes(t *testing.T) {
+	testcases := []struct {
+		linkPath, target string
+		want             bool
+	}{
+		// Absolute targets
+		{"link", "/etc/passwd", true},
+		{"a/b/link", "/", true},
+		// Relative targets that go above the root
+		{"link", "..", true},
+		{"link", "../x", true},
+		{"a/link", "../../x", true},
+		{"a/b/link", "../../../x", true},
+		{"a/link", "x/../../../a", true},
+		{"a/link", "./.././../x", true},
+		// Relative targets that stay inside
+		{"link", "x", false},
+		{"link", ".", false},
+		{"link", "./x/../y", false},
+		{"a/link", "../x", false},
+		{"a/b/link", "../../x", false},
+		{"a/link", "x//y/", false},
+		{"a/link", "x/../../b", false},
+	}
+	for _, tc := range testcases {
+		if got := symlinkEscapes(tc.linkPath, tc.target); got != tc.want {
+			t.Errorf("symlinkEscapes(%q, %q): want %v, got %v", tc.linkPath, tc.target, tc.want, got)
+		}
+	}
+}
+
+func TestNoEscapeSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestNoEscapeSymlinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	fs.args.PlaintextNames = true
+	// Created before the option was enabled
+	if status := fs.Symlink("../outside", "old", nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	fs.args.NoEscapeSymlinks = true
+	if _, status := fs.Readlink("old", nil); status != fuse.EPERM {
+		t.Errorf("Readlink of escaping symlink: want EPERM, got %v", status)
+	}
+	for _, target := range []string{"/etc", "../outside", "a/../../outside"} {
+		if status := fs.Symlink(target, "new", nil); status != fuse.EPERM {
+			t.Errorf("Symlink %q: want EPERM, got %v", target, status)
+		}
+	}
+	if status := fs.Symlink("a/../inside", "new", nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	if target, status := fs.Readlink("new", nil); !status.Ok() || target != "a/../inside" {
+		t.Errorf("Readlink: %q %v", target, status)
+	}
+}
+
+// Paths with more than "-max-depth" components fail with ELOOP
+func TestMaxDepth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestMaxDepth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = nametransform.WriteDirIV(-1, dir); err != nil {
+		t.Fatal(err)
+	}
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	fs.args.MaxDepth = 5
+	path := ""
+	for i := 1; i <= 5; i++ {
+		path = filepath.Join(path, "d")
+		if status := fs.Mkdir(path, 0700, nil); !status.Ok() {
+			t.Fatalf("depth %d: %v", i, status)
+		}
+	}
+	if _, status := fs.OpenDir(path, nil); !status.Ok() {
+		t.Errorf("OpenDir at the limit: %v", status)
+	}
+	deeper := filepath.Join(path, "d")
+	if status := fs.Mkdir(deeper, 0700, nil); status != fuse.Status(syscall.ELOOP) {
+		t.Errorf("Mkdir: want ELOOP, got %v", status)
+	}
+	if _, status := fs.OpenDir(deeper, nil); status != fuse.Status(syscall.ELOOP) {
+		t.Errorf("OpenDir: want ELOOP, got %v", status)
+	}
+}
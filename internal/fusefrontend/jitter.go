@@ -0,0 +1,30 @@
+package fusefrontend
+
+import (
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+// MaxTimingJitter is the largest value accepted for Args.TimingJitter.
+// Every read and write may be delayed by up to this long, so anything larger
+// makes the filesystem unusable.
+const MaxTimingJitter = time.Second
+
+// timingJitter sleeps for a random time between zero and
+// Args.TimingJitter, "-timing-jitter". Returns immediately if the option is
+// not used.
+//
+// The delay is added after the operation has completed and all locks have
+// been released, so it shifts the time the reply reaches the kernel
+// without serializing other requests. It does not change the order or the
+// size of the accesses to the backing files, which stay visible to an
+// observer, it only makes it harder to correlate them with what the
+// application is doing.
+func (fs *FS) timingJitter() {
+	limit := fs.args.TimingJitter
+	if limit <= 0 {
+		return
+	}
+	time.Sleep(time.Duration(cryptocore.RandUint64() % uint64(limit)))
+}
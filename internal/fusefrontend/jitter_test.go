@@ -0,0 +1,26 @@
+package fusefrontend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimingJitter(t *testing.T) {
+	fs := newTestFS()
+	t0 := time.Now()
+	for i := 0; i < 1000; i++ {
+		fs.timingJitter()
+	}
+	if d := time.Since(t0); d > 100*time.Millisecond {
+		t.Errorf("disabled jitter should not sleep, took %v", d)
+	}
+	fs.args.TimingJitter = 5 * time.Millisecond
+	for i := 0; i < 20; i++ {
+		t0 = time.Now()
+		fs.timingJitter()
+		// Leave some room for the scheduler
+		if d := time.Since(t0); d > fs.args.TimingJitter+50*time.Millisecond {
+			t.Errorf("delay %v is larger than the limit %v", d, fs.args.TimingJitter)
+		}
+	}
+}
@@ -4,12 +4,22 @@ package fusefrontend
 
 import (
 	"path/filepath"
+	"sync/atomic"
+	"syscall"
 
 	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
+// MountLockName is the name of the lock file that read-write mounts hold
+// in the root of CIPHERDIR
+const MountLockName = "gocryptfs.mnt.lock"
+
+// QuarantineDirName is the directory in the root of CIPHERDIR that
+// "-fsck -fix" moves directories with a corrupt gocryptfs.diriv to
+const QuarantineDirName = "gocryptfs.quarantine"
+
 // isFiltered - check if plaintext "path" should be forbidden
 //
 // Prevents name clashes with internal files when file names are not encrypted
@@ -23,6 +33,12 @@ func (fs *FS) isFiltered(path string) bool {
 			configfile.ConfDefaultName)
 		return true
 	}
+	// gocryptfs.mnt.lock in the root directory is forbidden
+	if path == MountLockName {
+		tlog.Info.Printf("The name /%s is reserved when -plaintextnames is used\n",
+			MountLockName)
+		return true
+	}
 	// Note: gocryptfs.diriv is NOT forbidden because diriv and plaintextnames
 	// are exclusive
 	return false
@@ -52,7 +68,7 @@ func (fs *FS) openBackingDir(relPath string) (dirfd int, cName string, err error
 	// Open parent dir
 	dirfd, err = syscallcompat.OpenDirNofollow(fs.args.Cipherdir, filepath.Dir(cRelPath))
 	if err != nil {
-		return -1, "", err
+		return -1, "", fs.checkBackingErr(err)
 	}
 	cName = filepath.Base(cRelPath)
 	return dirfd, cName, nil
@@ -60,8 +76,15 @@ func (fs *FS) openBackingDir(relPath string) (dirfd int, cName string, err error
 
 // encryptPath - encrypt relative plaintext path
 func (fs *FS) encryptPath(plainPath string) (string, error) {
+	if fs.backingLost() {
+		return "", syscall.EIO
+	}
+	if fs.args.TooDeep(plainPath) {
+		tlog.Debug.Printf("encryptPath: %d components, more than -max-depth=%d", PathDepth(plainPath), fs.args.MaxDepth)
+		return "", syscall.ELOOP
+	}
 	if plainPath != "" { // Empty path gets encrypted all the time without actual file accesses.
-		fs.AccessedSinceLastCheck = 1
+		atomic.StoreUint32(&fs.AccessedSinceLastCheck, 1)
 	} else { // Empty string gets encrypted as empty string
 		return plainPath, nil
 	}
@@ -73,5 +96,5 @@ func (fs *FS) encryptPath(plainPath string) (string, error) {
 	cPath, err := fs.nameTransform.EncryptPathDirIV(plainPath, fs.args.Cipherdir)
 	tlog.Debug.Printf("encryptPath '%s' -> '%s' (err: %v)", plainPath, cPath, err)
 	fs.dirIVLock.RUnlock()
-	return cPath, err
+	return cPath, fs.checkBackingErr(err)
 }
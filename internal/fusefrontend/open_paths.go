@@ -0,0 +1,101 @@
+package fusefrontend
+
+import (
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/ctlsock"
+)
+
+// openPathTable tracks the plaintext paths of open files for the
+// "OpenFiles" ctlsock request, and the files that are open for writing for
+// "-flush-interval". The lock is only held for a map update, so the overhead
+// per Open()/Release() is small.
+type openPathTable struct {
+	sync.Mutex
+	// Indexed by plaintext path
+	entries map[string]*ctlsock.OpenFile
+	// Files that are open for writing
+	writers map[*File]struct{}
+}
+
+// register records that "f" has been opened as "path" with open flags
+// "flags".
+func (t *openPathTable) register(f *File, path string, flags uint32) {
+	f.openPath = path
+	f.openForWrite = flags&syscall.O_ACCMODE != syscall.O_RDONLY
+	t.Lock()
+	defer t.Unlock()
+	if t.entries == nil {
+		t.entries = make(map[string]*ctlsock.OpenFile)
+	}
+	e := t.entries[path]
+	if e == nil {
+		e = &ctlsock.OpenFile{Path: path}
+		t.entries[path] = e
+	}
+	e.Count++
+	if f.openForWrite {
+		e.Writers++
+		if t.writers == nil {
+			t.writers = make(map[*File]struct{})
+		}
+		t.writers[f] = struct{}{}
+	}
+}
+
+// unregister is called when "f" is released.
+func (t *openPathTable) unregister(f *File) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.writers, f)
+	e := t.entries[f.openPath]
+	if e == nil {
+		return
+	}
+	e.Count--
+	if f.openForWrite {
+		e.Writers--
+	}
+	if e.Count <= 0 {
+		delete(t.entries, f.openPath)
+	}
+}
+
+// list returns a copy of the table, sorted by path.
+func (t *openPathTable) list() []ctlsock.OpenFile {
+	t.Lock()
+	out := make([]ctlsock.OpenFile, 0, len(t.entries))
+	for _, e := range t.entries {
+		out = append(out, *e)
+	}
+	t.Unlock()
+	sort.Sort(sortableOpenFiles(out))
+	return out
+}
+
+// writableFiles returns the files that are currently open for writing.
+func (t *openPathTable) writableFiles() []*File {
+	t.Lock()
+	defer t.Unlock()
+	out := make([]*File, 0, len(t.writers))
+	for f := range t.writers {
+		out = append(out, f)
+	}
+	return out
+}
+
+type sortableOpenFiles []ctlsock.OpenFile
+
+func (s sortableOpenFiles) Len() int {
+	return len(s)
+}
+
+func (s sortableOpenFiles) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s sortableOpenFiles) Less(i, j int) bool {
+	return s[i].Path < s[j].Path
+}
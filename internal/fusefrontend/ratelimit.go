@@ -0,0 +1,60 @@
+package fusefrontend
+
+// Bandwidth limits for reads and writes, "-read-limit" and "-write-limit"
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket. Tokens are bytes and are refilled at "rate"
+// per second, up to "burst". A request takes its tokens immediately, even if
+// that makes the balance negative, and then sleeps until the balance would
+// have been positive again. Waiters never hold the lock while sleeping, so
+// concurrent requests cannot deadlock and are served in the order they
+// arrive.
+type rateLimiter struct {
+	// rate is in bytes per second
+	rate  float64
+	burst float64
+	sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter for "rate" bytes per second that allows
+// bursts of up to 100ms worth of data. A rate of zero means unlimited and
+// returns nil, which is a valid no-op limiter.
+func newRateLimiter(rate uint64) *rateLimiter {
+	if rate == 0 {
+		return nil
+	}
+	burst := float64(rate) / 10
+	return &rateLimiter{
+		rate:   float64(rate),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until "n" bytes may be transferred.
+func (l *rateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	l.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.Unlock()
+	time.Sleep(delay)
+}
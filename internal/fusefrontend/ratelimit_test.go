@@ -0,0 +1,44 @@
+package fusefrontend
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestRateLimiter transfers 5 MB from several goroutines through a 10 MB/s
+// limiter and checks that it takes about half a second.
+func TestRateLimiter(t *testing.T) {
+	const rate = 10 * 1000 * 1000
+	l := newRateLimiter(rate)
+	const chunk = 128 * 1024
+	const total = 5 * 1000 * 1000
+	t0 := time.Now()
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < total/4/chunk; i++ {
+				l.wait(chunk)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(t0)
+	transferred := float64(total / 4 / chunk * 4 * chunk)
+	// The burst is free, everything else must be paid for
+	want := time.Duration((transferred - l.burst) / rate * float64(time.Second))
+	if elapsed < want*9/10 || elapsed > want*2 {
+		t.Errorf("want about %v, took %v", want, elapsed)
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	l := newRateLimiter(0)
+	if l != nil {
+		t.Fatal("rate 0 should give a nil limiter")
+	}
+	// Must not crash or block
+	l.wait(1 << 30)
+}
@@ -0,0 +1,120 @@
+package fusefrontend
+
+// Attribute prefetching for READDIRPLUS. When the kernel supports it,
+// go-fuse answers READDIRPLUS by calling GetAttr for every directory entry
+// right after OpenDir. OpenDir already has the backing directory open, so it
+// fstatat()s the entries relative to that fd and leaves the results here.
+// GetAttr then does not have to encrypt the path again and lstat() it.
+
+import (
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// attrCacheTTL is how long prefetched attributes are used. go-fuse asks for
+// them immediately, so this only has to cover the time until the
+// application reads the next batch of a big directory.
+const attrCacheTTL = time.Second
+
+type attrCacheEntry struct {
+	st syscall.Stat_t
+	// Value of attrCache.gen when the entry was stored. If it changed,
+	// something may have been modified.
+	gen     uint64
+	expires time.Time
+}
+
+// attrCache holds the prefetched attributes of the backing files, indexed by
+// plaintext path. Every entry is used once.
+type attrCache struct {
+	// enabled is set to 1 when the kernel has negotiated READDIRPLUS.
+	// Accessed atomically.
+	enabled uint32
+	// gen is incremented by every operation that may change attributes.
+	// Accessed atomically.
+	gen uint64
+	sync.Mutex
+	entries map[string]attrCacheEntry
+}
+
+// EnableReaddirPlus makes OpenDir prefetch attributes. Call it when the
+// kernel has negotiated READDIRPLUS (fuse.CAP_READDIRPLUS), otherwise the
+// prefetched attributes are never asked for.
+func (fs *FS) EnableReaddirPlus() {
+	atomic.StoreUint32(&fs.attrCache.enabled, 1)
+}
+
+// invalidate drops all prefetched attributes. Must be called by every
+// operation that changes attributes, after the change, so that a concurrent
+// prefetch cannot store the old values with the new generation.
+func (c *attrCache) invalidate() {
+	atomic.AddUint64(&c.gen, 1)
+}
+
+// prefetch fstatat()s the backing files "cNames" in the directory "dirfd"
+// and stores the results under the plaintext paths dirName/names[i].
+func (c *attrCache) prefetch(dirfd int, dirName string, names []string, cNames []string) {
+	if atomic.LoadUint32(&c.enabled) == 0 {
+		return
+	}
+	gen := atomic.LoadUint64(&c.gen)
+	expires := time.Now().Add(attrCacheTTL)
+	c.Lock()
+	defer c.Unlock()
+	c.expire()
+	if c.entries == nil {
+		c.entries = make(map[string]attrCacheEntry)
+	}
+	for i := range names {
+		var st unix.Stat_t
+		err := syscallcompat.Fstatat(dirfd, cNames[i], &st, unix.AT_SYMLINK_NOFOLLOW)
+		if err != nil {
+			tlog.Debug.Printf("attrCache.prefetch %q: %v", cNames[i], err)
+			continue
+		}
+		c.entries[filepath.Join(dirName, names[i])] = attrCacheEntry{
+			st:      syscallcompat.Unix2syscall(st),
+			gen:     gen,
+			expires: expires,
+		}
+	}
+}
+
+// take returns and removes the prefetched attributes of plaintext path
+// "name". Returns nil if there are none or they may be stale.
+func (c *attrCache) take(name string) *syscall.Stat_t {
+	if atomic.LoadUint32(&c.enabled) == 0 {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[name]
+	if !ok {
+		return nil
+	}
+	delete(c.entries, name)
+	if e.gen != atomic.LoadUint64(&c.gen) || time.Now().After(e.expires) {
+		return nil
+	}
+	return &e.st
+}
+
+// expire drops entries that have not been asked for in time, for example
+// when the application did not read the directory to the end.
+// The caller must hold the lock.
+func (c *attrCache) expire() {
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+}
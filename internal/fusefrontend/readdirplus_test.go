@@ -0,0 +1,90 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// TestReaddirPlus checks that the attributes prefetched by OpenDir are the
+// same that GetAttr returns without prefetching, and that they are not used
+// after a modification.
+func TestReaddirPlus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestReaddirPlus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = nametransform.WriteDirIV(-1, dir); err != nil {
+		t.Fatal(err)
+	}
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	fs.args.LongNames = true
+	fs.FileSystem = pathfs.NewLoopbackFileSystem(dir)
+	names := []string{"file", strings.Repeat("long", 60), "link", "dir"}
+	f, status := fs.Create(names[0], syscall.O_RDWR, 0640, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Write(make([]byte, 10000), 0)
+	f.Release()
+	f, status = fs.Create(names[1], syscall.O_RDWR, 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+	if status = fs.Symlink("target", names[2], nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status = fs.Mkdir(names[3], 0700, nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	want := make(map[string]*fuse.Attr)
+	for _, n := range names {
+		a, status := fs.GetAttr(n, nil)
+		if !status.Ok() {
+			t.Fatalf("%q: %v", n, status)
+		}
+		want[n] = a
+	}
+
+	fs.EnableReaddirPlus()
+	entries, status := fs.OpenDir("", nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if len(entries) != len(names) || len(fs.attrCache.entries) != len(names) {
+		t.Fatalf("want %d entries, got %d, %d prefetched", len(names), len(entries), len(fs.attrCache.entries))
+	}
+	for _, n := range names {
+		a, status := fs.GetAttr(n, nil)
+		if !status.Ok() {
+			t.Fatalf("%q: %v", n, status)
+		}
+		// GetAttr reads symlinks to get their size, which may update the atime
+		a.Atime, a.Atimensec = want[n].Atime, want[n].Atimensec
+		if *a != *want[n] {
+			t.Errorf("%q: prefetched attributes differ:\nwant %v\ngot  %v", n, want[n], a)
+		}
+	}
+	if len(fs.attrCache.entries) != 0 {
+		t.Errorf("entries were not consumed: %v", fs.attrCache.entries)
+	}
+	// A modification must not return the prefetched mode
+	fs.OpenDir("", nil)
+	if status = fs.Chmod(names[0], 0600, nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	a, _ := fs.GetAttr(names[0], nil)
+	if a.Mode&0777 != 0600 {
+		t.Errorf("stale mode %o after chmod", a.Mode&0777)
+	}
+}
@@ -0,0 +1,267 @@
+package fusefrontend
+
+// Background scrubbing, "-scrub-interval". Every file is read and
+// authenticated through the normal decryption path once per interval, so
+// that bit rot in rarely read files is found while there is still a good
+// backup.
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// scrubMinRate is the lowest read rate in bytes per second. It keeps a pass
+// over a small filesystem from crawling through each block for minutes.
+const scrubMinRate = 64 * 1024
+
+// scrubTimestampSlack is subtracted from the start time of a pass before
+// comparing it with file timestamps. The kernel sets them from a clock that
+// may lag behind time.Now() by up to a timer tick.
+const scrubTimestampSlack = 100 * time.Millisecond
+
+// scrubFile is a regular file found at the start of a pass
+type scrubFile struct {
+	path string
+	size uint64
+}
+
+// scrubber reads every file once per "interval"
+type scrubber struct {
+	fs       *FS
+	interval time.Duration
+	// stop is closed by StopScrub, done is closed when loop() has returned
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+	sync.Mutex
+	status ctlsock.ScrubStatus
+	// lastComplete is the start time of the last pass that has read all
+	// files. Files that have not been changed since then are skipped.
+	lastComplete time.Time
+}
+
+func newScrubber(fs *FS, interval time.Duration) *scrubber {
+	return &scrubber{
+		fs:       fs,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// stopped returns true if StopScrub has been called
+func (s *scrubber) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// loop runs as a goroutine when "-scrub-interval" is set. Each pass starts
+// "interval" after the start of the previous one, or right after it if it
+// took longer.
+func (s *scrubber) loop() {
+	defer close(s.done)
+	for {
+		start := time.Now()
+		if !s.pass() {
+			return
+		}
+		timer := time.NewTimer(time.Until(start.Add(s.interval)))
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// pass reads all files that have changed since the last complete pass.
+// The reads are spread out over the interval. Returns false if the pass
+// has been interrupted by StopScrub.
+func (s *scrubber) pass() bool {
+	start := time.Now()
+	s.Lock()
+	s.status.Pass++
+	pass := s.status.Pass
+	s.status.Running = true
+	s.status.FilesTotal, s.status.FilesDone, s.status.FilesSkipped = 0, 0, 0
+	s.status.BytesTotal, s.status.BytesDone = 0, 0
+	lastComplete := s.lastComplete
+	s.Unlock()
+	defer func() {
+		s.Lock()
+		s.status.Running = false
+		s.Unlock()
+	}()
+
+	var files []scrubFile
+	var skipped int
+	var total uint64
+	if !s.list("", lastComplete, &files, &skipped) {
+		return false
+	}
+	for _, f := range files {
+		total += f.size
+	}
+	s.Lock()
+	s.status.FilesTotal = len(files) + skipped
+	s.status.FilesSkipped = skipped
+	s.status.BytesTotal = total
+	s.Unlock()
+
+	rate := uint64(float64(total) / s.interval.Seconds())
+	if rate < scrubMinRate {
+		rate = scrubMinRate
+	}
+	limit := newRateLimiter(rate)
+	// Read in chunks of 100ms worth of data, so that StopScrub does not
+	// have to wait long
+	chunk := rate / 10
+	if chunk < 4096 {
+		chunk = 4096
+	} else if chunk > fuse.MAX_KERNEL_WRITE {
+		chunk = fuse.MAX_KERNEL_WRITE
+	}
+	buf := make([]byte, chunk)
+	for _, f := range files {
+		if !s.scrubFile(f.path, buf, limit) {
+			return false
+		}
+		s.Lock()
+		s.status.FilesDone++
+		s.Unlock()
+	}
+	s.Lock()
+	s.lastComplete = start.Add(-scrubTimestampSlack)
+	s.status.LastComplete = start.Format(time.RFC3339)
+	s.Unlock()
+	tlog.Debug.Printf("scrub: pass %d done in %v: %d files, %d skipped",
+		pass, time.Since(start), len(files), skipped)
+	return true
+}
+
+// list collects the regular files below the plaintext directory "dir".
+// Files whose backing file has not been modified since "since" are only
+// counted in "skipped". Returns false if the scrubber has been stopped.
+func (s *scrubber) list(dir string, since time.Time, files *[]scrubFile, skipped *int) bool {
+	if s.stopped() {
+		return false
+	}
+	entries, status := s.fs.OpenDir(dir, nil)
+	if !status.Ok() {
+		tlog.Warn.Printf("scrub: cannot list %q: %v", dir, status)
+		return true
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name)
+		switch e.Mode & syscall.S_IFMT {
+		case syscall.S_IFDIR:
+			if !s.list(path, since, files, skipped) {
+				return false
+			}
+		case syscall.S_IFREG:
+			cPath, err := s.fs.getBackingPath(path)
+			if err != nil {
+				continue
+			}
+			var st syscall.Stat_t
+			if err = syscall.Lstat(cPath, &st); err != nil {
+				// Deleted in the meantime
+				continue
+			}
+			var a fuse.Attr
+			a.FromStat(&st)
+			if !since.IsZero() && a.ChangeTime().Before(since) && a.ModTime().Before(since) {
+				*skipped++
+				continue
+			}
+			size := s.fs.plainSize(path, a.Size)
+			*files = append(*files, scrubFile{path: path, size: size})
+		}
+	}
+	return true
+}
+
+// scrubFile reads the file at "path" completely and logs the first block
+// that fails to authenticate. Returns false if the scrubber has been
+// stopped.
+func (s *scrubber) scrubFile(path string, buf []byte, limit *rateLimiter) bool {
+	// Reading the file must not burn it or change its atime
+	f, status := s.fs.OpenInternal(path)
+	if status == fuse.ENOENT {
+		// Deleted in the meantime
+		return true
+	} else if !status.Ok() {
+		tlog.Warn.Printf("scrub: cannot open %q: %v", path, status)
+		s.error()
+		return true
+	}
+	defer f.Release()
+	for off := int64(0); ; {
+		if s.stopped() {
+			return false
+		}
+		result, status := f.Read(buf, off)
+		var data []byte
+		if status.Ok() {
+			data, status = result.Bytes(buf)
+		}
+		if !status.Ok() {
+			tlog.Warn.Printf("scrub: %q: read at offset %d failed: %v", path, off, status)
+			s.error()
+			return true
+		}
+		if len(data) == 0 {
+			return true
+		}
+		limit.wait(len(data))
+		off += int64(len(data))
+		s.Lock()
+		s.status.BytesDone += uint64(len(data))
+		s.Unlock()
+	}
+}
+
+// error counts a file that could not be read
+func (s *scrubber) error() {
+	s.Lock()
+	s.status.Errors++
+	s.Unlock()
+}
+
+// StopScrub stops the "-scrub-interval" scrubber and waits until it has
+// closed its file. Must be called before unmounting. Does nothing if the
+// scrubber is not running.
+func (fs *FS) StopScrub() {
+	s := fs.scrub
+	if s == nil {
+		return
+	}
+	s.stopOnce.Do(func() { close(s.stop) })
+	<-s.done
+}
+
+// ScrubStatus implements ctlsock.ScrubStatusInterface
+func (fs *FS) ScrubStatus() *ctlsock.ScrubStatus {
+	s := fs.scrub
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	status := s.status
+	s.Unlock()
+	return &status
+}
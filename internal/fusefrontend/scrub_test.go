@@ -0,0 +1,179 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestScrub(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestScrub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	fs.args.PlaintextNames = true
+	if status := fs.Mkdir("dir", 0700, nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	write := func(name string, data []byte) {
+		f, status := fs.Create(name, syscall.O_WRONLY, 0600, nil)
+		if status == fuse.Status(syscall.EEXIST) {
+			f, status = fs.Open(name, syscall.O_WRONLY|syscall.O_TRUNC, nil)
+		}
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		for off := 0; off < len(data); off += 128 * 1024 {
+			end := off + 128*1024
+			if end > len(data) {
+				end = len(data)
+			}
+			if _, status = f.Write(data[off:end], int64(off)); !status.Ok() {
+				t.Fatal(status)
+			}
+		}
+		f.Release()
+	}
+	write("a", make([]byte, 10000))
+	write("dir/b", make([]byte, 300000))
+	write("dir/c", []byte("foo"))
+	// Corrupt the first block of "dir/c"
+	cPath := filepath.Join(dir, "dir/c")
+	ct, err := ioutil.ReadFile(cPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct[len(ct)-1] ^= 1
+	if err = ioutil.WriteFile(cPath, ct, 0600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * scrubTimestampSlack)
+
+	s := newScrubber(fs, time.Millisecond)
+	fs.scrub = s
+	if !s.pass() {
+		t.Fatal("pass was interrupted")
+	}
+	st := fs.ScrubStatus()
+	if st.Pass != 1 || st.Running || st.FilesTotal != 3 || st.FilesDone != 3 || st.FilesSkipped != 0 {
+		t.Errorf("wrong status after pass 1: %+v", st)
+	}
+	if st.BytesTotal != 310003 || st.BytesDone != 310000 || st.Errors != 1 {
+		t.Errorf("wrong byte or error count after pass 1: %+v", st)
+	}
+	if st.LastComplete == "" {
+		t.Error("LastComplete is not set")
+	}
+	// Nothing has changed, the second pass skips all files
+	if !s.pass() {
+		t.Fatal("pass was interrupted")
+	}
+	st = fs.ScrubStatus()
+	if st.FilesTotal != 3 || st.FilesDone != 0 || st.FilesSkipped != 3 || st.BytesDone != 0 {
+		t.Errorf("wrong status after pass 2: %+v", st)
+	}
+	// Modified files are read again
+	time.Sleep(2 * scrubTimestampSlack)
+	write("a", []byte("bar"))
+	if !s.pass() {
+		t.Fatal("pass was interrupted")
+	}
+	st = fs.ScrubStatus()
+	if st.FilesDone != 1 || st.FilesSkipped != 2 || st.BytesDone != 3 || st.Errors != 1 {
+		t.Errorf("wrong status after pass 3: %+v", st)
+	}
+}
+
+// StopScrub must interrupt a pass that is spread out over a long interval
+func TestScrubStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestScrubStop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	fs.args.PlaintextNames = true
+	f, status := fs.Create("big", syscall.O_WRONLY, 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	// At the minimum rate, reading this takes about 16 seconds
+	for off := int64(0); off < 1<<20; off += 128 * 1024 {
+		if _, status = f.Write(make([]byte, 128*1024), off); !status.Ok() {
+			t.Fatal(status)
+		}
+	}
+	f.Release()
+	fs.scrub = newScrubber(fs, time.Hour)
+	go fs.scrub.loop()
+	time.Sleep(100 * time.Millisecond)
+	t0 := time.Now()
+	fs.StopScrub()
+	if d := time.Since(t0); d > time.Second {
+		t.Errorf("StopScrub took %v", d)
+	}
+	if st := fs.ScrubStatus(); st.Pass != 1 || st.Running || st.LastComplete != "" {
+		t.Errorf("wrong status after StopScrub: %+v", st)
+	}
+	// Calling it again is fine
+	fs.StopScrub()
+}
+
+// The scrubber must not burn marked files or update atimes
+func TestScrubBurnAtime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestScrubBurnAtime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	fs.args.PlaintextNames = true
+	fs.args.BurnAfterReading = true
+	fs.args.StrictAtime = true
+	f, status := fs.Create("secret", syscall.O_WRONLY, 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, status = f.Write([]byte("foo"), 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+	status = fs.SetXAttr("secret", BurnXattr, []byte("1"), 0, nil)
+	if status == fuse.ENOTSUP || status == fuse.Status(syscall.EOPNOTSUPP) {
+		t.Skip("xattrs not supported")
+	} else if !status.Ok() {
+		t.Fatal(status)
+	}
+	cPath := filepath.Join(dir, "secret")
+	atime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err = os.Chtimes(cPath, atime, atime); err != nil {
+		t.Fatal(err)
+	}
+	s := newScrubber(fs, time.Millisecond)
+	fs.scrub = s
+	if !s.pass() {
+		t.Fatal("pass was interrupted")
+	}
+	if st := fs.ScrubStatus(); st.FilesDone != 1 || st.BytesDone != 3 || st.Errors != 0 {
+		t.Errorf("wrong status: %+v", st)
+	}
+	var st syscall.Stat_t
+	if err = syscall.Stat(cPath, &st); err != nil {
+		t.Fatalf("file has been burned: %v", err)
+	}
+	var a fuse.Attr
+	a.FromStat(&st)
+	if a.Atime != uint64(atime.Unix()) {
+		t.Errorf("atime has changed: %d -> %d", atime.Unix(), a.Atime)
+	}
+}
@@ -4,12 +4,16 @@ package fusefrontend
 // FUSE operations on paths
 
 import (
+	"errors"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/pkg/xattr"
 
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -23,6 +27,19 @@ var xattrNameIV = []byte("xattr_name_iv_xx")
 // encrypted original name.
 var xattrStorePrefix = "user.gocryptfs."
 
+// With "-debug-xattr", reading "user.gocryptfs.raw.NAME" returns the
+// encrypted on-disk value of the xattr NAME.
+const xattrRawPrefix = "user.gocryptfs.raw."
+
+// rawXattrName returns the name of the xattr whose encrypted value is
+// requested, if "attr" is a "-debug-xattr" pseudo-xattr.
+func (fs *FS) rawXattrName(attr string) (name string, ok bool) {
+	if !fs.args.DebugXattr || !strings.HasPrefix(attr, xattrRawPrefix) {
+		return "", false
+	}
+	return attr[len(xattrRawPrefix):], true
+}
+
 // GetXAttr reads the value of extended attribute "attr".
 // Implements pathfs.Filesystem.
 func (fs *FS) GetXAttr(path string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
@@ -32,16 +49,33 @@ func (fs *FS) GetXAttr(path string, attr string, context *fuse.Context) ([]byte,
 	if disallowedXAttrName(attr) {
 		return nil, _EOPNOTSUPP
 	}
-	cAttr := fs.encryptXattrName(attr)
+	if attr == xattrSha256Name {
+		return fs.contentSha256(path)
+	}
+	if attr == xattrGenName {
+		return fs.generation(path)
+	}
+	rawName, raw := fs.rawXattrName(attr)
+	if raw {
+		attr = rawName
+	}
+	k, status := fs.keysForPath(path)
+	if !status.Ok() {
+		return nil, status
+	}
+	cAttr := k.encryptXattrName(attr)
 	cPath, err := fs.getBackingPath(path)
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
-	encryptedData, err := xattr.LGet(cPath, cAttr)
-	if err != nil {
-		return nil, unpackXattrErr(err)
+	encryptedData, status := fs.getXattrBacking(path, cPath, cAttr)
+	if !status.Ok() {
+		return nil, status
+	}
+	if raw {
+		return encryptedData, fuse.OK
 	}
-	data, err := fs.decryptXattrValue(encryptedData)
+	data, err := k.decryptXattrValue(encryptedData)
 	if err != nil {
 		tlog.Warn.Printf("GetXAttr: %v", err)
 		return nil, fuse.EIO
@@ -51,12 +85,20 @@ func (fs *FS) GetXAttr(path string, attr string, context *fuse.Context) ([]byte,
 
 // SetXAttr implements pathfs.Filesystem.
 func (fs *FS) SetXAttr(path string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	if fs.args.ReadOnly {
+		return fuse.EROFS
+	}
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
 	if disallowedXAttrName(attr) {
 		return _EOPNOTSUPP
 	}
+	// "-debug-xattr" pseudo-xattrs, the content hash and the generation
+	// number are read-only
+	if _, raw := fs.rawXattrName(attr); raw || attr == xattrSha256Name || attr == xattrGenName {
+		return fuse.EPERM
+	}
 
 	flags = filterXattrSetFlags(flags)
 
@@ -64,25 +106,87 @@ func (fs *FS) SetXAttr(path string, attr string, data []byte, flags int, context
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
-	cAttr := fs.encryptXattrName(attr)
-	cData := fs.encryptXattrValue(data)
-	return unpackXattrErr(xattr.LSetWithFlags(cPath, cAttr, cData, flags))
+	k, status := fs.keysForPath(path)
+	if !status.Ok() {
+		return status
+	}
+	k.contentEnc.CountNonces(1)
+	cAttr := k.encryptXattrName(attr)
+	cData := k.encryptXattrValue(data)
+	status = fs.setXattrBacking(path, cPath, cAttr, cData, flags)
+	if status.Ok() {
+		fs.xattrChanged(cPath)
+	}
+	return status
 }
 
 // RemoveXAttr implements pathfs.Filesystem.
 func (fs *FS) RemoveXAttr(path string, attr string, context *fuse.Context) fuse.Status {
+	if fs.args.ReadOnly {
+		return fuse.EROFS
+	}
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
 	if disallowedXAttrName(attr) {
 		return _EOPNOTSUPP
 	}
+	if _, raw := fs.rawXattrName(attr); raw || attr == xattrSha256Name || attr == xattrGenName {
+		return fuse.EPERM
+	}
 	cPath, err := fs.getBackingPath(path)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
-	cAttr := fs.encryptXattrName(attr)
-	return unpackXattrErr(xattr.LRemove(cPath, cAttr))
+	k, status := fs.keysForPath(path)
+	if !status.Ok() {
+		return status
+	}
+	cAttr := k.encryptXattrName(attr)
+	if fs.args.XAttrSidecar {
+		status = fs.sidecarRemove(path, cAttr)
+	} else {
+		status = unpackXattrErr(removeXattrChunked(cPath, cAttr))
+	}
+	if status.Ok() {
+		fs.xattrChanged(cPath)
+	}
+	return status
+}
+
+// xattrChanged is called after the xattrs of the backing file "cPath" have
+// been changed. It updates the generation number. With "-xattr-sync", it
+// makes sure the change becomes durable: if the file is open, Flush() fsyncs
+// it when it is closed, otherwise it is fsync'ed now. xattrs of symlinks are not synced, as
+// symlinks cannot be opened.
+func (fs *FS) xattrChanged(cPath string) {
+	fs.modifiedPath(cPath)
+	if !fs.args.XattrSync {
+		return
+	}
+	if fs.args.XAttrSidecar {
+		// The sidecar file has already been fsync'ed. Make the rename that
+		// put it in place durable.
+		cPath = filepath.Dir(cPath)
+	} else {
+		var st syscall.Stat_t
+		if err := syscall.Lstat(cPath, &st); err != nil || st.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+			return
+		}
+		if e := openfiletable.Lookup(openfiletable.QInoFromStat(&st)); e != nil {
+			atomic.StoreUint32(&e.XattrDirty, 1)
+			return
+		}
+	}
+	fd, err := syscall.Open(cPath, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		tlog.Warn.Printf("-xattr-sync: %v", err)
+		return
+	}
+	defer syscall.Close(fd)
+	if err = syscall.Fsync(fd); err != nil {
+		tlog.Warn.Printf("-xattr-sync: fsync: %v", err)
+	}
 }
 
 // ListXAttr implements pathfs.Filesystem.
@@ -94,16 +198,20 @@ func (fs *FS) ListXAttr(path string, context *fuse.Context) ([]string, fuse.Stat
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
-	cNames, err := xattr.LList(cPath)
-	if err != nil {
-		return nil, unpackXattrErr(err)
+	k, status := fs.keysForPath(path)
+	if !status.Ok() {
+		return nil, status
+	}
+	cNames, status := fs.listXattrBacking(path, cPath)
+	if !status.Ok() {
+		return nil, status
 	}
 	names := make([]string, 0, len(cNames))
 	for _, curName := range cNames {
-		if !strings.HasPrefix(curName, xattrStorePrefix) {
+		if !strings.HasPrefix(curName, xattrStorePrefix) || isXattrChunk(curName) {
 			continue
 		}
-		name, err := fs.decryptXattrName(curName)
+		name, err := k.decryptXattrName(curName)
 		if err != nil {
 			tlog.Warn.Printf("ListXAttr: invalid xattr name %q: %v", curName, err)
 			fs.reportMitigatedCorruption(curName)
@@ -114,21 +222,56 @@ func (fs *FS) ListXAttr(path string, context *fuse.Context) ([]string, fuse.Stat
 	return names, fuse.OK
 }
 
+// getXattrBacking, setXattrBacking and listXattrBacking access the encrypted
+// xattrs of "path", whose backing file is "cPath". They are stored in the
+// native xattrs of the backing file, split into chunks if needed, or, with
+// "XAttrSidecar", in the sidecar file.
+func (fs *FS) getXattrBacking(path string, cPath string, cAttr string) ([]byte, fuse.Status) {
+	if fs.args.XAttrSidecar {
+		return fs.sidecarGet(path, cAttr)
+	}
+	cData, err := getXattrChunked(cPath, cAttr)
+	if err != nil {
+		return nil, unpackXattrErr(err)
+	}
+	return cData, fuse.OK
+}
+
+func (fs *FS) setXattrBacking(path string, cPath string, cAttr string, cData []byte, flags int) fuse.Status {
+	if fs.args.XAttrSidecar {
+		return fs.sidecarSet(path, cAttr, cData, flags)
+	}
+	return unpackXattrErr(setXattrChunked(cPath, cAttr, cData, flags))
+}
+
+// listXattrBacking also returns the names of chunks and of foreign xattrs,
+// callers have to filter them.
+func (fs *FS) listXattrBacking(path string, cPath string) ([]string, fuse.Status) {
+	if fs.args.XAttrSidecar {
+		return fs.sidecarList(path)
+	}
+	cNames, err := xattr.LList(cPath)
+	if err != nil {
+		return nil, unpackXattrErr(err)
+	}
+	return cNames, fuse.OK
+}
+
 // encryptXattrName transforms "user.foo" to "user.gocryptfs.a5sAd4XAa47f5as6dAf"
-func (fs *FS) encryptXattrName(attr string) (cAttr string) {
+func (k dirKey) encryptXattrName(attr string) (cAttr string) {
 	// xattr names are encrypted like file names, but with a fixed IV.
-	cAttr = xattrStorePrefix + fs.nameTransform.EncryptName(attr, xattrNameIV)
+	cAttr = xattrStorePrefix + k.nameTransform.EncryptName(attr, xattrNameIV)
 	return cAttr
 }
 
-func (fs *FS) decryptXattrName(cAttr string) (attr string, err error) {
+func (k dirKey) decryptXattrName(cAttr string) (attr string, err error) {
 	// Reject anything that does not start with "user.gocryptfs."
 	if !strings.HasPrefix(cAttr, xattrStorePrefix) {
 		return "", syscall.EINVAL
 	}
 	// Strip "user.gocryptfs." prefix
 	cAttr = cAttr[len(xattrStorePrefix):]
-	attr, err = fs.nameTransform.DecryptName(cAttr, xattrNameIV)
+	attr, err = k.nameTransform.DecryptName(cAttr, xattrNameIV)
 	if err != nil {
 		return "", err
 	}
@@ -139,43 +282,117 @@ func (fs *FS) decryptXattrName(cAttr string) (attr string, err error) {
 // The data is encrypted like a file content block, but without binding it to
 // a file location (block number and file id are set to zero).
 // Special case: an empty value is encrypted to an empty value.
-func (fs *FS) encryptXattrValue(data []byte) (cData []byte) {
+func (k dirKey) encryptXattrValue(data []byte) (cData []byte) {
 	if len(data) == 0 {
 		return []byte{}
 	}
-	return fs.contentEnc.EncryptBlock(data, 0, nil)
+	return k.contentEnc.EncryptBlock(data, 0, nil)
 }
 
 // decryptXattrValue decrypts the xattr value "cData".
-func (fs *FS) decryptXattrValue(cData []byte) (data []byte, err error) {
+func (k dirKey) decryptXattrValue(cData []byte) (data []byte, err error) {
 	if len(cData) == 0 {
 		return []byte{}, nil
 	}
-	data, err1 := fs.contentEnc.DecryptBlock([]byte(cData), 0, nil)
+	data, err1 := k.contentEnc.DecryptBlock([]byte(cData), 0, nil)
 	if err1 == nil {
 		return data, nil
 	}
 	// This backward compatibility is needed to support old
 	// file systems having xattr values base64-encoded.
-	cData, err2 := fs.nameTransform.B64.DecodeString(string(cData))
+	cData, err2 := k.nameTransform.B64.DecodeString(string(cData))
 	if err2 != nil {
 		// Looks like the value was not base64-encoded, but just corrupt.
 		// Return the original decryption error: err1
 		return nil, err1
 	}
-	return fs.contentEnc.DecryptBlock([]byte(cData), 0, nil)
+	return k.contentEnc.DecryptBlock([]byte(cData), 0, nil)
+}
+
+// overwrittenXattrs is called by Rename() in "-preserve-xattr-on-rename"
+// mode before "newPath" is overwritten. It returns the encrypted xattrs of
+// the regular file "newPath", or nil if there is no such file.
+// Errors are logged but not returned, the rename should go ahead anyway.
+func (fs *FS) overwrittenXattrs(newPath string) map[string][]byte {
+	cNewPath, err := fs.getBackingPath(newPath)
+	if err != nil {
+		return nil
+	}
+	var st syscall.Stat_t
+	err = syscall.Lstat(cNewPath, &st)
+	if err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		// Nothing is overwritten, or not a regular file
+		return nil
+	}
+	cNames, status := fs.listXattrBacking(newPath, cNewPath)
+	if !status.Ok() {
+		tlog.Warn.Printf("overwrittenXattrs: list %q: %v", newPath, status)
+		return nil
+	}
+	saved := make(map[string][]byte)
+	for _, cName := range cNames {
+		// Chunks are read together with their xattr
+		if !strings.HasPrefix(cName, xattrStorePrefix) || isXattrChunk(cName) {
+			continue
+		}
+		cData, status := fs.getXattrBacking(newPath, cNewPath, cName)
+		if !status.Ok() {
+			tlog.Warn.Printf("overwrittenXattrs: get %q: %v", newPath, status)
+			continue
+		}
+		saved[cName] = cData
+	}
+	return saved
+}
+
+// preserveXattrs is called by Rename() after "newPath" has been successfully
+// overwritten. It copies the xattrs "saved" by overwrittenXattrs that the
+// incoming file does not have to it. If both files have an xattr of the same
+// name, the value of the incoming file is kept.
+//
+// As xattr values are not bound to a file, we can copy the encrypted names
+// and values without decrypting them.
+// Errors are logged but not returned, the rename has already happened.
+func (fs *FS) preserveXattrs(newPath string, saved map[string][]byte) {
+	if len(saved) == 0 {
+		return
+	}
+	cNewPath, err := fs.getBackingPath(newPath)
+	if err != nil {
+		return
+	}
+	for cName, cData := range saved {
+		// XATTR_CREATE: do not overwrite xattrs that the incoming file already has
+		status := fs.setXattrBacking(newPath, cNewPath, cName, cData, xattr.XATTR_CREATE)
+		if !status.Ok() && status != fuse.Status(syscall.EEXIST) {
+			tlog.Warn.Printf("preserveXattrs: set %q: %v", newPath, status)
+		}
+	}
+	fs.xattrChanged(cNewPath)
 }
 
 // unpackXattrErr unpacks an error value that we got from xattr.LGet/LSet/etc
-// and converts it to a fuse status.
+// and converts it to a fuse status. The errno from the backing filesystem
+// is passed on as it is (ENODATA/ENOATTR, ERANGE, E2BIG, ENOTSUP, ...), also
+// when the *xattr.Error or the errno has been wrapped.
+// Errors that do not contain an errno are logged and mapped to EIO.
 func unpackXattrErr(err error) fuse.Status {
 	if err == nil {
 		return fuse.OK
 	}
-	err2, ok := err.(*xattr.Error)
-	if !ok {
+	var xerr *xattr.Error
+	if errors.As(err, &xerr) {
+		err = xerr.Err
+	}
+	var errno syscall.Errno
+	if !errors.As(err, &errno) || errno == 0 {
 		tlog.Warn.Printf("unpackXattrErr: cannot unpack err=%v", err)
 		return fuse.EIO
 	}
-	return fuse.ToStatus(err2.Err)
+	if errno == syscall.EOVERFLOW {
+		// xattr.get gives up on values larger than 64 MiB. getxattr(2)
+		// reports values that are too big with E2BIG.
+		return fuse.Status(syscall.E2BIG)
+	}
+	return fuse.Status(errno)
 }
@@ -0,0 +1,139 @@
+package fusefrontend
+
+// Encrypted xattr values that are too big for the backing filesystem are
+// split into chunks.
+//
+// The first chunk is stored under the encrypted name "user.gocryptfs.XYZ"
+// itself, chunk N >= 1 under "user.gocryptfs.XYZ@N". "@" is not part of the
+// base64 alphabet, so a chunk name can never be the encrypted name of a user
+// xattr. Chunks are hidden from ListXAttr.
+//
+// All chunks except the last have the same size, which is a power of two and
+// at least xattrChunkMin. This lets GetXAttr skip looking for more chunks
+// for the common case of a small value. An unchunked value that happens to
+// have such a size costs one extra lookup.
+//
+// Writing a chunked value is not atomic. A reader that races with the write
+// sees a mix of old and new chunks, which fails authentication and returns
+// EIO.
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/pkg/xattr"
+)
+
+// xattrChunkSep separates the encrypted xattr name and the chunk number
+const xattrChunkSep = "@"
+
+// xattrChunkMin is the smallest chunk size. When the backing filesystem
+// rejects this, we give up.
+const xattrChunkMin = 1024
+
+// xattrChunkMax is the maximum size of a backing xattr value, XATTR_SIZE_MAX
+// on Linux. Larger values are always chunked. Variable for the tests.
+var xattrChunkMax = 64 * 1024
+
+// xattrChunkName returns the backing xattr name of chunk "i" of "cAttr"
+func xattrChunkName(cAttr string, i int) string {
+	if i == 0 {
+		return cAttr
+	}
+	return fmt.Sprintf("%s%s%d", cAttr, xattrChunkSep, i)
+}
+
+// isXattrChunk returns true if the backing xattr name "cName" is a
+// continuation chunk
+func isXattrChunk(cName string) bool {
+	return strings.Contains(cName, xattrChunkSep)
+}
+
+func isENOATTR(err error) bool {
+	return unpackXattrErr(err) == fuse.Status(xattr.ENOATTR)
+}
+
+// getXattrChunked reads the encrypted value of "cAttr" and all its chunks.
+func getXattrChunked(cPath string, cAttr string) ([]byte, error) {
+	cData, err := xattr.LGet(cPath, cAttr)
+	if err != nil {
+		return nil, err
+	}
+	n := len(cData)
+	if n < xattrChunkMin || n&(n-1) != 0 {
+		// Not a full chunk
+		return cData, nil
+	}
+	for i := 1; ; i++ {
+		chunk, err := xattr.LGet(cPath, xattrChunkName(cAttr, i))
+		if isENOATTR(err) {
+			return cData, nil
+		} else if err != nil {
+			return nil, err
+		}
+		cData = append(cData, chunk...)
+		if len(chunk) != n {
+			return cData, nil
+		}
+	}
+}
+
+// setXattrChunked stores the encrypted value "cData" as "cAttr", split into
+// chunks if it is too big. XATTR_CREATE and XATTR_REPLACE in "flags" apply
+// to the first chunk, so they behave like for an ordinary xattr.
+func setXattrChunked(cPath string, cAttr string, cData []byte, flags int) error {
+	n := len(cData)
+	if n > xattrChunkMax {
+		n = xattrChunkMax
+	}
+	var err error
+	for {
+		err = xattr.LSetWithFlags(cPath, cAttr, cData[:n], flags)
+		if unpackXattrErr(err) != fuse.Status(syscall.E2BIG) || n <= xattrChunkMin {
+			break
+		}
+		// Try the next smaller power of two
+		n = 1 << uint(bits.Len(uint(n-1))-1)
+	}
+	if err != nil {
+		return err
+	}
+	flags &^= xattr.XATTR_CREATE | xattr.XATTR_REPLACE
+	i := 1
+	for ; i*n < len(cData); i++ {
+		end := (i + 1) * n
+		if end > len(cData) {
+			end = len(cData)
+		}
+		err = xattr.LSetWithFlags(cPath, xattrChunkName(cAttr, i), cData[i*n:end], flags)
+		if err != nil {
+			return err
+		}
+	}
+	// The old value may have had more chunks
+	return removeXattrChunks(cPath, cAttr, i)
+}
+
+// removeXattrChunked removes "cAttr" and all its chunks
+func removeXattrChunked(cPath string, cAttr string) error {
+	if err := xattr.LRemove(cPath, cAttr); err != nil {
+		return err
+	}
+	return removeXattrChunks(cPath, cAttr, 1)
+}
+
+// removeXattrChunks removes the chunks of "cAttr", starting at chunk number
+// "from", until one is not found.
+func removeXattrChunks(cPath string, cAttr string, from int) error {
+	for i := from; ; i++ {
+		err := xattr.LRemove(cPath, xattrChunkName(cAttr, i))
+		if isENOATTR(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package fusefrontend
+
+// The read-only virtual xattr "user.gocryptfs.gen" contains a generation
+// number that changes on every modification of the content or the metadata
+// of a file. NFS re-exports and caching clients can compare it to find out
+// if a file has changed.
+//
+// The number is the ctime of the backing file in nanoseconds. The ctime
+// is persistent and changes on every write, truncate and setattr, but its
+// resolution is limited to the kernel clock tick, so two modifications can
+// get the same ctime. For this reason, we remember the last value we have
+// returned for a file and return a bigger one if the file has been modified
+// through gocryptfs since. This part is not persistent, the next mount starts
+// again with the ctime.
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+)
+
+// xattrGenName is the name of the virtual xattr. Like xattrSha256Name, it is
+// not listed by ListXAttr.
+const xattrGenName = "user.gocryptfs.gen"
+
+// genTableMax is the maximum number of remembered generation numbers. When it
+// is reached, the table is cleared.
+const genTableMax = 10000
+
+type genEntry struct {
+	// Last generation number returned
+	last uint64
+	// Modified through gocryptfs since?
+	dirty bool
+}
+
+// genTable holds the state of the files whose generation number has been
+// asked for, indexed by backing inode.
+type genTable struct {
+	// used is set to 1 when the first entry is stored. Until then,
+	// modifications do not have to take the lock. Accessed atomically.
+	used uint32
+	sync.Mutex
+	entries map[openfiletable.QIno]genEntry
+}
+
+// modified must be called after every change to the content or the metadata
+// of inode "qi".
+func (t *genTable) modified(qi openfiletable.QIno) {
+	if atomic.LoadUint32(&t.used) == 0 {
+		return
+	}
+	t.Lock()
+	if e, ok := t.entries[qi]; ok {
+		e.dirty = true
+		t.entries[qi] = e
+	}
+	t.Unlock()
+}
+
+// get returns the generation number of the backing file "st".
+func (t *genTable) get(st *syscall.Stat_t) uint64 {
+	var a fuse.Attr
+	a.FromStat(st)
+	gen := a.Ctime*1e9 + uint64(a.Ctimensec)
+	qi := openfiletable.QInoFromStat(st)
+	t.Lock()
+	defer t.Unlock()
+	if e, ok := t.entries[qi]; ok {
+		if gen < e.last || (e.dirty && gen == e.last) {
+			gen = e.last
+			if e.dirty {
+				gen++
+			}
+		}
+	} else if t.entries == nil || len(t.entries) >= genTableMax {
+		t.entries = make(map[openfiletable.QIno]genEntry)
+	}
+	t.entries[qi] = genEntry{last: gen}
+	atomic.StoreUint32(&t.used, 1)
+	return gen
+}
+
+// modifiedAt calls genTable.modified for the backing file "cName" in
+// "dirfd". The file is only stat'ed if a generation number has been asked
+// for.
+func (fs *FS) modifiedAt(dirfd int, cName string) {
+	if atomic.LoadUint32(&fs.genTable.used) == 0 {
+		return
+	}
+	var st unix.Stat_t
+	if err := syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return
+	}
+	fs.genTable.modified(openfiletable.QIno{Dev: uint64(st.Dev), Ino: uint64(st.Ino)})
+}
+
+// modifiedPath is like modifiedAt for the backing path "cPath".
+func (fs *FS) modifiedPath(cPath string) {
+	if atomic.LoadUint32(&fs.genTable.used) == 0 {
+		return
+	}
+	var st syscall.Stat_t
+	if err := syscall.Lstat(cPath, &st); err != nil {
+		return
+	}
+	fs.genTable.modified(openfiletable.QInoFromStat(&st))
+}
+
+// generation returns the "user.gocryptfs.gen" value of the file at "path".
+func (fs *FS) generation(path string) ([]byte, fuse.Status) {
+	cPath, err := fs.getBackingPath(path)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	var st syscall.Stat_t
+	if err = syscall.Lstat(cPath, &st); err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	return []byte(strconv.FormatUint(fs.genTable.get(&st), 10)), fuse.OK
+}
@@ -3,7 +3,10 @@
 package fusefrontend
 
 import (
+	"syscall"
 	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
 )
 
 func TestDisallowedLinuxAttributes(t *testing.T) {
@@ -11,3 +14,27 @@ func TestDisallowedLinuxAttributes(t *testing.T) {
 		t.Fatalf("Names that don't start with 'user.' should fail")
 	}
 }
+
+// The generation number never goes backwards and only grows beyond the
+// ctime when the file has been modified
+func TestGenTable(t *testing.T) {
+	var tab genTable
+	st := syscall.Stat_t{Ino: 1}
+	st.Ctim.Sec = 10
+	if g := tab.get(&st); g != 10e9 {
+		t.Errorf("want the ctime, got %d", g)
+	}
+	qi := openfiletable.QInoFromStat(&st)
+	tab.modified(qi)
+	if g := tab.get(&st); g != 10e9+1 {
+		t.Errorf("modified: want %d, got %d", uint64(10e9+1), g)
+	}
+	if g := tab.get(&st); g != 10e9+1 {
+		t.Errorf("unmodified: want %d, got %d", uint64(10e9+1), g)
+	}
+	st.Ctim.Sec = 11
+	tab.modified(qi)
+	if g := tab.get(&st); g != 11e9 {
+		t.Errorf("new ctime: want %d, got %d", uint64(11e9), g)
+	}
+}
@@ -0,0 +1,162 @@
+package fusefrontend
+
+// The read-only virtual xattr "user.gocryptfs.sha256" contains the SHA-256
+// hash of the plaintext content of a file.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// xattrSha256Name is the name of the virtual xattr. It is not listed by
+// ListXAttr, so that copying all xattrs does not hash every file.
+const xattrSha256Name = "user.gocryptfs.sha256"
+
+// hashCacheMax is the maximum number of cached hashes. When it is reached,
+// the cache is cleared.
+const hashCacheMax = 10000
+
+type hashCacheEntry struct {
+	// hex-encoded SHA-256
+	sum string
+	// Backing file attributes when the hash was computed. If they are
+	// different, the file has been changed behind our back.
+	size                               uint64
+	mtime, mtimensec, ctime, ctimensec uint64
+}
+
+func newHashCacheEntry(st *syscall.Stat_t, sum string) hashCacheEntry {
+	var a fuse.Attr
+	a.FromStat(st)
+	return hashCacheEntry{
+		sum:       sum,
+		size:      a.Size,
+		mtime:     a.Mtime,
+		mtimensec: uint64(a.Mtimensec),
+		ctime:     a.Ctime,
+		ctimensec: uint64(a.Ctimensec),
+	}
+}
+
+// hashCache holds the hashes of files that have been asked for, indexed by
+// backing inode.
+type hashCache struct {
+	// used is set to 1 when the first hash computation starts. Until then,
+	// writes do not have to take the lock. Accessed atomically.
+	used uint32
+	// gen is incremented by every invalidate() call. Accessed atomically.
+	gen uint64
+	sync.Mutex
+	entries map[openfiletable.QIno]hashCacheEntry
+}
+
+// invalidate drops the hash of inode "qi". Must be called after every change
+// to the content, so that a concurrent computation cannot store the old hash.
+func (c *hashCache) invalidate(qi openfiletable.QIno) {
+	if atomic.LoadUint32(&c.used) == 0 {
+		return
+	}
+	atomic.AddUint64(&c.gen, 1)
+	c.Lock()
+	delete(c.entries, qi)
+	c.Unlock()
+}
+
+// lookup returns the cached hash of the backing file "st", if it is still
+// valid.
+func (c *hashCache) lookup(st *syscall.Stat_t) (string, bool) {
+	if atomic.LoadUint32(&c.used) == 0 {
+		return "", false
+	}
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[openfiletable.QInoFromStat(st)]
+	e2 := newHashCacheEntry(st, e.sum)
+	if !ok || e != e2 {
+		return "", false
+	}
+	return e.sum, true
+}
+
+// begin must be called before a hash is computed. It returns the generation
+// to pass to store(). From now on, invalidate() bumps the generation, so
+// that writes during the computation are noticed.
+func (c *hashCache) begin() uint64 {
+	atomic.StoreUint32(&c.used, 1)
+	return atomic.LoadUint64(&c.gen)
+}
+
+// store caches the hash "sum" of the backing file "st", unless invalidate()
+// has been called since begin() returned "gen".
+func (c *hashCache) store(st *syscall.Stat_t, sum string, gen uint64) {
+	c.Lock()
+	defer c.Unlock()
+	if atomic.LoadUint64(&c.gen) != gen {
+		return
+	}
+	if c.entries == nil || len(c.entries) >= hashCacheMax {
+		c.entries = make(map[openfiletable.QIno]hashCacheEntry)
+	}
+	c.entries[openfiletable.QInoFromStat(st)] = newHashCacheEntry(st, sum)
+}
+
+// contentSha256 returns the hex-encoded SHA-256 of the plaintext content of
+// the file at "path". The hash is computed on the first request, which reads
+// the whole file, and is cached until the file is modified.
+func (fs *FS) contentSha256(path string) ([]byte, fuse.Status) {
+	cPath, err := fs.getBackingPath(path)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	var st syscall.Stat_t
+	if err = syscall.Lstat(cPath, &st); err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return nil, fuse.ENOATTR
+	}
+	if sum, ok := fs.hashCache.lookup(&st); ok {
+		return []byte(sum), fuse.OK
+	}
+	gen := fs.hashCache.begin()
+	// Hashing is not a read by the user, so it must neither burn the file
+	// ("-burn-after-reading") nor update the atime ("-strict-atime")
+	f, status := fs.OpenInternal(path)
+	if !status.Ok() {
+		return nil, status
+	}
+	defer f.Release()
+	// Stat the file we actually read, it may have been replaced
+	if err = syscall.Fstat(f.intFd(), &st); err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	h := sha256.New()
+	buf := make([]byte, fuse.MAX_KERNEL_WRITE)
+	for off := int64(0); ; {
+		result, status := f.Read(buf, off)
+		if !status.Ok() {
+			tlog.Warn.Printf("contentSha256 %q: read at offset %d failed: %v", path, off, status)
+			return nil, status
+		}
+		data, status := result.Bytes(buf)
+		if !status.Ok() {
+			return nil, status
+		}
+		if len(data) == 0 {
+			break
+		}
+		h.Write(data)
+		off += int64(len(data))
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	fs.hashCache.store(&st, sum, gen)
+	return []byte(sum), fuse.OK
+}
@@ -0,0 +1,286 @@
+package fusefrontend
+
+// Extended attributes stored in sidecar files ("XAttrSidecar" feature flag),
+// for backing filesystems that do not support xattrs, like FAT.
+//
+// The xattrs of the backing file CNAME are stored in the file
+// "gocryptfs.xattr.HASH" in the same directory, where HASH is the
+// base64-encoded SHA256 hash of CNAME. The sidecar file contains a JSON
+// object that maps the encrypted xattr names to the encrypted values, both
+// encrypted exactly like they would be stored in native xattrs.
+// The xattrs of the root directory are stored in the root directory itself.
+//
+// Sidecar files are replaced atomically via rename. Hard links do not share
+// their xattrs, every name has its own sidecar file.
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/pkg/xattr"
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// xattrSidecarPrefix is the name prefix of the sidecar files. Encrypted names
+// never contain a ".", so there can be no collision.
+const xattrSidecarPrefix = "gocryptfs.xattr."
+
+// xattrSidecarMax limits the size of a sidecar file we are willing to read
+const xattrSidecarMax = 64 * 1024 * 1024
+
+// xattrSidecar maps encrypted xattr names to encrypted values
+type xattrSidecar map[string][]byte
+
+// sidecarName returns the name of the sidecar file for the backing name
+// "cName".
+func (fs *FS) sidecarName(cName string) string {
+	h := sha256.Sum256([]byte(cName))
+	return xattrSidecarPrefix + fs.nameTransform.B64.EncodeToString(h[:])
+}
+
+// isSidecarName returns true if the backing name "cName" is a sidecar file
+// or a temporary file left behind when writing one.
+func isSidecarName(cName string) bool {
+	return strings.HasPrefix(cName, xattrSidecarPrefix)
+}
+
+// readSidecar reads the sidecar file "name" in "dirfd". A missing sidecar
+// file means that there are no xattrs.
+func (fs *FS) readSidecar(dirfd int, name string) (xattrSidecar, error) {
+	fd, err := syscallcompat.Openat(dirfd, name, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err == syscall.ENOENT {
+		return xattrSidecar{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close()
+	js, err := ioutil.ReadAll(io.LimitReader(f, xattrSidecarMax+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(js) > xattrSidecarMax {
+		tlog.Warn.Printf("readSidecar %q: file is too big", name)
+		return nil, syscall.EIO
+	}
+	m := xattrSidecar{}
+	if err = json.Unmarshal(js, &m); err != nil {
+		tlog.Warn.Printf("readSidecar %q: %v", name, err)
+		fs.reportMitigatedCorruption(name)
+		return nil, syscall.EIO
+	}
+	return m, nil
+}
+
+// writeSidecar atomically replaces the sidecar file "name" in "dirfd" with
+// the content of "m". An empty map deletes the sidecar file.
+func (fs *FS) writeSidecar(dirfd int, name string, m xattrSidecar) error {
+	if len(m) == 0 {
+		err := syscallcompat.Unlinkat(dirfd, name, 0)
+		if err == syscall.ENOENT {
+			return nil
+		}
+		return err
+	}
+	js, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.tmp.%d", name, cryptocore.RandUint64())
+	tmpdirfd := dirfd
+	if fs.args.TmpDir != "" {
+		// "-tmpdir" is on the same filesystem, checked at startup
+		tmp = filepath.Join(fs.args.TmpDir, tmp)
+		tmpdirfd = unix.AT_FDCWD
+	}
+	fd, err := syscallcompat.Openat(tmpdirfd, tmp, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), tmp)
+	_, err = f.Write(js)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = syscallcompat.Renameat(tmpdirfd, tmp, dirfd, name)
+	}
+	if err != nil {
+		syscallcompat.Unlinkat(tmpdirfd, tmp, 0)
+	}
+	return err
+}
+
+// openSidecar returns the directory and the name of the sidecar file of
+// the plaintext path "path". Fails with ENOENT if "path" does not exist.
+// The caller must close dirfd.
+func (fs *FS) openSidecar(path string) (dirfd int, name string, err error) {
+	dirfd, cName, err := fs.openBackingDir(path)
+	if err != nil {
+		return -1, "", err
+	}
+	var st unix.Stat_t
+	err = syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		syscall.Close(dirfd)
+		return -1, "", err
+	}
+	return dirfd, fs.sidecarName(cName), nil
+}
+
+// sidecarGet returns the encrypted value of the encrypted xattr "cAttr".
+func (fs *FS) sidecarGet(path string, cAttr string) ([]byte, fuse.Status) {
+	dirfd, name, err := fs.openSidecar(path)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	defer syscall.Close(dirfd)
+	fs.sidecarLock.Lock()
+	m, err := fs.readSidecar(dirfd, name)
+	fs.sidecarLock.Unlock()
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	cData, ok := m[cAttr]
+	if !ok {
+		return nil, fuse.Status(xattr.ENOATTR)
+	}
+	return cData, fuse.OK
+}
+
+// sidecarList returns the encrypted xattr names.
+func (fs *FS) sidecarList(path string) ([]string, fuse.Status) {
+	dirfd, name, err := fs.openSidecar(path)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	defer syscall.Close(dirfd)
+	fs.sidecarLock.Lock()
+	m, err := fs.readSidecar(dirfd, name)
+	fs.sidecarLock.Unlock()
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	cNames := make([]string, 0, len(m))
+	for cAttr := range m {
+		cNames = append(cNames, cAttr)
+	}
+	return cNames, fuse.OK
+}
+
+// sidecarSet stores the encrypted value "cData" under "cAttr". "flags" are
+// the setxattr(2) flags XATTR_CREATE and XATTR_REPLACE.
+func (fs *FS) sidecarSet(path string, cAttr string, cData []byte, flags int) fuse.Status {
+	return fs.sidecarModify(path, func(m xattrSidecar) error {
+		_, exists := m[cAttr]
+		if flags&xattr.XATTR_CREATE != 0 && exists {
+			return syscall.EEXIST
+		}
+		if flags&xattr.XATTR_REPLACE != 0 && !exists {
+			return xattr.ENOATTR
+		}
+		m[cAttr] = cData
+		return nil
+	})
+}
+
+// sidecarRemove deletes the encrypted xattr "cAttr".
+func (fs *FS) sidecarRemove(path string, cAttr string) fuse.Status {
+	return fs.sidecarModify(path, func(m xattrSidecar) error {
+		if _, exists := m[cAttr]; !exists {
+			return xattr.ENOATTR
+		}
+		delete(m, cAttr)
+		return nil
+	})
+}
+
+// sidecarModify applies "modify" to sidecar file of "path" and writes it
+// back if "modify" did not return an error.
+func (fs *FS) sidecarModify(path string, modify func(xattrSidecar) error) fuse.Status {
+	dirfd, name, err := fs.openSidecar(path)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	defer syscall.Close(dirfd)
+	fs.sidecarLock.Lock()
+	defer fs.sidecarLock.Unlock()
+	m, err := fs.readSidecar(dirfd, name)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	if err = modify(m); err != nil {
+		return fuse.ToStatus(err)
+	}
+	return fuse.ToStatus(fs.writeSidecar(dirfd, name, m))
+}
+
+// sidecarDelete deletes the sidecar file of the backing file "cName" in
+// "dirfd", which has just been deleted.
+func (fs *FS) sidecarDelete(dirfd int, cName string) {
+	if !fs.args.XAttrSidecar {
+		return
+	}
+	err := syscallcompat.Unlinkat(dirfd, fs.sidecarName(cName), 0)
+	if err != nil && err != syscall.ENOENT {
+		tlog.Warn.Printf("sidecarDelete: %v", err)
+	}
+}
+
+// sidecarRename moves the sidecar file along with the backing file that has
+// just been renamed from oldCName to newCName. The xattrs of a file that has
+// been overwritten are dropped. "-preserve-xattr-on-rename" copies them
+// afterwards, see preserveXattrs.
+func (fs *FS) sidecarRename(oldDirfd int, oldCName string, newDirfd int, newCName string) {
+	if !fs.args.XAttrSidecar {
+		return
+	}
+	oldName := fs.sidecarName(oldCName)
+	newName := fs.sidecarName(newCName)
+	fs.sidecarLock.Lock()
+	defer fs.sidecarLock.Unlock()
+	m, err := fs.readSidecar(oldDirfd, oldName)
+	if err != nil {
+		tlog.Warn.Printf("sidecarRename: %v", err)
+		return
+	}
+	if err = fs.writeSidecar(newDirfd, newName, m); err != nil {
+		tlog.Warn.Printf("sidecarRename: %v", err)
+		return
+	}
+	if err = syscallcompat.Unlinkat(oldDirfd, oldName, 0); err != nil && err != syscall.ENOENT {
+		tlog.Warn.Printf("sidecarRename: %v", err)
+	}
+}
+
+// sidecarLink gives the new hard link "newCName" a copy of the xattrs of
+// "oldCName".
+func (fs *FS) sidecarLink(oldDirfd int, oldCName string, newDirfd int, newCName string) {
+	if !fs.args.XAttrSidecar {
+		return
+	}
+	fs.sidecarLock.Lock()
+	defer fs.sidecarLock.Unlock()
+	m, err := fs.readSidecar(oldDirfd, fs.sidecarName(oldCName))
+	if err == nil {
+		err = fs.writeSidecar(newDirfd, fs.sidecarName(newCName), m)
+	}
+	if err != nil {
+		tlog.Warn.Printf("sidecarLink: %v", err)
+	}
+}
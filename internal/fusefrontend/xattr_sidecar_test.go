@@ -0,0 +1,163 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/pkg/xattr"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+func newSidecarTestFS(t *testing.T) (*FS, string) {
+	dir, err := ioutil.TempDir("", "TestXAttrSidecar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = nametransform.WriteDirIV(-1, dir); err != nil {
+		t.Fatal(err)
+	}
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	fs.args.XAttrSidecar = true
+	return fs, dir
+}
+
+// countSidecars returns the number of sidecar files in "dir"
+func countSidecars(t *testing.T, dir string) int {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, e := range entries {
+		if isSidecarName(e.Name()) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestXAttrSidecar(t *testing.T) {
+	fs, dir := newSidecarTestFS(t)
+	defer os.RemoveAll(dir)
+	f, status := fs.Create("foo", syscall.O_RDWR, 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+	val := []byte("bar")
+	if status = fs.SetXAttr("foo", "user.foo", val, 0, nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status = fs.SetXAttr("foo", "user.foo", val, xattr.XATTR_CREATE, nil); status != fuse.Status(syscall.EEXIST) {
+		t.Errorf("XATTR_CREATE on existing xattr: want EEXIST, got %v", status)
+	}
+	if status = fs.SetXAttr("foo", "user.new", val, xattr.XATTR_REPLACE, nil); status != fuse.Status(xattr.ENOATTR) {
+		t.Errorf("XATTR_REPLACE on missing xattr: want ENOATTR, got %v", status)
+	}
+	val2, status := fs.GetXAttr("foo", "user.foo", nil)
+	if !status.Ok() || !bytes.Equal(val, val2) {
+		t.Fatalf("GetXAttr: %v %q", status, val2)
+	}
+	names, status := fs.ListXAttr("foo", nil)
+	if !status.Ok() || len(names) != 1 || names[0] != "user.foo" {
+		t.Errorf("ListXAttr: %v %v", status, names)
+	}
+	if n := countSidecars(t, dir); n != 1 {
+		t.Errorf("want 1 sidecar file, have %d", n)
+	}
+	// Nothing must end up in the backing xattrs
+	cPath, err := fs.getBackingPath("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cNames, _ := xattr.LList(cPath)
+	for _, n := range cNames {
+		if strings.HasPrefix(n, "user.gocryptfs.") {
+			t.Errorf("backing file has xattr %q", n)
+		}
+	}
+	// Sidecar files are hidden
+	entries, status := fs.OpenDir("", nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if len(entries) != 1 || entries[0].Name != "foo" {
+		t.Errorf("OpenDir: %v", entries)
+	}
+	// The xattrs move with the file
+	if status = fs.Rename("foo", "foo2", nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	if val2, status = fs.GetXAttr("foo2", "user.foo", nil); !status.Ok() || !bytes.Equal(val, val2) {
+		t.Errorf("GetXAttr after rename: %v %q", status, val2)
+	}
+	if n := countSidecars(t, dir); n != 1 {
+		t.Errorf("after rename: want 1 sidecar file, have %d", n)
+	}
+	// Removing the last xattr deletes the sidecar
+	if status = fs.RemoveXAttr("foo2", "user.foo", nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status = fs.RemoveXAttr("foo2", "user.foo", nil); status != fuse.Status(xattr.ENOATTR) {
+		t.Errorf("RemoveXAttr on missing xattr: want ENOATTR, got %v", status)
+	}
+	if n := countSidecars(t, dir); n != 0 {
+		t.Errorf("after remove: want 0 sidecar files, have %d", n)
+	}
+	// Unlink deletes the sidecar
+	if status = fs.SetXAttr("foo2", "user.foo", val, 0, nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status = fs.Unlink("foo2", nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	if n := countSidecars(t, dir); n != 0 {
+		t.Errorf("after unlink: want 0 sidecar files, have %d", n)
+	}
+}
+
+// With "-preserve-xattr-on-rename", the xattrs of the overwritten file are
+// copied to the incoming file, but only if the rename succeeds.
+func TestXAttrSidecarPreserve(t *testing.T) {
+	fs, dir := newSidecarTestFS(t)
+	defer os.RemoveAll(dir)
+	fs.args.PreserveXattrOnRename = true
+	for _, n := range []string{"old", "new"} {
+		f, status := fs.Create(n, syscall.O_RDWR, 0600, nil)
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		f.Release()
+	}
+	if status := fs.SetXAttr("old", "user.a", []byte("old"), 0, nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	for _, a := range []string{"user.a", "user.b"} {
+		if status := fs.SetXAttr("new", a, []byte("new"), 0, nil); !status.Ok() {
+			t.Fatal(status)
+		}
+	}
+	// Failed rename: nothing is copied
+	if status := fs.Rename("missing", "new", nil); status.Ok() {
+		t.Fatal("rename of a missing file succeeded")
+	}
+	if _, status := fs.GetXAttr("old", "user.b", nil); status != fuse.Status(xattr.ENOATTR) {
+		t.Errorf("failed rename: want ENOATTR, got %v", status)
+	}
+	if status := fs.Rename("old", "new", nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	for _, tc := range []struct{ attr, want string }{{"user.a", "old"}, {"user.b", "new"}} {
+		val, status := fs.GetXAttr("new", tc.attr, nil)
+		if !status.Ok() || string(val) != tc.want {
+			t.Errorf("%s: want %q, got %q %v", tc.attr, tc.want, val, status)
+		}
+	}
+}
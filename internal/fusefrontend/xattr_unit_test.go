@@ -4,11 +4,26 @@ package fusefrontend
 // "xattr_integration_test.go" in the test/xattr package.
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
 
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/pkg/xattr"
+
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
 )
 
 func newTestFS() *FS {
@@ -24,10 +39,401 @@ func newTestFS() *FS {
 func TestEncryptDecryptXattrName(t *testing.T) {
 	fs := newTestFS()
 	attr1 := "user.foo123456789"
-	cAttr := fs.encryptXattrName(attr1)
+	cAttr := fs.masterKey().encryptXattrName(attr1)
 	t.Logf("cAttr=%v", cAttr)
-	attr2, err := fs.decryptXattrName(cAttr)
+	attr2, err := fs.masterKey().decryptXattrName(cAttr)
 	if attr1 != attr2 || err != nil {
 		t.Fatalf("Decrypt mismatch: %v != %v", attr1, attr2)
 	}
 }
+
+func TestUnpackXattrErr(t *testing.T) {
+	xerr := func(errno error) error {
+		return &xattr.Error{Op: "xattr.LGet", Path: "/foo", Name: "user.bar", Err: errno}
+	}
+	testcases := []struct {
+		err  error
+		want fuse.Status
+	}{
+		{nil, fuse.OK},
+		{xerr(xattr.ENOATTR), fuse.Status(xattr.ENOATTR)},
+		{xerr(syscall.ERANGE), fuse.Status(syscall.ERANGE)},
+		{xerr(syscall.E2BIG), fuse.Status(syscall.E2BIG)},
+		{xerr(syscall.ENOTSUP), fuse.Status(syscall.ENOTSUP)},
+		{xerr(syscall.EOPNOTSUPP), fuse.Status(syscall.EOPNOTSUPP)},
+		{xerr(syscall.EEXIST), fuse.Status(syscall.EEXIST)},
+		{xerr(syscall.EPERM), fuse.EPERM},
+		{xerr(syscall.ENOENT), fuse.ENOENT},
+		{xerr(syscall.ENOSPC), fuse.Status(syscall.ENOSPC)},
+		{xerr(syscall.EDQUOT), fuse.Status(syscall.EDQUOT)},
+		// Value too big for xattr.LGet's buffer
+		{xerr(syscall.EOVERFLOW), fuse.Status(syscall.E2BIG)},
+		// Wrapped
+		{fmt.Errorf("preserveXattrs: %w", xerr(syscall.ENOTSUP)), fuse.Status(syscall.ENOTSUP)},
+		{xerr(&os.PathError{Op: "lgetxattr", Path: "/foo", Err: syscall.EACCES}), fuse.EACCES},
+		{syscall.ENODATA, fuse.Status(syscall.ENODATA)},
+		// No errno
+		{errors.New("something else"), fuse.EIO},
+		{xerr(errors.New("something else")), fuse.EIO},
+		{xerr(syscall.Errno(0)), fuse.EIO},
+	}
+	for i, tc := range testcases {
+		if have := unpackXattrErr(tc.err); have != tc.want {
+			t.Errorf("#%d %v: want %v, have %v", i, tc.err, tc.want, have)
+		}
+	}
+}
+
+// "-debug-xattr": user.gocryptfs.raw.NAME returns the encrypted value
+func TestDebugXattr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestDebugXattr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = nametransform.WriteDirIV(-1, dir); err != nil {
+		t.Fatal(err)
+	}
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	f, status := fs.Create("foo", syscall.O_RDWR, 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+	val := []byte("bar")
+	status = fs.SetXAttr("foo", "user.foo", val, 0, nil)
+	if status == fuse.Status(syscall.EOPNOTSUPP) {
+		t.Skip("backing filesystem does not support xattrs")
+	} else if !status.Ok() {
+		t.Fatal(status)
+	}
+	const rawName = "user.gocryptfs.raw.user.foo"
+	// Not enabled: an ordinary (non-existing) xattr
+	if _, status = fs.GetXAttr("foo", rawName, nil); status.Ok() {
+		t.Error("raw xattr readable without -debug-xattr")
+	}
+	fs.args.DebugXattr = true
+	cVal, status := fs.GetXAttr("foo", rawName, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if bytes.Equal(cVal, val) {
+		t.Error("raw value is not encrypted")
+	}
+	if dec, err := fs.masterKey().decryptXattrValue(cVal); err != nil || !bytes.Equal(dec, val) {
+		t.Errorf("raw value does not decrypt to the plaintext: %q %v", dec, err)
+	}
+	if status = fs.SetXAttr("foo", rawName, val, 0, nil); status != fuse.EPERM {
+		t.Errorf("SetXAttr on raw xattr: want EPERM, got %v", status)
+	}
+	if status = fs.RemoveXAttr("foo", rawName, nil); status != fuse.EPERM {
+		t.Errorf("RemoveXAttr on raw xattr: want EPERM, got %v", status)
+	}
+	names, _ := fs.ListXAttr("foo", nil)
+	if len(names) != 1 || names[0] != "user.foo" {
+		t.Errorf("wrong xattr list: %v", names)
+	}
+}
+
+// TestXattrSync checks that "-xattr-sync" marks an open file for fsync on
+// Flush(). Whether the fsync actually made the xattrs durable cannot be
+// checked without crashing the machine.
+func TestXattrSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestXattrSync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	fs.args.PlaintextNames = true
+	f, status := fs.Create("foo", syscall.O_RDONLY, 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	entry := f.(*File).fileTableEntry
+	for _, enabled := range []bool{false, true} {
+		fs.args.XattrSync = enabled
+		status = fs.SetXAttr("foo", "user.foo", []byte("bar"), 0, nil)
+		if status == fuse.Status(syscall.EOPNOTSUPP) {
+			t.Skip("backing filesystem does not support xattrs")
+		} else if !status.Ok() {
+			t.Fatal(status)
+		}
+		dirty := atomic.LoadUint32(&entry.XattrDirty) == 1
+		if dirty != enabled {
+			t.Errorf("XattrSync=%v: XattrDirty=%v after SetXAttr", enabled, dirty)
+		}
+		if status = f.Flush(); !status.Ok() {
+			t.Fatal(status)
+		}
+		if atomic.LoadUint32(&entry.XattrDirty) != 0 {
+			t.Errorf("XattrSync=%v: XattrDirty still set after Flush", enabled)
+		}
+	}
+	// A file that is not open is synced right away
+	if status = fs.RemoveXAttr("foo", "user.foo", nil); !status.Ok() {
+		t.Fatal(status)
+	}
+}
+
+// TestXattrChunks round-trips a value that is three times as big as the
+// (simulated) backing limit.
+func TestXattrChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestXattrChunks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	fs.args.PlaintextNames = true
+	f, status := fs.Create("foo", syscall.O_RDONLY, 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+	defer func(old int) { xattrChunkMax = old }(xattrChunkMax)
+	xattrChunkMax = xattrChunkMin
+
+	val := bytes.Repeat([]byte("0123456789"), 300)
+	status = fs.SetXAttr("foo", "user.big", val, 0, nil)
+	if status == fuse.Status(syscall.EOPNOTSUPP) || status == fuse.Status(syscall.ENOSPC) {
+		t.Skipf("backing filesystem does not support xattrs of this size: %v", status)
+	} else if !status.Ok() {
+		t.Fatal(status)
+	}
+	cNames, err := xattr.LList(dir + "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cNames) != 3 {
+		t.Errorf("want 3 backing xattrs, got %v", cNames)
+	}
+	got, status := fs.GetXAttr("foo", "user.big", nil)
+	if !status.Ok() || !bytes.Equal(got, val) {
+		t.Errorf("round-trip failed: %v, len %d", status, len(got))
+	}
+	names, _ := fs.ListXAttr("foo", nil)
+	if len(names) != 1 || names[0] != "user.big" {
+		t.Errorf("chunks are visible: %v", names)
+	}
+	if status = fs.SetXAttr("foo", "user.big", val, xattr.XATTR_CREATE, nil); status != fuse.Status(syscall.EEXIST) {
+		t.Errorf("XATTR_CREATE: want EEXIST, got %v", status)
+	}
+	// Shrinking the value removes the chunks that are no longer needed
+	if status = fs.SetXAttr("foo", "user.big", []byte("small"), 0, nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	if cNames, _ = xattr.LList(dir + "/foo"); len(cNames) != 1 {
+		t.Errorf("want 1 backing xattr, got %v", cNames)
+	}
+	if got, _ = fs.GetXAttr("foo", "user.big", nil); string(got) != "small" {
+		t.Errorf("wrong value %q", got)
+	}
+	if status = fs.SetXAttr("foo", "user.big", val, 0, nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status = fs.RemoveXAttr("foo", "user.big", nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	if cNames, _ = xattr.LList(dir + "/foo"); len(cNames) != 0 {
+		t.Errorf("chunks left behind: %v", cNames)
+	}
+}
+
+func TestXattrChunkName(t *testing.T) {
+	fs := newTestFS()
+	// The separator must never show up in an encrypted name
+	for _, attr := range []string{"user.foo", "user.foo@1", "user." + strings.Repeat("@", 100)} {
+		cAttr := fs.masterKey().encryptXattrName(attr)
+		if isXattrChunk(cAttr) {
+			t.Errorf("encrypted name %q of %q looks like a chunk", cAttr, attr)
+		}
+		if c := xattrChunkName(cAttr, 2); !isXattrChunk(c) || c != cAttr+"@2" {
+			t.Errorf("wrong chunk name %q", c)
+		}
+	}
+}
+
+func TestXattrSha256(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestXattrSha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	fs.args.PlaintextNames = true
+	f, status := fs.Create("foo", syscall.O_RDWR, 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	// Decrypts the file through FS and hashes it
+	want := func() string {
+		var content []byte
+		buf := make([]byte, fuse.MAX_KERNEL_WRITE)
+		for off := int64(0); ; {
+			res, status := f.Read(buf, off)
+			if !status.Ok() {
+				t.Fatal(status)
+			}
+			data, _ := res.Bytes(buf)
+			if len(data) == 0 {
+				break
+			}
+			content = append(content, data...)
+			off += int64(len(data))
+		}
+		sum := sha256.Sum256(content)
+		return hex.EncodeToString(sum[:])
+	}
+	check := func(what string) {
+		got, status := fs.GetXAttr("foo", xattrSha256Name, nil)
+		if !status.Ok() {
+			t.Fatalf("%s: %v", what, status)
+		}
+		if w := want(); string(got) != w {
+			t.Errorf("%s: want %s, got %s", what, w, got)
+		}
+	}
+	check("empty file")
+	if _, status = f.Write(bytes.Repeat([]byte("0123456789"), 1000), 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	check("after write")
+	check("cached")
+	if len(fs.hashCache.entries) != 1 {
+		t.Errorf("want 1 cached hash, got %d", len(fs.hashCache.entries))
+	}
+	if _, status = f.Write([]byte("x"), 5000); !status.Ok() {
+		t.Fatal(status)
+	}
+	check("after overwrite")
+	if status = f.Truncate(3000); !status.Ok() {
+		t.Fatal(status)
+	}
+	check("after truncate")
+
+	if status = fs.SetXAttr("foo", xattrSha256Name, []byte("x"), 0, nil); status != fuse.EPERM {
+		t.Errorf("SetXAttr: want EPERM, got %v", status)
+	}
+	if status = fs.RemoveXAttr("foo", xattrSha256Name, nil); status != fuse.EPERM {
+		t.Errorf("RemoveXAttr: want EPERM, got %v", status)
+	}
+	if names, _ := fs.ListXAttr("foo", nil); len(names) != 0 {
+		t.Errorf("virtual xattr is listed: %v", names)
+	}
+	if _, status = fs.GetXAttr("", xattrSha256Name, nil); status != fuse.ENOATTR {
+		t.Errorf("directory: want ENOATTR, got %v", status)
+	}
+}
+
+// A write during the very first hash computation must keep its result out
+// of the cache.
+func TestHashCacheFirstComputation(t *testing.T) {
+	f, err := ioutil.TempFile("", "TestHashCacheFirstComputation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	var st syscall.Stat_t
+	if err = syscall.Fstat(int(f.Fd()), &st); err != nil {
+		t.Fatal(err)
+	}
+	var c hashCache
+	gen := c.begin()
+	c.invalidate(openfiletable.QInoFromStat(&st))
+	c.store(&st, "stale", gen)
+	if sum, ok := c.lookup(&st); ok {
+		t.Errorf("stale hash %q has been cached", sum)
+	}
+}
+
+// "user.gocryptfs.gen" must grow on every modification, even when the
+// modifications are quicker than the ctime resolution.
+func TestXattrGen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestXattrGen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := newTestFS()
+	fs.args.Cipherdir = dir
+	fs.args.PlaintextNames = true
+	f, status := fs.Create("foo", syscall.O_RDWR, 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	gen := func() uint64 {
+		val, status := fs.GetXAttr("foo", xattrGenName, nil)
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		g, err := strconv.ParseUint(string(val), 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return g
+	}
+	last := gen()
+	if g := gen(); g != last {
+		t.Errorf("changed without modification: %d -> %d", last, g)
+	}
+	xattrSupported := true
+	ops := []struct {
+		name string
+		op   func() fuse.Status
+	}{
+		{"write", func() fuse.Status { _, s := f.Write([]byte("foo"), 0); return s }},
+		{"overwrite", func() fuse.Status { _, s := f.Write([]byte("bar"), 0); return s }},
+		{"truncate", func() fuse.Status { return f.Truncate(1) }},
+		{"path truncate", func() fuse.Status { return fs.Truncate("foo", 2, nil) }},
+		{"allocate", func() fuse.Status { return f.Allocate(0, 100, 0) }},
+		{"chmod", func() fuse.Status { return f.Chmod(0640) }},
+		{"path chmod", func() fuse.Status { return fs.Chmod("foo", 0600, nil) }},
+		{"chown", func() fuse.Status { return f.Chown(uint32(os.Getuid()), uint32(os.Getgid())) }},
+		{"path chown", func() fuse.Status { return fs.Chown("foo", uint32(os.Getuid()), uint32(os.Getgid()), nil) }},
+		{"utimens", func() fuse.Status { return f.Utimens(nil, nil) }},
+		{"path utimens", func() fuse.Status { return fs.Utimens("foo", nil, nil, nil) }},
+		{"link", func() fuse.Status { return fs.Link("foo", "bar", nil) }},
+		{"setxattr", func() fuse.Status {
+			s := fs.SetXAttr("foo", "user.foo", []byte("1"), 0, nil)
+			if s == _EOPNOTSUPP {
+				xattrSupported = false
+				return fuse.OK
+			}
+			return s
+		}},
+		{"removexattr", func() fuse.Status {
+			if !xattrSupported {
+				return fuse.OK
+			}
+			return fs.RemoveXAttr("foo", "user.foo", nil)
+		}},
+	}
+	for _, o := range ops {
+		if status = o.op(); !status.Ok() {
+			t.Fatalf("%s: %v", o.name, status)
+		}
+		if o.name == "setxattr" && !xattrSupported {
+			continue
+		}
+		g := gen()
+		if g <= last {
+			t.Errorf("%s: generation did not grow: %d -> %d", o.name, last, g)
+		}
+		last = g
+	}
+	if status = fs.SetXAttr("foo", xattrGenName, []byte("1"), 0, nil); status != fuse.EPERM {
+		t.Errorf("SetXAttr: want EPERM, got %v", status)
+	}
+	if names, _ := fs.ListXAttr("foo", nil); len(names) != 0 {
+		t.Errorf("virtual xattr is listed: %v", names)
+	}
+}
@@ -10,7 +10,13 @@ import (
 	"github.com/rfjakob/gocryptfs/internal/pathiv"
 )
 
-var _ ctlsock.Interface = &ReverseFS{} // Verify that interface is implemented.
+var _ ctlsock.Interface = &ReverseFS{}       // Verify that interface is implemented.
+var _ ctlsock.StatusInterface = &ReverseFS{} // Verify that interface is implemented.
+
+// Status implements ctlsock.StatusInterface
+func (rfs *ReverseFS) Status() ctlsock.Status {
+	return ctlsock.Status{MountID: rfs.args.MountID, Label: rfs.args.Label}
+}
 
 // EncryptPath implements ctlsock.Backend.
 // This is actually not used inside reverse mode, but we implement it because
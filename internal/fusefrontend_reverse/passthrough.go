@@ -0,0 +1,25 @@
+package fusefrontend_reverse
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// isPassthrough returns true if the plaintext file name "pName" has one of
+// the extensions passed to "-passthrough-ext". The content of such files is
+// presented unencrypted, only the name is encrypted.
+func (rfs *ReverseFS) isPassthrough(pName string) bool {
+	if len(rfs.args.PassthroughExt) == 0 {
+		return false
+	}
+	ext := strings.ToLower(filepath.Ext(pName))
+	if ext == "" {
+		return false
+	}
+	for _, e := range rfs.args.PassthroughExt {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
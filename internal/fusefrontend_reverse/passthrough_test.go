@@ -0,0 +1,81 @@
+package fusefrontend_reverse
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// A ".gpg" file must read identically through the reverse view, while other
+// files are still encrypted.
+func TestPassthroughExt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestPassthroughExt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	content := bytes.Repeat([]byte("-----BEGIN PGP MESSAGE-----\n"), 500)
+	for _, n := range []string{"x.gpg", "X.PUB", "x.txt"} {
+		if err = ioutil.WriteFile(filepath.Join(dir, n), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key := make([]byte, cryptocore.KeyLen)
+	cCore := cryptocore.New(key, cryptocore.BackendAESSIV, contentenc.DefaultIVBits, true, false)
+	cEnc := contentenc.New(cCore, contentenc.DefaultBS, false)
+	nameTransform := nametransform.New(cCore.EMECipher, true, true)
+	args := fusefrontend.Args{
+		Cipherdir:      dir,
+		PassthroughExt: []string{".gpg", ".pub"},
+	}
+	rfs := NewFS(args, cEnc, nameTransform)
+
+	read := func(name string) ([]byte, uint64) {
+		cPath, err := rfs.EncryptPath(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cPath == name {
+			t.Fatalf("%q: name is not encrypted", name)
+		}
+		a, status := rfs.GetAttr(cPath, nil)
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		f, status := rfs.Open(cPath, 0, nil)
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		defer f.Release()
+		buf := make([]byte, 2*len(content))
+		res, status := f.Read(buf, 0)
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		data, _ := res.Bytes(buf)
+		return data, a.Size
+	}
+	for _, n := range []string{"x.gpg", "X.PUB"} {
+		data, size := read(n)
+		if !bytes.Equal(data, content) {
+			t.Errorf("%q: content differs from the backing file", n)
+		}
+		if size != uint64(len(content)) {
+			t.Errorf("%q: wrong size %d", n, size)
+		}
+	}
+	data, size := read("x.txt")
+	if bytes.Contains(data, content[:28]) {
+		t.Error("x.txt is not encrypted")
+	}
+	if size != cEnc.PlainSizeToCipherSize(uint64(len(content))) || size != uint64(len(data)) {
+		t.Errorf("x.txt: wrong size %d", size)
+	}
+}
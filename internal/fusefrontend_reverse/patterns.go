@@ -0,0 +1,232 @@
+package fusefrontend_reverse
+
+// "-reverse-patterns-file": exclude plaintext paths using per-directory
+// pattern files in gitignore syntax.
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// patternsRecheck is how long we trust a cached pattern file before we stat
+// it again to see if it has changed.
+const patternsRecheck = time.Second
+
+// patternsMaxSize is the maximum size of a pattern file we read. Larger
+// files are ignored with a warning.
+const patternsMaxSize = 1024 * 1024
+
+// excludeRule is one line of a pattern file.
+type excludeRule struct {
+	// Path segments of the pattern. Unanchored patterns start with "**".
+	segments []string
+	// "!pattern": re-include paths that an earlier rule has excluded
+	negate bool
+	// "pattern/": only match directories
+	dirOnly bool
+}
+
+// parsePatterns parses the contents of a pattern file. The syntax is the one
+// of .gitignore: blank lines and lines starting with "#" are ignored, "!"
+// negates, a trailing "/" only matches directories, a pattern without a
+// slash matches at any depth, "*", "?", "[...]" and "**" work like in git.
+func parsePatterns(data []byte) (rules []excludeRule) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		var r excludeRule
+		if line[0] == '!' {
+			r.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		// A slash at the beginning or in the middle anchors the pattern to
+		// the directory of the pattern file
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimLeft(line, "/")
+		r.segments = strings.Split(line, "/")
+		if !anchored {
+			r.segments = append([]string{"**"}, r.segments...)
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// match returns true if "relPath", relative to the directory that contains
+// the pattern file, matches the rule.
+func (r *excludeRule) match(relPath string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	return matchSegments(r.segments, strings.Split(relPath, "/"))
+}
+
+// matchSegments matches path segments against pattern segments. "**" matches
+// zero or more segments, everything else is matched with path.Match.
+func matchSegments(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// Trailing "**" matches everything
+			if len(pattern) == 1 {
+				return len(name) > 0
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		ok, err := path.Match(pattern[0], name[0])
+		if err != nil || !ok {
+			return false
+		}
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+	return len(name) == 0
+}
+
+// cachedPatterns are the parsed rules of one pattern file.
+type cachedPatterns struct {
+	rules []excludeRule
+	// When we have last looked at the file
+	checked time.Time
+	// Identity of the file when we parsed it. Zero if it did not exist.
+	ino   uint64
+	size  int64
+	mtime time.Time
+}
+
+// patternMatcher decides which plaintext paths the pattern files exclude.
+type patternMatcher struct {
+	// Plaintext root directory
+	root string
+	// Name of the pattern files, for example ".gocryptfs.exclude"
+	fileName string
+
+	sync.Mutex
+	// Indexed by relative plaintext directory path
+	cache map[string]*cachedPatterns
+}
+
+func newPatternMatcher(root string, fileName string) *patternMatcher {
+	return &patternMatcher{
+		root:     root,
+		fileName: fileName,
+		cache:    make(map[string]*cachedPatterns),
+	}
+}
+
+// rulesFor returns the rules from the pattern file in plaintext directory
+// "dir". The file is reloaded if it has changed.
+func (m *patternMatcher) rulesFor(dir string) []excludeRule {
+	m.Lock()
+	defer m.Unlock()
+	c := m.cache[dir]
+	now := time.Now()
+	if c != nil && now.Sub(c.checked) < patternsRecheck {
+		return c.rules
+	}
+	n := &cachedPatterns{checked: now}
+	fi, err := os.Lstat(path.Join(m.root, dir, m.fileName))
+	if err == nil && fi.Mode().IsRegular() {
+		n.ino = fi.Sys().(*syscall.Stat_t).Ino
+		n.size = fi.Size()
+		n.mtime = fi.ModTime()
+	}
+	if c != nil && c.ino == n.ino && c.size == n.size && c.mtime.Equal(n.mtime) {
+		// Unchanged
+		c.checked = now
+		return c.rules
+	}
+	if n.ino != 0 {
+		n.rules = m.load(dir)
+	}
+	m.cache[dir] = n
+	return n.rules
+}
+
+// load reads and parses the pattern file in "dir", safe against symlink
+// races.
+func (m *patternMatcher) load(dir string) []excludeRule {
+	dirfd, err := syscallcompat.OpenDirNofollow(m.root, dir)
+	if err != nil {
+		return nil
+	}
+	fd, err := openNoatime(dirfd, m.fileName, syscall.O_RDONLY|syscall.O_NOFOLLOW)
+	syscall.Close(dirfd)
+	if err != nil {
+		tlog.Warn.Printf("-reverse-patterns-file: cannot open %q: %v", path.Join(dir, m.fileName), err)
+		return nil
+	}
+	f := os.NewFile(uintptr(fd), m.fileName)
+	defer f.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(f, patternsMaxSize+1))
+	if err != nil || len(data) > patternsMaxSize {
+		tlog.Warn.Printf("-reverse-patterns-file: ignoring %q: too large or unreadable (%v)", path.Join(dir, m.fileName), err)
+		return nil
+	}
+	tlog.Debug.Printf("-reverse-patterns-file: loaded %q", path.Join(dir, m.fileName))
+	return parsePatterns(data)
+}
+
+// excluded returns true if the relative plaintext path "pPath" is excluded
+// by the pattern files. Like in git, a path is excluded if any of its parent
+// directories is excluded, and "!" cannot re-include a path below an
+// excluded directory.
+func (m *patternMatcher) excluded(pPath string, isDir bool) bool {
+	if pPath == "" {
+		return false
+	}
+	parts := strings.Split(pPath, "/")
+	for i := 1; i <= len(parts); i++ {
+		if m.excludedSelf(parts[:i], i < len(parts) || isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludedSelf looks at the path "parts" on its own, ignoring the parent
+// directories. Pattern files deeper in the tree take precedence over the
+// ones above them, and later lines over earlier ones.
+func (m *patternMatcher) excludedSelf(parts []string, isDir bool) bool {
+	excluded := false
+	for d := 0; d < len(parts); d++ {
+		rules := m.rulesFor(path.Join(parts[:d]...))
+		rel := path.Join(parts[d:]...)
+		for i := range rules {
+			if rules[i].match(rel, isDir) {
+				excluded = !rules[i].negate
+			}
+		}
+	}
+	return excluded
+}
@@ -0,0 +1,182 @@
+package fusefrontend_reverse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+)
+
+func TestMatchPatterns(t *testing.T) {
+	rules := parsePatterns([]byte(`
+# comment
+*.tmp
+/top
+build/
+a/**/z
+\#hash
+`))
+	testcases := []struct {
+		path  string
+		isDir bool
+		match bool
+	}{
+		{"x.tmp", false, true},
+		{"foo/x.tmp", false, true},
+		{"x.tmpx", false, false},
+		{"top", false, true},
+		{"foo/top", false, false},
+		{"build", true, true},
+		{"build", false, false},
+		{"foo/build", true, true},
+		{"a/z", false, true},
+		{"a/b/c/z", false, true},
+		{"b/a/z", false, false},
+		{"#hash", false, true},
+		{"comment", false, false},
+	}
+	for _, tc := range testcases {
+		match := false
+		for i := range rules {
+			if rules[i].match(tc.path, tc.isDir) {
+				match = true
+			}
+		}
+		if match != tc.match {
+			t.Errorf("%q (dir=%v): want match=%v, got %v", tc.path, tc.isDir, tc.match, match)
+		}
+	}
+}
+
+func writePatterns(t *testing.T, path string, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Nested pattern files: deeper files take precedence, "!" re-includes,
+// and nothing below an excluded directory comes back.
+func TestPatternMatcherNested(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestPatternMatcherNested")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"sub/deeper", "build/sub"} {
+		if err = os.MkdirAll(filepath.Join(dir, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const name = ".gocryptfs.exclude"
+	writePatterns(t, filepath.Join(dir, name), "*.tmp\nbuild/\n")
+	writePatterns(t, filepath.Join(dir, "sub", name), "!keep.tmp\nsecret\n")
+	writePatterns(t, filepath.Join(dir, "build/sub", name), "!*\n")
+	m := newPatternMatcher(dir, name)
+	testcases := []struct {
+		path     string
+		isDir    bool
+		excluded bool
+	}{
+		{"", true, false},
+		{name, false, false},
+		{"a.tmp", false, true},
+		{"keep.tmp", false, true},
+		{"sub/a.tmp", false, true},
+		{"sub/keep.tmp", false, false},
+		{"sub/deeper/keep.tmp", false, false},
+		{"sub/secret", false, true},
+		{"secret", false, false},
+		{"sub/secret/x", false, true},
+		{"build", true, true},
+		{"build/sub/x", false, true},
+	}
+	for _, tc := range testcases {
+		if e := m.excluded(tc.path, tc.isDir); e != tc.excluded {
+			t.Errorf("%q: want excluded=%v, got %v", tc.path, tc.excluded, e)
+		}
+	}
+}
+
+// A changed pattern file must be picked up after patternsRecheck.
+func TestPatternMatcherReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestPatternMatcherReload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	const name = ".gocryptfs.exclude"
+	m := newPatternMatcher(dir, name)
+	if m.excluded("foo", false) {
+		t.Fatal("foo excluded without a pattern file")
+	}
+	// Expire the cache instead of sleeping
+	expire := func() {
+		for _, c := range m.cache {
+			c.checked = time.Time{}
+		}
+	}
+	writePatterns(t, filepath.Join(dir, name), "foo\n")
+	expire()
+	if !m.excluded("foo", false) {
+		t.Fatal("new pattern file not picked up")
+	}
+	writePatterns(t, filepath.Join(dir, name), "bar\nbaz\n")
+	expire()
+	if m.excluded("foo", false) || !m.excluded("bar", false) {
+		t.Error("changed pattern file not picked up")
+	}
+	os.Remove(filepath.Join(dir, name))
+	expire()
+	if m.excluded("bar", false) {
+		t.Error("deleted pattern file still active")
+	}
+}
+
+// isExcluded and OpenDir must honor the pattern files.
+func TestReverseFSPatterns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestReverseFSPatterns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	const name = ".gocryptfs.exclude"
+	writePatterns(t, filepath.Join(dir, name), "*.log\n")
+	writePatterns(t, filepath.Join(dir, "x.log"), "")
+	writePatterns(t, filepath.Join(dir, "x.txt"), "")
+	rfs := ReverseFS{
+		args: fusefrontend.Args{
+			Cipherdir:      dir,
+			PlaintextNames: true,
+			PatternsFile:   name,
+		},
+		patterns: newPatternMatcher(dir, name),
+	}
+	if !rfs.isExcluded("x.log") {
+		t.Error("x.log should be excluded")
+	}
+	if rfs.isExcluded("x.txt") {
+		t.Error("x.txt should not be excluded")
+	}
+	entries, status := rfs.OpenDir("", nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	have := make(map[string]bool)
+	for _, e := range entries {
+		have[e.Name] = true
+	}
+	if have["x.log"] || !have["x.txt"] || !have[name] {
+		t.Errorf("wrong directory listing: %v", entries)
+	}
+	// Filtering keeps the entry types
+	entries = rfs.filterPatterns("", []fuse.DirEntry{{Name: "d.log", Mode: syscall.S_IFDIR}})
+	if len(entries) != 0 {
+		t.Errorf("d.log should have been filtered: %v", entries)
+	}
+}
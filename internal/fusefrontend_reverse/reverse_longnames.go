@@ -68,7 +68,7 @@ func (rfs *ReverseFS) findLongnameParent(dir string, dirIV []byte, longname stri
 		tlog.Warn.Printf("findLongnameParent: OpenDirNofollow failed: %v\n", err)
 		return "", err
 	}
-	fd, err := syscallcompat.Openat(dirfd, filepath.Base(dir), syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	fd, err := openNoatime(dirfd, filepath.Base(dir), syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW)
 	syscall.Close(dirfd)
 	if err != nil {
 		tlog.Warn.Printf("findLongnameParent: Openat failed: %v\n", err)
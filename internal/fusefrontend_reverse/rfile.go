@@ -30,6 +30,11 @@ type reverseFile struct {
 	block0IV []byte
 	// Content encryption helper
 	contentEnc *contentenc.ContentEnc
+	// Number of retries on transient read errors, "-io-retries"
+	ioRetries int
+	// passthrough is set for files matching "-passthrough-ext". Their
+	// content is returned as-is, without header and encryption.
+	passthrough bool
 }
 
 var inodeTable syncmap.Map
@@ -52,7 +57,7 @@ func (rfs *ReverseFS) newFile(relPath string) (*reverseFile, fuse.Status) {
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
-	fd, err := syscallcompat.Openat(dirfd, filepath.Base(pRelPath), syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	fd, err := openNoatime(dirfd, filepath.Base(pRelPath), syscall.O_RDONLY|syscall.O_NOFOLLOW)
 	syscall.Close(dirfd)
 	if err != nil {
 		return nil, fuse.ToStatus(err)
@@ -100,11 +105,13 @@ func (rfs *ReverseFS) newFile(relPath string) (*reverseFile, fuse.Status) {
 		ID:      derivedIVs.ID,
 	}
 	return &reverseFile{
-		File:       nodefs.NewDefaultFile(),
-		fd:         os.NewFile(uintptr(fd), pRelPath),
-		header:     header,
-		block0IV:   derivedIVs.Block0IV,
-		contentEnc: rfs.contentEnc,
+		File:        nodefs.NewDefaultFile(),
+		fd:          os.NewFile(uintptr(fd), pRelPath),
+		header:      header,
+		block0IV:    derivedIVs.Block0IV,
+		contentEnc:  rfs.contentEnc,
+		ioRetries:   rfs.args.IORetries,
+		passthrough: rfs.isPassthrough(pRelPath),
 	}, fuse.OK
 }
 
@@ -141,7 +148,7 @@ func (rf *reverseFile) readBackingFile(off uint64, length uint64) (out []byte, e
 	// Read the backing plaintext in one go
 	alignedOffset, alignedLength := contentenc.JointPlaintextRange(blocks)
 	plaintext := make([]byte, int(alignedLength))
-	n, err := rf.fd.ReadAt(plaintext, int64(alignedOffset))
+	n, err := syscallcompat.ReadAtRetry(rf.fd, plaintext, int64(alignedOffset), rf.ioRetries)
 	if err != nil && err != io.EOF {
 		tlog.Warn.Printf("readBackingFile: ReadAt: %s", err.Error())
 		return nil, err
@@ -167,6 +174,14 @@ func (rf *reverseFile) readBackingFile(off uint64, length uint64) (out []byte, e
 
 // Read - FUSE call
 func (rf *reverseFile) Read(buf []byte, ioff int64) (resultData fuse.ReadResult, status fuse.Status) {
+	if rf.passthrough {
+		n, err := syscallcompat.ReadAtRetry(rf.fd, buf, ioff, rf.ioRetries)
+		if err != nil && err != io.EOF {
+			tlog.Warn.Printf("reverseFile.Read: passthrough ReadAt: %v", err)
+			return nil, fuse.ToStatus(err)
+		}
+		return fuse.ReadResultData(buf[:n]), fuse.OK
+	}
 	length := uint64(len(buf))
 	off := uint64(ioff)
 	var out bytes.Buffer
@@ -40,6 +40,9 @@ type ReverseFS struct {
 	contentEnc *contentenc.ContentEnc
 	// Relative ciphertext paths to exclude (hide) from the user. Used by -exclude.
 	cExclude []string
+	// Per-directory pattern files. Used by -reverse-patterns-file, nil
+	// otherwise.
+	patterns *patternMatcher
 }
 
 var _ pathfs.FileSystem = &ReverseFS{}
@@ -76,6 +79,9 @@ func NewFS(args fusefrontend.Args, c *contentenc.ContentEnc, n *nametransform.Na
 		}
 		tlog.Debug.Printf("-exclude: %v -> %v", fs.args.Exclude, fs.cExclude)
 	}
+	if args.PatternsFile != "" {
+		fs.patterns = newPatternMatcher(args.Cipherdir, args.PatternsFile)
+	}
 	return fs
 }
 
@@ -91,7 +97,7 @@ func relDir(path string) string {
 }
 
 // isExcluded finds out if relative ciphertext path "relPath" is excluded
-// (used when -exclude is passed by the user)
+// (used when -exclude or -reverse-patterns-file is passed by the user)
 func (rfs *ReverseFS) isExcluded(relPath string) bool {
 	for _, e := range rfs.cExclude {
 		// If the root dir is excluded, everything is excluded.
@@ -107,7 +113,54 @@ func (rfs *ReverseFS) isExcluded(relPath string) bool {
 			return true
 		}
 	}
-	return false
+	return rfs.isExcludedByPatterns(relPath)
+}
+
+// isExcludedByPatterns finds out if relative ciphertext path "relPath" is
+// excluded by a -reverse-patterns-file. Virtual files share the fate of the
+// file or directory they belong to.
+func (rfs *ReverseFS) isExcludedByPatterns(relPath string) bool {
+	if rfs.patterns == nil || rfs.isTranslatedConfig(relPath) {
+		return false
+	}
+	if rfs.isDirIV(relPath) {
+		relPath = relDir(relPath)
+	} else if rfs.isNameFile(relPath) {
+		relPath = strings.TrimSuffix(relPath, nametransform.LongNameSuffix)
+	}
+	if relPath == "" {
+		return false
+	}
+	pPath, err := rfs.decryptPath(relPath)
+	if err != nil {
+		return false
+	}
+	var st syscall.Stat_t
+	err = syscall.Lstat(filepath.Join(rfs.args.Cipherdir, pPath), &st)
+	isDir := err == nil && st.Mode&syscall.S_IFMT == syscall.S_IFDIR
+	return rfs.patterns.excluded(pPath, isDir)
+}
+
+// filterPatterns removes the entries of plaintext directory "relPath" that
+// are excluded by a -reverse-patterns-file.
+func (rfs *ReverseFS) filterPatterns(relPath string, entries []fuse.DirEntry) []fuse.DirEntry {
+	if rfs.patterns == nil {
+		return entries
+	}
+	filtered := entries[:0]
+	for _, entry := range entries {
+		// The config file is never hidden
+		if relPath == "" && entry.Name == configfile.ConfReverseName && !rfs.args.ConfigCustom {
+			filtered = append(filtered, entry)
+			continue
+		}
+		isDir := entry.Mode&syscall.S_IFMT == syscall.S_IFDIR
+		if rfs.patterns.excluded(filepath.Join(relPath, entry.Name), isDir) {
+			continue
+		}
+		filtered = append(filtered, entry)
+	}
+	return filtered
 }
 
 // isDirIV determines if the path points to a gocryptfs.diriv file
@@ -150,18 +203,7 @@ func (rfs *ReverseFS) GetAttr(relPath string, context *fuse.Context) (*fuse.Attr
 	}
 	// Handle "gocryptfs.conf"
 	if rfs.isTranslatedConfig(relPath) {
-		absConfPath, _ := rfs.abs(configfile.ConfReverseName, nil)
-		var st syscall.Stat_t
-		err := syscall.Lstat(absConfPath, &st)
-		if err != nil {
-			return nil, fuse.ToStatus(err)
-		}
-		var a fuse.Attr
-		a.FromStat(&st)
-		if rfs.args.ForceOwner != nil {
-			a.Owner = *rfs.args.ForceOwner
-		}
-		return &a, fuse.OK
+		return rfs.configAttr()
 	}
 	// Handle virtual files (gocryptfs.diriv, *.name)
 	var f nodefs.File
@@ -207,9 +249,11 @@ func (rfs *ReverseFS) GetAttr(relPath string, context *fuse.Context) (*fuse.Attr
 	var a fuse.Attr
 	st2 := syscallcompat.Unix2syscall(st)
 	a.FromStat(&st2)
-	// Calculate encrypted file size
+	// Calculate encrypted file size. Passthrough files keep their size.
 	if a.IsRegular() {
-		a.Size = rfs.contentEnc.PlainSizeToCipherSize(a.Size)
+		if !rfs.isPassthrough(name) {
+			a.Size = rfs.contentEnc.PlainSizeToCipherSize(a.Size)
+		}
 	} else if a.IsSymlink() {
 		var linkTarget string
 		var readlinkStatus fuse.Status
@@ -259,7 +303,11 @@ func (rfs *ReverseFS) Open(relPath string, flags uint32, context *fuse.Context)
 		return nil, fuse.ENOENT
 	}
 	if rfs.isTranslatedConfig(relPath) {
-		return rfs.loopbackfs.Open(configfile.ConfReverseName, flags, context)
+		f, status := rfs.loopbackfs.Open(configfile.ConfReverseName, flags, context)
+		if !status.Ok() {
+			return nil, status
+		}
+		return &configFile{File: f, rfs: rfs}, fuse.OK
 	}
 	if rfs.isDirIV(relPath) {
 		return rfs.newDirIVFile(relPath)
@@ -309,7 +357,7 @@ func (rfs *ReverseFS) OpenDir(cipherPath string, context *fuse.Context) ([]fuse.
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
-	fd, err := syscallcompat.Openat(dirfd, filepath.Base(relPath), syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	fd, err := openNoatime(dirfd, filepath.Base(relPath), syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW)
 	syscall.Close(dirfd)
 	if err != nil {
 		return nil, fuse.ToStatus(err)
@@ -319,6 +367,9 @@ func (rfs *ReverseFS) OpenDir(cipherPath string, context *fuse.Context) ([]fuse.
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
+	// Filter out entries excluded by pattern files while we still know
+	// the plaintext names
+	entries = rfs.filterPatterns(relPath, entries)
 	if rfs.args.PlaintextNames {
 		return rfs.openDirPlaintextnames(cipherPath, entries)
 	}
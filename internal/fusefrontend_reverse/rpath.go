@@ -64,6 +64,9 @@ func (rfs *ReverseFS) rDecryptName(cName string, dirIV []byte, pDir string) (pNa
 // decryptPath decrypts a relative ciphertext path to a relative plaintext
 // path.
 func (rfs *ReverseFS) decryptPath(relPath string) (string, error) {
+	if rfs.args.TooDeep(relPath) {
+		return "", syscall.ELOOP
+	}
 	if rfs.args.PlaintextNames || relPath == "" {
 		return relPath, nil
 	}
@@ -0,0 +1,75 @@
+package fusefrontend_reverse
+
+// Timestamps in reverse mode
+//
+// Backup tools decide what to copy by the timestamps. The encrypted view
+// must show the timestamps of the plaintext files, and gocryptfs must not
+// change them:
+//
+// * Files and directories are opened with O_NOATIME where allowed, so that
+//   reading them through the encrypted view does not update the atime.
+// * Virtual gocryptfs.diriv files and gocryptfs.conf have the timestamps of
+//   their parent directory instead of the time they were created. A
+//   gocryptfs.diriv has no backing file, and .gocryptfs.reverse.conf is
+//   rewritten by "-passwd" even though the files do not change. Virtual
+//   .name files have the timestamps of the file they belong to.
+
+import (
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+)
+
+// openNoatime opens "name" in "dirfd" with O_NOATIME. O_NOATIME is only
+// allowed for the owner of the file (or with CAP_FOWNER), otherwise we fall
+// back to a normal open.
+func openNoatime(dirfd int, name string, flags int) (int, error) {
+	fd, err := syscallcompat.Openat(dirfd, name, flags|syscallcompat.O_NOATIME, 0)
+	if err == syscall.EPERM && syscallcompat.O_NOATIME != 0 {
+		fd, err = syscallcompat.Openat(dirfd, name, flags, 0)
+	}
+	return fd, err
+}
+
+// configAttr returns the attributes of the virtual "gocryptfs.conf", which
+// is ".gocryptfs.reverse.conf" with the timestamps of the root directory.
+func (rfs *ReverseFS) configAttr() (*fuse.Attr, fuse.Status) {
+	absConfPath, _ := rfs.abs(configfile.ConfReverseName, nil)
+	var st, rootSt syscall.Stat_t
+	if err := syscall.Lstat(absConfPath, &st); err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	if err := syscall.Lstat(rfs.args.Cipherdir, &rootSt); err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	var a, root fuse.Attr
+	a.FromStat(&st)
+	root.FromStat(&rootSt)
+	a.Atime, a.Atimensec = root.Atime, root.Atimensec
+	a.Mtime, a.Mtimensec = root.Mtime, root.Mtimensec
+	a.Ctime, a.Ctimensec = root.Ctime, root.Ctimensec
+	if rfs.args.ForceOwner != nil {
+		a.Owner = *rfs.args.ForceOwner
+	}
+	return &a, fuse.OK
+}
+
+// configFile is the open "gocryptfs.conf". Like GetAttr on the path, fstat
+// returns the timestamps of the root directory.
+type configFile struct {
+	nodefs.File
+	rfs *ReverseFS
+}
+
+// GetAttr - FUSE call
+func (f *configFile) GetAttr(a *fuse.Attr) fuse.Status {
+	attr, status := f.rfs.configAttr()
+	if status.Ok() {
+		*a = *attr
+	}
+	return status
+}
@@ -0,0 +1,131 @@
+package fusefrontend_reverse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+type timestamps struct {
+	atime, mtime, ctime time.Time
+}
+
+func attrTimes(a *fuse.Attr) timestamps {
+	return timestamps{
+		atime: time.Unix(int64(a.Atime), int64(a.Atimensec)),
+		mtime: time.Unix(int64(a.Mtime), int64(a.Mtimensec)),
+		ctime: time.Unix(int64(a.Ctime), int64(a.Ctimensec)),
+	}
+}
+
+func lstatTimes(t *testing.T, path string) timestamps {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err != nil {
+		t.Fatal(err)
+	}
+	var a fuse.Attr
+	a.FromStat(&st)
+	return attrTimes(&a)
+}
+
+// The encrypted view must show the timestamps of the plaintext files, and
+// reading through it must not change them.
+func TestTimestamps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestTimestamps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = os.Mkdir(dir+"/sub", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(dir+"/sub/file", []byte("content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(dir+"/"+configfile.ConfReverseName, []byte("{}"), 0400); err != nil {
+		t.Fatal(err)
+	}
+	// An atime before the mtime makes even "relatime" mounts update the
+	// atime on the next read
+	old := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	for _, p := range []string{dir + "/sub/file", dir + "/sub", dir} {
+		if err = os.Chtimes(p, old, old.Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key := make([]byte, cryptocore.KeyLen)
+	cCore := cryptocore.New(key, cryptocore.BackendAESSIV, contentenc.DefaultIVBits, true, false)
+	cEnc := contentenc.New(cCore, contentenc.DefaultBS, false)
+	nameTransform := nametransform.New(cCore.EMECipher, true, true)
+	rfs := NewFS(fusefrontend.Args{Cipherdir: dir}, cEnc, nameTransform)
+
+	check := func(what string, cPath string, want timestamps) {
+		a, status := rfs.GetAttr(cPath, nil)
+		if !status.Ok() {
+			t.Fatalf("%s: %v", what, status)
+		}
+		if have := attrTimes(a); have != want {
+			t.Errorf("%s: want %v, have %v", what, want, have)
+		}
+	}
+	cSub, err := rfs.EncryptPath("sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cFile, err := rfs.EncryptPath("sub/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileTimes := lstatTimes(t, dir+"/sub/file")
+	subTimes := lstatTimes(t, dir+"/sub")
+	rootTimes := lstatTimes(t, dir)
+	check("file", cFile, fileTimes)
+	check("dir", cSub, subTimes)
+	check("diriv", filepath.Join(cSub, nametransform.DirIVFilename), subTimes)
+	check("root diriv", nametransform.DirIVFilename, rootTimes)
+	check("config", configfile.ConfDefaultName, rootTimes)
+
+	// Read everything
+	f, status := rfs.Open(cFile, syscall.O_RDONLY, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, status = f.Read(make([]byte, 4096), 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+	if _, status = rfs.OpenDir(cSub, nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, status = rfs.OpenDir("", nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	cf, status := rfs.Open(configfile.ConfDefaultName, syscall.O_RDONLY, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	var a fuse.Attr
+	if status = cf.GetAttr(&a); !status.Ok() || attrTimes(&a) != rootTimes {
+		t.Errorf("open config: want %v, have %v %v", rootTimes, attrTimes(&a), status)
+	}
+	cf.Release()
+
+	if have := lstatTimes(t, dir+"/sub/file"); have != fileTimes {
+		t.Errorf("reading changed the timestamps of the file: %v -> %v", fileTimes, have)
+	}
+	if have := lstatTimes(t, dir+"/sub"); have != subTimes {
+		t.Errorf("listing changed the timestamps of the dir: %v -> %v", subTimes, have)
+	}
+	check("file after reading", cFile, fileTimes)
+}
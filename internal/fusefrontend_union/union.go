@@ -0,0 +1,703 @@
+// Package fusefrontend_union stacks a writable gocryptfs filesystem ("upper")
+// on top of a read-only one ("lower"), similar to what overlayfs does for
+// plaintext directories. Reads fall through to the lower layer, everything
+// that modifies a file first copies it to the upper layer ("copy-up").
+//
+// Deleted lower entries are hidden by whiteouts in the upper layer. A
+// whiteout is a symlink with the name of the deleted entry that points to
+// WhiteoutTarget. As names and symlink targets are encrypted by the upper
+// filesystem, whiteouts cannot be told apart from other symlinks in the
+// ciphertext. A directory that replaces a deleted lower directory is marked
+// "opaque" by an entry called OpaqueName, which hides the contents of the
+// lower directory.
+package fusefrontend_union
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+const (
+	// WhiteoutTarget is the symlink target that marks a whiteout.
+	WhiteoutTarget = ".gocryptfs.whiteout"
+	// OpaqueName is the name of the entry that marks a directory as opaque.
+	// Users cannot create or see entries with this name.
+	OpaqueName = ".gocryptfs.opaque"
+	// Buffer size for copying file contents
+	copyUpBufSize = 128 * 1024
+)
+
+// UnionFS implements the go-fuse virtual filesystem interface.
+type UnionFS struct {
+	// Embed a default implementation that returns ENOSYS for everything we
+	// do not implement
+	pathfs.FileSystem
+	lower pathfs.FileSystem
+	upper pathfs.FileSystem
+	// Serializes all operations that modify the upper layer, so that
+	// copy-up and whiteout handling see a consistent state.
+	lock sync.Mutex
+}
+
+var _ pathfs.FileSystem = &UnionFS{} // Verify that interface is implemented.
+
+// NewFS returns a union of "lower" and "upper". "lower" is never modified.
+func NewFS(lower pathfs.FileSystem, upper pathfs.FileSystem) *UnionFS {
+	return &UnionFS{
+		FileSystem: pathfs.NewDefaultFileSystem(),
+		lower:      lower,
+		upper:      upper,
+	}
+}
+
+// parentDir returns the parent directory of "name" in the "" = root
+// convention of pathfs.
+func parentDir(name string) string {
+	d := filepath.Dir(name)
+	if d == "." {
+		return ""
+	}
+	return d
+}
+
+// isReserved returns true if the last path component of "name" cannot be
+// used by the user.
+func isReserved(name string) bool {
+	return filepath.Base(name) == OpaqueName
+}
+
+// isAbsent returns true if "status" means that there is no entry
+func isAbsent(status fuse.Status) bool {
+	return status == fuse.ENOENT || status == fuse.Status(syscall.ENOTDIR) ||
+		status == fuse.Status(syscall.ELOOP)
+}
+
+// isWhiteout returns true if the upper entry "name" with attributes "a" is a
+// whiteout.
+func (u *UnionFS) isWhiteout(name string, a *fuse.Attr, context *fuse.Context) bool {
+	if !a.IsSymlink() {
+		return false
+	}
+	target, status := u.upper.Readlink(name, context)
+	return status.Ok() && target == WhiteoutTarget
+}
+
+// isOpaque returns true if the upper directory "dir" hides the lower one.
+func (u *UnionFS) isOpaque(dir string, context *fuse.Context) bool {
+	_, status := u.upper.GetAttr(filepath.Join(dir, OpaqueName), context)
+	return status.Ok()
+}
+
+// lowerVisible returns false if a lower entry at "name" would be hidden by a
+// whiteout or by an opaque or non-directory upper entry on the way there.
+// An upper entry at "name" itself does not count.
+func (u *UnionFS) lowerVisible(name string, context *fuse.Context) bool {
+	if name == "" {
+		return true
+	}
+	parts := strings.Split(name, "/")
+	for i := range parts {
+		p := strings.Join(parts[:i+1], "/")
+		a, status := u.upper.GetAttr(p, context)
+		if !status.Ok() {
+			// Nothing below can exist in upper either
+			return true
+		}
+		if u.isWhiteout(p, a, context) {
+			return false
+		}
+		if i < len(parts)-1 && (!a.IsDir() || u.isOpaque(p, context)) {
+			return false
+		}
+	}
+	return true
+}
+
+// inLower returns true if "name" exists in the lower layer and is not hidden
+// by an upper entry on the way there.
+func (u *UnionFS) inLower(name string, context *fuse.Context) bool {
+	if !u.lowerVisible(name, context) {
+		return false
+	}
+	_, status := u.lower.GetAttr(name, context)
+	return status.Ok()
+}
+
+// lookup finds the layer "name" lives in and returns its attributes.
+func (u *UnionFS) lookup(name string, context *fuse.Context) (layer pathfs.FileSystem, a *fuse.Attr, status fuse.Status) {
+	if isReserved(name) {
+		return nil, nil, fuse.ENOENT
+	}
+	a, status = u.upper.GetAttr(name, context)
+	if status.Ok() {
+		if u.isWhiteout(name, a, context) {
+			return nil, nil, fuse.ENOENT
+		}
+		return u.upper, a, fuse.OK
+	}
+	if !isAbsent(status) {
+		return nil, nil, status
+	}
+	if !u.lowerVisible(name, context) {
+		return nil, nil, fuse.ENOENT
+	}
+	a, status = u.lower.GetAttr(name, context)
+	if !status.Ok() {
+		return nil, nil, status
+	}
+	return u.lower, a, fuse.OK
+}
+
+// exists returns true if "name" is visible in the union
+func (u *UnionFS) exists(name string, context *fuse.Context) bool {
+	_, _, status := u.lookup(name, context)
+	return status.Ok()
+}
+
+// removeWhiteout deletes the whiteout at "name", if there is one.
+// The caller must hold u.lock.
+func (u *UnionFS) removeWhiteout(name string, context *fuse.Context) (removed bool, status fuse.Status) {
+	a, status := u.upper.GetAttr(name, context)
+	if !status.Ok() || !u.isWhiteout(name, a, context) {
+		return false, fuse.OK
+	}
+	status = u.upper.Unlink(name, context)
+	return status.Ok(), status
+}
+
+// createWhiteout hides the lower entry "name".
+// The caller must hold u.lock.
+func (u *UnionFS) createWhiteout(name string, context *fuse.Context) fuse.Status {
+	status := u.copyUp(parentDir(name), context)
+	if !status.Ok() {
+		return status
+	}
+	return u.upper.Symlink(WhiteoutTarget, name, context)
+}
+
+// copyUp makes sure that "name" and its parent directories exist in the
+// upper layer, copying them from the lower layer if needed. Directories are
+// created empty, their lower contents stay visible through the merge in
+// OpenDir.
+// The caller must hold u.lock.
+func (u *UnionFS) copyUp(name string, context *fuse.Context) fuse.Status {
+	if name == "" {
+		return fuse.OK
+	}
+	layer, a, status := u.lookup(name, context)
+	if !status.Ok() {
+		return status
+	}
+	if layer == u.upper {
+		return fuse.OK
+	}
+	status = u.copyUp(parentDir(name), context)
+	if !status.Ok() {
+		return status
+	}
+	tlog.Debug.Printf("union: copy-up %q", name)
+	switch a.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		status = u.upper.Mkdir(name, a.Mode&07777, context)
+	case syscall.S_IFREG:
+		status = u.copyUpFile(name, a, context)
+	case syscall.S_IFLNK:
+		var target string
+		target, status = u.lower.Readlink(name, context)
+		if status.Ok() {
+			status = u.upper.Symlink(target, name, context)
+		}
+	default:
+		status = u.upper.Mknod(name, a.Mode, a.Rdev, context)
+	}
+	if !status.Ok() {
+		tlog.Warn.Printf("union: copy-up of %q failed: %v", name, status)
+		return status
+	}
+	u.copyUpMetadata(name, a, context)
+	return fuse.OK
+}
+
+// copyUpFile copies the contents of the regular file "name" to the upper
+// layer.
+func (u *UnionFS) copyUpFile(name string, a *fuse.Attr, context *fuse.Context) fuse.Status {
+	src, status := u.lower.Open(name, syscall.O_RDONLY, context)
+	if !status.Ok() {
+		return status
+	}
+	defer src.Release()
+	dst, status := u.upper.Create(name, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL, a.Mode&07777, context)
+	if !status.Ok() {
+		return status
+	}
+	status = copyFileData(dst, src)
+	dst.Release()
+	if !status.Ok() {
+		u.upper.Unlink(name, context)
+	}
+	return status
+}
+
+func copyFileData(dst nodefs.File, src nodefs.File) fuse.Status {
+	buf := make([]byte, copyUpBufSize)
+	var off int64
+	for {
+		result, status := src.Read(buf, off)
+		if !status.Ok() {
+			return status
+		}
+		data, status := result.Bytes(buf)
+		if !status.Ok() {
+			return status
+		}
+		// EOF
+		if len(data) == 0 {
+			return dst.Flush()
+		}
+		_, status = dst.Write(data, off)
+		if !status.Ok() {
+			return status
+		}
+		off += int64(len(data))
+	}
+}
+
+// copyUpMetadata copies xattrs, timestamps and, if we are root, ownership.
+// Errors are ignored, like "cp -a" does on filesystems that do not support
+// some of this.
+func (u *UnionFS) copyUpMetadata(name string, a *fuse.Attr, context *fuse.Context) {
+	attrs, _ := u.lower.ListXAttr(name, context)
+	for _, attr := range attrs {
+		data, status := u.lower.GetXAttr(name, attr, context)
+		if status.Ok() {
+			u.upper.SetXAttr(name, attr, data, 0, context)
+		}
+	}
+	if os.Getuid() == 0 {
+		u.upper.Chown(name, a.Uid, a.Gid, context)
+	}
+	if !a.IsSymlink() {
+		atime := time.Unix(int64(a.Atime), int64(a.Atimensec))
+		mtime := time.Unix(int64(a.Mtime), int64(a.Mtimensec))
+		u.upper.Utimens(name, &atime, &mtime, context)
+	}
+}
+
+// copyUpLocked takes the lock and copies "name" up.
+func (u *UnionFS) copyUpLocked(name string, context *fuse.Context) fuse.Status {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.copyUp(name, context)
+}
+
+// prepareCreate checks that "name" can be created and makes room for it in
+// the upper layer. It returns whether a whiteout was removed.
+// The caller must hold u.lock.
+func (u *UnionFS) prepareCreate(name string, context *fuse.Context) (hadWhiteout bool, status fuse.Status) {
+	if isReserved(name) {
+		return false, fuse.EPERM
+	}
+	if u.exists(name, context) {
+		return false, fuse.Status(syscall.EEXIST)
+	}
+	status = u.copyUp(parentDir(name), context)
+	if !status.Ok() {
+		return false, status
+	}
+	return u.removeWhiteout(name, context)
+}
+
+// String implements pathfs.Filesystem.
+func (u *UnionFS) String() string {
+	return "gocryptfs-union"
+}
+
+// GetAttr implements pathfs.Filesystem.
+func (u *UnionFS) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	layer, a, status := u.lookup(name, context)
+	if status.Ok() && layer == u.upper && a.IsDir() && !u.isOpaque(name, context) && u.inLower(name, context) {
+		// The subdirectories of a merged directory are spread over both
+		// layers, so the nlink of the upper one is too low. Like overlayfs,
+		// report 1, which tells "find" that the number of subdirectories is
+		// not known.
+		a.Nlink = 1
+	}
+	return a, status
+}
+
+// OpenDir implements pathfs.Filesystem.
+// The entries of the upper directory are merged with the ones of the lower
+// directory, unless the upper directory is opaque. Upper entries win.
+func (u *UnionFS) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	layer, a, status := u.lookup(name, context)
+	if !status.Ok() {
+		return nil, status
+	}
+	if !a.IsDir() {
+		return nil, fuse.Status(syscall.ENOTDIR)
+	}
+	var out []fuse.DirEntry
+	// Names that hide lower entries
+	seen := make(map[string]bool)
+	mergeLower := true
+	if layer == u.upper {
+		entries, status := u.upper.OpenDir(name, context)
+		if !status.Ok() {
+			return nil, status
+		}
+		for _, e := range entries {
+			if e.Name == OpaqueName {
+				mergeLower = false
+				continue
+			}
+			seen[e.Name] = true
+			if e.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+				child := filepath.Join(name, e.Name)
+				a, status := u.upper.GetAttr(child, context)
+				if status.Ok() && u.isWhiteout(child, a, context) {
+					continue
+				}
+			}
+			out = append(out, e)
+		}
+		mergeLower = mergeLower && u.inLower(name, context)
+	}
+	if mergeLower {
+		entries, status := u.lower.OpenDir(name, context)
+		if !status.Ok() {
+			return nil, status
+		}
+		for _, e := range entries {
+			if !seen[e.Name] {
+				out = append(out, e)
+			}
+		}
+	}
+	return out, fuse.OK
+}
+
+// Open implements pathfs.Filesystem.
+func (u *UnionFS) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY || flags&syscall.O_TRUNC != 0 {
+		status := u.copyUpLocked(name, context)
+		if !status.Ok() {
+			return nil, status
+		}
+		return u.upper.Open(name, flags, context)
+	}
+	layer, _, status := u.lookup(name, context)
+	if !status.Ok() {
+		return nil, status
+	}
+	return layer.Open(name, flags, context)
+}
+
+// Create implements pathfs.Filesystem.
+func (u *UnionFS) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	_, status := u.prepareCreate(name, context)
+	if !status.Ok() {
+		return nil, status
+	}
+	return u.upper.Create(name, flags, mode, context)
+}
+
+// Mkdir implements pathfs.Filesystem.
+// If the new directory replaces a deleted lower directory, it is marked
+// opaque so the old lower contents do not reappear.
+func (u *UnionFS) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	hadWhiteout, status := u.prepareCreate(name, context)
+	if !status.Ok() {
+		return status
+	}
+	status = u.upper.Mkdir(name, mode, context)
+	if !status.Ok() {
+		if hadWhiteout {
+			u.createWhiteout(name, context)
+		}
+		return status
+	}
+	if hadWhiteout {
+		status = u.upper.Symlink(WhiteoutTarget, filepath.Join(name, OpaqueName), context)
+		if !status.Ok() {
+			tlog.Warn.Printf("union: Mkdir %q: could not create opaque marker: %v", name, status)
+			u.upper.Rmdir(name, context)
+			u.createWhiteout(name, context)
+		}
+	}
+	return status
+}
+
+// Mknod implements pathfs.Filesystem.
+func (u *UnionFS) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	_, status := u.prepareCreate(name, context)
+	if !status.Ok() {
+		return status
+	}
+	return u.upper.Mknod(name, mode, dev, context)
+}
+
+// Symlink implements pathfs.Filesystem.
+func (u *UnionFS) Symlink(target string, linkName string, context *fuse.Context) fuse.Status {
+	if target == WhiteoutTarget {
+		// Would be mistaken for a whiteout
+		return fuse.EINVAL
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	_, status := u.prepareCreate(linkName, context)
+	if !status.Ok() {
+		return status
+	}
+	return u.upper.Symlink(target, linkName, context)
+}
+
+// Link implements pathfs.Filesystem.
+// A lower file is copied up before linking to it.
+func (u *UnionFS) Link(oldName string, newName string, context *fuse.Context) fuse.Status {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	status := u.copyUp(oldName, context)
+	if !status.Ok() {
+		return status
+	}
+	_, status = u.prepareCreate(newName, context)
+	if !status.Ok() {
+		return status
+	}
+	return u.upper.Link(oldName, newName, context)
+}
+
+// Unlink implements pathfs.Filesystem.
+func (u *UnionFS) Unlink(name string, context *fuse.Context) fuse.Status {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	layer, a, status := u.lookup(name, context)
+	if !status.Ok() {
+		return status
+	}
+	if a.IsDir() {
+		return fuse.Status(syscall.EISDIR)
+	}
+	if layer == u.upper {
+		status = u.upper.Unlink(name, context)
+		if !status.Ok() || !u.inLower(name, context) {
+			return status
+		}
+	}
+	return u.createWhiteout(name, context)
+}
+
+// Rmdir implements pathfs.Filesystem.
+func (u *UnionFS) Rmdir(name string, context *fuse.Context) fuse.Status {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.rmdir(name, context)
+}
+
+// rmdir removes the directory "name" if it is empty in the union.
+// The caller must hold u.lock.
+func (u *UnionFS) rmdir(name string, context *fuse.Context) fuse.Status {
+	layer, a, status := u.lookup(name, context)
+	if !status.Ok() {
+		return status
+	}
+	if !a.IsDir() {
+		return fuse.Status(syscall.ENOTDIR)
+	}
+	entries, status := u.OpenDir(name, context)
+	if !status.Ok() {
+		return status
+	}
+	for _, e := range entries {
+		if e.Name != "." && e.Name != ".." {
+			return fuse.Status(syscall.ENOTEMPTY)
+		}
+	}
+	if layer == u.upper {
+		// The upper directory may still contain whiteouts and the opaque
+		// marker
+		raw, _ := u.upper.OpenDir(name, context)
+		for _, e := range raw {
+			if e.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+				u.upper.Unlink(filepath.Join(name, e.Name), context)
+			}
+		}
+		status = u.upper.Rmdir(name, context)
+		if !status.Ok() || !u.inLower(name, context) {
+			return status
+		}
+	}
+	return u.createWhiteout(name, context)
+}
+
+// Rename implements pathfs.Filesystem.
+// Like overlayfs without "redirect_dir", renaming a directory that has
+// contents in the lower layer returns EXDEV. mv(1) then falls back to
+// copying.
+func (u *UnionFS) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	_, srcA, status := u.lookup(oldName, context)
+	if !status.Ok() {
+		return status
+	}
+	if isReserved(newName) {
+		return fuse.EPERM
+	}
+	_, dstA, dstStatus := u.lookup(newName, context)
+	if dstStatus.Ok() {
+		if srcA.IsDir() && !dstA.IsDir() {
+			return fuse.Status(syscall.ENOTDIR)
+		}
+		if !srcA.IsDir() && dstA.IsDir() {
+			return fuse.Status(syscall.EISDIR)
+		}
+	}
+	if srcA.IsDir() && u.inLower(oldName, context) {
+		return fuse.Status(syscall.EXDEV)
+	}
+	if dstStatus.Ok() && dstA.IsDir() {
+		// Fails with ENOTEMPTY if the target is not empty
+		status = u.rmdir(newName, context)
+		if !status.Ok() {
+			return status
+		}
+	}
+	status = u.copyUp(oldName, context)
+	if !status.Ok() {
+		return status
+	}
+	status = u.copyUp(parentDir(newName), context)
+	if !status.Ok() {
+		return status
+	}
+	_, status = u.removeWhiteout(newName, context)
+	if !status.Ok() {
+		return status
+	}
+	status = u.upper.Rename(oldName, newName, context)
+	if !status.Ok() || !u.inLower(oldName, context) {
+		return status
+	}
+	return u.createWhiteout(oldName, context)
+}
+
+// Readlink implements pathfs.Filesystem.
+func (u *UnionFS) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	layer, _, status := u.lookup(name, context)
+	if !status.Ok() {
+		return "", status
+	}
+	return layer.Readlink(name, context)
+}
+
+// Access implements pathfs.Filesystem.
+func (u *UnionFS) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	layer, _, status := u.lookup(name, context)
+	if !status.Ok() {
+		return status
+	}
+	status = layer.Access(name, mode, context)
+	if layer == u.lower && status == fuse.EROFS && mode&unix.W_OK != 0 {
+		// The lower layer may be on read-only media, but writes go to the
+		// upper layer anyway.
+		status = layer.Access(name, mode&^unix.W_OK, context)
+	}
+	return status
+}
+
+// Chmod implements pathfs.Filesystem.
+func (u *UnionFS) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	status := u.copyUpLocked(name, context)
+	if !status.Ok() {
+		return status
+	}
+	return u.upper.Chmod(name, mode, context)
+}
+
+// Chown implements pathfs.Filesystem.
+func (u *UnionFS) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	status := u.copyUpLocked(name, context)
+	if !status.Ok() {
+		return status
+	}
+	return u.upper.Chown(name, uid, gid, context)
+}
+
+// Utimens implements pathfs.Filesystem.
+func (u *UnionFS) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	status := u.copyUpLocked(name, context)
+	if !status.Ok() {
+		return status
+	}
+	return u.upper.Utimens(name, atime, mtime, context)
+}
+
+// Truncate implements pathfs.Filesystem.
+func (u *UnionFS) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	status := u.copyUpLocked(name, context)
+	if !status.Ok() {
+		return status
+	}
+	return u.upper.Truncate(name, size, context)
+}
+
+// GetXAttr implements pathfs.Filesystem.
+func (u *UnionFS) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	layer, _, status := u.lookup(name, context)
+	if !status.Ok() {
+		return nil, status
+	}
+	return layer.GetXAttr(name, attr, context)
+}
+
+// ListXAttr implements pathfs.Filesystem.
+func (u *UnionFS) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	layer, _, status := u.lookup(name, context)
+	if !status.Ok() {
+		return nil, status
+	}
+	return layer.ListXAttr(name, context)
+}
+
+// SetXAttr implements pathfs.Filesystem.
+func (u *UnionFS) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	status := u.copyUpLocked(name, context)
+	if !status.Ok() {
+		return status
+	}
+	return u.upper.SetXAttr(name, attr, data, flags, context)
+}
+
+// RemoveXAttr implements pathfs.Filesystem.
+func (u *UnionFS) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	status := u.copyUpLocked(name, context)
+	if !status.Ok() {
+		return status
+	}
+	return u.upper.RemoveXAttr(name, attr, context)
+}
+
+// StatFs implements pathfs.Filesystem.
+// New data goes to the upper layer, so that is what we report.
+func (u *UnionFS) StatFs(name string) *fuse.StatfsOut {
+	return u.upper.StatFs("")
+}
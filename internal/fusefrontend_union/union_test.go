@@ -0,0 +1,211 @@
+package fusefrontend_union
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// newLayer creates an empty gocryptfs filesystem in a temporary directory.
+// Each layer gets its own random key.
+func newLayer(t *testing.T) (*fusefrontend.FS, string) {
+	dir, err := ioutil.TempDir("", "gocryptfs-union")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nametransform.WriteDirIV(-1, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := cryptocore.RandBytes(cryptocore.KeyLen)
+	cCore := cryptocore.New(key, cryptocore.BackendGoGCM, contentenc.DefaultIVBits, true, false)
+	cEnc := contentenc.New(cCore, contentenc.DefaultBS, false)
+	nameTransform := nametransform.New(cCore.EMECipher, true, true)
+	args := fusefrontend.Args{Cipherdir: dir, LongNames: true}
+	return fusefrontend.NewFS(args, cEnc, nameTransform), dir
+}
+
+func create(t *testing.T, fs *fusefrontend.FS, name string, content string) {
+	f, status := fs.Create(name, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL, 0600, nil)
+	if !status.Ok() {
+		t.Fatalf("Create %q: %v", name, status)
+	}
+	_, status = f.Write([]byte(content), 0)
+	if !status.Ok() {
+		t.Fatalf("Write %q: %v", name, status)
+	}
+	f.Release()
+}
+
+func read(t *testing.T, u *UnionFS, name string) string {
+	f, status := u.Open(name, syscall.O_RDONLY, nil)
+	if !status.Ok() {
+		t.Fatalf("Open %q: %v", name, status)
+	}
+	defer f.Release()
+	buf := make([]byte, 1000)
+	result, status := f.Read(buf, 0)
+	if !status.Ok() {
+		t.Fatalf("Read %q: %v", name, status)
+	}
+	data, _ := result.Bytes(buf)
+	return string(data)
+}
+
+func list(t *testing.T, u *UnionFS, name string) []string {
+	entries, status := u.OpenDir(name, nil)
+	if !status.Ok() {
+		t.Fatalf("OpenDir %q: %v", name, status)
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Name == "." || e.Name == ".." {
+			continue
+		}
+		names = append(names, e.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func equal(a []string, b ...string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// snapshot returns a listing of the lower ciphertext dir with sizes and
+// mtimes, to check that it was not modified.
+func snapshot(t *testing.T, dir string) string {
+	var out string
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		out += fmt.Sprintf("%s %d %v\n", path, fi.Size(), fi.ModTime())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestUnion(t *testing.T) {
+	lower, lowerDir := newLayer(t)
+	defer os.RemoveAll(lowerDir)
+	upper, upperDir := newLayer(t)
+	defer os.RemoveAll(upperDir)
+	lower.Mkdir("dir", 0700, nil)
+	lower.Mkdir("dir/sub", 0700, nil)
+	create(t, lower, "dir/a", "lower a")
+	create(t, lower, "dir/b", "lower b")
+	create(t, lower, "dir/sub/c", "lower c")
+	before := snapshot(t, lowerDir)
+
+	u := NewFS(lower, upper)
+	// Reads fall through
+	if c := read(t, u, "dir/a"); c != "lower a" {
+		t.Errorf("read: %q", c)
+	}
+	// Copy-up on write
+	f, status := u.Open("dir/a", syscall.O_WRONLY, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Write([]byte("upper"), 0)
+	f.Release()
+	if c := read(t, u, "dir/a"); c != "upper a" {
+		t.Errorf("after copy-up: %q", c)
+	}
+	// New files go to upper, directories are merged
+	nf, status := u.Create("dir/new", syscall.O_WRONLY|syscall.O_CREAT, 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	nf.Release()
+	if l := list(t, u, "dir"); !equal(l, "a", "b", "new", "sub") {
+		t.Errorf("merged listing: %v", l)
+	}
+	// Deleting a lower file creates a whiteout
+	if status = u.Unlink("dir/b", nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, status = u.GetAttr("dir/b", nil); status != fuse.ENOENT {
+		t.Errorf("deleted file still visible: %v", status)
+	}
+	if l := list(t, u, "dir"); !equal(l, "a", "new", "sub") {
+		t.Errorf("listing after delete: %v", l)
+	}
+	// ...and it can be recreated
+	create2, status := u.Create("dir/b", syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL, 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	create2.Release()
+	if c := read(t, u, "dir/b"); c != "" {
+		t.Errorf("recreated file has old content: %q", c)
+	}
+	// Directory replaced after deletion must be opaque
+	if status = u.Unlink("dir/sub/c", nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status = u.Rmdir("dir/sub", nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, status = u.GetAttr("dir/sub/c", nil); status != fuse.ENOENT {
+		t.Errorf("file in deleted dir still visible: %v", status)
+	}
+	if status = u.Mkdir("dir/sub", 0700, nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	if l := list(t, u, "dir/sub"); len(l) != 0 {
+		t.Errorf("recreated dir is not empty: %v", l)
+	}
+	if status = u.Mkdir("dir/sub/"+OpaqueName, 0700, nil); status != fuse.EPERM {
+		t.Errorf("creating a reserved name: %v", status)
+	}
+	// Renaming a lower file
+	if status = u.Rename("dir/new", "dir/renamed", nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	if status = u.Rename("dir/a", "a2", nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	if l := list(t, u, ""); !equal(l, "a2", "dir") {
+		t.Errorf("root listing: %v", l)
+	}
+	if l := list(t, u, "dir"); !equal(l, "b", "renamed", "sub") {
+		t.Errorf("listing after rename: %v", l)
+	}
+	// Directories with lower contents cannot be renamed
+	if status = u.Rename("dir", "dir2", nil); status != fuse.Status(syscall.EXDEV) {
+		t.Errorf("dir rename: want EXDEV, have %v", status)
+	}
+	// The lower layer is untouched
+	if after := snapshot(t, lowerDir); after != before {
+		t.Errorf("lower layer was modified:\n%s\n%s", before, after)
+	}
+	// Whiteouts are encrypted symlinks in the upper layer and the lower
+	// layer stays readable on its own
+	if _, status = lower.GetAttr("dir/b", nil); !status.Ok() {
+		t.Errorf("lower dir/b: %v", status)
+	}
+}
@@ -0,0 +1,17 @@
+// Package mlock keeps secret keys in memory that cannot be swapped to disk.
+package mlock
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	mlockWarn     sync.Once
+	mlockFailures uint32
+)
+
+// Failures returns how many LockedCopy calls could not lock their memory.
+func Failures() uint32 {
+	return atomic.LoadUint32(&mlockFailures)
+}
@@ -0,0 +1,6 @@
+package mlock
+
+// madviseDontdump is not supported on MacOS.
+func madviseDontdump(buf []byte) error {
+	return nil
+}
@@ -0,0 +1,10 @@
+package mlock
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// madviseDontdump excludes "buf" from core dumps.
+func madviseDontdump(buf []byte) error {
+	return unix.Madvise(buf, unix.MADV_DONTDUMP)
+}
@@ -0,0 +1,78 @@
+package mlock
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+// smapsEntry returns the lines of /proc/self/smaps that describe the mapping
+// starting at "addr".
+func smapsEntry(t *testing.T, addr uintptr) []string {
+	f, err := os.Open("/proc/self/smaps")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer f.Close()
+	prefix := fmt.Sprintf("%x-", addr)
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		l := scanner.Text()
+		if strings.HasPrefix(l, prefix) {
+			lines = []string{l}
+		} else if len(lines) > 0 {
+			// Attribute lines look like "Locked: 4 kB", the next mapping
+			// starts with an address range
+			if !strings.HasSuffix(strings.Fields(l)[0], ":") {
+				break
+			}
+			lines = append(lines, l)
+		}
+	}
+	if len(lines) == 0 {
+		t.Fatalf("no mapping found at %x", addr)
+	}
+	return lines
+}
+
+func TestLockedCopy(t *testing.T) {
+	key := bytes.Repeat([]byte{0xaa}, 32)
+	before := Failures()
+	buf := LockedCopy(key)
+	defer FreeLocked(buf)
+	if !bytes.Equal(buf, key) {
+		t.Fatal("content mismatch")
+	}
+	if Failures() != before {
+		t.Skip("mlock failed, RLIMIT_MEMLOCK is probably too low")
+	}
+	var locked, dontdump bool
+	for _, l := range smapsEntry(t, uintptr(unsafe.Pointer(&buf[0]))) {
+		if strings.HasPrefix(l, "Locked:") && strings.Fields(l)[1] != "0" {
+			locked = true
+		}
+		if strings.HasPrefix(l, "VmFlags:") && strings.Contains(l, " dd") {
+			dontdump = true
+		}
+	}
+	if !locked {
+		t.Error("key memory is not locked")
+	}
+	if !dontdump {
+		t.Error("key memory is not excluded from core dumps")
+	}
+}
+
+func TestFreeLockedHeap(t *testing.T) {
+	// Must not crash on memory that has not been allocated by LockedCopy
+	buf := []byte{1, 2, 3}
+	FreeLocked(buf)
+	if buf[0] != 0 {
+		t.Error("buffer was not zeroed")
+	}
+}
@@ -0,0 +1,31 @@
+// +build !linux,!darwin
+
+package mlock
+
+// There is no mlock(2) on Windows. The crypto packages use LockedCopy and
+// must still build there, see crossbuild.bash.
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+)
+
+// LockedCopy returns a copy of "key" on the Go heap. The memory cannot be
+// locked on this platform, which is counted as a failure.
+func LockedCopy(key []byte) []byte {
+	atomic.AddUint32(&mlockFailures, 1)
+	return append([]byte{}, key...)
+}
+
+// FreeLocked overwrites "buf" with zeros.
+func FreeLocked(buf []byte) {
+	for i := range buf {
+		buf[i] = 0
+	}
+}
+
+// LockAll is not supported on this platform.
+func LockAll() error {
+	return fmt.Errorf("mlockall is not supported on %s", runtime.GOOS)
+}
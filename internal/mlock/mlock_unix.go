@@ -0,0 +1,67 @@
+// +build linux darwin
+
+package mlock
+
+import (
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// LockedCopy returns a copy of "key" in memory that has been allocated
+// using mmap(2) outside of the Go heap. The memory is mlock'ed so it cannot
+// be swapped to disk, and, on Linux, excluded from core dumps.
+//
+// If mlock fails, usually because RLIMIT_MEMLOCK is too low, a warning is
+// printed (once) and the copy is returned anyway. Use Failures to check
+// if this happened.
+//
+// Free the memory using FreeLocked.
+func LockedCopy(key []byte) []byte {
+	if len(key) == 0 {
+		return []byte{}
+	}
+	buf, err := unix.Mmap(-1, 0, len(key), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANON)
+	if err != nil {
+		tlog.Warn.Printf("LockedCopy: mmap failed: %v", err)
+		atomic.AddUint32(&mlockFailures, 1)
+		return append([]byte{}, key...)
+	}
+	if err = madviseDontdump(buf); err != nil {
+		tlog.Debug.Printf("LockedCopy: madvise: %v", err)
+	}
+	if err = unix.Mlock(buf); err != nil {
+		atomic.AddUint32(&mlockFailures, 1)
+		mlockWarn.Do(func() {
+			tlog.Warn.Printf("Could not mlock the key memory, keys may be swapped to disk: %v. "+
+				"Check \"ulimit -l\".", err)
+		})
+	}
+	copy(buf, key)
+	return buf
+}
+
+// FreeLocked overwrites memory returned by LockedCopy with zeros and
+// releases it. "buf" must not be used afterwards.
+func FreeLocked(buf []byte) {
+	for i := range buf {
+		buf[i] = 0
+	}
+	if len(buf) == 0 {
+		return
+	}
+	// Fails with EINVAL if "buf" was not allocated by mmap, which happens
+	// when LockedCopy fell back to the Go heap.
+	unix.Munmap(buf)
+}
+
+// LockAll locks all current and future memory of the process, including the
+// Go heap. This covers the keys that cannot be copied into LockedCopy
+// memory: the master key, and the expanded AES keys inside the Go crypto
+// library (file name encryption, and content encryption with the Go GCM
+// backend).
+func LockAll() error {
+	return unix.Mlockall(unix.MCL_CURRENT | unix.MCL_FUTURE)
+}
@@ -58,6 +58,15 @@ func ReadDirIVAt(dirfd int) (iv []byte, err error) {
 // allZeroDirIV is preallocated to quickly check if the data read from disk is all zero
 var allZeroDirIV = make([]byte, DirIVLen)
 
+// fixSidecarPerms sets the permissions of a newly created sidecar file to
+// exactly "perms". A restrictive umask (like 0277) would otherwise take away
+// the owner read bit, and we could not read our own file anymore.
+func fixSidecarPerms(fd int, perms uint32) {
+	if err := syscall.Fchmod(fd, perms); err != nil {
+		tlog.Debug.Printf("fixSidecarPerms: Fchmod: %v", err)
+	}
+}
+
 // fdReadDirIV reads and verifies the DirIV from an opened gocryptfs.diriv file.
 func fdReadDirIV(fd *os.File) (iv []byte, err error) {
 	// We want to detect if the file is bigger than DirIVLen, so
@@ -77,6 +86,11 @@ func fdReadDirIV(fd *os.File) (iv []byte, err error) {
 	return iv, nil
 }
 
+// DirIVPerms are the permissions of gocryptfs.diriv files. They are
+// read-only because the IV must never change after creation, and only the
+// owner can read them, whatever the mode of the directory.
+const DirIVPerms = 0400
+
 // WriteDirIV - create diriv file inside of the specified directory. If dirfd
 // is nil "dir" should be the absolute path to the directory. If dirfd != nil
 // "dir" should be a path (without slashes) relative to the directory
@@ -89,13 +103,16 @@ func WriteDirIV(dirfd int, dir string) error {
 	}
 	iv := cryptocore.RandBytes(DirIVLen)
 	file := filepath.Join(dir, DirIVFilename)
-	// 0400 permissions: gocryptfs.diriv should never be modified after creation.
 	// Don't use "ioutil.WriteFile", it causes trouble on NFS: https://github.com/rfjakob/gocryptfs/issues/105
-	fdRaw, err := syscallcompat.Openat(dirfd, file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	fdRaw, err := syscallcompat.Openat(dirfd, file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, DirIVPerms)
 	if err != nil {
-		tlog.Warn.Printf("WriteDirIV: Openat: %v", err)
+		// EEXIST is handled by the caller
+		if err != syscall.EEXIST {
+			tlog.Warn.Printf("WriteDirIV: Openat: %v", err)
+		}
 		return err
 	}
+	fixSidecarPerms(fdRaw, DirIVPerms)
 	fd := os.NewFile(uintptr(fdRaw), file)
 	_, err = fd.Write(iv)
 	if err != nil {
@@ -137,6 +154,14 @@ func (be *NameTransform) EncryptPathDirIV(plainPath string, rootDir string) (str
 	if plainPath == "" {
 		return plainPath, nil
 	}
+	plainPath, err = be.StripSuffix(plainPath)
+	if err != nil {
+		return "", err
+	}
+	plainPath, err = be.normalize(plainPath)
+	if err != nil {
+		return "", err
+	}
 	// Reject names longer than 255 bytes.
 	baseName := filepath.Base(plainPath)
 	if len(baseName) > unix.NAME_MAX {
@@ -147,7 +172,11 @@ func (be *NameTransform) EncryptPathDirIV(plainPath string, rootDir string) (str
 	// in the tar extract benchmark.
 	parentDir := Dir(plainPath)
 	if iv, cParentDir := be.DirIVCache.Lookup(parentDir); iv != nil {
-		cBaseName := be.encryptAndHashName(baseName, iv)
+		t, err := be.forDir(cParentDir)
+		if err != nil {
+			return "", err
+		}
+		cBaseName := t.encryptAndHashName(baseName, iv)
 		return filepath.Join(cParentDir, cBaseName), nil
 	}
 	// We have to walk the directory tree, starting at the root directory.
@@ -165,7 +194,11 @@ func (be *NameTransform) EncryptPathDirIV(plainPath string, rootDir string) (str
 			}
 			be.DirIVCache.Store(plainWD, iv, cipherWD)
 		}
-		cipherName := be.encryptAndHashName(plainName, iv)
+		t, err := be.forDir(cipherWD)
+		if err != nil {
+			return "", err
+		}
+		cipherName := t.encryptAndHashName(plainName, iv)
 		cipherWD = filepath.Join(cipherWD, cipherName)
 		plainWD = filepath.Join(plainWD, plainName)
 	}
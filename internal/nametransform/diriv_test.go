@@ -0,0 +1,60 @@
+package nametransform
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// TestSidecarPerms checks that gocryptfs.diriv and .name files get their
+// fixed permissions even with a umask that would make them unreadable, and
+// that they can still be read afterwards.
+func TestSidecarPerms(t *testing.T) {
+	n, dir := newTestTransform(t)
+	defer os.RemoveAll(dir)
+	oldUmask := syscall.Umask(0777)
+	defer syscall.Umask(oldUmask)
+
+	if err := os.Mkdir(dir+"/sub", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteDirIV(-1, dir+"/sub"); err != nil {
+		t.Fatal(err)
+	}
+	plainName := strings.Repeat("x", 200)
+	cName, err := n.EncryptPathDirIV(plainName, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirfd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(dirfd)
+	if err = n.WriteLongName(dirfd, cName, plainName); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		path string
+		perm os.FileMode
+	}{
+		{dir + "/sub/" + DirIVFilename, DirIVPerms},
+		{dir + "/" + cName + LongNameSuffix, LongNamePerms},
+	}
+	for _, tc := range testCases {
+		fi, err := os.Stat(tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != tc.perm {
+			t.Errorf("%s: want mode %#o, got %#o", tc.path, tc.perm, fi.Mode().Perm())
+		}
+	}
+	if _, err = ReadDirIV(dir + "/sub"); err != nil {
+		t.Errorf("reading diriv: %v", err)
+	}
+	if _, err = ReadLongName(dir + "/" + cName); err != nil {
+		t.Errorf("reading long name: %v", err)
+	}
+}
@@ -8,8 +8,8 @@ import (
 )
 
 const (
-	maxEntries = 100
-	expireTime = 1 * time.Second
+	defaultMaxEntries = 100
+	expireTime        = 1 * time.Second
 )
 
 type cacheEntry struct {
@@ -19,8 +19,12 @@ type cacheEntry struct {
 	cDir string
 }
 
-// DirIVCache stores up to "maxEntries" directory IVs.
+// DirIVCache stores up to "MaxEntries" directory IVs.
 type DirIVCache struct {
+	// MaxEntries is the maximum number of cached entries. Zero means
+	// defaultMaxEntries. Must be set before the cache is used.
+	MaxEntries int
+
 	// data in the cache, indexed by relative plaintext path
 	// of the directory.
 	data map[string]cacheEntry
@@ -76,6 +80,10 @@ func (c *DirIVCache) Store(dir string, iv []byte, cDir string) {
 	if strings.Count(dir, "/") != strings.Count(cDir, "/") {
 		log.Panicf("inconsistent number of path segments: dir=%q cDir=%q", dir, cDir)
 	}
+	maxEntries := c.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = defaultMaxEntries
+	}
 	// Clear() may have cleared c.data: re-initialize
 	if c.data == nil {
 		c.data = make(map[string]cacheEntry, maxEntries)
@@ -0,0 +1,48 @@
+package dirivcache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestEviction checks that the cache never holds more than MaxEntries
+// entries and drops everything once it expires. The kernel FORGET requests
+// are handled inside go-fuse's pathfs and never reach gocryptfs, so the
+// cache must free memory on its own.
+func TestEviction(t *testing.T) {
+	var c DirIVCache
+	c.MaxEntries = 10
+	iv := make([]byte, 16)
+	for i := 0; i < 1000; i++ {
+		c.Store(fmt.Sprintf("dir%d", i), iv, fmt.Sprintf("cdir%d", i))
+		if len(c.data) > c.MaxEntries {
+			t.Fatalf("cache has %d entries, max is %d", len(c.data), c.MaxEntries)
+		}
+	}
+	if iv2, _ := c.Lookup("dir999"); iv2 == nil {
+		t.Errorf("last stored entry is missing")
+	}
+	time.Sleep(expireTime + 100*time.Millisecond)
+	if iv2, _ := c.Lookup("dir999"); iv2 != nil {
+		t.Errorf("entry still cached after expiry")
+	}
+	if len(c.data) != 0 {
+		t.Errorf("cache still has %d entries after expiry", len(c.data))
+	}
+}
+
+// TestRootDirIV checks that the root directory IV survives Clear().
+func TestRootDirIV(t *testing.T) {
+	var c DirIVCache
+	iv := []byte("0123456789abcdef")
+	c.Store("", iv, "")
+	c.Store("a", iv, "b")
+	c.Clear()
+	if iv2, _ := c.Lookup("a"); iv2 != nil {
+		t.Errorf("entry still cached after Clear")
+	}
+	if iv2, _ := c.Lookup(""); iv2 == nil {
+		t.Errorf("root dir IV lost after Clear")
+	}
+}
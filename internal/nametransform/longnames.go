@@ -97,11 +97,29 @@ func DeleteLongName(dirfd int, hashName string) error {
 	return err
 }
 
+// LongNamePerms are the permissions of gocryptfs.longname.*.name files.
+// Like gocryptfs.diriv, only the owner can access them.
+const LongNamePerms = 0600
+
 // WriteLongName encrypts plainName and writes it into "hashName.name".
 // For the convenience of the caller, plainName may also be a path and will be
 // converted internally.
+//
+// With EncfsQuirks, creating long names fails with ENAMETOOLONG, like on encfs,
+// which has no long name support and could not store such a file. Existing
+// long names can still be accessed.
 func (n *NameTransform) WriteLongName(dirfd int, hashName string, plainName string) (err error) {
-	plainName = filepath.Base(plainName)
+	if n.EncfsQuirks {
+		return syscall.ENAMETOOLONG
+	}
+	plainName, err = n.StripSuffix(filepath.Base(plainName))
+	if err != nil {
+		return err
+	}
+	plainName, err = n.normalize(plainName)
+	if err != nil {
+		return err
+	}
 
 	// Encrypt the basename
 	dirIV, err := ReadDirIVAt(dirfd)
@@ -112,7 +130,7 @@ func (n *NameTransform) WriteLongName(dirfd int, hashName string, plainName stri
 
 	// Write the encrypted name into hashName.name
 	fdRaw, err := syscallcompat.Openat(dirfd, hashName+LongNameSuffix,
-		syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL, 0600)
+		syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL, LongNamePerms)
 	if err != nil {
 		// Don't warn if the file already exists - this is allowed for renames
 		// and should be handled by the caller.
@@ -121,6 +139,7 @@ func (n *NameTransform) WriteLongName(dirfd int, hashName string, plainName stri
 		}
 		return err
 	}
+	fixSidecarPerms(fdRaw, LongNamePerms)
 	fd := os.NewFile(uintptr(fdRaw), hashName+LongNameSuffix)
 	defer fd.Close()
 	_, err = fd.Write([]byte(cName))
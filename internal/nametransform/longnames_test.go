@@ -1,6 +1,9 @@
 package nametransform
 
 import (
+	"os"
+	"strings"
+	"syscall"
 	"testing"
 )
 
@@ -20,3 +23,40 @@ func TestIsLongName(t *testing.T) {
 		t.Errorf("False positive")
 	}
 }
+
+// With EncfsQuirks, WriteLongName must fail without creating a .name file
+func TestWriteLongNameEncfsQuirks(t *testing.T) {
+	n, dir := newTestTransform(t)
+	defer os.RemoveAll(dir)
+	n.EncfsQuirks = true
+	plainName := strings.Repeat("x", 200)
+	cName, err := n.EncryptPathDirIV(plainName, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsLongContent(cName) {
+		t.Fatalf("%q should be a long name", cName)
+	}
+	err = n.WriteLongName(-1, dir+"/"+cName, plainName)
+	if err != syscall.ENAMETOOLONG {
+		t.Errorf("want ENAMETOOLONG, have %v", err)
+	}
+	if _, err = os.Stat(dir + "/" + cName + LongNameSuffix); !os.IsNotExist(err) {
+		t.Errorf(".name file was created: %v", err)
+	}
+}
+
+// Without long name support, long names must be returned unhashed so that
+// the backing filesystem can reject them
+func TestNoLongNames(t *testing.T) {
+	n, dir := newTestTransform(t)
+	defer os.RemoveAll(dir)
+	n.longNames = false
+	cName, err := n.EncryptPathDirIV(strings.Repeat("x", 200), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if NameType(cName) != LongNameNone || len(cName) <= 255 {
+		t.Errorf("long name was hashed: %q", cName)
+	}
+}
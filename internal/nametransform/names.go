@@ -8,6 +8,7 @@ import (
 	"syscall"
 
 	"github.com/rfjakob/eme"
+	"golang.org/x/text/unicode/norm"
 
 	"github.com/rfjakob/gocryptfs/internal/nametransform/dirivcache"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
@@ -21,6 +22,18 @@ type NameTransform struct {
 	// B64 = either base64.URLEncoding or base64.RawURLEncoding, depeding
 	// on the Raw64 feature flag
 	B64 *base64.Encoding
+	// normForm is the Unicode normalization form plaintext names are
+	// converted to before encryption. nil means no normalization.
+	normForm *norm.Form
+	// EncfsQuirks enables the behaviors documented for "-encfs-quirks".
+	// Currently, this only means that new long names are refused.
+	EncfsQuirks bool
+	// nameSuffix is appended to all plaintext names, see SetNameSuffix
+	nameSuffix string
+	// ForDir, if set, returns the NameTransform for the names in the
+	// ciphertext directory "cDir" (relative path). Used for directories that
+	// have their own key ("-lock-dir").
+	ForDir func(cDir string) (*NameTransform, error)
 }
 
 // New returns a new NameTransform instance.
@@ -36,6 +49,28 @@ func New(e *eme.EMECipher, longNames bool, raw64 bool) *NameTransform {
 	}
 }
 
+// WithCipher returns a NameTransform with the same settings as "n" that
+// encrypts names with "e".
+func (n *NameTransform) WithCipher(e *eme.EMECipher) *NameTransform {
+	return &NameTransform{
+		emeCipher:   e,
+		longNames:   n.longNames,
+		B64:         n.B64,
+		normForm:    n.normForm,
+		EncfsQuirks: n.EncfsQuirks,
+		nameSuffix:  n.nameSuffix,
+	}
+}
+
+// forDir returns the NameTransform for the names in ciphertext directory
+// "cDir", see ForDir.
+func (n *NameTransform) forDir(cDir string) (*NameTransform, error) {
+	if n.ForDir == nil {
+		return n, nil
+	}
+	return n.ForDir(cDir)
+}
+
 // DecryptName decrypts a base64-encoded encrypted filename "cipherName" using the
 // initialization vector "iv".
 func (n *NameTransform) DecryptName(cipherName string, iv []byte) (string, error) {
@@ -0,0 +1,29 @@
+package nametransform
+
+import (
+	"syscall"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// SetNormalization makes the NameTransform convert plaintext names to the
+// Unicode normalization form "f" before encrypting them. This way, names that
+// only differ in their normalization (like "é" as one code point versus "e"
+// plus a combining accent) map to the same ciphertext name.
+// Names that are not valid UTF-8 are rejected with EILSEQ.
+func (n *NameTransform) SetNormalization(f norm.Form) {
+	n.normForm = &f
+}
+
+// normalize returns "plainName" converted to the normalization form set by
+// SetNormalization. Without normalization, the name is returned unchanged.
+func (n *NameTransform) normalize(plainName string) (string, error) {
+	if n.normForm == nil {
+		return plainName, nil
+	}
+	if !utf8.ValidString(plainName) {
+		return "", syscall.EILSEQ
+	}
+	return n.normForm.String(plainName), nil
+}
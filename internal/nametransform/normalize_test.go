@@ -0,0 +1,91 @@
+package nametransform
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+const (
+	// "cafe" with precomposed "é" (U+00E9)
+	cafeNFC = "caf\u00e9"
+	// "cafe" with "e" followed by a combining acute accent (U+0301)
+	cafeNFD = "cafe\u0301"
+)
+
+func newTestTransform(t *testing.T) (*NameTransform, string) {
+	dir, err := ioutil.TempDir("", "gocryptfs-normalize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = WriteDirIV(-1, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := cryptocore.RandBytes(cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, 128, true, false)
+	return New(cc.EMECipher, true, true), dir
+}
+
+func TestNormalize(t *testing.T) {
+	n, dir := newTestTransform(t)
+	defer os.RemoveAll(dir)
+	// Without normalization, both variants are different names
+	c1, _ := n.EncryptPathDirIV(cafeNFC, dir)
+	c2, _ := n.EncryptPathDirIV(cafeNFD, dir)
+	if c1 == c2 {
+		t.Errorf("NFC and NFD variants encrypt to the same name without normalization")
+	}
+	// ...and invalid UTF-8 is allowed
+	_, err := n.EncryptPathDirIV("\xff", dir)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, f := range []norm.Form{norm.NFC, norm.NFD} {
+		n.SetNormalization(f)
+		n.DirIVCache.Clear()
+		c1, err := n.EncryptPathDirIV(cafeNFC, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c2, err := n.EncryptPathDirIV(cafeNFD, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c1 != c2 {
+			t.Errorf("form %v: NFC and NFD variants encrypt to different names", f)
+		}
+		iv, _ := ReadDirIV(dir)
+		plain, err := n.DecryptName(c1, iv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plain != f.String(cafeNFC) {
+			t.Errorf("form %v: name decrypts to %q", f, plain)
+		}
+		// Directory components are normalized as well
+		os.Mkdir(dir+"/"+c1, 0700)
+		WriteDirIV(-1, dir+"/"+c1)
+		c3, err := n.EncryptPathDirIV(cafeNFD+"/"+cafeNFC, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c4, err := n.EncryptPathDirIV(cafeNFC+"/"+cafeNFD, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c3 != c4 {
+			t.Errorf("form %v: path variants encrypt to different paths: %q %q", f, c3, c4)
+		}
+		_, err = n.EncryptPathDirIV("\xff", dir)
+		if err != syscall.EILSEQ {
+			t.Errorf("form %v: invalid UTF-8: want EILSEQ, have %v", f, err)
+		}
+	}
+}
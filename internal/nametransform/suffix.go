@@ -0,0 +1,37 @@
+package nametransform
+
+import (
+	"strings"
+	"syscall"
+)
+
+// SetNameSuffix makes the NameTransform present every plaintext name with
+// "suffix" appended ("-name-suffix"). A file stored as "report" shows up as
+// "report.pdf", and "report.pdf" is stored as "report" again. Stored names
+// that already end in the suffix get it twice, so every name round-trips.
+func (n *NameTransform) SetNameSuffix(suffix string) {
+	n.nameSuffix = suffix
+}
+
+// AddSuffix returns the name the stored plaintext name "name" is presented
+// as.
+func (n *NameTransform) AddSuffix(name string) string {
+	return name + n.nameSuffix
+}
+
+// StripSuffix removes the suffix from every component of the presented
+// plaintext path "plainPath". Names without the suffix do not exist in the
+// presented view, so they fail with ENOENT.
+func (n *NameTransform) StripSuffix(plainPath string) (string, error) {
+	if n.nameSuffix == "" || plainPath == "" {
+		return plainPath, nil
+	}
+	parts := strings.Split(plainPath, "/")
+	for i, p := range parts {
+		if len(p) <= len(n.nameSuffix) || !strings.HasSuffix(p, n.nameSuffix) {
+			return "", syscall.ENOENT
+		}
+		parts[i] = p[:len(p)-len(n.nameSuffix)]
+	}
+	return strings.Join(parts, "/"), nil
+}
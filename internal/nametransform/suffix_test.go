@@ -0,0 +1,120 @@
+package nametransform
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestStripSuffix(t *testing.T) {
+	var n NameTransform
+	// Without a suffix, paths are unchanged
+	if p, err := n.StripSuffix("a/b"); err != nil || p != "a/b" {
+		t.Errorf("no suffix: got %q %v", p, err)
+	}
+	n.SetNameSuffix(".pdf")
+	testcases := []struct {
+		in   string
+		want string
+		err  error
+	}{
+		{"", "", nil},
+		{"report.pdf", "report", nil},
+		// Stored names that end in the suffix themselves
+		{"report.pdf.pdf", "report.pdf", nil},
+		{"dir.pdf/report.pdf", "dir/report", nil},
+		// Names without the suffix do not exist in the view
+		{"report", "", syscall.ENOENT},
+		{"report.PDF", "", syscall.ENOENT},
+		{"dir/report.pdf", "", syscall.ENOENT},
+		{".pdf", "", syscall.ENOENT},
+	}
+	for _, tc := range testcases {
+		p, err := n.StripSuffix(tc.in)
+		if p != tc.want || err != tc.err {
+			t.Errorf("StripSuffix(%q): want %q %v, got %q %v", tc.in, tc.want, tc.err, p, err)
+		}
+		if err == nil && tc.in != "" && !strings.Contains(tc.in, "/") && n.AddSuffix(p) != tc.in {
+			t.Errorf("%q does not round-trip: %q", tc.in, n.AddSuffix(p))
+		}
+	}
+}
+
+func TestNameSuffixEncrypt(t *testing.T) {
+	n, dir := newTestTransform(t)
+	defer os.RemoveAll(dir)
+	c1, err := n.EncryptPathDirIV("report", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := n.EncryptPathDirIV("report.pdf", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.SetNameSuffix(".pdf")
+	n.DirIVCache.Clear()
+	// "report.pdf" in the view is stored as "report"
+	c3, err := n.EncryptPathDirIV("report.pdf", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c3 != c1 {
+		t.Errorf("report.pdf: want %q, got %q", c1, c3)
+	}
+	// ...and "report.pdf.pdf" as "report.pdf"
+	c4, err := n.EncryptPathDirIV("report.pdf.pdf", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c4 != c2 {
+		t.Errorf("report.pdf.pdf: want %q, got %q", c2, c4)
+	}
+	iv, _ := ReadDirIV(dir)
+	plain, err := n.DecryptName(c1, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.AddSuffix(plain) != "report.pdf" {
+		t.Errorf("decrypted name is presented as %q", n.AddSuffix(plain))
+	}
+	if _, err = n.EncryptPathDirIV("report", dir); err != syscall.ENOENT {
+		t.Errorf("name without suffix: want ENOENT, got %v", err)
+	}
+}
+
+// The .name file of a long name must contain the stored name, without the
+// suffix, like the hash does.
+func TestNameSuffixLongName(t *testing.T) {
+	n, dir := newTestTransform(t)
+	defer os.RemoveAll(dir)
+	n.SetNameSuffix(".pdf")
+	stored := strings.Repeat("x", 200)
+	hashName, err := n.EncryptPathDirIV(stored+".pdf", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsLongContent(hashName) {
+		t.Fatalf("%q is not a long name", hashName)
+	}
+	dirfd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(dirfd)
+	if err = n.WriteLongName(dirfd, hashName, stored+".pdf"); err != nil {
+		t.Fatal(err)
+	}
+	cName, err := ReadLongName(dir + "/" + hashName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv, _ := ReadDirIV(dir)
+	plain, err := n.DecryptName(cName, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain != stored {
+		t.Errorf(".name file contains %q, want %q", plain, stored)
+	}
+}
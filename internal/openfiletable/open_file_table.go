@@ -67,6 +67,13 @@ type Entry struct {
 	// IDLock must be taken before reading or writing the ID field in this struct,
 	// unless you have an exclusive lock on ContentLock.
 	IDLock sync.Mutex
+	// Burn is set to 1 by "-burn-after-reading" when the file has been read
+	// completely. Must be accessed atomically.
+	Burn uint32
+	// XattrDirty is set to 1 by "-xattr-sync" when the xattrs of the file
+	// have been changed, and reset when the file has been fsync'ed. Must be
+	// accessed atomically.
+	XattrDirty uint32
 }
 
 // Register creates an open file table entry for "qi" (or incrementes the
@@ -84,9 +91,19 @@ func Register(qi QIno) *Entry {
 	return e
 }
 
+// Lookup returns the open file table entry for "qi", or nil if the file is
+// not open. Does not change the reference count, so the entry may go away
+// at any time. Only use it to set flags.
+func Lookup(qi QIno) *Entry {
+	t.Lock()
+	defer t.Unlock()
+	return t.entries[qi]
+}
+
 // Unregister decrements the reference count for "qi" and deletes the entry from
-// the open file table if the reference count reaches 0.
-func Unregister(qi QIno) {
+// the open file table if the reference count reaches 0. Returns true in
+// that case.
+func Unregister(qi QIno) (last bool) {
 	t.Lock()
 	defer t.Unlock()
 
@@ -94,7 +111,9 @@ func Unregister(qi QIno) {
 	e.refCount--
 	if e.refCount == 0 {
 		delete(t.entries, qi)
+		return true
 	}
+	return false
 }
 
 // countingMutex incrementes t.writeLockCount on each Lock() call.
@@ -7,6 +7,8 @@ import (
 	"log"
 
 	"github.com/jacobsa/crypto/siv"
+
+	"github.com/rfjakob/gocryptfs/internal/mlock"
 )
 
 type sivAead struct {
@@ -33,8 +35,9 @@ func New(key []byte) cipher.AEAD {
 
 // Same as "New" without the 64-byte restriction.
 func new2(keyIn []byte) cipher.AEAD {
-	// Create a private copy so the caller can zero the one he owns
-	key := append([]byte{}, keyIn...)
+	// Create a private copy so the caller can zero the one he owns. It is
+	// allocated in memory that cannot be swapped out.
+	key := mlock.LockedCopy(keyIn)
 	return &sivAead{
 		key: key,
 	}
@@ -90,8 +93,6 @@ func (s *sivAead) Open(dst, nonce, ciphertext, authData []byte) ([]byte, error)
 // This is not bulletproof due to possible GC copies, but
 // still raises to bar for extracting the key.
 func (s *sivAead) Wipe() {
-	for i := range s.key {
-		s.key[i] = 0
-	}
+	mlock.FreeLocked(s.key)
 	s.key = nil
 }
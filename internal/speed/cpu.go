@@ -0,0 +1,31 @@
+package speed
+
+import (
+	"runtime"
+
+	"golang.org/x/sys/cpu"
+)
+
+// cpuFeatures describes the hardware acceleration for AES the CPU offers.
+type cpuFeatures struct {
+	// Known is false if we cannot detect the features on this architecture.
+	// The other fields are false in this case.
+	Known bool
+	// AES instructions (AES-NI on x86)
+	AES bool
+	// Carry-less multiplication (PCLMULQDQ on x86), which speeds up the
+	// GHASH part of GCM
+	PCLMULQDQ bool
+}
+
+// detectCPU reads the feature flags of the CPU we are running on.
+func detectCPU() cpuFeatures {
+	if runtime.GOARCH != "amd64" && runtime.GOARCH != "386" {
+		return cpuFeatures{}
+	}
+	return cpuFeatures{
+		Known:     true,
+		AES:       cpu.X86.HasAES,
+		PCLMULQDQ: cpu.X86.HasPCLMULQDQ,
+	}
+}
@@ -8,8 +8,10 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"log"
+	"runtime"
 	"testing"
 
 	"github.com/rfjakob/gocryptfs/internal/prefer_openssl"
@@ -17,20 +19,58 @@ import (
 	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
 )
 
-// Run - run the speed the test and print the results.
-func Run() {
+// result is the outcome of one benchmark
+type result struct {
+	Name string
+	// Throughput in MB/s. Zero if the backend is not available.
+	MBs float64
+	// Selected by "-openssl=auto" on this machine
+	Preferred bool
+	// Uses hardware acceleration on this CPU
+	Accelerated bool
+}
+
+// report is what Run prints as JSON
+type report struct {
+	CPU     cpuFeatures
+	Results []result
+}
+
+// Run - run the speed the test and print the results. With "jsonOutput",
+// the results are printed as JSON.
+func Run(jsonOutput bool) {
+	c := detectCPU()
+	// Both Go and OpenSSL only use the fast GCM implementation if the CPU has
+	// AES and PCLMULQDQ instructions. AES-SIV only needs AES.
+	gcmAccel := c.AES && c.PCLMULQDQ
 	bTable := []struct {
-		name      string
-		f         func(*testing.B)
-		preferred bool
+		name        string
+		f           func(*testing.B)
+		preferred   bool
+		accelerated bool
 	}{
-		{name: "AES-GCM-256-OpenSSL", f: bStupidGCM, preferred: prefer_openssl.PreferOpenSSL()},
-		{name: "AES-GCM-256-Go", f: bGoGCM, preferred: !prefer_openssl.PreferOpenSSL()},
-		{name: "AES-SIV-512-Go", f: bAESSIV, preferred: false},
+		{name: "AES-GCM-256-OpenSSL", f: bStupidGCM, preferred: prefer_openssl.PreferOpenSSL(), accelerated: gcmAccel},
+		{name: "AES-GCM-256-Go", f: bGoGCM, preferred: !prefer_openssl.PreferOpenSSL(), accelerated: gcmAccel},
+		{name: "AES-SIV-512-Go", f: bAESSIV, preferred: false, accelerated: c.AES},
+	}
+	r := report{CPU: c}
+	if !jsonOutput {
+		printCPU(c)
 	}
 	for _, b := range bTable {
-		fmt.Printf("%-20s\t", b.name)
+		if !jsonOutput {
+			fmt.Printf("%-20s\t", b.name)
+		}
 		mbs := mbPerSec(testing.Benchmark(b.f))
+		r.Results = append(r.Results, result{
+			Name:        b.name,
+			MBs:         mbs,
+			Preferred:   b.preferred,
+			Accelerated: b.accelerated,
+		})
+		if jsonOutput {
+			continue
+		}
 		if mbs > 0 {
 			fmt.Printf("%7.2f MB/s", mbs)
 		} else {
@@ -42,6 +82,33 @@ func Run() {
 			fmt.Printf("\t\n")
 		}
 	}
+	if jsonOutput {
+		js, err := json.MarshalIndent(r, "", "\t")
+		if err != nil {
+			log.Panic(err)
+		}
+		fmt.Println(string(js))
+	}
+}
+
+// printCPU prints the hardware acceleration status in human-readable form.
+func printCPU(c cpuFeatures) {
+	if !c.Known {
+		fmt.Printf("CPU: cannot detect AES acceleration on %s\n", runtime.GOARCH)
+		return
+	}
+	yesNo := func(b bool) string {
+		if b {
+			return "yes"
+		}
+		return "no"
+	}
+	fmt.Printf("CPU: AES-NI: %s, PCLMULQDQ: %s\n", yesNo(c.AES), yesNo(c.PCLMULQDQ))
+	if !c.AES {
+		fmt.Printf("Your CPU has no AES acceleration, expect all ciphers to be slow.\n")
+	} else if !c.PCLMULQDQ {
+		fmt.Printf("Your CPU has no PCLMULQDQ, so AES-GCM is not fully accelerated.\n")
+	}
 }
 
 func mbPerSec(r testing.BenchmarkResult) float64 {
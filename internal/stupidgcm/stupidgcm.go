@@ -13,6 +13,8 @@ import (
 	"fmt"
 	"log"
 	"unsafe"
+
+	"github.com/rfjakob/gocryptfs/internal/mlock"
 )
 
 const (
@@ -38,8 +40,8 @@ func New(keyIn []byte, forceDecode bool) cipher.AEAD {
 	if len(keyIn) != keyLen {
 		log.Panicf("Only %d-byte keys are supported", keyLen)
 	}
-	// Create a private copy of the key
-	key := append([]byte{}, keyIn...)
+	// Create a private copy of the key, in memory that cannot be swapped out
+	key := mlock.LockedCopy(keyIn)
 	return &StupidGCM{key: key, forceDecode: forceDecode}
 }
 
@@ -242,8 +244,6 @@ func (g *StupidGCM) Open(dst, iv, in, authData []byte) ([]byte, error) {
 // This is not bulletproof due to possible GC copies, but
 // still raises to bar for extracting the key.
 func (g *StupidGCM) Wipe() {
-	for i := range g.key {
-		g.key[i] = 0
-	}
+	mlock.FreeLocked(g.key)
 	g.key = nil
 }
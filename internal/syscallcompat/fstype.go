@@ -0,0 +1,22 @@
+package syscallcompat
+
+// FsKind says whether a filesystem stores its data locally or on the network
+type FsKind int
+
+const (
+	// FsUnknown means that we cannot tell. FUSE filesystems, for example,
+	// may be local (ntfs-3g) or network (sshfs) filesystems.
+	FsUnknown FsKind = iota
+	// FsLocal is a filesystem on a local block device or in memory
+	FsLocal
+	// FsNetwork is a filesystem that is accessed over the network
+	FsNetwork
+)
+
+// FsType describes the type of a filesystem
+type FsType struct {
+	// Name is the filesystem type as used by mount(8), like "ext4" or
+	// "nfs". For unknown types, it contains the raw type number.
+	Name string
+	Kind FsKind
+}
@@ -0,0 +1,40 @@
+package syscallcompat
+
+import (
+	"syscall"
+)
+
+// fsNames maps the f_fstypename values returned by statfs(2) to filesystem
+// kinds
+var fsNames = map[string]FsKind{
+	"nfs":    FsNetwork,
+	"smbfs":  FsNetwork,
+	"afpfs":  FsNetwork,
+	"webdav": FsNetwork,
+	"ftp":    FsNetwork,
+	"apfs":   FsLocal,
+	"hfs":    FsLocal,
+	"msdos":  FsLocal,
+	"exfat":  FsLocal,
+	"ntfs":   FsLocal,
+	"udf":    FsLocal,
+	"cd9660": FsLocal,
+}
+
+// GetFsType returns the type of the filesystem "path" is on
+func GetFsType(path string) (FsType, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return FsType{}, err
+	}
+	var name []byte
+	for _, c := range st.Fstypename {
+		if c == 0 {
+			break
+		}
+		name = append(name, byte(c))
+	}
+	t := FsType{Name: string(name)}
+	t.Kind = fsNames[t.Name]
+	return t, nil
+}
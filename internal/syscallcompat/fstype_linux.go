@@ -0,0 +1,69 @@
+package syscallcompat
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// fsMagic maps the f_type values returned by statfs(2) to filesystem types.
+// The values are from linux/magic.h and statfs(2).
+var fsMagic = map[int64]FsType{
+	// Network
+	0x6969:     {"nfs", FsNetwork},
+	0xFF534D42: {"cifs", FsNetwork},
+	0xFE534D42: {"smb2", FsNetwork},
+	0x517B:     {"smbfs", FsNetwork},
+	0x00C36400: {"ceph", FsNetwork},
+	0x5346414F: {"afs", FsNetwork},
+	0x6B414653: {"afs", FsNetwork},
+	0x73757245: {"coda", FsNetwork},
+	0x01021997: {"9p", FsNetwork},
+	0x564C:     {"ncpfs", FsNetwork},
+	0x47504653: {"gpfs", FsNetwork},
+	0x0BD00BD0: {"lustre", FsNetwork},
+	0x01161970: {"gfs2", FsNetwork},
+	0x7461636F: {"ocfs2", FsNetwork},
+	// Local
+	0xEF53:     {"ext4", FsLocal},
+	0x58465342: {"xfs", FsLocal},
+	0x9123683E: {"btrfs", FsLocal},
+	0x2FC12FC1: {"zfs", FsLocal},
+	0xF2F52010: {"f2fs", FsLocal},
+	0x3153464A: {"jfs", FsLocal},
+	0x52654973: {"reiserfs", FsLocal},
+	0x4D44:     {"vfat", FsLocal},
+	0x2011BAB0: {"exfat", FsLocal},
+	0x5346544E: {"ntfs", FsLocal},
+	0x4244:     {"hfs", FsLocal},
+	0x482B:     {"hfsplus", FsLocal},
+	0x9660:     {"iso9660", FsLocal},
+	0x15013346: {"udf", FsLocal},
+	0x01021994: {"tmpfs", FsLocal},
+	0x858458F6: {"ramfs", FsLocal},
+	0x794C7630: {"overlay", FsLocal},
+	0xF15F:     {"ecryptfs", FsLocal},
+	0x73717368: {"squashfs", FsLocal},
+	0x28CD3D45: {"cramfs", FsLocal},
+	0xE0F5E1E2: {"erofs", FsLocal},
+	// Unknown
+	0x65735546: {"fuse", FsUnknown},
+}
+
+// GetFsType returns the type of the filesystem "path" is on
+func GetFsType(path string) (FsType, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return FsType{}, err
+	}
+	return fsTypeFromMagic(int64(st.Type)), nil
+}
+
+func fsTypeFromMagic(magic int64) FsType {
+	// On 32-bit platforms, f_type is 32 bits wide and values with the high
+	// bit set come out negative
+	magic &= 0xFFFFFFFF
+	if t, ok := fsMagic[magic]; ok {
+		return t
+	}
+	return FsType{Name: fmt.Sprintf("0x%X", magic), Kind: FsUnknown}
+}
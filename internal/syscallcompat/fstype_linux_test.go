@@ -0,0 +1,32 @@
+package syscallcompat
+
+import (
+	"testing"
+)
+
+func TestFsTypeFromMagic(t *testing.T) {
+	testcases := []struct {
+		magic int64
+		want  FsType
+	}{
+		{0xEF53, FsType{"ext4", FsLocal}},
+		{0x6969, FsType{"nfs", FsNetwork}},
+		// CIFS as a sign-extended 32-bit f_type
+		{-0xACB2BE, FsType{"cifs", FsNetwork}},
+		{0x65735546, FsType{"fuse", FsUnknown}},
+		{0x1234, FsType{"0x1234", FsUnknown}},
+	}
+	for _, tc := range testcases {
+		if have := fsTypeFromMagic(tc.magic); have != tc.want {
+			t.Errorf("magic 0x%X: want %v, have %v", tc.magic, tc.want, have)
+		}
+	}
+	// tmpDir is on /tmp, which may be tmpfs, ext4, overlay, ...
+	ft, err := GetFsType(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ft.Name == "" {
+		t.Errorf("no name for the filesystem of %q", tmpDir)
+	}
+}
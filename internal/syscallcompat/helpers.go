@@ -19,3 +19,29 @@ func IsENOSPC(err error) bool {
 	}
 	return false
 }
+
+// PreserveDirTimes runs "fn", which creates or deletes gocryptfs-internal
+// files inside directory "dir", and then restores the atime and mtime "dir"
+// had before. This way, the directory timestamps only change when the
+// plaintext view of the directory changes, which is what backup tools
+// look at.
+//
+// A change to "dir" that happens concurrently with "fn" would be hidden as
+// well, so only use this where that cannot happen.
+// Restoring the timestamps is best-effort (it fails if we do not own "dir"),
+// only the error from "fn" is returned.
+func PreserveDirTimes(dir string, fn func() error) error {
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return fn()
+	}
+	err := fn()
+	syscall.UtimesNano(dir, []syscall.Timespec{statAtime(&st), statMtime(&st)})
+	return err
+}
+
+// CopyTimes sets the atime and mtime of "path" to the ones in "st".
+// Follows symlinks.
+func CopyTimes(path string, st *syscall.Stat_t) error {
+	return syscall.UtimesNano(path, []syscall.Timespec{statAtime(st), statMtime(st)})
+}
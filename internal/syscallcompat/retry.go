@@ -0,0 +1,70 @@
+package syscallcompat
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// retryBaseDelay is how long we sleep before the first retry. The delay
+// doubles with every further retry, up to retryMaxDelay.
+var retryBaseDelay = 10 * time.Millisecond
+
+const retryMaxDelay = time.Second
+
+// IsTransient returns true if "err" is a (potentially wrapped) error that
+// may go away if we simply try again: EINTR or EAGAIN.
+// Permanent errors like EIO or ENOSPC return false.
+func IsTransient(err error) bool {
+	// os.File.ReadAt/WriteAt return &PathError
+	if err2, ok := err.(*os.PathError); ok {
+		err = err2.Err
+	}
+	return err == syscall.EINTR || err == syscall.EAGAIN
+}
+
+// ReadAtRetry calls r.ReadAt and retries up to "retries" times, with
+// exponential backoff, if it fails with a transient error. Data that was
+// read before the error is kept and only the remainder is requested again.
+// If all retries fail, the last error is returned.
+func ReadAtRetry(r io.ReaderAt, buf []byte, off int64, retries int) (n int, err error) {
+	delay := retryBaseDelay
+	for i := 0; ; i++ {
+		var m int
+		m, err = r.ReadAt(buf[n:], off+int64(n))
+		n += m
+		if err == nil || i >= retries || !IsTransient(err) {
+			return n, err
+		}
+		tlog.Warn.Printf("ReadAtRetry: off=%d: %v, retry %d/%d in %v", off, err, i+1, retries, delay)
+		delay = retrySleep(delay)
+	}
+}
+
+// WriteAtRetry is like ReadAtRetry, but for w.WriteAt.
+func WriteAtRetry(w io.WriterAt, buf []byte, off int64, retries int) (n int, err error) {
+	delay := retryBaseDelay
+	for i := 0; ; i++ {
+		var m int
+		m, err = w.WriteAt(buf[n:], off+int64(n))
+		n += m
+		if err == nil || i >= retries || !IsTransient(err) {
+			return n, err
+		}
+		tlog.Warn.Printf("WriteAtRetry: off=%d: %v, retry %d/%d in %v", off, err, i+1, retries, delay)
+		delay = retrySleep(delay)
+	}
+}
+
+// retrySleep sleeps for "delay" and returns the delay for the next retry.
+func retrySleep(delay time.Duration) time.Duration {
+	time.Sleep(delay)
+	delay *= 2
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay
+}
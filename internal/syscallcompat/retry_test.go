@@ -0,0 +1,97 @@
+package syscallcompat
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// flakyFile wraps a real backing file and fails the first "failures"
+// ReadAt/WriteAt calls with "err". The failing calls transfer half of the
+// requested bytes to exercise the partial-transfer handling.
+type flakyFile struct {
+	f        *os.File
+	failures int
+	err      error
+	calls    int
+}
+
+func (ff *flakyFile) ReadAt(buf []byte, off int64) (int, error) {
+	ff.calls++
+	if ff.calls <= ff.failures {
+		n, _ := ff.f.ReadAt(buf[:len(buf)/2], off)
+		return n, &os.PathError{Op: "read", Path: ff.f.Name(), Err: ff.err}
+	}
+	return ff.f.ReadAt(buf, off)
+}
+
+func (ff *flakyFile) WriteAt(buf []byte, off int64) (int, error) {
+	ff.calls++
+	if ff.calls <= ff.failures {
+		n, _ := ff.f.WriteAt(buf[:len(buf)/2], off)
+		return n, &os.PathError{Op: "write", Path: ff.f.Name(), Err: ff.err}
+	}
+	return ff.f.WriteAt(buf, off)
+}
+
+func openFlaky(t *testing.T, failures int, err error) *flakyFile {
+	f, err2 := ioutil.TempFile(tmpDir, "retry")
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+	return &flakyFile{f: f, failures: failures, err: err}
+}
+
+func TestRetry(t *testing.T) {
+	retryBaseDelay = time.Microsecond
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	testCases := []struct {
+		failures int
+		err      error
+		retries  int
+		// Expected number of calls and whether we expect success
+		calls int
+		ok    bool
+	}{
+		{0, syscall.EAGAIN, 0, 1, true},
+		{2, syscall.EAGAIN, 3, 3, true},
+		{3, syscall.EINTR, 3, 4, true},
+		{4, syscall.EAGAIN, 3, 4, false},
+		{2, syscall.EAGAIN, 0, 1, false},
+		// Permanent errors must not be retried
+		{1, syscall.EIO, 3, 1, false},
+		{1, syscall.ENOSPC, 3, 1, false},
+	}
+	for i, tc := range testCases {
+		// Write
+		ff := openFlaky(t, tc.failures, tc.err)
+		defer ff.f.Close()
+		n, err := WriteAtRetry(ff, content, 0, tc.retries)
+		if ff.calls != tc.calls {
+			t.Errorf("case %d: WriteAt: want %d calls, have %d", i, tc.calls, ff.calls)
+		}
+		if tc.ok && (err != nil || n != len(content)) {
+			t.Errorf("case %d: WriteAt: n=%d err=%v", i, n, err)
+		}
+		if !tc.ok && err.(*os.PathError).Err != tc.err {
+			t.Errorf("case %d: WriteAt: want error %v, have %v", i, tc.err, err)
+		}
+		// Read
+		ff.f.WriteAt(content, 0)
+		ff.calls = 0
+		buf := make([]byte, len(content))
+		n, err = ReadAtRetry(ff, buf, 0, tc.retries)
+		if ff.calls != tc.calls {
+			t.Errorf("case %d: ReadAt: want %d calls, have %d", i, tc.calls, ff.calls)
+		}
+		if tc.ok && (err != nil || !bytes.Equal(buf, content)) {
+			t.Errorf("case %d: ReadAt: n=%d err=%v", i, n, err)
+		}
+		if !tc.ok && err.(*os.PathError).Err != tc.err {
+			t.Errorf("case %d: ReadAt: want error %v, have %v", i, tc.err, err)
+		}
+	}
+}
@@ -16,6 +16,9 @@ const (
 
 	// O_PATH is only defined on Linux
 	O_PATH = 0
+
+	// O_NOATIME is only defined on Linux
+	O_NOATIME = 0
 )
 
 // Sorry, fallocate is not available on OSX at all and
@@ -30,6 +33,22 @@ func Fallocate(fd int, mode uint32, off int64, len int64) error {
 	return syscall.EOPNOTSUPP
 }
 
+// Fdatasync is not available on Darwin, so we do a full fsync.
+func Fdatasync(fd int) error {
+	return syscall.Fsync(fd)
+}
+
+// DropPageCache is a no-op on Darwin, which has no posix_fadvise.
+func DropPageCache(fd int, off int64, len int64) error {
+	return nil
+}
+
+// Reflink is not implemented on Darwin. clonefile(2) works on paths, not on
+// file descriptors, and is not in our version of x/sys/unix.
+func Reflink(dstFd int, srcFd int) error {
+	return syscall.EOPNOTSUPP
+}
+
 // Dup3 is not available on Darwin, so we use Dup2 instead.
 func Dup3(oldfd int, newfd int, flags int) (err error) {
 	if flags != 0 {
@@ -81,3 +100,11 @@ func Fstatat(dirfd int, path string, stat *unix.Stat_t, flags int) (err error) {
 func Getdents(fd int) ([]fuse.DirEntry, error) {
 	return emulateGetdents(fd)
 }
+
+func statAtime(st *syscall.Stat_t) syscall.Timespec {
+	return st.Atimespec
+}
+
+func statMtime(st *syscall.Stat_t) syscall.Timespec {
+	return st.Mtimespec
+}
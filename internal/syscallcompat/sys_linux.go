@@ -21,6 +21,12 @@ const (
 
 	// O_PATH is only defined on Linux
 	O_PATH = unix.O_PATH
+
+	// O_NOATIME is only defined on Linux
+	O_NOATIME = syscall.O_NOATIME
+
+	// _FICLONE is from linux/fs.h. Not in our version of x/sys/unix.
+	_FICLONE = 0x40049409
 )
 
 var preallocWarn sync.Once
@@ -56,6 +62,28 @@ func Fallocate(fd int, mode uint32, off int64, len int64) (err error) {
 	return syscall.Fallocate(fd, mode, off, len)
 }
 
+// DropPageCache asks the kernel to drop cached pages of the range
+// [off, off+len) of "fd". Dirty pages must have been written back before
+// (fsync), otherwise they stay.
+func DropPageCache(fd int, off int64, len int64) error {
+	return unix.Fadvise(fd, off, len, unix.FADV_DONTNEED)
+}
+
+// Reflink makes "dstFd" a copy-on-write clone of "srcFd" (ioctl FICLONE).
+// Fails with EOPNOTSUPP (or EXDEV, EINVAL) if the filesystem cannot do it.
+func Reflink(dstFd int, srcFd int) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(dstFd), _FICLONE, uintptr(srcFd))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Fdatasync syscall.
+func Fdatasync(fd int) (err error) {
+	return syscall.Fdatasync(fd)
+}
+
 // Openat wraps the Openat syscall.
 func Openat(dirfd int, path string, flags int, mode uint32) (fd int, err error) {
 	if flags&syscall.O_CREAT != 0 {
@@ -139,3 +167,11 @@ func Fstatat(dirfd int, path string, stat *unix.Stat_t, flags int) (err error) {
 func Getdents(fd int) ([]fuse.DirEntry, error) {
 	return getdents(fd)
 }
+
+func statAtime(st *syscall.Stat_t) syscall.Timespec {
+	return st.Atim
+}
+
+func statMtime(st *syscall.Stat_t) syscall.Timespec {
+	return st.Mtim
+}
@@ -0,0 +1,78 @@
+package syscallcompat
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// IDMapRange is one line of /proc/PID/uid_map or /proc/PID/gid_map: "Count"
+// ids starting at "Inside" in the user namespace are ids starting at
+// "Outside" in the parent namespace.
+type IDMapRange struct {
+	Inside, Outside, Count uint32
+}
+
+// IDMap is the uid or gid mapping of a user namespace
+type IDMap []IDMapRange
+
+// ParseIDMap parses the content of a uid_map or gid_map file.
+func ParseIDMap(data string) (IDMap, error) {
+	var m IDMap
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid id map line %q", line)
+		}
+		var v [3]uint32
+		for i, f := range fields {
+			n, err := strconv.ParseUint(f, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid id map line %q: %v", line, err)
+			}
+			v[i] = uint32(n)
+		}
+		m = append(m, IDMapRange{Inside: v[0], Outside: v[1], Count: v[2]})
+	}
+	return m, nil
+}
+
+// ReadIDMap reads and parses the id map file "path", for example
+// "/proc/self/uid_map".
+func ReadIDMap(path string) (IDMap, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseIDMap(string(data))
+}
+
+// IsInitial returns true if "m" is the identity mapping of all ids, which is
+// what the initial user namespace has.
+func (m IDMap) IsInitial() bool {
+	return len(m) == 1 && m[0].Inside == 0 && m[0].Outside == 0 && m[0].Count == 4294967295
+}
+
+// Contains returns true if the id "inside" is mapped.
+func (m IDMap) Contains(inside uint32) bool {
+	for _, r := range m {
+		if inside >= r.Inside && uint64(inside) < uint64(r.Inside)+uint64(r.Count) {
+			return true
+		}
+	}
+	return false
+}
+
+// InUserNamespace returns true if we run inside a user namespace other than
+// the initial one. Always false on systems without /proc/self/uid_map.
+func InUserNamespace() bool {
+	m, err := ReadIDMap("/proc/self/uid_map")
+	if err != nil {
+		return false
+	}
+	return !m.IsInitial()
+}
@@ -0,0 +1,27 @@
+package syscallcompat
+
+import (
+	"testing"
+)
+
+func TestParseIDMap(t *testing.T) {
+	m, err := ParseIDMap("         0          0 4294967295\n")
+	if err != nil || !m.IsInitial() {
+		t.Errorf("initial map not recognized: %v %v", m, err)
+	}
+	m, err = ParseIDMap("         0       1000          1\n         1     100000      65536\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.IsInitial() {
+		t.Error("namespace map taken for the initial map")
+	}
+	for id, want := range map[uint32]bool{0: true, 1: true, 65536: true, 65537: false, 1000: true, 100000: false} {
+		if m.Contains(id) != want {
+			t.Errorf("Contains(%d) = %v, want %v", id, !want, want)
+		}
+	}
+	if _, err = ParseIDMap("0 0\n"); err == nil {
+		t.Error("short line should be rejected")
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"log/syslog"
 	"os"
 
 	"golang.org/x/crypto/ssh/terminal"
@@ -135,33 +134,6 @@ func init() {
 	}
 }
 
-// SwitchToSyslog redirects the output of this logger to syslog.
-func (l *toggledLogger) SwitchToSyslog(p syslog.Priority) {
-	w, err := syslog.New(p, ProgramName)
-	if err != nil {
-		Warn.Printf("SwitchToSyslog: %v", err)
-	} else {
-		l.Logger.SetOutput(w)
-		// Disable colors
-		l.prefix = ""
-		l.postfix = ""
-	}
-}
-
-// SwitchLoggerToSyslog redirects the default log.Logger that the go-fuse lib uses
-// to syslog.
-func SwitchLoggerToSyslog(p syslog.Priority) {
-	w, err := syslog.New(p, ProgramName)
-	if err != nil {
-		Warn.Printf("SwitchLoggerToSyslog: %v", err)
-	} else {
-		log.SetPrefix("go-fuse: ")
-		// Disable printing the timestamp, syslog already provides that
-		log.SetFlags(0)
-		log.SetOutput(w)
-	}
-}
-
 // PrintMasterkeyReminder reminds the user that he should store the master key in
 // a safe place.
 func PrintMasterkeyReminder(key []byte) {
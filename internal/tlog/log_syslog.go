@@ -0,0 +1,39 @@
+// +build !windows
+
+package tlog
+
+// Windows has no syslog. Keeping this in a separate file allows the packages
+// that do not depend on FUSE (cryptocore, contentenc, configfile) to be
+// built for Windows.
+
+import (
+	"log"
+	"log/syslog"
+)
+
+// SwitchToSyslog redirects the output of this logger to syslog.
+func (l *toggledLogger) SwitchToSyslog(p syslog.Priority) {
+	w, err := syslog.New(p, ProgramName)
+	if err != nil {
+		Warn.Printf("SwitchToSyslog: %v", err)
+	} else {
+		l.Logger.SetOutput(w)
+		// Disable colors
+		l.prefix = ""
+		l.postfix = ""
+	}
+}
+
+// SwitchLoggerToSyslog redirects the default log.Logger that the go-fuse lib uses
+// to syslog.
+func SwitchLoggerToSyslog(p syslog.Priority) {
+	w, err := syslog.New(p, ProgramName)
+	if err != nil {
+		Warn.Printf("SwitchLoggerToSyslog: %v", err)
+	} else {
+		log.SetPrefix("go-fuse: ")
+		// Disable printing the timestamp, syslog already provides that
+		log.SetFlags(0)
+		log.SetOutput(w)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// kdfProgressDelay is how long a password hash may take before we show the
+// progress indicator without "-show-kdf-progress"
+const kdfProgressDelay = 2 * time.Second
+
+// kdfProgressInterval is how often the spinner is updated
+const kdfProgressInterval = 200 * time.Millisecond
+
+// kdfProgress returns the configfile.KDFProgress callback for "args", or nil
+// if no progress should be shown.
+//
+// With "-show-kdf-progress", the progress is shown right away. Otherwise, it
+// is shown when the hash takes longer than kdfProgressDelay, but only if
+// stderr is a terminal. "-q" disables it. scrypt cannot tell how far it is,
+// so we show a spinner and the elapsed time.
+func kdfProgress(args *argContainer) func(kdf string) func() {
+	if args.quiet {
+		return nil
+	}
+	tty := terminal.IsTerminal(int(os.Stderr.Fd()))
+	delay := kdfProgressDelay
+	if args.showkdfprogress {
+		delay = 0
+	} else if !tty {
+		return nil
+	}
+	return func(kdf string) func() {
+		return startSpinner(os.Stderr, tty, delay, kdf)
+	}
+}
+
+// startSpinner writes a progress indicator for "kdf" to "w" after "delay",
+// until the returned function is called. The spinner runs in its own
+// goroutine and does not slow down the hash. When "w" is not a terminal,
+// only a start and an end line are written.
+func startSpinner(w io.Writer, tty bool, delay time.Duration, kdf string) (done func()) {
+	start := time.Now()
+	stop := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		}
+		if !tty {
+			fmt.Fprintf(w, "Hashing password (%s)...\n", kdf)
+			<-stop
+			fmt.Fprintf(w, "Hashing password (%s): done after %.1fs\n", kdf, time.Since(start).Seconds())
+			return
+		}
+		ticker := time.NewTicker(kdfProgressInterval)
+		defer ticker.Stop()
+		frames := `|/-\`
+		for i := 0; ; i++ {
+			fmt.Fprintf(w, "\rHashing password (%s) %c %.0fs", kdf, frames[i%len(frames)], time.Since(start).Seconds())
+			select {
+			case <-stop:
+				fmt.Fprintf(w, "\rHashing password (%s): done after %.1fs\n", kdf, time.Since(start).Seconds())
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-exited
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartSpinner(t *testing.T) {
+	var buf bytes.Buffer
+	done := startSpinner(&buf, false, 0, "scrypt")
+	time.Sleep(10 * time.Millisecond)
+	done()
+	out := buf.String()
+	if !strings.HasPrefix(out, "Hashing password (scrypt)...\n") || !strings.Contains(out, "done after") {
+		t.Errorf("unexpected output %q", out)
+	}
+	// Fast hashes do not show anything
+	buf.Reset()
+	startSpinner(&buf, true, time.Hour, "scrypt")()
+	if buf.Len() != 0 {
+		t.Errorf("unexpected output %q", buf.String())
+	}
+}
+
+func TestKDFProgressQuiet(t *testing.T) {
+	if kdfProgress(&argContainer{quiet: true, showkdfprogress: true}) != nil {
+		t.Error("-q should disable the progress indicator")
+	}
+	if kdfProgress(&argContainer{showkdfprogress: true}) == nil {
+		t.Error("-show-kdf-progress should enable the progress indicator")
+	}
+}
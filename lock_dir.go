@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// lockDir handles "gocryptfs -lock-dir DIR CIPHERDIR". It gives the empty
+// directory DIR (a plaintext path inside the filesystem) its own random
+// key, protected by a separate password.
+func lockDir(args *argContainer) {
+	if args.reverse || args.plaintextnames {
+		tlog.Fatal.Printf("-lock-dir cannot be used together with -reverse or -plaintextnames")
+		os.Exit(exitcodes.Usage)
+	}
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		os.Exit(exitcodes.LoadConf)
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagPlaintextNames) {
+		tlog.Fatal.Printf("-lock-dir is not supported on filesystems with plaintext names")
+		os.Exit(exitcodes.Usage)
+	}
+	dir := ctlsock.SanitizePath(args.lockdir)
+	if dir == "" {
+		tlog.Fatal.Printf("-lock-dir: the root directory cannot be locked")
+		os.Exit(exitcodes.Usage)
+	}
+	args.allow_other = false
+	pfs, wipeKeys := initFuseFrontend(args)
+	defer wipeKeys()
+	fs := pfs.(*fusefrontend.FS)
+	attr, status := fs.GetAttr(dir, nil)
+	if !status.Ok() {
+		tlog.Fatal.Printf("-lock-dir %q: %v", dir, status)
+		os.Exit(exitcodes.Usage)
+	}
+	if attr.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		tlog.Fatal.Printf("-lock-dir %q: not a directory", dir)
+		os.Exit(exitcodes.Usage)
+	}
+	entries, status := listDir(fs, dir)
+	if !status.Ok() || len(entries) > 0 {
+		tlog.Fatal.Printf("-lock-dir %q: directory is not empty. Lock an empty directory, "+
+			"then move the files into it.", dir)
+		os.Exit(exitcodes.Usage)
+	}
+	// The xattrs of the directory would be encrypted with the directory key
+	// afterwards
+	if names, _ := fs.ListXAttr(dir, nil); len(names) > 0 {
+		tlog.Fatal.Printf("-lock-dir %q: directory has extended attributes. Remove them first.", dir)
+		os.Exit(exitcodes.Usage)
+	}
+	cDir, err := fs.EncryptPath(dir)
+	if err != nil {
+		tlog.Fatal.Printf("-lock-dir %q: %v", dir, err)
+		os.Exit(exitcodes.Other)
+	}
+	if args.dirextpass == "" {
+		tlog.Info.Printf("Choose a password for directory %q.", dir)
+	}
+	password := readpassword.Twice(args.dirextpass)
+	cAbsDir := filepath.Join(args.cipherdir, cDir)
+	// The key slot is not visible in the plaintext view, so the mtime of the
+	// directory should not change
+	err = syscallcompat.PreserveDirTimes(cAbsDir, func() error {
+		return configfile.CreateDirKey(cAbsDir, password, args.scryptn)
+	})
+	for i := range password {
+		password[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Printf("-lock-dir %q: %v", dir, err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	fs.ClearDirCaches()
+	if !cf.IsFeatureFlagSet(configfile.FlagDirKeys) {
+		cf.SetFeatureFlag(configfile.FlagDirKeys)
+		err = cf.WriteFile()
+		if err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(exitcodes.WriteConf)
+		}
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"Directory %q has been locked. Mount with -unlock-dir to access it."+
+		tlog.ColorReset, dir)
+}
+
+// unlockDirs handles "-unlock-dir". For each directory, it asks for the
+// directory password and hands the directory key to "fs". Returns the
+// crypto cores so the keys can be wiped on unmount.
+func unlockDirs(args *argContainer, fs *fusefrontend.FS, cryptoBackend cryptocore.AEADTypeEnum,
+	maxReqSize int) (cores []*cryptocore.CryptoCore) {
+	for _, d := range args.unlockdir {
+		dir := ctlsock.SanitizePath(d)
+		cDir, err := fs.EncryptPath(dir)
+		if err != nil {
+			tlog.Fatal.Printf("-unlock-dir %q: %v", dir, err)
+			os.Exit(exitcodes.CipherDir)
+		}
+		slot, err := configfile.LoadDirKey(filepath.Join(args.cipherdir, cDir))
+		if os.IsNotExist(err) {
+			tlog.Fatal.Printf("-unlock-dir %q: directory is not locked", dir)
+			os.Exit(exitcodes.Usage)
+		} else if err != nil {
+			tlog.Fatal.Printf("-unlock-dir %q: %v", dir, err)
+			os.Exit(exitcodes.LoadConf)
+		}
+		password := readpassword.Once(args.dirextpass, "Password for directory "+dir)
+		key, err := slot.DecryptKey(password)
+		for i := range password {
+			password[i] = 0
+		}
+		if err != nil {
+			tlog.Fatal.Printf("-unlock-dir %q: %v", dir, err)
+			exitcodes.Exit(configfileExitErr(err))
+		}
+		cCore := cryptocore.New(key, cryptoBackend, contentenc.DefaultIVBits, args.hkdf, args.forcedecode)
+		ce := contentenc.NewWithMaxReqSize(cCore, contentenc.DefaultBS, maxReqSize, args.forcedecode)
+		if args.xts {
+			enableXTS(ce, key)
+		}
+		for i := range key {
+			key[i] = 0
+		}
+		fs.AddDirKey(slot.KeyID, ce, cCore.EMECipher)
+		cores = append(cores, cCore)
+		tlog.Info.Printf("Unlocked directory %q", dir)
+	}
+	return cores
+}
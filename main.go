@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"math/bits"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -41,6 +43,13 @@ func loadConfig(args *argContainer) (masterkey []byte, cf *configfile.ConfFile,
 		tlog.Fatal.Printf("Cannot open config file: %v", err)
 		return nil, nil, err
 	}
+	// "-passwd" is how the user re-keys a filesystem that fails the check
+	if !args.passwd {
+		if err = checkKDFPolicy(args, cf); err != nil {
+			tlog.Fatal.Println(err)
+			return nil, nil, err
+		}
+	}
 	// The user has passed the master key on the command line (probably because
 	// he forgot the password).
 	if args.masterkey != "" {
@@ -63,11 +72,32 @@ func loadConfig(args *argContainer) (masterkey []byte, cf *configfile.ConfFile,
 
 	if err != nil {
 		tlog.Fatal.Println(err)
-		return nil, nil, err
+		return nil, nil, configfileExitErr(err)
 	}
 	return masterkey, cf, nil
 }
 
+// checkKDFPolicy returns an error with exit code exitcodes.KDFPolicy if the
+// password hash parameters of "cf" are weaker than "-min-scrypt-n".
+func checkKDFPolicy(args *argContainer, cf *configfile.ConfFile) error {
+	if args.minscryptn == 0 || cf.ScryptObject.N >= args.minscryptn {
+		return nil
+	}
+	msg := fmt.Sprintf("-min-scrypt-n: the config file uses scrypt N=%d (-scryptn %d), "+
+		"below the required N=%d. Re-key the filesystem with \"gocryptfs -passwd -min-scrypt-n %d\".",
+		cf.ScryptObject.N, cf.ScryptObject.LogN(), args.minscryptn, args.minscryptn)
+	return exitcodes.NewErr(msg, exitcodes.KDFPolicy)
+}
+
+// configfileExitErr attaches the matching exit code to an error returned by
+// the configfile package, for use with exitcodes.Exit.
+func configfileExitErr(err error) error {
+	if errors.Is(err, configfile.ErrWrongPassword) {
+		return exitcodes.NewErr(err.Error(), exitcodes.PasswordIncorrect)
+	}
+	return err
+}
+
 // changePassword - change the password of config file "filename"
 // Does not return (calls os.Exit both on success and on error).
 func changePassword(args *argContainer) {
@@ -95,7 +125,12 @@ func changePassword(args *argContainer) {
 		tlog.Info.Println("Please enter your new password.")
 		newPw := readpassword.Twice(args.extpass)
 		readpassword.CheckTrailingGarbage()
-		confFile.EncryptKey(masterkey, newPw, confFile.ScryptObject.LogN())
+		// Keep the scrypt cost, but raise it to "-min-scrypt-n"
+		logN := confFile.ScryptObject.LogN()
+		if args.minscryptn > 1<<uint(logN) {
+			logN = bits.TrailingZeros(uint(args.minscryptn))
+		}
+		confFile.EncryptKey(masterkey, newPw, logN)
 		for i := range newPw {
 			newPw[i] = 0
 		}
@@ -126,6 +161,51 @@ func changePassword(args *argContainer) {
 	tlog.Info.Printf(tlog.ColorGreen + "Password changed." + tlog.ColorReset)
 }
 
+// setLabel handles "gocryptfs -set-label". The label is not secret, so we do
+// not have to unlock the master key.
+func setLabel(args *argContainer) {
+	if err := configfile.CheckLabel(args.setlabel); err != nil {
+		tlog.Fatal.Printf("-set-label: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	confFile, err := configfile.Load(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		os.Exit(exitcodes.LoadConf)
+	}
+	confFile.Label = args.setlabel
+	err = confFile.WriteFile()
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	tlog.Info.Printf("Label set to %q.", confFile.Label)
+}
+
+// migrateConfig implements "-migrate". It updates the config file in place
+// and exits if this is not possible.
+func migrateConfig(args *argContainer) {
+	changes, err := configfile.Migrate(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("-migrate: %v", err)
+		if len(changes) > 0 {
+			os.Exit(exitcodes.WriteConf)
+		}
+		if errors.Is(err, configfile.ErrUnsupportedVersion) {
+			os.Exit(exitcodes.DeprecatedFS)
+		}
+		os.Exit(exitcodes.LoadConf)
+	}
+	if len(changes) == 0 {
+		tlog.Info.Printf("-migrate: config file is up to date")
+		return
+	}
+	for _, c := range changes {
+		tlog.Info.Printf("-migrate: %s", c)
+	}
+	tlog.Info.Printf("-migrate: config file %q updated", args.config)
+}
+
 // printVersion prints a version string like this:
 // gocryptfs v0.12-36-ge021b9d-dirty; go-fuse a4c968c; 2016-07-03 go1.6.2
 func printVersion() {
@@ -154,6 +234,10 @@ func main() {
 		// On a 2-core machine, setting maxprocs to 4 gives 10% better performance
 		runtime.GOMAXPROCS(4)
 	}
+	// Started by go-fuse as the "fusermount" helper, see setupUsernsMount
+	if isFusermountHelper() {
+		os.Exit(fusermountHelper(os.Args[1:]))
+	}
 	// mount(1) unsets PATH. Since exec.Command does not handle this case, we set
 	// PATH to a default value if it's empty or unset.
 	if os.Getenv("PATH") == "" {
@@ -165,7 +249,7 @@ func main() {
 	args := parseCliOpts()
 	// Fork a child into the background if "-fg" is not set AND we are mounting
 	// a filesystem. The child will do all the work.
-	if !args.fg && flagSet.NArg() == 2 {
+	if !args.fg && flagSet.NArg() == 2 && countOpFlags(&args) == 0 {
 		ret := forkChild()
 		os.Exit(ret)
 	}
@@ -186,7 +270,16 @@ func main() {
 	}
 	// "-speed"
 	if args.speed {
-		speed.Run()
+		speed.Run(args.json)
+		os.Exit(0)
+	}
+	// "-verify-audit"
+	if args.verifyaudit {
+		if flagSet.NArg() != 1 {
+			tlog.Fatal.Printf("Usage: %s -verify-audit LOGFILE", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		verifyAudit(flagSet.Arg(0))
 		os.Exit(0)
 	}
 	if args.wpanic {
@@ -216,6 +309,8 @@ func main() {
 	if args.quiet {
 		tlog.Info.Enabled = false
 	}
+	// "-show-kdf-progress"
+	configfile.KDFProgress = kdfProgress(&args)
 	// "-reverse" implies "-aessiv"
 	if args.reverse {
 		args.aessiv = true
@@ -225,6 +320,43 @@ func main() {
 			os.Exit(exitcodes.ExcludeError)
 		}
 	}
+	if args.label != "" && !args.init {
+		tlog.Fatal.Printf("-label only works together with -init, use -set-label to change the label")
+		os.Exit(exitcodes.Usage)
+	}
+	if (args.deterministic || args.seed != "") && !args.init {
+		tlog.Fatal.Printf("-deterministic and -seed only work together with -init")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.fix && !args.fsck {
+		tlog.Fatal.Printf("-fix only works together with -fsck")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-since" and "-fsck-state"
+	if args.since != "" || args.fsckstate != "" {
+		parseFsckSince(&args)
+	}
+	// "-lowerdir"
+	if args.lowerdir != "" {
+		if args.reverse || args.ctlsock != "" || args.idle != 0 {
+			tlog.Fatal.Printf("-lowerdir cannot be used together with -reverse, -ctlsock or -idle")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.masterkey != "" || args.zerokey {
+			tlog.Fatal.Printf("-lowerdir cannot be used together with -masterkey or -zerokey")
+			os.Exit(exitcodes.Usage)
+		}
+		args.lowerdir, _ = filepath.Abs(args.lowerdir)
+		err = isDir(args.lowerdir)
+		if err != nil {
+			tlog.Fatal.Printf("Invalid lowerdir: %v", err)
+			os.Exit(exitcodes.CipherDir)
+		}
+		if args.lowerdir == args.cipherdir {
+			tlog.Fatal.Printf("lowerdir and cipherdir must be different")
+			os.Exit(exitcodes.Usage)
+		}
+	}
 	// "-config"
 	if args.config != "" {
 		args.config, err = filepath.Abs(args.config)
@@ -239,6 +371,10 @@ func main() {
 	} else {
 		args.config = filepath.Join(args.cipherdir, configfile.ConfDefaultName)
 	}
+	// "-tmpdir"
+	if args.tmpdir != "" {
+		checkTmpdir(&args)
+	}
 	// "-force_owner"
 	if args.force_owner != "" {
 		var uidNum, gidNum int64
@@ -257,22 +393,23 @@ func main() {
 			tlog.Fatal.Printf("force_owner: Unable to parse GID %v as positive integer", ownerPieces[1])
 			os.Exit(exitcodes.Usage)
 		}
+		checkNamespaceOwner(uint32(uidNum), uint32(gidNum))
 		args._forceOwner = &fuse.Owner{Uid: uint32(uidNum), Gid: uint32(gidNum)}
 	}
+	// The profiles are written out by exitcodes.RunAtExit. It runs on a
+	// normal return from main(), on SIGINT/SIGTERM and in exitcodes.Exit.
+	defer exitcodes.RunAtExit()
 	// "-cpuprofile"
 	if args.cpuprofile != "" {
-		onExitFunc := setupCpuprofile(args.cpuprofile)
-		defer onExitFunc()
+		exitcodes.AtExit(setupCpuprofile(args.cpuprofile))
 	}
 	// "-memprofile"
 	if args.memprofile != "" {
-		onExitFunc := setupMemprofile(args.memprofile)
-		defer onExitFunc()
+		exitcodes.AtExit(setupMemprofile(args.memprofile))
 	}
 	// "-trace"
 	if args.trace != "" {
-		onExitFunc := setupTrace(args.trace)
-		defer onExitFunc()
+		exitcodes.AtExit(setupTrace(args.trace))
 	}
 	if args.cpuprofile != "" || args.memprofile != "" || args.trace != "" {
 		tlog.Info.Printf("Note: You must unmount gracefully, otherwise the profile file(s) will stay empty!\n")
@@ -298,33 +435,104 @@ func main() {
 		// Don't call os.Exit to give deferred functions a chance to run
 		return
 	}
+	if args.burnafterreading {
+		tlog.Fatal.Printf("-burn-after-reading can only be used when mounting")
+		os.Exit(exitcodes.Usage)
+	}
 	if nOps > 1 {
-		tlog.Fatal.Printf("At most one of -info, -init, -passwd, -fsck is allowed")
+		tlog.Fatal.Printf("At most one of -info, -init, -passwd, -fsck, -compare, -derive-filekey, -export-manifest, -verify-manifest, -rekey-master, -lock-dir, -import, -tar, -set-label is allowed")
 		os.Exit(exitcodes.Usage)
 	}
+	// The operations below return instead of calling os.Exit(0) so the
+	// deferred exitcodes.RunAtExit() can write out the profiles.
+	// "-compare"
+	if args.compare {
+		if flagSet.NArg() != 2 {
+			tlog.Fatal.Printf("The option -compare takes exactly two arguments, %d given",
+				flagSet.NArg())
+			os.Exit(exitcodes.Usage)
+		}
+		compare(&args)
+		return
+	}
+	// "-rekey-master"
+	if args.rekeymaster {
+		if flagSet.NArg() != 2 {
+			tlog.Fatal.Printf("The option -rekey-master takes exactly two arguments, %d given",
+				flagSet.NArg())
+			os.Exit(exitcodes.Usage)
+		}
+		rekeyMaster(&args)
+		return
+	}
+	// "-import"
+	if args.importdir {
+		if flagSet.NArg() != 2 {
+			tlog.Fatal.Printf("The option -import takes exactly two arguments, %d given",
+				flagSet.NArg())
+			os.Exit(exitcodes.Usage)
+		}
+		importDir(&args)
+		return
+	}
+	// "-derive-filekey"
+	if args.derivefilekey {
+		if flagSet.NArg() != 2 {
+			tlog.Fatal.Printf("The option -derive-filekey takes exactly two arguments, %d given",
+				flagSet.NArg())
+			os.Exit(exitcodes.Usage)
+		}
+		deriveFilekey(&args)
+		return
+	}
 	if flagSet.NArg() != 1 {
-		tlog.Fatal.Printf("The options -info, -init, -passwd, -fsck take exactly one argument, %d given",
+		tlog.Fatal.Printf("The options -info, -init, -passwd, -fsck, -export-manifest, -verify-manifest, -lock-dir, -tar, -set-label take exactly one argument, %d given",
 			flagSet.NArg())
 		os.Exit(exitcodes.Usage)
 	}
 	// "-info"
 	if args.info {
 		info(args.config)
-		os.Exit(0)
+		return
 	}
 	// "-init"
 	if args.init {
 		initDir(&args)
-		os.Exit(0)
+		return
 	}
 	// "-passwd"
 	if args.passwd {
 		changePassword(&args)
-		os.Exit(0)
+		return
 	}
 	// "-fsck"
 	if args.fsck {
 		fsck(&args)
-		os.Exit(0)
+		return
+	}
+	// "-export-manifest"
+	if args.exportmanifest != "" {
+		exportManifest(&args)
+		return
+	}
+	// "-verify-manifest"
+	if args.verifymanifest != "" {
+		verifyManifest(&args)
+		return
+	}
+	// "-lock-dir"
+	if args.lockdir != "" {
+		lockDir(&args)
+		return
+	}
+	// "-tar"
+	if args.tar {
+		tarExport(&args)
+		return
+	}
+	// "-set-label"
+	if args.setlabel != "" {
+		setLabel(&args)
+		return
 	}
 }
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// The manifest written by "-export-manifest" is a text file with one JSON
+// object per line. The first line is the unencrypted manifestHeader. Every
+// following line is a manifestEntry, encrypted like a file content block
+// (with the record number as the block number and the manifest ID as the
+// file ID), and base64-encoded. The last record has End set. Records are
+// written in walk order (depth-first, directory entries sorted by name), which
+// is what allows resuming an interrupted export and verifying in one pass.
+
+// manifestVersion is the version of the manifest format
+const manifestVersion = 1
+
+// manifestMaxReported is the number of drifted paths that
+// "-verify-manifest" prints before it only counts them.
+const manifestMaxReported = 20
+
+// manifestHeader is the first line of a manifest
+type manifestHeader struct {
+	Creator string
+	Version int
+	// ID is a random value that binds the records to this manifest
+	ID []byte
+}
+
+// manifestEntry describes one path in the filesystem
+type manifestEntry struct {
+	// Path is relative to the root of the filesystem, "" is the root dir.
+	Path string `json:",omitempty"`
+	// Mode includes the file type bits
+	Mode     uint32 `json:",omitempty"`
+	UID, GID uint32 `json:",omitempty"`
+	// Size is only set for regular files
+	Size    uint64 `json:",omitempty"`
+	MtimeNs int64  `json:",omitempty"`
+	// Target is the symlink target
+	Target string `json:",omitempty"`
+	// SHA256 of the plaintext content of regular files, hex-encoded
+	SHA256 string            `json:",omitempty"`
+	Xattrs map[string][]byte `json:",omitempty"`
+	// End marks the last record. Count is the number of entries before it.
+	End   bool   `json:",omitempty"`
+	Count uint64 `json:",omitempty"`
+}
+
+// manifestReader reads and decrypts the records of a manifest
+type manifestReader struct {
+	ce *contentenc.ContentEnc
+	r  *bufio.Reader
+	id []byte
+	// Number of records read
+	n uint64
+	// Length of the manifest up to the end of the last complete record
+	off int64
+}
+
+// newManifestReader reads the header from "f" and returns a reader for the
+// records that follow.
+func newManifestReader(f io.Reader, ce *contentenc.ContentEnc) (*manifestReader, error) {
+	mr := &manifestReader{ce: ce, r: bufio.NewReader(f)}
+	line, err := mr.r.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %v", err)
+	}
+	var h manifestHeader
+	err = json.Unmarshal(line, &h)
+	if err != nil {
+		return nil, fmt.Errorf("parsing header: %v", err)
+	}
+	if h.Version != manifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d", h.Version)
+	}
+	mr.id = h.ID
+	mr.off = int64(len(line))
+	return mr, nil
+}
+
+// next returns the next record or io.EOF. A truncated last line, as left
+// behind by an interrupted export, is treated like the end of the file.
+func (mr *manifestReader) next() (*manifestEntry, error) {
+	line, err := mr.r.ReadBytes('\n')
+	if err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, err
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(string(bytes.TrimSpace(line)))
+	if err != nil {
+		return nil, fmt.Errorf("record %d: %v", mr.n, err)
+	}
+	plaintext, err := mr.ce.DecryptBlock(ciphertext, mr.n, mr.id)
+	if err != nil {
+		return nil, fmt.Errorf("record %d: decryption failed: %v", mr.n, err)
+	}
+	var e manifestEntry
+	err = json.Unmarshal(plaintext, &e)
+	if err != nil {
+		return nil, fmt.Errorf("record %d: %v", mr.n, err)
+	}
+	mr.n++
+	mr.off += int64(len(line))
+	return &e, nil
+}
+
+// manifestWalker walks the filesystem in manifest order and calls "emit" for
+// every path.
+type manifestWalker struct {
+	fs *fusefrontend.FS
+	// While "resuming" is set, paths up to and including "resumePath" are
+	// not emitted because they are already recorded.
+	resuming   bool
+	resumePath string
+	emit       func(e *manifestEntry, err error) error
+}
+
+// walk visits "path" and, if it is a directory, everything below it.
+func (w *manifestWalker) walk(path string) error {
+	attr, status := w.fs.GetAttr(path, nil)
+	if !status.Ok() {
+		return w.emit(nil, fmt.Errorf("%q: error stating: %v", path, status))
+	}
+	if w.resuming {
+		if path == w.resumePath {
+			w.resuming = false
+		} else if path != "" && !strings.HasPrefix(w.resumePath, path+"/") {
+			// Already recorded, and not an ancestor of resumePath
+			return nil
+		}
+	} else {
+		err := w.emit(w.entry(path, attr))
+		if err != nil {
+			return err
+		}
+	}
+	if attr.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return nil
+	}
+	entries, status := listDir(w.fs, path)
+	if !status.Ok() {
+		return w.emit(nil, fmt.Errorf("%q: error opening dir: %v", path, status))
+	}
+	for _, e := range entries {
+		err := w.walk(filepath.Join(path, e.Name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entry collects the metadata, content hash and xattrs of "path"
+func (w *manifestWalker) entry(path string, attr *fuse.Attr) (*manifestEntry, error) {
+	e := &manifestEntry{
+		Path:    path,
+		Mode:    attr.Mode,
+		UID:     attr.Owner.Uid,
+		GID:     attr.Owner.Gid,
+		MtimeNs: int64(attr.Mtime)*1e9 + int64(attr.Mtimensec),
+	}
+	switch attr.Mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		e.Size = attr.Size
+		hash, status := hashFile(w.fs, path)
+		if !status.Ok() {
+			return nil, fmt.Errorf("%q: error reading: %v", path, status)
+		}
+		e.SHA256 = hex.EncodeToString(hash)
+	case syscall.S_IFLNK:
+		var status fuse.Status
+		e.Target, status = w.fs.Readlink(path, nil)
+		if !status.Ok() {
+			return nil, fmt.Errorf("%q: error reading symlink: %v", path, status)
+		}
+	}
+	names, status := w.fs.ListXAttr(path, nil)
+	if status == fuse.Status(syscall.EOPNOTSUPP) {
+		return e, nil
+	} else if !status.Ok() {
+		return nil, fmt.Errorf("%q: error listing xattrs: %v", path, status)
+	}
+	for _, name := range names {
+		val, status := w.fs.GetXAttr(path, name, nil)
+		if !status.Ok() {
+			return nil, fmt.Errorf("%q: error reading xattr %q: %v", path, name, status)
+		}
+		if e.Xattrs == nil {
+			e.Xattrs = make(map[string][]byte)
+		}
+		e.Xattrs[name] = val
+	}
+	return e, nil
+}
+
+// manifestLess returns true if path "a" comes before path "b" in manifest
+// order: depth-first, with the entries of each directory sorted by name.
+func manifestLess(a, b string) bool {
+	if a == "" || b == "" {
+		return a == "" && b != ""
+	}
+	partsA := strings.Split(a, "/")
+	partsB := strings.Split(b, "/")
+	for i := 0; i < len(partsA) && i < len(partsB); i++ {
+		if partsA[i] != partsB[i] {
+			return partsA[i] < partsB[i]
+		}
+	}
+	return len(partsA) < len(partsB)
+}
+
+// initManifestFS sets up the forward filesystem for "-export-manifest" and
+// "-verify-manifest".
+func initManifestFS(args *argContainer) (*fusefrontend.FS, func()) {
+	if args.reverse {
+		tlog.Fatal.Printf("The manifest operations do not support -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	args.allow_other = false
+	// We read with MAX_KERNEL_WRITE-sized buffers
+	args.lowmem = false
+	pfs, wipeKeys := initFuseFrontend(args)
+	return pfs.(*fusefrontend.FS), wipeKeys
+}
+
+// exportManifest handles "gocryptfs -export-manifest FILE CIPHERDIR".
+// If FILE already contains an incomplete manifest, the export continues after
+// the last recorded path.
+func exportManifest(args *argContainer) {
+	fs, wipeKeys := initManifestFS(args)
+	defer wipeKeys()
+	ce := fs.ContentEnc()
+	f, err := os.OpenFile(args.exportmanifest, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open manifest: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+	defer f.Close()
+	w := manifestWalker{fs: fs}
+	var id []byte
+	var count uint64
+	st, err := f.Stat()
+	if err != nil {
+		tlog.Fatal.Printf("Cannot stat manifest: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+	if st.Size() == 0 {
+		id = cryptocore.RandBytes(16)
+		h, _ := json.Marshal(manifestHeader{
+			Creator: tlog.ProgramName + " " + GitVersion,
+			Version: manifestVersion,
+			ID:      id,
+		})
+		_, err = f.Write(append(h, '\n'))
+	} else {
+		// Resume an interrupted export
+		var mr *manifestReader
+		mr, err = newManifestReader(f, ce)
+		if err != nil {
+			tlog.Fatal.Printf("Cannot resume manifest: %v", err)
+			os.Exit(exitcodes.Other)
+		}
+		for {
+			var e *manifestEntry
+			e, err = mr.next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				tlog.Fatal.Printf("Cannot resume manifest: %v", err)
+				os.Exit(exitcodes.Other)
+			}
+			if e.End {
+				tlog.Info.Printf("Manifest %q is already complete", args.exportmanifest)
+				return
+			}
+			w.resuming = true
+			w.resumePath = e.Path
+		}
+		id = mr.id
+		count = mr.n
+		if w.resuming {
+			tlog.Info.Printf("Resuming after %d records, last path %q", count, w.resumePath)
+		}
+		// Drop a truncated last line
+		err = f.Truncate(mr.off)
+		if err == nil {
+			_, err = f.Seek(mr.off, io.SeekStart)
+		}
+	}
+	if err != nil {
+		tlog.Fatal.Printf("Writing manifest failed: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+	writeRecord := func(e *manifestEntry) error {
+		plaintext, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		ciphertext := ce.EncryptBlock(plaintext, count, id)
+		_, err = f.WriteString(base64.RawURLEncoding.EncodeToString(ciphertext) + "\n")
+		count++
+		return err
+	}
+	w.emit = func(e *manifestEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return writeRecord(e)
+	}
+	err = w.walk("")
+	if err == nil && w.resuming {
+		err = fmt.Errorf("cannot resume, %q does not exist any more", w.resumePath)
+	}
+	if err == nil {
+		err = writeRecord(&manifestEntry{End: true, Count: count})
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		tlog.Fatal.Printf("Writing manifest failed: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+	tlog.Info.Printf("Wrote %d entries to manifest %q", count-1, args.exportmanifest)
+}
+
+// manifestVerifier compares the walked filesystem against the records from
+// the manifest
+type manifestVerifier struct {
+	mr *manifestReader
+	// next record from the manifest that has not been matched yet
+	pending *manifestEntry
+	// Number of differences found
+	nDiffs int
+}
+
+// report records a difference at "path" and prints it if we have not printed
+// too many already.
+func (v *manifestVerifier) report(path string, format string, a ...interface{}) {
+	v.nDiffs++
+	if v.nDiffs > manifestMaxReported {
+		return
+	}
+	if path == "" {
+		path = "/"
+	}
+	fmt.Printf("verify-manifest: %q: %s\n", path, fmt.Sprintf(format, a...))
+}
+
+// advance loads the next record into v.pending
+func (v *manifestVerifier) advance() error {
+	e, err := v.mr.next()
+	if err != nil {
+		return err
+	}
+	if e.End {
+		e = nil
+	}
+	v.pending = e
+	return nil
+}
+
+// check is the emit callback of the walker
+func (v *manifestVerifier) check(e *manifestEntry, err error) error {
+	if err != nil {
+		v.nDiffs++
+		fmt.Printf("verify-manifest: %v\n", err)
+		return nil
+	}
+	// Recorded paths that sort before the current one were not found
+	for v.pending != nil && manifestLess(v.pending.Path, e.Path) {
+		v.report(v.pending.Path, "missing")
+		if err := v.advance(); err != nil {
+			return err
+		}
+	}
+	if v.pending == nil || v.pending.Path != e.Path {
+		v.report(e.Path, "not in manifest")
+		return nil
+	}
+	m := v.pending
+	if err := v.advance(); err != nil {
+		return err
+	}
+	if m.Mode != e.Mode {
+		v.report(e.Path, "mode differs: %#o / %#o", m.Mode, e.Mode)
+		return nil
+	}
+	if m.UID != e.UID || m.GID != e.GID {
+		v.report(e.Path, "owner differs: %d:%d / %d:%d", m.UID, m.GID, e.UID, e.GID)
+	}
+	if m.Size != e.Size {
+		v.report(e.Path, "size differs: %d / %d", m.Size, e.Size)
+	} else if m.SHA256 != e.SHA256 {
+		v.report(e.Path, "content differs")
+	}
+	if m.MtimeNs != e.MtimeNs {
+		v.report(e.Path, "mtime differs: %d / %d", m.MtimeNs, e.MtimeNs)
+	}
+	if m.Target != e.Target {
+		v.report(e.Path, "symlink target differs: %q / %q", m.Target, e.Target)
+	}
+	for name, val := range m.Xattrs {
+		val2, ok := e.Xattrs[name]
+		if !ok {
+			v.report(e.Path, "xattr %q missing", name)
+		} else if !bytes.Equal(val, val2) {
+			v.report(e.Path, "xattr %q differs", name)
+		}
+	}
+	for name := range e.Xattrs {
+		if _, ok := m.Xattrs[name]; !ok {
+			v.report(e.Path, "xattr %q not in manifest", name)
+		}
+	}
+	return nil
+}
+
+// verifyManifest handles "gocryptfs -verify-manifest FILE CIPHERDIR". It
+// walks the filesystem and reports every difference to the manifest.
+func verifyManifest(args *argContainer) {
+	fs, wipeKeys := initManifestFS(args)
+	defer wipeKeys()
+	f, err := os.Open(args.verifymanifest)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open manifest: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+	defer f.Close()
+	// First pass: check that the manifest is intact and complete. This is
+	// cheap compared to hashing all files.
+	mr, err := newManifestReader(f, fs.ContentEnc())
+	var e *manifestEntry
+	for err == nil {
+		e, err = mr.next()
+		if err == nil && e.End {
+			if e.Count != mr.n-1 {
+				err = fmt.Errorf("end record has count %d, but there are %d records", e.Count, mr.n-1)
+			}
+			break
+		}
+	}
+	if err == io.EOF {
+		err = fmt.Errorf("manifest is incomplete, run -export-manifest again to finish it")
+	}
+	if err != nil {
+		tlog.Fatal.Printf("Invalid manifest: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot read manifest: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+	// Second pass: walk the filesystem and the manifest in lockstep
+	mr, _ = newManifestReader(f, fs.ContentEnc())
+	v := manifestVerifier{mr: mr}
+	err = v.advance()
+	if err == nil {
+		w := manifestWalker{fs: fs, emit: v.check}
+		err = w.walk("")
+	}
+	for err == nil && v.pending != nil {
+		v.report(v.pending.Path, "missing")
+		err = v.advance()
+	}
+	if err != nil {
+		tlog.Fatal.Printf("Reading manifest failed: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+	if v.nDiffs == 0 {
+		tlog.Info.Printf("verify-manifest summary: no differences found\n")
+		return
+	}
+	if v.nDiffs > manifestMaxReported {
+		fmt.Printf("verify-manifest: ... (%d more not shown)\n", v.nDiffs-manifestMaxReported)
+	}
+	fmt.Printf("verify-manifest summary: %d differences\n", v.nDiffs)
+	wipeKeys()
+	exitcodes.Exit(exitcodes.NewErr("verify-manifest found differences", exitcodes.ManifestDrift))
+}
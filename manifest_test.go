@@ -0,0 +1,28 @@
+package main
+
+import (
+	"sort"
+	"testing"
+)
+
+type manifestOrder []string
+
+func (s manifestOrder) Len() int           { return len(s) }
+func (s manifestOrder) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s manifestOrder) Less(i, j int) bool { return manifestLess(s[i], s[j]) }
+
+// Sorting with manifestLess must give the depth-first order in which the
+// filesystem is walked
+func TestManifestLess(t *testing.T) {
+	want := []string{"", "a", "a/b", "a/b/c", "a/d", "a.b", "a.b/x", "b", "b-c"}
+	have := manifestOrder{"b-c", "a/d", "a.b/x", "", "b", "a/b/c", "a", "a.b", "a/b"}
+	sort.Sort(have)
+	for i := range want {
+		if have[i] != want[i] {
+			t.Fatalf("wrong order: %v", have)
+		}
+	}
+	if manifestLess("a", "a") {
+		t.Error("a path must not sort before itself")
+	}
+}
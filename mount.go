@@ -18,11 +18,14 @@ import (
 	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode"
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"golang.org/x/text/unicode/norm"
 
+	"github.com/rfjakob/gocryptfs/internal/audit"
 	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
@@ -30,11 +33,64 @@ import (
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
 	"github.com/rfjakob/gocryptfs/internal/fusefrontend_reverse"
+	"github.com/rfjakob/gocryptfs/internal/mlock"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
+// Settings used by "-low-mem"
+const (
+	// Largest read or write request, in bytes. Also caps the kernel read-ahead.
+	lowMemMaxReqSize = 32 * 1024
+	// Number of concurrent async requests the kernel may send us
+	lowMemMaxBackground = 4
+	// Size of the DirIV cache
+	lowMemDirIVCacheEntries = 10
+	// Trigger garbage collection when the heap has grown by 20% (Go default: 100%)
+	lowMemGCPercent = 20
+)
+
+// clampReqSize brings the "-max-write" or "-max-read" value "v" into the
+// range the kernel, go-fuse and our buffer pools can handle, with a warning if
+// it has to be changed. Zero means the default and is returned unchanged.
+func clampReqSize(name string, v byteSize) byteSize {
+	if v == 0 {
+		return 0
+	}
+	c := v
+	// go-fuse and the kernel (without FUSE_MAX_PAGES) do not go higher
+	if c > fuse.MAX_KERNEL_WRITE {
+		c = fuse.MAX_KERNEL_WRITE
+	}
+	// Our buffer pools work in whole plaintext blocks
+	c -= c % contentenc.DefaultBS
+	if c < contentenc.DefaultBS {
+		c = contentenc.DefaultBS
+	}
+	if c != v {
+		tlog.Warn.Printf("%s: %d is not supported, using %d", name, uint64(v), uint64(c))
+	}
+	return c
+}
+
+// reqSizes returns the largest write and read requests, in bytes, we accept
+// from the kernel.
+func reqSizes(args *argContainer) (maxWrite int, maxRead int) {
+	maxWrite, maxRead = fuse.MAX_KERNEL_WRITE, fuse.MAX_KERNEL_WRITE
+	if args.lowmem {
+		maxWrite, maxRead = lowMemMaxReqSize, lowMemMaxReqSize
+	}
+	if args.maxwrite != 0 {
+		maxWrite = int(args.maxwrite)
+	}
+	if args.maxread != 0 {
+		maxRead = int(args.maxread)
+	}
+	return maxWrite, maxRead
+}
+
 // doMount mounts an encrypted directory.
 // Called from main.
 func doMount(args *argContainer) {
@@ -59,6 +115,11 @@ func doMount(args *argContainer) {
 			args.mountpoint, args.cipherdir)
 		os.Exit(exitcodes.MountPoint)
 	}
+	if args.lowerdir != "" && (args.lowerdir == args.mountpoint || strings.HasPrefix(args.lowerdir, args.mountpoint+"/")) {
+		tlog.Fatal.Printf("Mountpoint %q would shadow lowerdir %q, this is not supported",
+			args.mountpoint, args.lowerdir)
+		os.Exit(exitcodes.MountPoint)
+	}
 	if args.nonempty {
 		err = isDir(args.mountpoint)
 	} else {
@@ -74,6 +135,15 @@ func doMount(args *argContainer) {
 		tlog.Fatal.Printf("Invalid mountpoint: %v", err)
 		os.Exit(exitcodes.MountPoint)
 	}
+	checkNesting(args)
+	// "-require-local", "-require-network"
+	if args.requirelocal || args.requirenetwork {
+		checkCipherdirFsType(args)
+	}
+	// "-migrate"
+	if args.migrate {
+		migrateConfig(args)
+	}
 	// Open control socket early so we can error out before asking the user
 	// for the password
 	if args.ctlsock != "" {
@@ -95,14 +165,184 @@ func doMount(args *argContainer) {
 			}
 		}()
 	}
+	if args.burnafterreading && (args.ro || args.reverse) {
+		tlog.Fatal.Printf("-burn-after-reading cannot be used together with -ro or -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.unmountonbackingloss && (args.reverse || args.lowerdir != "") {
+		tlog.Fatal.Printf("-unmount-on-backing-loss cannot be used together with -reverse or -lowerdir")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.noescapesymlinks && args.reverse {
+		tlog.Fatal.Printf("-no-escape-symlinks is not supported in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if (args.readlimit > 0 || args.writelimit > 0) && args.reverse {
+		tlog.Fatal.Printf("-read-limit and -write-limit are not supported in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.strictatime && hasMountOption(args.ko, "noatime") {
+		tlog.Fatal.Printf("-strict-atime cannot be used together with -ko noatime")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.strictatime && args.ro {
+		tlog.Fatal.Printf("-strict-atime cannot be used together with -ro")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.timingjitter < 0 || args.timingjitter > fusefrontend.MaxTimingJitter {
+		tlog.Fatal.Printf("-timing-jitter must be between 0 and %v", fusefrontend.MaxTimingJitter)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.timingjitter > 0 && args.reverse {
+		tlog.Fatal.Printf("-timing-jitter cannot be used together with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.flushinterval < 0 {
+		tlog.Fatal.Printf("-flush-interval must not be negative")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.flushinterval > 0 && args.reverse {
+		tlog.Fatal.Printf("-flush-interval cannot be used together with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.nowriteholes && args.reverse {
+		tlog.Fatal.Printf("-no-write-holes cannot be used together with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	switch args.fsckondirty {
+	case "warn", "fsck", "off":
+	default:
+		tlog.Fatal.Printf("-fsck-on-dirty: invalid value %q, must be warn, fsck or off", args.fsckondirty)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.scrubinterval < 0 {
+		tlog.Fatal.Printf("-scrub-interval must not be negative")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.scrubinterval > 0 && args.reverse {
+		tlog.Fatal.Printf("-scrub-interval cannot be used together with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.scrubinterval > 0 && args.idle > 0 {
+		// The scrubber accesses the filesystem all the time
+		tlog.Fatal.Printf("-scrub-interval cannot be used together with -idle")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.reversepatternsfile != "" && !args.reverse {
+		tlog.Fatal.Printf("-reverse-patterns-file only works in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if strings.Contains(args.reversepatternsfile, "/") {
+		tlog.Fatal.Printf("-reverse-patterns-file takes a file name, not a path")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.passthroughext != "" {
+		if !args.reverse {
+			tlog.Fatal.Printf("-passthrough-ext only works in reverse mode")
+			os.Exit(exitcodes.Usage)
+		}
+		args._passthroughExt = parsePassthroughExt(args.passthroughext)
+	}
+	args.maxwrite = clampReqSize("-max-write", args.maxwrite)
+	args.maxread = clampReqSize("-max-read", args.maxread)
+	if strings.Contains(args.namesuffix, "/") {
+		tlog.Fatal.Printf("-name-suffix must not contain \"/\"")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.auditlog != "" {
+		args.auditlog, _ = filepath.Abs(args.auditlog)
+		if args.auditlog == args.mountpoint || strings.HasPrefix(args.auditlog, args.mountpoint+"/") {
+			tlog.Fatal.Printf("-audit-log: the log cannot be stored inside the mount")
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if len(args.unlockdir) > 0 && args.reverse {
+		tlog.Fatal.Printf("-unlock-dir cannot be used together with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-require-mlock": lock the whole process before the password is read,
+	// so that the keys on the Go heap cannot be swapped out either
+	if args.requiremlock {
+		if err := mlock.LockAll(); err != nil {
+			tlog.Fatal.Printf("-require-mlock: could not lock memory: %v. Check \"ulimit -l\".", err)
+			os.Exit(exitcodes.Mlock)
+		}
+	}
+	// Refuse to mount a CIPHERDIR twice. Also done before asking for the
+	// password.
+	var fsckSince time.Time
+	var fsckOnDirty bool
+	if lockFile := lockCipherdir(args); lockFile != nil {
+		// Closing the file releases the lock
+		defer lockFile.Close()
+		args._mountLock = lockFile
+		fsckSince, fsckOnDirty = checkMountState(args, lockFile)
+	}
+	// "-ctl-listen"
+	if args.ctllisten != "" {
+		initCtlListen(args)
+		defer args._ctlListenFd.Close()
+	}
+	// "-premount-cmd" may have to prepare a TPM or smartcard before we can
+	// derive the key. Nothing is mounted yet, so we can just exit.
+	if args.premountcmd != "" {
+		if err = runHook(args.premountcmd, args); err != nil {
+			tlog.Fatal.Printf("-premount-cmd failed: %v", err)
+			if args._ctlsockFd != nil {
+				// Delete the socket file
+				args._ctlsockFd.Close()
+			}
+			os.Exit(exitcodes.PremountCmd)
+		}
+	}
 	// We cannot use JSON for pretty-printing as the fields are unexported
 	tlog.Debug.Printf("cli args: %#v", args)
 	// Initialize gocryptfs (read config file, ask for password, ...)
 	fs, wipeKeys := initFuseFrontend(args)
+	// "-fsck-on-dirty=fsck". Only the files that may have been written
+	// during the last mount are read, through a read-only instance so that
+	// "-burn-after-reading" and "-strict-atime" do not kick in, and nothing
+	// is repaired.
+	if fsckOnDirty {
+		ckArgs := *args
+		ckArgs.fix = false
+		ck := fsckFS(fs.(*fusefrontend.FS).CheckCopy(), &ckArgs, fsckSince)
+		if len(ck.corruptList) > 0 {
+			tlog.Fatal.Printf("-fsck-on-dirty: %d corrupt files, refusing to mount. "+
+				"Run \"gocryptfs -fsck\" for details, or mount with -fsck-on-dirty=warn.", len(ck.corruptList))
+			wipeKeys()
+			os.Exit(exitcodes.FsckErrors)
+		}
+		tlog.Info.Printf("-fsck-on-dirty: no problems found")
+	}
+	// "-lowerdir"
+	if args.lowerdir != "" {
+		fs, wipeKeys = initUnionFS(args, fs, wipeKeys)
+	}
+	if args.requiremlock && mlock.Failures() > 0 {
+		tlog.Fatal.Printf("-require-mlock: could not lock the keys into memory, refusing to mount")
+		wipeKeys()
+		os.Exit(exitcodes.Mlock)
+	}
+	// "-audit-log"
+	fuseFs := fs
+	if args.auditlog != "" {
+		auditLog := openAuditLog(args)
+		// Not deferred: the "unmount" record must also be written when we
+		// exit through gracefulShutdown (SIGINT, SIGTERM)
+		exitcodes.AtExit(func() { closeAuditLog(auditLog) })
+		fuseFs = audit.NewFS(fs, auditLog)
+	}
 	// Initialize go-fuse FUSE server
-	srv := initGoFuse(fs, args)
+	srv, drain := initGoFuse(fuseFs, args)
 	// Try to wipe secret keys from memory after unmount
 	defer wipeKeys()
+	// Record that we are mounted until srv.Serve() returns after a clean
+	// unmount. "-fsck-on-dirty" looks at this on the next mount.
+	if args._mountLock != nil {
+		markDirty(args._mountLock, time.Now())
+		defer markClean(args._mountLock)
+	}
 
 	tlog.Info.Println(tlog.ColorGreen + "Filesystem mounted and ready." + tlog.ColorReset)
 	// We have been forked into the background, as evidenced by the set
@@ -131,26 +371,109 @@ func doMount(args *argContainer) {
 		// Send SIGUSR1 to our parent
 		sendUsr1(args.notifypid)
 	}
+	// Logged after switching to syslog so that it ends up in the daemon logs
+	if args._label != "" {
+		tlog.Info.Printf("Mount ID: %s, label %q", args._mountID, args._label)
+	} else {
+		tlog.Info.Printf("Mount ID: %s", args._mountID)
+	}
+	// "-postmount-cmd". The hook may access the mount, which only works once
+	// srv.Serve() is running, so we cannot wait for it here.
+	if args.postmountcmd != "" {
+		go func() {
+			if err := srv.WaitMount(); err != nil {
+				tlog.Warn.Printf("-postmount-cmd: mount not ready: %v", err)
+				return
+			}
+			if err := runHook(args.postmountcmd, args); err != nil {
+				tlog.Warn.Printf("-postmount-cmd failed: %v", err)
+			}
+		}()
+	}
+	// "-prewarm". Stopped when srv.Serve() returns.
+	if args.prewarm {
+		stopPrewarm := make(chan struct{})
+		defer close(stopPrewarm)
+		prewarm(srv, args.mountpoint, stopPrewarm)
+	}
+	// READDIRPLUS attribute prefetching. "-sharedstorage" cannot use it, as
+	// the backing files may change behind our back.
+	if ffs, ok := fs.(*fusefrontend.FS); ok && !args.sharedstorage {
+		go enableReaddirPlus(srv, ffs)
+	}
 	// Increase the open file limit to 4096. This is not essential, so do it after
 	// we have switched to syslog and don't bother the user with warnings.
 	setOpenFileLimit()
-	// Wait for SIGINT in the background and unmount ourselves if we get it.
-	// This prevents a dangling "Transport endpoint is not connected"
-	// mountpoint if the user hits CTRL-C.
-	handleSigint(srv, args.mountpoint)
+	// Wait for SIGINT and SIGTERM in the background and unmount ourselves if
+	// we get it. This prevents a dangling "Transport endpoint is not
+	// connected" mountpoint if the user hits CTRL-C.
+	handleSigint(srv, drain, fs, args)
 	// Return memory that was allocated for scrypt (64M by default!) and other
 	// stuff that is no longer needed to the OS
 	debug.FreeOSMemory()
+	// "-unmount-on-backing-loss"
+	if ffs, ok := fs.(*fusefrontend.FS); ok && args.unmountonbackingloss {
+		ffs.OnBackingLoss = func() {
+			tlog.Info.Printf("-unmount-on-backing-loss: unmounting %s", args.mountpoint)
+			unmount(srv, args.mountpoint)
+		}
+	}
 	// Set up autounmount, if requested.
 	if args.idle > 0 && !args.reverse {
 		// Not being in reverse mode means we always have a forward file system.
 		fwdFs := fs.(*fusefrontend.FS)
 		go idleMonitor(args.idle, fwdFs, srv, args.mountpoint)
 	}
+	// "-scrub-interval". The scrubber must not read CIPHERDIR after we have
+	// been unmounted.
+	if ffs, ok := fs.(*fusefrontend.FS); ok {
+		defer ffs.StopScrub()
+	}
 	// Jump into server loop. Returns when it gets an umount request from the kernel.
 	srv.Serve()
 }
 
+// mountNames returns the filesystem name and the subtype that "mount" and
+// "df -T" show for the mount. They default to CIPHERDIR and "gocryptfs" (or
+// "gocryptfs-reverse") and can be set with "-fsname" and "-subtype".
+// Characters that would break the mount options or the mount table are
+// replaced by "_".
+func mountNames(args *argContainer) (fsname string, subtype string) {
+	fsname = args.cipherdir
+	if args.fsname != "" {
+		fsname = args.fsname
+	}
+	fsname2 := strings.Map(func(r rune) rune {
+		if r == ',' || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, fsname)
+	if fsname2 != fsname {
+		tlog.Warn.Printf("Warning: %q will be displayed as %q in \"df -T\"", fsname, fsname2)
+		fsname = fsname2
+	}
+	subtype = "gocryptfs"
+	if args.reverse {
+		subtype += "-reverse"
+	}
+	if args.subtype != "" {
+		subtype = args.subtype
+	}
+	// The subtype becomes part of the filesystem type, "fuse.SUBTYPE"
+	subtype2 := strings.Map(func(r rune) rune {
+		if r < 0x80 && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("._-+", r)) {
+			return r
+		}
+		return '_'
+	}, subtype)
+	if subtype2 != subtype {
+		tlog.Warn.Printf("Warning: subtype %q will be displayed as %q", subtype, subtype2)
+		subtype = subtype2
+	}
+	return fsname, subtype
+}
+
 // Based on the EncFS idle monitor:
 // https://github.com/vgough/encfs/blob/1974b417af189a41ffae4c6feb011d2a0498e437/encfs/main.cpp#L851
 // idleMonitor is a function to be run as a thread that checks for
@@ -211,6 +534,75 @@ type ctlsockFs interface {
 	ctlsock.Interface
 }
 
+// parsePassthroughExt parses the comma-separated "-passthrough-ext" list.
+// Extensions are matched case-insensitively and may be given with or
+// without the leading dot. Exits on invalid input.
+func parsePassthroughExt(val string) (exts []string) {
+	for _, e := range strings.Split(val, ",") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if !strings.HasPrefix(e, ".") {
+			e = "." + e
+		}
+		if e == "." || strings.ContainsAny(e[1:], "./") {
+			tlog.Fatal.Printf("-passthrough-ext: invalid extension %q", e)
+			os.Exit(exitcodes.Usage)
+		}
+		exts = append(exts, e)
+	}
+	return exts
+}
+
+// checkCipherdirFsType implements "-require-local" and "-require-network".
+// It exits if the filesystem CIPHERDIR is on is of the wrong kind.
+func checkCipherdirFsType(args *argContainer) {
+	if args.requirelocal && args.requirenetwork {
+		tlog.Fatal.Printf("-require-local and -require-network cannot be used together")
+		os.Exit(exitcodes.Usage)
+	}
+	ft, err := syscallcompat.GetFsType(args.cipherdir)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot determine the filesystem type of CIPHERDIR: %v", err)
+		os.Exit(exitcodes.CipherDir)
+	}
+	tlog.Debug.Printf("CIPHERDIR is on %s, kind %d", ft.Name, ft.Kind)
+	switch {
+	case ft.Kind == syscallcompat.FsUnknown:
+		// Do not refuse what may be perfectly fine, like sshfs with
+		// "-require-network"
+		tlog.Warn.Printf("Cannot tell if CIPHERDIR on %s is a local or a network filesystem, mounting anyway", ft.Name)
+	case args.requirelocal && ft.Kind == syscallcompat.FsNetwork:
+		tlog.Fatal.Printf("-require-local: CIPHERDIR is on the network filesystem %s. "+
+			"Consider -sharedstorage if other machines access it.", ft.Name)
+		os.Exit(exitcodes.CipherDir)
+	case args.requirenetwork && ft.Kind != syscallcompat.FsNetwork:
+		tlog.Fatal.Printf("-require-network: CIPHERDIR is on the local filesystem %s", ft.Name)
+		os.Exit(exitcodes.CipherDir)
+	}
+}
+
+// enableReaddirPlus enables attribute prefetching in OpenDir if the kernel
+// has negotiated READDIRPLUS. The kernel settings are only known once the
+// mount is ready.
+func enableReaddirPlus(srv *fuse.Server, fs *fusefrontend.FS) {
+	if err := srv.WaitMount(); err != nil {
+		return
+	}
+	if srv.KernelSettings().Flags&fuse.CAP_READDIRPLUS != 0 {
+		tlog.Debug.Printf("kernel supports READDIRPLUS, enabling attribute prefetching")
+		fs.EnableReaddirPlus()
+	}
+}
+
+// enableXTS switches "ce" to AES-XTS content encryption with the key derived
+// from "masterkey"
+func enableXTS(ce *contentenc.ContentEnc, masterkey []byte) {
+	key := cryptocore.XTSContentKey(masterkey)
+	ce.EnableXTS(key)
+	for i := range key {
+		key[i] = 0
+	}
+}
+
 // initFuseFrontend - initialize gocryptfs/fusefrontend
 // Calls os.Exit on errors
 func initFuseFrontend(args *argContainer) (pfs pathfs.FileSystem, wipeKeys func()) {
@@ -231,22 +623,58 @@ func initFuseFrontend(args *argContainer) (pfs pathfs.FileSystem, wipeKeys func(
 		args.allow_other = true
 	}
 	frontendArgs := fusefrontend.Args{
-		Cipherdir:      args.cipherdir,
-		PlaintextNames: args.plaintextnames,
-		LongNames:      args.longnames,
-		ConfigCustom:   args._configCustom,
-		NoPrealloc:     args.noprealloc,
-		SerializeReads: args.serialize_reads,
-		ForceDecode:    args.forcedecode,
-		ForceOwner:     args._forceOwner,
-		Exclude:        args.exclude,
-	}
+		Cipherdir:             args.cipherdir,
+		PlaintextNames:        args.plaintextnames,
+		LongNames:             args.longnames,
+		ConfigCustom:          args._configCustom,
+		NoPrealloc:            args.noprealloc,
+		NoWriteHoles:          args.nowriteholes,
+		SerializeReads:        args.serialize_reads,
+		ForceDecode:           args.forcedecode,
+		ForceOwner:            args._forceOwner,
+		Exclude:               args.exclude,
+		PatternsFile:          args.reversepatternsfile,
+		PassthroughExt:        args._passthroughExt,
+		FlushOnClose:          args.flushonclose,
+		XattrSync:             args.xattrsync,
+		TmpDir:                args.tmpdir,
+		NoEscapeSymlinks:      args.noescapesymlinks,
+		PreserveXattrOnRename: args.preservexattronrename,
+		IORetries:             args.ioretries,
+		MaxDepth:              args.maxdepth,
+		ReadOnly:              args.ro,
+		BurnAfterReading:      args.burnafterreading,
+		StrictAtime:           args.strictatime,
+		SkipCorrupt:           args.skipcorrupt,
+		Recovery:              args.recovery,
+		MaxFileSize:           uint64(args.maxfilesize),
+		ReadLimit:             uint64(args.readlimit),
+		WriteLimit:            uint64(args.writelimit),
+		TimingJitter:          args.timingjitter,
+		PlaintextContent:      args.plaintextcontent,
+		FlushInterval:         args.flushinterval,
+		ScrubInterval:         args.scrubinterval,
+		WriteVerify:           args.writeverify,
+		ODirectDontNeed:       args.odirectdontneed,
+		DebugXattr:            args.debugxattr,
+		MountID:               cryptocore.MountID(masterkey),
+	}
+	args._mountID = frontendArgs.MountID
 	// confFile is nil when "-zerokey" or "-masterkey" was used
 	if confFile != nil {
+		frontendArgs.Label = confFile.Label
+		args._label = confFile.Label
 		// Settings from the config file override command line args
 		frontendArgs.PlaintextNames = confFile.IsFeatureFlagSet(configfile.FlagPlaintextNames)
 		args.raw64 = confFile.IsFeatureFlagSet(configfile.FlagRaw64)
 		args.hkdf = confFile.IsFeatureFlagSet(configfile.FlagHKDF)
+		if confFile.IsFeatureFlagSet(configfile.FlagNoLongNames) {
+			frontendArgs.LongNames = false
+		}
+		frontendArgs.DirKeys = confFile.IsFeatureFlagSet(configfile.FlagDirKeys)
+		frontendArgs.PlaintextContent = confFile.IsFeatureFlagSet(configfile.FlagPlaintextContent)
+		frontendArgs.XAttrSidecar = confFile.IsFeatureFlagSet(configfile.FlagXAttrSidecar)
+		args.xts = confFile.IsFeatureFlagSet(configfile.FlagXTS)
 		if confFile.IsFeatureFlagSet(configfile.FlagAESSIV) {
 			cryptoBackend = cryptocore.BackendAESSIV
 		} else if args.reverse {
@@ -254,6 +682,24 @@ func initFuseFrontend(args *argContainer) (pfs pathfs.FileSystem, wipeKeys func(
 			os.Exit(exitcodes.Usage)
 		}
 	}
+	if frontendArgs.PlaintextContent {
+		if args.reverse || args.forcedecode {
+			tlog.Fatal.Printf("PlaintextContent cannot be used together with -reverse or -forcedecode")
+			os.Exit(exitcodes.Usage)
+		}
+		tlog.Warn.Printf("PlaintextContent: file contents are NOT encrypted and NOT integrity-protected. Only the file names are.")
+	}
+	if args.xts {
+		if args.reverse || args.forcedecode || args.recovery || args.writeverify {
+			tlog.Fatal.Printf("XTS cannot be used together with -reverse, -forcedecode, -recovery or -write-verify")
+			os.Exit(exitcodes.Usage)
+		}
+		tlog.Warn.Printf("XTS: file contents are encrypted but NOT integrity-protected.")
+	}
+	if len(frontendArgs.PassthroughExt) > 0 {
+		tlog.Warn.Printf("-passthrough-ext: the contents of %s files are NOT encrypted and NOT integrity-protected. Only the file names are.",
+			strings.Join(frontendArgs.PassthroughExt, ", "))
+	}
 	// If allow_other is set and we run as root, try to give newly created files to
 	// the right user.
 	if args.allow_other && os.Getuid() == 0 {
@@ -264,16 +710,57 @@ func initFuseFrontend(args *argContainer) (pfs pathfs.FileSystem, wipeKeys func(
 
 	// Init crypto backend
 	cCore := cryptocore.New(masterkey, cryptoBackend, contentenc.DefaultIVBits, args.hkdf, args.forcedecode)
-	cEnc := contentenc.New(cCore, contentenc.DefaultBS, args.forcedecode)
+	maxWrite, maxRead := reqSizes(args)
+	maxReqSize := maxWrite
+	if maxRead > maxReqSize {
+		maxReqSize = maxRead
+	}
+	cEnc := contentenc.NewWithMaxReqSize(cCore, contentenc.DefaultBS, maxReqSize, args.forcedecode)
+	if args.xts {
+		enableXTS(cEnc, masterkey)
+	}
 	nameTransform := nametransform.New(cCore.EMECipher, frontendArgs.LongNames, args.raw64)
+	if args.lowmem {
+		nameTransform.DirIVCache.MaxEntries = lowMemDirIVCacheEntries
+	}
+	nameTransform.EncfsQuirks = args.encfsquirks
+	// "-name-suffix"
+	if args.namesuffix != "" {
+		if frontendArgs.PlaintextNames || args.reverse {
+			tlog.Fatal.Printf("-name-suffix cannot be used together with -plaintextnames or -reverse")
+			os.Exit(exitcodes.Usage)
+		}
+		nameTransform.SetNameSuffix(args.namesuffix)
+	}
+	if confFile != nil {
+		if confFile.IsFeatureFlagSet(configfile.FlagNormalizeNFC) {
+			nameTransform.SetNormalization(norm.NFC)
+		} else if confFile.IsFeatureFlagSet(configfile.FlagNormalizeNFD) {
+			nameTransform.SetNormalization(norm.NFD)
+		}
+	}
+	// Make sure the crypto actually works before we use it
+	if !args.skipselftest {
+		err := cEnc.SelfTest()
+		if err != nil {
+			tlog.Fatal.Printf("Crypto self-test failed, refusing to continue: %v", err)
+			os.Exit(exitcodes.SelfTest)
+		}
+	}
 	// After the crypto backend is initialized,
 	// we can purge the master key from memory.
 	for i := range masterkey {
 		masterkey[i] = 0
 	}
 	masterkey = nil
+	// "-snapshot". Done last, so that we do not exit and leave the snapshot
+	// behind.
+	if args.snapshot {
+		frontendArgs.Cipherdir = takeSnapshot(args)
+	}
 	// Spawn fusefrontend
 	var fs ctlsockFs
+	var dirCores []*cryptocore.CryptoCore
 	if args.reverse {
 		if cryptoBackend != cryptocore.BackendAESSIV {
 			log.Panic("reverse mode must use AES-SIV, everything else is insecure")
@@ -281,17 +768,27 @@ func initFuseFrontend(args *argContainer) (pfs pathfs.FileSystem, wipeKeys func(
 		fs = fusefrontend_reverse.NewFS(frontendArgs, cEnc, nameTransform)
 
 	} else {
-		fs = fusefrontend.NewFS(frontendArgs, cEnc, nameTransform)
+		ffs := fusefrontend.NewFS(frontendArgs, cEnc, nameTransform)
+		dirCores = unlockDirs(args, ffs, cryptoBackend, maxReqSize)
+		fs = ffs
 	}
 	// We have opened the socket early so that we cannot fail here after
 	// asking the user for the password
 	if args._ctlsockFd != nil {
 		go ctlsock.Serve(args._ctlsockFd, fs)
 	}
-	return fs, func() { cCore.Wipe() }
+	if args._ctlListenFd != nil {
+		go ctlsock.ServeTLS(args._ctlListenFd, fs, args._ctlToken)
+	}
+	return fs, func() {
+		cCore.Wipe()
+		for _, c := range dirCores {
+			c.Wipe()
+		}
+	}
 }
 
-func initGoFuse(fs pathfs.FileSystem, args *argContainer) *fuse.Server {
+func initGoFuse(fs pathfs.FileSystem, args *argContainer) (*fuse.Server, *drainFS) {
 	// pathFsOpts are passed into go-fuse/pathfs
 	pathFsOpts := &pathfs.PathNodeFsOptions{ClientInodes: true}
 	if args.sharedstorage {
@@ -306,6 +803,10 @@ func initGoFuse(fs pathfs.FileSystem, args *argContainer) *fuse.Server {
 		// inode numbers ( https://github.com/rfjakob/gocryptfs/issues/149 ).
 		pathFsOpts.ClientInodes = false
 	}
+	if args.lowerdir != "" {
+		// Inode numbers of the two layers can collide
+		pathFsOpts.ClientInodes = false
+	}
 	pathFs := pathfs.NewPathNodeFs(fs, pathFsOpts)
 	var fuseOpts *nodefs.Options
 	if args.sharedstorage {
@@ -322,6 +823,7 @@ func initGoFuse(fs pathfs.FileSystem, args *argContainer) *fuse.Server {
 		}
 	}
 	conn := nodefs.NewFileSystemConnector(pathFs.Root(), fuseOpts)
+	maxWrite, maxRead := reqSizes(args)
 	mOpts := fuse.MountOptions{
 		// Writes and reads are usually capped at 128kiB on Linux through
 		// the FUSE_MAX_PAGES_PER_REQ kernel constant in fuse_i.h. Our
@@ -329,8 +831,16 @@ func initGoFuse(fs pathfs.FileSystem, args *argContainer) *fuse.Server {
 		// the kernel constant higher, and Synology NAS kernels are known to
 		// have it >128kiB. We cannot handle more than 128kiB, so we tell
 		// the kernel to limit the size explicitly.
-		MaxWrite: fuse.MAX_KERNEL_WRITE,
-		Options:  []string{fmt.Sprintf("max_read=%d", fuse.MAX_KERNEL_WRITE)},
+		// "-max-write" and "-max-read" can only lower the limits.
+		MaxWrite: maxWrite,
+		Options:  []string{fmt.Sprintf("max_read=%d", maxRead)},
+	}
+	if args.lowmem {
+		// Smaller requests mean smaller buffers, both in go-fuse and in our
+		// buffer pools.
+		mOpts.MaxReadAhead = lowMemMaxReqSize
+		mOpts.MaxBackground = lowMemMaxBackground
+		debug.SetGCPercent(lowMemGCPercent)
 	}
 	if args.allow_other {
 		tlog.Info.Printf(tlog.ColorYellow + "The option \"-allow_other\" is set. Make sure the file " +
@@ -343,26 +853,19 @@ func initGoFuse(fs pathfs.FileSystem, args *argContainer) *fuse.Server {
 		tlog.Info.Printf(tlog.ColorYellow + "THE OPTION \"-forcedecode\" IS ACTIVE. GOCRYPTFS WILL RETURN CORRUPT DATA!" +
 			tlog.ColorReset)
 	}
+	if args.recovery {
+		tlog.Info.Printf(tlog.ColorYellow + "-recovery: read-only mount. Corrupt blocks are returned as zeros, " +
+			"corrupt names are left out of directory listings." + tlog.ColorReset)
+	}
 	if args.nonempty {
 		mOpts.Options = append(mOpts.Options, "nonempty")
 	}
 	// Set values shown in "df -T" and friends
+	fsname, subtype := mountNames(args)
 	// First column, "Filesystem"
-	fsname := args.cipherdir
-	if args.fsname != "" {
-		fsname = args.fsname
-	}
-	fsname2 := strings.Replace(fsname, ",", "_", -1)
-	if fsname2 != fsname {
-		tlog.Warn.Printf("Warning: %q will be displayed as %q in \"df -T\"", fsname, fsname2)
-		fsname = fsname2
-	}
 	mOpts.Options = append(mOpts.Options, "fsname="+fsname)
 	// Second column, "Type", will be shown as "fuse." + Name
-	mOpts.Name = "gocryptfs"
-	if args.reverse {
-		mOpts.Name += "-reverse"
-	}
+	mOpts.Name = subtype
 	// Add a volume name if running osxfuse. Otherwise the Finder will show it as
 	// something like "osxfuse Volume 0 (gocryptfs)".
 	if runtime.GOOS == "darwin" {
@@ -398,12 +901,16 @@ func initGoFuse(fs pathfs.FileSystem, args *argContainer) *fuse.Server {
 		tlog.Debug.Printf("Adding -ko mount options: %v", parts)
 		mOpts.Options = append(mOpts.Options, parts...)
 	}
-	srv, err := fuse.NewServer(conn.RawFS(), args.mountpoint, &mOpts)
+	drain := newDrainFS(conn.RawFS())
+	setupUsernsMount()
+	srv, err := fuse.NewServer(drain, args.mountpoint, &mOpts)
 	if err != nil {
 		tlog.Fatal.Printf("fuse.NewServer failed: %s", strings.TrimSpace(err.Error()))
 		if runtime.GOOS == "darwin" {
 			tlog.Info.Printf("Maybe you should run: /Library/Filesystems/osxfuse.fs/Contents/Resources/load_osxfuse")
 		}
+		// Deletes the "-snapshot"
+		exitcodes.RunAtExit()
 		os.Exit(exitcodes.FuseNewServer)
 	}
 	srv.SetDebug(args.fusedebug)
@@ -413,17 +920,16 @@ func initGoFuse(fs pathfs.FileSystem, args *argContainer) *fuse.Server {
 	// directories with the requested permissions.
 	syscall.Umask(0000)
 
-	return srv
+	return srv, drain
 }
 
-func handleSigint(srv *fuse.Server, mountpoint string) {
+func handleSigint(srv *fuse.Server, drain *drainFS, fs pathfs.FileSystem, args *argContainer) {
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt)
 	signal.Notify(ch, syscall.SIGTERM)
 	go func() {
 		<-ch
-		unmount(srv, mountpoint)
-		os.Exit(exitcodes.SigInt)
+		gracefulShutdown(srv, drain, fs, args)
 	}()
 }
 
@@ -441,3 +947,14 @@ func unmount(srv *fuse.Server, mountpoint string) {
 		}
 	}
 }
+
+// hasMountOption returns true if the comma-separated list of mount options
+// "opts" (as passed to "-ko") contains "opt".
+func hasMountOption(opts string, opt string) bool {
+	for _, o := range strings.Split(opts, ",") {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// lockCipherdir takes an exclusive flock on "gocryptfs.mnt.lock" in the
+// CIPHERDIR so the same CIPHERDIR cannot be mounted read-write twice.
+// The lock is released when the returned file is closed or when the process
+// exits, so a crashed gocryptfs never leaves a stale lock behind.
+//
+// Returns nil if no lock was taken ("-ro", "-reverse", "-sharedstorage",
+// "-force").
+func lockCipherdir(args *argContainer) *os.File {
+	if args.ro || args.reverse || args.sharedstorage {
+		return nil
+	}
+	if args.force {
+		tlog.Info.Printf("-force: not locking CIPHERDIR")
+		return nil
+	}
+	path := filepath.Join(args.cipherdir, fusefrontend.MountLockName)
+	var f *os.File
+	// Creating the lock file must not change the mtime of the root directory
+	err := syscallcompat.PreserveDirTimes(args.cipherdir, func() (err error) {
+		f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+		return err
+	})
+	if err != nil {
+		tlog.Fatal.Printf("Could not open lock file: %v", err)
+		os.Exit(exitcodes.CipherdirLocked)
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		tlog.Fatal.Printf("CIPHERDIR %q is already mounted read-write by another gocryptfs process. "+
+			"Mounting it twice can corrupt your files. Pass -force to mount anyway.", args.cipherdir)
+		os.Exit(exitcodes.CipherdirLocked)
+	} else if err != nil {
+		tlog.Fatal.Printf("Could not lock %q: %v", path, err)
+		os.Exit(exitcodes.CipherdirLocked)
+	}
+	return f
+}
+
+// The lock file also records whether the last read-write mount ended
+// cleanly. While CIPHERDIR is mounted, it contains "dirty" and the mount
+// time, and a clean unmount empties it again. As it is only read and
+// written while we hold the lock, concurrent mounts cannot get in the way.
+const mountStateDirty = "dirty"
+
+// readMountState returns the mount time and true if the last mount that
+// held "lockFile" did not unmount cleanly.
+func readMountState(lockFile *os.File) (time.Time, bool) {
+	buf := make([]byte, 100)
+	n, err := lockFile.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		tlog.Warn.Printf("Could not read the mount state from %q: %v", lockFile.Name(), err)
+		return time.Time{}, false
+	}
+	fields := strings.Fields(string(buf[:n]))
+	if len(fields) == 0 || fields[0] != mountStateDirty {
+		return time.Time{}, false
+	}
+	var since time.Time
+	if len(fields) > 1 {
+		since, _ = time.Parse(time.RFC3339, fields[1])
+	}
+	return since, true
+}
+
+// writeMountState stores "state" in "lockFile" and syncs it, so that it
+// survives the crash it is meant to detect.
+func writeMountState(lockFile *os.File, state string) {
+	err := lockFile.Truncate(0)
+	if err == nil && state != "" {
+		_, err = lockFile.WriteAt([]byte(state+"\n"), 0)
+	}
+	if err == nil {
+		err = lockFile.Sync()
+	}
+	if err != nil {
+		tlog.Warn.Printf("Could not write the mount state to %q: %v", lockFile.Name(), err)
+	}
+}
+
+// markDirty records in "lockFile" that CIPHERDIR is mounted since "t"
+func markDirty(lockFile *os.File, t time.Time) {
+	writeMountState(lockFile, mountStateDirty+" "+t.Format(time.RFC3339))
+}
+
+// markClean records in "lockFile" that CIPHERDIR has been unmounted cleanly.
+// Does nothing if "lockFile" is nil.
+func markClean(lockFile *os.File) {
+	if lockFile == nil {
+		return
+	}
+	writeMountState(lockFile, "")
+}
+
+// checkMountState handles an unclean shutdown of the last mount according
+// to "-fsck-on-dirty". Returns true if the caller should run fsck on the
+// files changed since the returned time.
+func checkMountState(args *argContainer, lockFile *os.File) (time.Time, bool) {
+	since, dirty := readMountState(lockFile)
+	if !dirty || args.fsckondirty == "off" {
+		return since, false
+	}
+	if args.fsckondirty == "fsck" {
+		tlog.Info.Printf("CIPHERDIR was not unmounted cleanly last time, running -fsck-on-dirty=fsck")
+		return since, true
+	}
+	tlog.Warn.Printf("CIPHERDIR was not unmounted cleanly last time (mounted since %s). "+
+		"Files that were being written may be corrupt. Run \"gocryptfs -fsck\" to check.", since.Format(time.RFC3339))
+	return since, false
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMountState(t *testing.T) {
+	f, err := ioutil.TempFile("", "TestMountState")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	// An empty lock file, as left behind by older versions, is clean
+	if _, dirty := readMountState(f); dirty {
+		t.Error("empty lock file is dirty")
+	}
+	mountTime := time.Now().Truncate(time.Second)
+	markDirty(f, mountTime)
+	since, dirty := readMountState(f)
+	if !dirty || !since.Equal(mountTime) {
+		t.Errorf("after markDirty: want dirty since %v, got %v %v", mountTime, dirty, since)
+	}
+	args := argContainer{fsckondirty: "fsck"}
+	if since, fsck := checkMountState(&args, f); !fsck || !since.Equal(mountTime) {
+		t.Errorf("-fsck-on-dirty=fsck: want fsck since %v, got %v %v", mountTime, fsck, since)
+	}
+	for _, mode := range []string{"warn", "off"} {
+		args.fsckondirty = mode
+		if _, fsck := checkMountState(&args, f); fsck {
+			t.Errorf("-fsck-on-dirty=%s wants to run fsck", mode)
+		}
+	}
+	markClean(f)
+	if _, dirty := readMountState(f); dirty {
+		t.Error("dirty after markClean")
+	}
+	args.fsckondirty = "fsck"
+	if _, fsck := checkMountState(&args, f); fsck {
+		t.Error("wants to run fsck after a clean unmount")
+	}
+	// Nil is what lockCipherdir returns for mounts that do not lock
+	markClean(nil)
+}
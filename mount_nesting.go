@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// isAncestorDir returns true if the directory "outer" is "inner" or one of
+// its parents. The directories are compared by device and inode number, so
+// this sees through symlinks and bind mounts, where the textual path
+// comparison in doMount does not.
+func isAncestorDir(outer string, inner string) (bool, error) {
+	var stOuter syscall.Stat_t
+	if err := syscall.Stat(outer, &stOuter); err != nil {
+		return false, err
+	}
+	p, err := filepath.EvalSymlinks(inner)
+	if err != nil {
+		return false, err
+	}
+	for {
+		var st syscall.Stat_t
+		if err := syscall.Stat(p, &st); err == nil && st.Dev == stOuter.Dev && st.Ino == stOuter.Ino {
+			return true, nil
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return false, nil
+		}
+		p = parent
+	}
+}
+
+// checkNesting refuses to mount if the mountpoint and CIPHERDIR are nested
+// in each other, which makes gocryptfs access its own mount recursively.
+// Can be overridden with "-force".
+// Calls os.Exit on errors.
+func checkNesting(args *argContainer) {
+	var msg string
+	if inside, err := isAncestorDir(args.cipherdir, args.mountpoint); err != nil {
+		// The mountpoint may not exist yet on MacOS
+		tlog.Debug.Printf("checkNesting: %v", err)
+		return
+	} else if inside {
+		msg = fmt.Sprintf("Mountpoint %q is inside cipherdir %q", args.mountpoint, args.cipherdir)
+	} else if inside, _ = isAncestorDir(args.mountpoint, args.cipherdir); inside {
+		msg = fmt.Sprintf("Cipherdir %q is inside mountpoint %q", args.cipherdir, args.mountpoint)
+	} else {
+		return
+	}
+	if args.force {
+		tlog.Warn.Printf("-force: %s (after resolving symlinks and bind mounts), mounting anyway", msg)
+		return
+	}
+	tlog.Fatal.Printf("%s (after resolving symlinks and bind mounts). "+
+		"gocryptfs would access its own mount. Pass -force to mount anyway.", msg)
+	os.Exit(exitcodes.MountPoint)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestIsAncestorDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestIsAncestorDir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"/cipher/mnt", "/mnt", "/other"} {
+		if err = os.MkdirAll(dir+d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// "link" points into the cipherdir, "cipher/up" back out of it
+	if err = os.Symlink(dir+"/cipher/mnt", dir+"/link"); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink(dir+"/mnt", dir+"/cipher/up"); err != nil {
+		t.Fatal(err)
+	}
+	testcases := []struct {
+		outer, inner string
+		want         bool
+	}{
+		{"/cipher", "/cipher/mnt", true},
+		{"/cipher", "/cipher", true},
+		{"/cipher", "/link", true},
+		{"/cipher", "/mnt", false},
+		{"/cipher/mnt", "/cipher", false},
+		{"/cipher", "/cipher/up", false},
+		{"/other", "/link", false},
+	}
+	for _, tc := range testcases {
+		got, err := isAncestorDir(dir+tc.outer, dir+tc.inner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("isAncestorDir(%q, %q): want %v, got %v", tc.outer, tc.inner, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMountNames(t *testing.T) {
+	testCases := []struct {
+		args    argContainer
+		fsname  string
+		subtype string
+	}{
+		{argContainer{cipherdir: "/secure"}, "/secure", "gocryptfs"},
+		{argContainer{cipherdir: "/secure", reverse: true}, "/secure", "gocryptfs-reverse"},
+		{argContainer{cipherdir: "/secure", fsname: "vault", subtype: "gocryptfs.vault"}, "vault", "gocryptfs.vault"},
+		// Commas would split the mount options, whitespace and control
+		// characters would break the mount table
+		{argContainer{cipherdir: "/a,b c\nd"}, "/a_b_c_d", "gocryptfs"},
+		{argContainer{cipherdir: "/x", subtype: "my vault,ro/ä"}, "/x", "my_vault_ro__"},
+	}
+	for _, tc := range testCases {
+		fsname, subtype := mountNames(&tc.args)
+		if fsname != tc.fsname || subtype != tc.subtype {
+			t.Errorf("%+v: want %q %q, got %q %q", tc.args, tc.fsname, tc.subtype, fsname, subtype)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+const (
+	// prewarmWorkers is the number of directories that "-prewarm" lists at
+	// the same time
+	prewarmWorkers = 2
+	// prewarmPause is how long "-prewarm" waits while files are open
+	prewarmPause = 100 * time.Millisecond
+	// prewarmBatch is the number of directory entries read at once
+	prewarmBatch = 1024
+)
+
+// prewarmer walks the mounted filesystem for "-prewarm". Looking up every
+// entry through the mount fills the kernel dentry and inode caches, and
+// reading the directories and gocryptfs.diriv files brings the backing
+// storage into the page cache.
+type prewarmer struct {
+	mountpoint string
+	// stop is closed on unmount
+	stop <-chan struct{}
+	// Directories that still have to be walked, relative to mountpoint
+	queue []string
+	// Number of directories in the queue or being walked
+	pending int
+	// Number of directories walked
+	walked int
+	cond   *sync.Cond
+	sync.Mutex
+}
+
+func newPrewarmer(mountpoint string, stop <-chan struct{}) *prewarmer {
+	p := &prewarmer{
+		mountpoint: mountpoint,
+		stop:       stop,
+		queue:      []string{""},
+		pending:    1,
+	}
+	p.cond = sync.NewCond(p)
+	return p
+}
+
+// prewarm walks the tree below "mountpoint" in the background once the mount
+// is ready. Returns immediately.
+func prewarm(srv *fuse.Server, mountpoint string, stop <-chan struct{}) {
+	p := newPrewarmer(mountpoint, stop)
+	go func() {
+		if err := srv.WaitMount(); err != nil {
+			tlog.Warn.Printf("-prewarm: mount not ready: %v", err)
+			return
+		}
+		t0 := time.Now()
+		p.run()
+		if p.stopped() {
+			tlog.Debug.Printf("-prewarm: cancelled after %d directories", p.walked)
+			return
+		}
+		tlog.Info.Printf("-prewarm: walked %d directories in %v", p.walked,
+			time.Since(t0).Round(time.Millisecond))
+	}()
+}
+
+// run walks the tree and returns when it is done or stopped
+func (p *prewarmer) run() {
+	var wg sync.WaitGroup
+	for i := 0; i < prewarmWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.worker()
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *prewarmer) stopped() bool {
+	select {
+	case <-p.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// idle waits until no files are open, as that means somebody is using the
+// filesystem and should not have to compete with us. Returns false on
+// unmount.
+func (p *prewarmer) idle() bool {
+	for openfiletable.CountOpenFiles() > 0 {
+		select {
+		case <-p.stop:
+			return false
+		case <-time.After(prewarmPause):
+		}
+	}
+	return !p.stopped()
+}
+
+func (p *prewarmer) worker() {
+	for {
+		p.Lock()
+		for len(p.queue) == 0 && p.pending > 0 {
+			p.cond.Wait()
+		}
+		if p.pending == 0 {
+			p.Unlock()
+			return
+		}
+		dir := p.queue[len(p.queue)-1]
+		p.queue = p.queue[:len(p.queue)-1]
+		p.Unlock()
+
+		var subdirs []string
+		walked := 0
+		if p.idle() {
+			subdirs = p.walkDir(dir)
+			walked = 1
+		} else {
+			// Unmounting. Drop the rest of the queue.
+			p.Lock()
+			p.pending -= len(p.queue)
+			p.queue = nil
+			p.Unlock()
+		}
+
+		p.Lock()
+		p.walked += walked
+		p.queue = append(p.queue, subdirs...)
+		p.pending += len(subdirs) - 1
+		p.cond.Broadcast()
+		p.Unlock()
+	}
+}
+
+// walkDir lists "dir" and lstat()s all entries. Returns the subdirectories.
+// The directory is closed before returning.
+func (p *prewarmer) walkDir(dir string) (subdirs []string) {
+	f, err := os.Open(filepath.Join(p.mountpoint, dir))
+	if err != nil {
+		tlog.Debug.Printf("-prewarm: %v", err)
+		return nil
+	}
+	defer f.Close()
+	for !p.stopped() {
+		// Readdir lstat()s every entry, which makes the kernel look it up
+		fi, err := f.Readdir(prewarmBatch)
+		for _, e := range fi {
+			if e.IsDir() {
+				subdirs = append(subdirs, filepath.Join(dir, e.Name()))
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			tlog.Debug.Printf("-prewarm: %q: %v", dir, err)
+			break
+		}
+	}
+	return subdirs
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrewarmer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestPrewarmer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// 1 + 3 + 3*4 directories, plus some files
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 4; j++ {
+			sub := filepath.Join(dir, fmt.Sprintf("d%d/e%d", i, j))
+			if err = os.MkdirAll(sub, 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err = ioutil.WriteFile(sub+"/file", nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	p := newPrewarmer(dir, make(chan struct{}))
+	p.run()
+	if p.walked != 16 || p.pending != 0 || len(p.queue) != 0 {
+		t.Errorf("walked=%d pending=%d queue=%v", p.walked, p.pending, p.queue)
+	}
+	// A stopped walk returns without walking anything
+	stop := make(chan struct{})
+	close(stop)
+	p = newPrewarmer(dir, stop)
+	p.run()
+	if p.walked != 0 || p.pending != 0 {
+		t.Errorf("stopped: walked=%d pending=%d", p.walked, p.pending)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+type rekeyObj struct {
+	src, dst *fusefrontend.FS
+	// Number of paths that could not be copied
+	nErrors int
+}
+
+// report records a path that could not be copied and prints why.
+func (r *rekeyObj) report(path string, format string, v ...interface{}) {
+	r.nErrors++
+	if path == "" {
+		path = "/"
+	}
+	tlog.Warn.Printf("rekey-master: %q: %s", path, fmt.Sprintf(format, v...))
+}
+
+// dir copies the contents of directory "path" recursively.
+func (r *rekeyObj) dir(path string) {
+	entries, status := listDir(r.src, path)
+	if !status.Ok() {
+		r.report(path, "error opening dir: %v", status)
+		return
+	}
+	for _, e := range entries {
+		r.entry(filepath.Join(path, e.Name))
+	}
+}
+
+// entry copies "path" from src to dst, if it has not been copied already
+// by an earlier, interrupted run.
+func (r *rekeyObj) entry(path string) {
+	attr, status := r.src.GetAttr(path, nil)
+	if !status.Ok() {
+		r.report(path, "error stating: %v", status)
+		return
+	}
+	fileType := attr.Mode & syscall.S_IFMT
+	dstAttr, status := r.dst.GetAttr(path, nil)
+	exists := status.Ok()
+	if exists && dstAttr.Mode&syscall.S_IFMT != fileType {
+		r.report(path, "exists in the destination with a different type")
+		return
+	}
+	switch fileType {
+	case syscall.S_IFDIR:
+		if !exists {
+			status = r.dst.Mkdir(path, 0700, nil)
+		} else {
+			// Make sure we can create the entries, the real permissions are
+			// set after that.
+			status = r.dst.Chmod(path, 0700, nil)
+		}
+		if !status.Ok() {
+			r.report(path, "error creating dir: %v", status)
+			return
+		}
+		r.dir(path)
+	case syscall.S_IFREG:
+		// The mtime is set last, so a file with the right size and mtime has
+		// been copied completely.
+		if exists && dstAttr.Size == attr.Size && dstAttr.Mtime == attr.Mtime &&
+			dstAttr.Mtimensec == attr.Mtimensec {
+			return
+		}
+		status = r.copyFile(path, exists)
+		if !status.Ok() {
+			r.report(path, "error copying: %v", status)
+			return
+		}
+	case syscall.S_IFLNK:
+		target, status := r.src.Readlink(path, nil)
+		if !status.Ok() {
+			r.report(path, "error reading symlink: %v", status)
+			return
+		}
+		if exists {
+			dstTarget, _ := r.dst.Readlink(path, nil)
+			if dstTarget == target {
+				return
+			}
+			r.dst.Unlink(path, nil)
+		}
+		status = r.dst.Symlink(target, path, nil)
+		if !status.Ok() {
+			r.report(path, "error creating symlink: %v", status)
+			return
+		}
+	default:
+		// Device nodes, fifos and sockets
+		if !exists {
+			status = r.dst.Mknod(path, attr.Mode, attr.Rdev, nil)
+			if !status.Ok() {
+				r.report(path, "error creating node: %v", status)
+				return
+			}
+		}
+	}
+	r.setAttr(path, attr)
+}
+
+// copyFile copies the content of regular file "path". If the file already
+// exists in dst, it is overwritten.
+func (r *rekeyObj) copyFile(path string, exists bool) fuse.Status {
+	in, status := r.src.Open(path, syscall.O_RDONLY, nil)
+	if !status.Ok() {
+		return status
+	}
+	defer in.Release()
+	var out nodefs.File
+	if exists {
+		// Make sure we can open the file for writing
+		r.dst.Chmod(path, 0600, nil)
+		out, status = r.dst.Open(path, syscall.O_WRONLY|syscall.O_TRUNC, nil)
+	} else {
+		out, status = r.dst.Create(path, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL, 0600, nil)
+	}
+	if !status.Ok() {
+		return status
+	}
+	defer out.Release()
+	buf := make([]byte, fuse.MAX_KERNEL_WRITE)
+	var off int64
+	for {
+		result, status := in.Read(buf, off)
+		if !status.Ok() {
+			return status
+		}
+		data, status := result.Bytes(buf)
+		if !status.Ok() {
+			return status
+		}
+		// EOF
+		if len(data) == 0 {
+			return out.Flush()
+		}
+		_, status = out.Write(data, off)
+		if !status.Ok() {
+			return status
+		}
+		off += int64(len(data))
+	}
+}
+
+// setAttr copies the xattrs, owner, permissions and timestamps of "path".
+func (r *rekeyObj) setAttr(path string, attr *fuse.Attr) {
+	names, status := r.src.ListXAttr(path, nil)
+	if !status.Ok() && status != fuse.Status(syscall.EOPNOTSUPP) {
+		r.report(path, "error listing xattrs: %v", status)
+	}
+	for _, name := range names {
+		val, status := r.src.GetXAttr(path, name, nil)
+		if status.Ok() {
+			status = r.dst.SetXAttr(path, name, val, 0, nil)
+		}
+		if !status.Ok() {
+			r.report(path, "error copying xattr %q: %v", name, status)
+		}
+	}
+	// Only root can give files to other users
+	if os.Getuid() == 0 {
+		status = r.dst.Chown(path, attr.Owner.Uid, attr.Owner.Gid, nil)
+		if !status.Ok() {
+			r.report(path, "error setting owner: %v", status)
+		}
+	}
+	if attr.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+		// Symlinks have no permissions and Utimens would follow them
+		return
+	}
+	status = r.dst.Chmod(path, attr.Mode&07777, nil)
+	if !status.Ok() {
+		r.report(path, "error setting permissions: %v", status)
+	}
+	atime := time.Unix(int64(attr.Atime), int64(attr.Atimensec))
+	mtime := time.Unix(int64(attr.Mtime), int64(attr.Mtimensec))
+	status = r.dst.Utimens(path, &atime, &mtime, nil)
+	if !status.Ok() {
+		r.report(path, "error setting timestamps: %v", status)
+	}
+}
+
+// rekeyMaster handles "gocryptfs -rekey-master SRC DST". It copies the
+// decrypted contents of SRC into DST, which is created with a new random
+// master key if it is empty. If DST already is a gocryptfs filesystem, it
+// is assumed to be the result of an interrupted run and the copy is resumed.
+// When the copy is done, DST is compared against SRC.
+func rekeyMaster(args *argContainer) {
+	if args.reverse {
+		tlog.Fatal.Printf("Running -rekey-master with -reverse is not supported")
+		os.Exit(exitcodes.Usage)
+	}
+	if args._configCustom || args.masterkey != "" || args.zerokey {
+		tlog.Fatal.Printf("-rekey-master cannot be used together with -config, -masterkey or -zerokey")
+		os.Exit(exitcodes.Usage)
+	}
+	src, srcDir, wipeKeysSrc := initCompareFS(*args, flagSet.Arg(0))
+	defer wipeKeysSrc()
+	dstDir, err := filepath.Abs(flagSet.Arg(1))
+	if err != nil {
+		tlog.Fatal.Printf("Invalid destination: %v", err)
+		os.Exit(exitcodes.CipherDir)
+	}
+	if dstDir == srcDir {
+		tlog.Fatal.Printf("Source and destination must be different")
+		os.Exit(exitcodes.Usage)
+	}
+	dstConf := filepath.Join(dstDir, configfile.ConfDefaultName)
+	if _, err = os.Stat(dstConf); os.IsNotExist(err) {
+		// Create the new filesystem with the same settings as the old one
+		srcConf, err := configfile.Load(filepath.Join(srcDir, configfile.ConfDefaultName))
+		if err != nil {
+			tlog.Fatal.Printf("Cannot open config file: %v", err)
+			os.Exit(exitcodes.LoadConf)
+		}
+		initArgs := *args
+		initArgs.cipherdir = dstDir
+		initArgs.config = dstConf
+		initArgs.plaintextnames = srcConf.IsFeatureFlagSet(configfile.FlagPlaintextNames)
+		initArgs.aessiv = srcConf.IsFeatureFlagSet(configfile.FlagAESSIV)
+		initArgs.nolongname = srcConf.IsFeatureFlagSet(configfile.FlagNoLongNames)
+		initArgs.normalizenames = ""
+		if srcConf.IsFeatureFlagSet(configfile.FlagNormalizeNFC) {
+			initArgs.normalizenames = "nfc"
+		} else if srcConf.IsFeatureFlagSet(configfile.FlagNormalizeNFD) {
+			initArgs.normalizenames = "nfd"
+		}
+		if err = os.Mkdir(dstDir, 0700); err != nil && !os.IsExist(err) {
+			tlog.Fatal.Printf("Cannot create destination: %v", err)
+			os.Exit(exitcodes.Init)
+		}
+		tlog.Info.Printf("Creating %s", dstDir)
+		initDir(&initArgs)
+	} else {
+		tlog.Info.Printf("%s already exists, resuming", dstDir)
+	}
+	dst, _, wipeKeysDst := initCompareFS(*args, dstDir)
+	defer wipeKeysDst()
+	dstArgs := *args
+	dstArgs.cipherdir = dstDir
+	if lockFile := lockCipherdir(&dstArgs); lockFile != nil {
+		defer lockFile.Close()
+	}
+	r := rekeyObj{src: src, dst: dst}
+	r.dir("")
+	rootAttr, status := src.GetAttr("", nil)
+	if status.Ok() {
+		r.setAttr("", rootAttr)
+	} else {
+		r.report("", "error stating: %v", status)
+	}
+	tlog.Info.Printf("rekey-master: copy done, verifying")
+	c := compareObj{a: src, b: dst, dirA: srcDir, dirB: dstDir}
+	c.dir("")
+	if r.nErrors == 0 && c.nDiffs == 0 {
+		tlog.Info.Printf(tlog.ColorGreen+"rekey-master: %s has been re-encrypted into %s"+tlog.ColorReset,
+			srcDir, dstDir)
+		return
+	}
+	fmt.Printf("rekey-master summary: %d errors, %d differences. Run the same command again to retry.\n",
+		r.nErrors, c.nDiffs)
+	wipeKeysSrc()
+	wipeKeysDst()
+	exitcodes.Exit(exitcodes.NewErr("rekey-master incomplete", exitcodes.RekeyIncomplete))
+}
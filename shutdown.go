@@ -0,0 +1,406 @@
+package main
+
+// Graceful shutdown on SIGINT and SIGTERM: stop accepting new FUSE requests,
+// wait for the ones in flight, fsync open files, unmount.
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// drainFS wraps a fuse.RawFileSystem and counts the requests that are being
+// processed. Once draining has started, new requests are rejected with
+// ENOTCONN, which is also what applications get when the mount is gone.
+// Requests that release resources or write out data (Release, Flush, Fsync,
+// Forget) are always let through.
+type drainFS struct {
+	fuse.RawFileSystem
+	mu       sync.Mutex
+	inflight int
+	draining bool
+	// idle is closed when draining has started and no requests are left
+	idle chan struct{}
+	// idleClosed is set once "idle" has been closed. Requests that are
+	// always let through can still come and go after that.
+	idleClosed bool
+}
+
+func newDrainFS(fs fuse.RawFileSystem) *drainFS {
+	return &drainFS{
+		RawFileSystem: fs,
+		idle:          make(chan struct{}),
+	}
+}
+
+// begin registers a new request. Returns false if the request must be
+// rejected. If it returns true, end() must be called when the request is
+// done.
+func (d *drainFS) begin(always bool) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining && !always {
+		return false
+	}
+	d.inflight++
+	return true
+}
+
+func (d *drainFS) end() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.inflight--
+	d.checkIdle()
+}
+
+// checkIdle closes "idle" if draining has started and no requests are left.
+// Must be called with "mu" held.
+func (d *drainFS) checkIdle() {
+	if d.draining && d.inflight == 0 && !d.idleClosed {
+		close(d.idle)
+		d.idleClosed = true
+	}
+}
+
+// drain stops accepting new requests and waits up to "timeout" for the ones
+// in flight. Returns the number of requests that were still running when
+// the timeout expired.
+func (d *drainFS) drain(timeout time.Duration) int {
+	d.mu.Lock()
+	d.draining = true
+	d.checkIdle()
+	d.mu.Unlock()
+	select {
+	case <-d.idle:
+		return 0
+	case <-time.After(timeout):
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.inflight
+}
+
+// openFileSyncer is implemented by fusefrontend.FS
+type openFileSyncer interface {
+	SyncOpenFiles() int
+}
+
+// scrubStopper is implemented by fusefrontend.FS
+type scrubStopper interface {
+	StopScrub()
+}
+
+// gracefulShutdown is called on SIGINT and SIGTERM. It drains "d", fsyncs
+// the open files of "fs" and unmounts. If requests are still running after
+// "-shutdown-timeout", the filesystem is unmounted lazily and we exit with
+// exitcodes.ShutdownForced.
+func gracefulShutdown(srv *fuse.Server, d *drainFS, fs pathfs.FileSystem, args *argContainer) {
+	tlog.Info.Printf("Shutting down, waiting up to %v for in-flight operations", args.shutdowntimeout)
+	if left := d.drain(args.shutdowntimeout); left > 0 {
+		tlog.Warn.Printf("-shutdown-timeout: %d operations still running, forcing unmount", left)
+		forceUnmount(args.mountpoint)
+		exitcodes.RunAtExit()
+		os.Exit(exitcodes.ShutdownForced)
+	}
+	if s, ok := fs.(scrubStopper); ok {
+		s.StopScrub()
+	}
+	if s, ok := fs.(openFileSyncer); ok {
+		n := s.SyncOpenFiles()
+		tlog.Debug.Printf("gracefulShutdown: synced %d open files", n)
+	}
+	unmount(srv, args.mountpoint)
+	markClean(args._mountLock)
+	exitcodes.RunAtExit()
+	os.Exit(exitcodes.SigInt)
+}
+
+// forceUnmount detaches the mountpoint without waiting for the FUSE server.
+func forceUnmount(mountpoint string) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("umount", "-f", mountpoint)
+	} else {
+		cmd = exec.Command("fusermount", "-u", "-z", mountpoint)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		tlog.Warn.Printf("forceUnmount: %v", err)
+	}
+}
+
+// enotconn is returned for requests that arrive while draining
+const enotconn = fuse.Status(syscall.ENOTCONN)
+
+func (d *drainFS) Lookup(header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
+	if !d.begin(false) {
+		return enotconn
+	}
+	defer d.end()
+	return d.RawFileSystem.Lookup(header, name, out)
+}
+
+func (d *drainFS) GetAttr(input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
+	// Keep stat() of the mountpoint working for the unmount tools
+	if !d.begin(input.NodeId == fuse.FUSE_ROOT_ID) {
+		return enotconn
+	}
+	defer d.end()
+	return d.RawFileSystem.GetAttr(input, out)
+}
+
+func (d *drainFS) SetAttr(input *fuse.SetAttrIn, out *fuse.AttrOut) fuse.Status {
+	if !d.begin(false) {
+		return enotconn
+	}
+	defer d.end()
+	return d.RawFileSystem.SetAttr(input, out)
+}
+
+func (d *drainFS) Mknod(input *fuse.MknodIn, name string, out *fuse.EntryOut) fuse.Status {
+	if !d.begin(false) {
+		return enotconn
+	}
+	defer d.end()
+	return d.RawFileSystem.Mknod(input, name, out)
+}
+
+func (d *drainFS) Mkdir(input *fuse.MkdirIn, name string, out *fuse.EntryOut) fuse.Status {
+	if !d.begin(false) {
+		return enotconn
+	}
+	defer d.end()
+	return d.RawFileSystem.Mkdir(input, name, out)
+}
+
+func (d *drainFS) Unlink(header *fuse.InHeader, name string) fuse.Status {
+	if !d.begin(false) {
+		return enotconn
+	}
+	defer d.end()
+	return d.RawFileSystem.Unlink(header, name)
+}
+
+func (d *drainFS) Rmdir(header *fuse.InHeader, name string) fuse.Status {
+	if !d.begin(false) {
+		return enotconn
+	}
+	defer d.end()
+	return d.RawFileSystem.Rmdir(header, name)
+}
+
+func (d *drainFS) Rename(input *fuse.RenameIn, oldName string, newName string) fuse.Status {
+	if !d.begin(false) {
+		return enotconn
+	}
+	defer d.end()
+	return d.RawFileSystem.Rename(input, oldName, newName)
+}
+
+func (d *drainFS) Link(input *fuse.LinkIn, filename string, out *fuse.EntryOut) fuse.Status {
+	if !d.begin(false) {
+		return enotconn
+	}
+	defer d.end()
+	return d.RawFileSystem.Link(input, filename, out)
+}
+
+func (d *drainFS) Symlink(header *fuse.InHeader, pointedTo string, linkName string, out *fuse.EntryOut) fuse.Status {
+	if !d.begin(false) {
+		return enotconn
+	}
+	defer d.end()
+	return d.RawFileSystem.Symlink(header, pointedTo, linkName, out)
+}
+
+func (d *drainFS) Readlink(header *fuse.InHeader) ([]byte, fuse.Status) {
+	if !d.begin(false) {
+		return nil, enotconn
+	}
+	defer d.end()
+	return d.RawFileSystem.Readlink(header)
+}
+
+func (d *drainFS) Access(input *fuse.AccessIn) fuse.Status {
+	if !d.begin(false) {
+		return enotconn
+	}
+	defer d.end()
+	return d.RawFileSystem.Access(input)
+}
+
+func (d *drainFS) GetXAttrSize(header *fuse.InHeader, attr string) (int, fuse.Status) {
+	if !d.begin(false) {
+		return 0, enotconn
+	}
+	defer d.end()
+	return d.RawFileSystem.GetXAttrSize(header, attr)
+}
+
+func (d *drainFS) GetXAttrData(header *fuse.InHeader, attr string) ([]byte, fuse.Status) {
+	if !d.begin(false) {
+		return nil, enotconn
+	}
+	defer d.end()
+	return d.RawFileSystem.GetXAttrData(header, attr)
+}
+
+func (d *drainFS) ListXAttr(header *fuse.InHeader) ([]byte, fuse.Status) {
+	if !d.begin(false) {
+		return nil, enotconn
+	}
+	defer d.end()
+	return d.RawFileSystem.ListXAttr(header)
+}
+
+func (d *drainFS) SetXAttr(input *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
+	if !d.begin(false) {
+		return enotconn
+	}
+	defer d.end()
+	return d.RawFileSystem.SetXAttr(input, attr, data)
+}
+
+func (d *drainFS) RemoveXAttr(header *fuse.InHeader, attr string) fuse.Status {
+	if !d.begin(false) {
+		return enotconn
+	}
+	defer d.end()
+	return d.RawFileSystem.RemoveXAttr(header, attr)
+}
+
+func (d *drainFS) Create(input *fuse.CreateIn, name string, out *fuse.CreateOut) fuse.Status {
+	if !d.begin(false) {
+		return enotconn
+	}
+	defer d.end()
+	return d.RawFileSystem.Create(input, name, out)
+}
+
+func (d *drainFS) Open(input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	if !d.begin(false) {
+		return enotconn
+	}
+	defer d.end()
+	return d.RawFileSystem.Open(input, out)
+}
+
+func (d *drainFS) Read(input *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
+	if !d.begin(false) {
+		return nil, enotconn
+	}
+	defer d.end()
+	return d.RawFileSystem.Read(input, buf)
+}
+
+func (d *drainFS) GetLk(input *fuse.LkIn, out *fuse.LkOut) fuse.Status {
+	if !d.begin(false) {
+		return enotconn
+	}
+	defer d.end()
+	return d.RawFileSystem.GetLk(input, out)
+}
+
+func (d *drainFS) SetLk(input *fuse.LkIn) fuse.Status {
+	if !d.begin(false) {
+		return enotconn
+	}
+	defer d.end()
+	return d.RawFileSystem.SetLk(input)
+}
+
+func (d *drainFS) SetLkw(input *fuse.LkIn) fuse.Status {
+	if !d.begin(false) {
+		return enotconn
+	}
+	defer d.end()
+	return d.RawFileSystem.SetLkw(input)
+}
+
+func (d *drainFS) Release(input *fuse.ReleaseIn) {
+	d.begin(true)
+	defer d.end()
+	d.RawFileSystem.Release(input)
+}
+
+func (d *drainFS) Write(input *fuse.WriteIn, data []byte) (uint32, fuse.Status) {
+	if !d.begin(false) {
+		return 0, enotconn
+	}
+	defer d.end()
+	return d.RawFileSystem.Write(input, data)
+}
+
+func (d *drainFS) Flush(input *fuse.FlushIn) fuse.Status {
+	d.begin(true)
+	defer d.end()
+	return d.RawFileSystem.Flush(input)
+}
+
+func (d *drainFS) Fsync(input *fuse.FsyncIn) fuse.Status {
+	d.begin(true)
+	defer d.end()
+	return d.RawFileSystem.Fsync(input)
+}
+
+func (d *drainFS) Fallocate(input *fuse.FallocateIn) fuse.Status {
+	if !d.begin(false) {
+		return enotconn
+	}
+	defer d.end()
+	return d.RawFileSystem.Fallocate(input)
+}
+
+func (d *drainFS) OpenDir(input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	if !d.begin(false) {
+		return enotconn
+	}
+	defer d.end()
+	return d.RawFileSystem.OpenDir(input, out)
+}
+
+func (d *drainFS) ReadDir(input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	if !d.begin(false) {
+		return enotconn
+	}
+	defer d.end()
+	return d.RawFileSystem.ReadDir(input, out)
+}
+
+func (d *drainFS) ReadDirPlus(input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	if !d.begin(false) {
+		return enotconn
+	}
+	defer d.end()
+	return d.RawFileSystem.ReadDirPlus(input, out)
+}
+
+func (d *drainFS) ReleaseDir(input *fuse.ReleaseIn) {
+	d.begin(true)
+	defer d.end()
+	d.RawFileSystem.ReleaseDir(input)
+}
+
+func (d *drainFS) FsyncDir(input *fuse.FsyncIn) fuse.Status {
+	d.begin(true)
+	defer d.end()
+	return d.RawFileSystem.FsyncDir(input)
+}
+
+func (d *drainFS) StatFs(header *fuse.InHeader, out *fuse.StatfsOut) fuse.Status {
+	if !d.begin(false) {
+		return enotconn
+	}
+	defer d.end()
+	return d.RawFileSystem.StatFs(header, out)
+}
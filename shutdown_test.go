@@ -0,0 +1,83 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// blockingFS blocks Write until "release" is closed
+type blockingFS struct {
+	fuse.RawFileSystem
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingFS) Write(input *fuse.WriteIn, data []byte) (uint32, fuse.Status) {
+	close(b.started)
+	<-b.release
+	return uint32(len(data)), fuse.OK
+}
+
+func TestDrainFS(t *testing.T) {
+	b := &blockingFS{
+		RawFileSystem: fuse.NewDefaultRawFileSystem(),
+		started:       make(chan struct{}),
+		release:       make(chan struct{}),
+	}
+	d := newDrainFS(b)
+	done := make(chan fuse.Status)
+	go func() {
+		_, status := d.Write(&fuse.WriteIn{}, []byte("x"))
+		done <- status
+	}()
+	<-b.started
+	// The write is still running
+	if left := d.drain(10 * time.Millisecond); left != 1 {
+		t.Errorf("want 1 request left, got %d", left)
+	}
+	// New requests are rejected, Release and the root GetAttr are not
+	if status := d.Open(&fuse.OpenIn{}, &fuse.OpenOut{}); status != fuse.Status(syscall.ENOTCONN) {
+		t.Errorf("Open while draining: %v", status)
+	}
+	d.Release(&fuse.ReleaseIn{})
+	var in fuse.GetAttrIn
+	in.NodeId = fuse.FUSE_ROOT_ID
+	if status := d.GetAttr(&in, &fuse.AttrOut{}); status == fuse.Status(syscall.ENOTCONN) {
+		t.Error("GetAttr of the root was rejected")
+	}
+	close(b.release)
+	if status := <-done; !status.Ok() {
+		t.Errorf("in-flight write failed: %v", status)
+	}
+	if left := d.drain(time.Second); left != 0 {
+		t.Errorf("want 0 requests left, got %d", left)
+	}
+	// Requests that are let through after the drain has finished must not
+	// close "idle" a second time
+	if status := d.GetAttr(&in, &fuse.AttrOut{}); status == fuse.Status(syscall.ENOTCONN) {
+		t.Error("GetAttr of the root was rejected after draining")
+	}
+	d.Release(&fuse.ReleaseIn{})
+}
+
+// Draining with nothing in flight finishes immediately, and the requests
+// that are always let through keep working afterwards.
+func TestDrainFSIdle(t *testing.T) {
+	d := newDrainFS(fuse.NewDefaultRawFileSystem())
+	if left := d.drain(time.Second); left != 0 {
+		t.Errorf("want 0 requests left, got %d", left)
+	}
+	var in fuse.GetAttrIn
+	in.NodeId = fuse.FUSE_ROOT_ID
+	if status := d.GetAttr(&in, &fuse.AttrOut{}); status == fuse.Status(syscall.ENOTCONN) {
+		t.Error("GetAttr of the root was rejected")
+	}
+	d.Release(&fuse.ReleaseIn{})
+	d.Flush(&fuse.FlushIn{})
+	if left := d.drain(time.Second); left != 0 {
+		t.Errorf("second drain: want 0 requests left, got %d", left)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+// "-snapshot": serve the mount from a copy-on-write copy of CIPHERDIR
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/xattr"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// errNoReflink is returned by snapshotTree when the filesystem cannot
+// reflink
+type errNoReflink struct {
+	err error
+}
+
+func (e errNoReflink) Error() string {
+	return fmt.Sprintf("reflink not supported: %v", e.err)
+}
+
+// errCrossDevice is returned by snapshotTree when the snapshot directory is
+// on another filesystem than CIPHERDIR. Reflinks only work within one
+// filesystem.
+type errCrossDevice struct {
+	err error
+}
+
+func (e errCrossDevice) Error() string {
+	return fmt.Sprintf("snapshot is on another filesystem: %v", e.err)
+}
+
+// takeSnapshot reflinks the contents of args.cipherdir into a new hidden
+// directory next to it, or in "-tmpdir", and returns its path. The snapshot is deleted via
+// exitcodes.AtExit, i.e. after unmount.
+// Calls os.Exit on errors.
+func takeSnapshot(args *argContainer) string {
+	parent := filepath.Dir(args.cipherdir)
+	if args.tmpdir != "" {
+		parent = args.tmpdir
+	}
+	dir, err := ioutil.TempDir(parent, "."+filepath.Base(args.cipherdir)+".snapshot.")
+	if err != nil {
+		tlog.Fatal.Printf("-snapshot: %v. Pass -tmpdir with a writeable directory "+
+			"on the filesystem of CIPHERDIR.", err)
+		os.Exit(exitcodes.Snapshot)
+	}
+	t0 := time.Now()
+	n, err := snapshotTree(args.cipherdir, dir)
+	if err != nil {
+		removeSnapshot(dir)
+		if e, ok := err.(errNoReflink); ok {
+			tlog.Fatal.Printf("-snapshot: the filesystem of %q does not support reflinks (%v). "+
+				"Reflinks work on btrfs, XFS (created with reflink=1) and bcachefs. "+
+				"On other filesystems, take a snapshot with LVM or ZFS and mount that.",
+				args.cipherdir, e.err)
+		} else if e, ok := err.(errCrossDevice); ok {
+			tlog.Fatal.Printf("-snapshot: %q is not on the filesystem of %q (%v), for example "+
+				"because CIPHERDIR is a mountpoint. Pass -tmpdir with a directory "+
+				"on the filesystem of CIPHERDIR.", parent, args.cipherdir, e.err)
+		} else {
+			tlog.Fatal.Printf("-snapshot: %v", err)
+		}
+		os.Exit(exitcodes.Snapshot)
+	}
+	tlog.Info.Printf("-snapshot: cloned %d files in %v into %q",
+		n, time.Since(t0).Round(time.Millisecond), dir)
+	exitcodes.AtExit(func() { removeSnapshot(dir) })
+	return dir
+}
+
+// snapshotTree recreates the tree "src" in the existing directory "dst",
+// with regular files reflinked. Returns the number of files cloned.
+func snapshotTree(src string, dst string) (n int, err error) {
+	type dirTimes struct {
+		path string
+		st   *syscall.Stat_t
+	}
+	// Directories get their final mode and times after their contents
+	// are in place
+	var dirs []dirTimes
+	err = filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// Deleted while we were walking the tree
+			return nil
+		} else if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		target := filepath.Join(dst, rel)
+		st := fi.Sys().(*syscall.Stat_t)
+		switch {
+		case fi.IsDir():
+			if rel != "." {
+				if err = os.Mkdir(target, 0700); err != nil {
+					return err
+				}
+			}
+			dirs = append(dirs, dirTimes{target, st})
+		case fi.Mode().IsRegular():
+			if err = reflinkFile(path, target, fi.Mode().Perm()); err != nil {
+				return err
+			}
+			n++
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err = os.Symlink(link, target); err != nil {
+				return err
+			}
+		default:
+			// Device files, fifos and sockets
+			if err = syscall.Mknod(target, uint32(st.Mode), int(st.Rdev)); err != nil {
+				tlog.Warn.Printf("-snapshot: skipping %q: %v", path, err)
+				return nil
+			}
+		}
+		copyMeta(path, target, fi, st)
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d := dirs[i]
+		syscall.Chmod(d.path, uint32(d.st.Mode&07777))
+		syscallcompat.CopyTimes(d.path, d.st)
+	}
+	return n, nil
+}
+
+// reflinkFile creates "dst" as a copy-on-write clone of the regular file "src"
+func reflinkFile(src string, dst string, perm os.FileMode) error {
+	in, err := os.OpenFile(src, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm|0200)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	err = syscallcompat.Reflink(int(out.Fd()), int(in.Fd()))
+	if err == syscall.EXDEV {
+		return errCrossDevice{err}
+	} else if err == syscall.EOPNOTSUPP || err == syscall.EINVAL || err == syscall.ENOTTY {
+		return errNoReflink{err}
+	} else if err != nil {
+		return &os.PathError{Op: "reflink", Path: src, Err: err}
+	}
+	return nil
+}
+
+// copyMeta copies the xattrs, the owner and, except for directories and
+// symlinks, the mode and the timestamps. Best-effort. Only xattr errors are
+// logged, as the xattrs stored by gocryptfs are part of the filesystem.
+func copyMeta(src string, dst string, fi os.FileInfo, st *syscall.Stat_t) {
+	names, _ := xattr.LList(src)
+	for _, name := range names {
+		val, err := xattr.LGet(src, name)
+		if err == nil {
+			err = xattr.LSet(dst, name, val)
+		}
+		if err != nil {
+			tlog.Warn.Printf("-snapshot: %q: could not copy xattr: %v", dst, err)
+		}
+	}
+	if os.Getuid() == 0 {
+		os.Lchown(dst, int(st.Uid), int(st.Gid))
+	}
+	if fi.IsDir() || fi.Mode()&os.ModeSymlink != 0 {
+		return
+	}
+	syscall.Chmod(dst, uint32(st.Mode&07777))
+	syscallcompat.CopyTimes(dst, st)
+}
+
+// removeSnapshot deletes the snapshot directory. Directories are made
+// writeable first, they may have been read-only in CIPHERDIR.
+func removeSnapshot(dir string) {
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.IsDir() {
+			os.Chmod(path, 0700)
+		}
+		return nil
+	})
+	if err := os.RemoveAll(dir); err != nil {
+		tlog.Warn.Printf("-snapshot: could not delete %q: %v", dir, err)
+	}
+}
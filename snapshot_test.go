@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestSnapshotTree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := dir + "/src"
+	if err = os.MkdirAll(src+"/sub", 0700); err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("hello world")
+	if err = ioutil.WriteFile(src+"/sub/file", content, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink("sub/file", src+"/link"); err != nil {
+		t.Fatal(err)
+	}
+	// Read-only directory, must still be deletable by removeSnapshot
+	if err = os.Chmod(src+"/sub", 0500); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(src+"/sub", 0700)
+	dst, err := ioutil.TempDir(dir, "snap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := snapshotTree(src, dst)
+	if _, ok := err.(errNoReflink); ok {
+		removeSnapshot(dst)
+		t.Skipf("no reflink support in %q: %v", dir, err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("want 1 cloned file, got %d", n)
+	}
+	// Changes to the original do not show up in the snapshot
+	os.Chmod(src+"/sub", 0700)
+	if err = ioutil.WriteFile(src+"/sub/file", []byte("changed"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dst, "link"))
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("snapshot content: %q %v", got, err)
+	}
+	fi, err := os.Stat(dst + "/sub")
+	if err != nil || fi.Mode().Perm() != 0500 {
+		t.Errorf("directory mode: %v %v", fi.Mode(), err)
+	}
+	removeSnapshot(dst)
+	if _, err = os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("snapshot not deleted: %v", err)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"golang.org/x/crypto/ssh/terminal"
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+type tarObj struct {
+	fs *fusefrontend.FS
+	tw *tar.Writer
+	// Path of the first entry we have written for each inode that has more
+	// than one hard link
+	links map[uint64]string
+	// Number of entries written
+	nEntries int
+}
+
+// dir writes the entries of directory "path" and, recursively, of all its
+// subdirectories. It stops at the first error.
+func (t *tarObj) dir(path string) error {
+	entries, status := listDir(t.fs, path)
+	if !status.Ok() {
+		return fmt.Errorf("%q: error opening dir: %v", path, status)
+	}
+	for _, e := range entries {
+		p := filepath.Join(path, e.Name)
+		attr, status := t.fs.GetAttr(p, nil)
+		if !status.Ok() {
+			return fmt.Errorf("%q: error stating: %v", p, status)
+		}
+		if err := t.entry(p, attr); err != nil {
+			return err
+		}
+		if attr.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			if err := t.dir(p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// entry writes the header of "path" and, for regular files, the contents.
+func (t *tarObj) entry(path string, attr *fuse.Attr) error {
+	hdr := &tar.Header{
+		Name:       path,
+		Mode:       int64(attr.Mode & 07777),
+		Uid:        int(attr.Owner.Uid),
+		Gid:        int(attr.Owner.Gid),
+		ModTime:    time.Unix(int64(attr.Mtime), int64(attr.Mtimensec)),
+		AccessTime: time.Unix(int64(attr.Atime), int64(attr.Atimensec)),
+		ChangeTime: time.Unix(int64(attr.Ctime), int64(attr.Ctimensec)),
+		// PAX handles long names, large files and sub-second timestamps
+		Format: tar.FormatPAX,
+	}
+	switch attr.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case syscall.S_IFREG:
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = int64(attr.Size)
+		if attr.Nlink > 1 {
+			if first, ok := t.links[attr.Ino]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				t.links[attr.Ino] = path
+			}
+		}
+	case syscall.S_IFLNK:
+		target, status := t.fs.Readlink(path, nil)
+		if !status.Ok() {
+			return fmt.Errorf("%q: error reading symlink: %v", path, status)
+		}
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = target
+	case syscall.S_IFIFO:
+		hdr.Typeflag = tar.TypeFifo
+	case syscall.S_IFCHR, syscall.S_IFBLK:
+		hdr.Typeflag = tar.TypeChar
+		if attr.Mode&syscall.S_IFMT == syscall.S_IFBLK {
+			hdr.Typeflag = tar.TypeBlock
+		}
+		hdr.Devmajor = int64(unix.Major(uint64(attr.Rdev)))
+		hdr.Devminor = int64(unix.Minor(uint64(attr.Rdev)))
+	default:
+		tlog.Warn.Printf("tar: %q: skipping unsupported file type %#o", path, attr.Mode&syscall.S_IFMT)
+		return nil
+	}
+	if err := t.xattrs(path, hdr); err != nil {
+		return err
+	}
+	if err := t.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("%q: %v", path, err)
+	}
+	t.nEntries++
+	if hdr.Typeflag == tar.TypeReg {
+		return t.contents(path, hdr.Size)
+	}
+	return nil
+}
+
+// xattrs adds the decrypted extended attributes of "path" to "hdr" as PAX
+// records, in the format GNU tar and bsdtar use.
+func (t *tarObj) xattrs(path string, hdr *tar.Header) error {
+	names, status := t.fs.ListXAttr(path, nil)
+	if status == fuse.Status(syscall.EOPNOTSUPP) || status == fuse.ENOSYS {
+		return nil
+	}
+	if !status.Ok() {
+		return fmt.Errorf("%q: error listing xattrs: %v", path, status)
+	}
+	for _, name := range names {
+		val, status := t.fs.GetXAttr(path, name, nil)
+		if !status.Ok() {
+			return fmt.Errorf("%q: error reading xattr %q: %v", path, name, status)
+		}
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords["SCHILY.xattr."+name] = string(val)
+	}
+	return nil
+}
+
+// contents decrypts regular file "path" into the archive. Exactly "size"
+// bytes, the size recorded in the header, must be written.
+func (t *tarObj) contents(path string, size int64) error {
+	f, status := t.fs.Open(path, syscall.O_RDONLY, nil)
+	if !status.Ok() {
+		return fmt.Errorf("%q: error opening: %v", path, status)
+	}
+	defer f.Release()
+	buf := make([]byte, fuse.MAX_KERNEL_WRITE)
+	var off int64
+	for off < size {
+		n := int64(len(buf))
+		if size-off < n {
+			n = size - off
+		}
+		res, status := f.Read(buf[:n], off)
+		if !status.Ok() {
+			return fmt.Errorf("%q: error reading at offset %d: %v", path, off, status)
+		}
+		data, status := res.Bytes(buf[:n])
+		if !status.Ok() {
+			return fmt.Errorf("%q: error reading at offset %d: %v", path, off, status)
+		}
+		if len(data) == 0 {
+			return fmt.Errorf("%q: file shrank to %d bytes while reading", path, off)
+		}
+		if _, err := t.tw.Write(data); err != nil {
+			return fmt.Errorf("%q: %v", path, err)
+		}
+		off += int64(len(data))
+	}
+	return nil
+}
+
+// abort makes sure that the archive cannot be mistaken for a complete one.
+// If the error happened between two entries, the archive would look fine
+// except for the missing end-of-archive marker, which many tar readers do not
+// check. We write the header of a marker file without its contents, so the
+// archive always ends in the middle of an entry. If we already are in the
+// middle of an entry, WriteHeader fails and nothing is written.
+func (t *tarObj) abort(out *bufio.Writer) {
+	t.tw.WriteHeader(&tar.Header{
+		Name:     "GOCRYPTFS-TAR-INCOMPLETE",
+		Typeflag: tar.TypeReg,
+		Mode:     0600,
+		Size:     1,
+	})
+	out.Flush()
+}
+
+// tarExport handles "gocryptfs -tar CIPHERDIR". It writes the decrypted
+// contents of CIPHERDIR to stdout as a tar archive, without a FUSE mount.
+// The tree is streamed one file at a time, memory use does not depend on its
+// size.
+//
+// If a file cannot be read or decrypted, we stop right there and exit with
+// exitcodes.TarIncomplete. The archive is cut off in the middle of an entry
+// (see abort), which tar readers report as an error ("unexpected EOF")
+// instead of silently extracting a partial tree.
+func tarExport(args *argContainer) {
+	if args.reverse {
+		tlog.Fatal.Printf("Running -tar with -reverse is not supported")
+		os.Exit(exitcodes.Usage)
+	}
+	// Exporting must not change CIPHERDIR
+	if args.strictatime || args.burnafterreading {
+		tlog.Fatal.Printf("-tar cannot be used together with -strict-atime or -burn-after-reading")
+		os.Exit(exitcodes.Usage)
+	}
+	args.ro = true
+	if terminal.IsTerminal(int(os.Stdout.Fd())) {
+		tlog.Fatal.Printf("-tar: refusing to write the archive to a terminal, redirect stdout")
+		os.Exit(exitcodes.Usage)
+	}
+	// stdout is the archive, all messages go to stderr
+	tlog.Info.Logger.SetOutput(os.Stderr)
+	tlog.Debug.Logger.SetOutput(os.Stderr)
+	args.allow_other = false
+	// We read with MAX_KERNEL_WRITE-sized buffers
+	args.lowmem = false
+	args.maxwrite, args.maxread = 0, 0
+	pfs, wipeKeys := initFuseFrontend(args)
+	defer wipeKeys()
+	out := bufio.NewWriterSize(os.Stdout, 128*1024)
+	t := tarObj{
+		fs:    pfs.(*fusefrontend.FS),
+		tw:    tar.NewWriter(out),
+		links: make(map[uint64]string),
+	}
+	err := t.dir("")
+	if err == nil {
+		err = t.tw.Close()
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	if err == nil {
+		tlog.Info.Printf("tar: wrote %d entries", t.nEntries)
+		return
+	}
+	t.abort(out)
+	tlog.Fatal.Printf("tar: %v", err)
+	tlog.Fatal.Printf("tar: aborted after %d entries, the archive is incomplete", t.nEntries)
+	wipeKeys()
+	exitcodes.Exit(exitcodes.NewErr("tar incomplete", exitcodes.TarIncomplete))
+}
@@ -3,14 +3,22 @@ package cli
 // Test CLI operations like "-init", "-password" etc
 
 import (
+	"archive/tar"
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/pkg/xattr"
+
 	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
 
@@ -429,7 +437,7 @@ func TestMountBackground(t *testing.T) {
 // user. Only one operation flag is allowed.
 func TestMultipleOperationFlags(t *testing.T) {
 	// Test all combinations
-	opFlags := []string{"-init", "-info", "-passwd", "-fsck"}
+	opFlags := []string{"-init", "-info", "-passwd", "-fsck", "-compare", "-derive-filekey"}
 	for _, flag1 := range opFlags {
 		var flag2 string
 		for _, flag2 = range opFlags {
@@ -563,3 +571,1067 @@ func TestIdle(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// Check that "-compare" finds no differences between a filesystem and a copy
+// of it, and returns exitcodes.CompareMismatch against an empty filesystem.
+func TestCompare(t *testing.T) {
+	example := "../example_filesystems/v1.3"
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-compare", "-extpass", "echo test",
+		example, example)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		t.Errorf("comparing %q with itself failed: %v", example, err)
+	}
+	empty := test_helpers.InitFS(t)
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-compare", "-extpass", "echo test",
+		example, empty)
+	err = cmd.Run()
+	exitCode := test_helpers.ExtractCmdExitCode(err)
+	if exitCode != exitcodes.CompareMismatch {
+		t.Errorf("wrong exit code: want=%d have=%d", exitcodes.CompareMismatch, exitCode)
+	}
+}
+
+// Profiles must be written even when gocryptfs exits with an error code
+func TestProfileOnErrorExit(t *testing.T) {
+	example := "../example_filesystems/v1.3"
+	empty := test_helpers.InitFS(t)
+	cpuprof := empty + ".cpuprof"
+	memprof := empty + ".memprof"
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-compare", "-extpass", "echo test",
+		"-cpuprofile", cpuprof, "-memprofile", memprof, example, empty)
+	err := cmd.Run()
+	exitCode := test_helpers.ExtractCmdExitCode(err)
+	if exitCode != exitcodes.CompareMismatch {
+		t.Fatalf("wrong exit code: want=%d have=%d", exitcodes.CompareMismatch, exitCode)
+	}
+	for _, f := range []string{cpuprof, memprof} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() == 0 {
+			t.Errorf("%q is empty", f)
+		}
+	}
+}
+
+// "-derive-filekey" must print the file ID from the header and the
+// HKDF-derived content key, and fail with exitcodes.MasterKey if the key
+// does not belong to the file.
+func TestDeriveFilekey(t *testing.T) {
+	example := "../example_filesystems/v1.3"
+	file := example + "/mGj2_hdnHe34Sp0iIQUwuw"
+	masterkey := "fd890dab-86bf61cf-ec5ad460-ad3ed01f-9c52d546-2a31783d-a56b088d-3d05232e"
+	out, err := exec.Command(test_helpers.GocryptfsBinary, "-q", "-derive-filekey",
+		"-masterkey="+masterkey, example, file).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"FileID:        3e5d15115425b7a99a12e8d42549f3e7\n",
+		"Size:          10\n",
+		"KeyDerivation: HKDF-SHA256\n",
+		"ContentKey:    0cbf2a99856b0a76d4005ce7abd5b87527dfb445f384980d55dace609f5ed9bd\n",
+		"Block0:        ok\n",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+	wrongKey := "00000000" + masterkey[8:]
+	err = exec.Command(test_helpers.GocryptfsBinary, "-q", "-derive-filekey",
+		"-masterkey="+wrongKey, example, file).Run()
+	exitCode := test_helpers.ExtractCmdExitCode(err)
+	if exitCode != exitcodes.MasterKey {
+		t.Errorf("wrong key: want exit code %d, have %d", exitcodes.MasterKey, exitCode)
+	}
+	// The password is not accepted
+	err = exec.Command(test_helpers.GocryptfsBinary, "-q", "-derive-filekey",
+		"-extpass", "echo test", example, file).Run()
+	exitCode = test_helpers.ExtractCmdExitCode(err)
+	if exitCode != exitcodes.Usage {
+		t.Errorf("password: want exit code %d, have %d", exitcodes.Usage, exitCode)
+	}
+}
+
+// "-derive-filekey" must refuse filesystems whose files are not encrypted
+// with the printed content key, instead of reporting a wrong master key.
+func TestDeriveFilekeyUnsupported(t *testing.T) {
+	masterkey := "fd890dab-86bf61cf-ec5ad460-ad3ed01f-9c52d546-2a31783d-a56b088d-3d05232e"
+	for _, flag := range []string{"-xts", "-plaintextcontent"} {
+		dir := test_helpers.InitFS(t, flag)
+		err := ioutil.WriteFile(dir+"/file", []byte("x"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = exec.Command(test_helpers.GocryptfsBinary, "-q", "-derive-filekey",
+			"-masterkey="+masterkey, dir, dir+"/file").Run()
+		exitCode := test_helpers.ExtractCmdExitCode(err)
+		if exitCode != exitcodes.Usage {
+			t.Errorf("%s: want exit code %d, have %d", flag, exitcodes.Usage, exitCode)
+		}
+	}
+}
+
+// Smoke test for -flush-on-close: kill gocryptfs with SIGKILL right after
+// closing a file, then check that the file can be read back after
+// remounting. SIGKILL does not drop the page cache, so this passes without
+// the flag as well. That Flush actually fsyncs is checked by the unit test
+// TestFlushOnClose in internal/fusefrontend.
+func TestFlushOnClose(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	err := os.Mkdir(mnt, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Let gocryptfs notify us via SIGUSR1 when the mount is ready
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	defer signal.Stop(usr1)
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-nosyslog", "-fg",
+		"-extpass", "echo test", "-flush-on-close",
+		fmt.Sprintf("-notifypid=%d", os.Getpid()), dir, mnt)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-usr1:
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("timeout waiting for mount")
+	}
+	content := []byte("durable data")
+	err = ioutil.WriteFile(mnt+"/file", content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+	// The kernel still thinks the filesystem is mounted
+	test_helpers.UnmountErr(mnt)
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	content2, err := ioutil.ReadFile(mnt + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != string(content2) {
+		t.Errorf("wrong content: want=%q have=%q", content, content2)
+	}
+}
+
+// Test -init with -normalize-names=nfc: NFC and NFD variants of a name must
+// refer to the same file, and invalid UTF-8 names must be rejected.
+func TestNormalizeNames(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-normalize-names=nfc")
+	_, c, err := configfile.LoadAndDecrypt(dir+"/"+configfile.ConfDefaultName, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagNormalizeNFC) {
+		t.Error("NormalizeNFC flag should be set but is not")
+	}
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	nfc := "caf\u00e9"
+	nfd := "cafe\u0301"
+	err = ioutil.WriteFile(mnt+"/"+nfd, []byte("foo"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(mnt + "/" + nfc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "foo" {
+		t.Errorf("wrong content: %q", content)
+	}
+	entries, err := ioutil.ReadDir(mnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != nfc {
+		t.Errorf("directory listing should contain only the NFC name, have %v", entries)
+	}
+	// Creating the NFC variant exclusively must fail
+	_, err = os.OpenFile(mnt+"/"+nfc, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if !os.IsExist(err) {
+		t.Errorf("want EEXIST, have %v", err)
+	}
+	err = ioutil.WriteFile(mnt+"/\xff", nil, 0600)
+	if err2, ok := err.(*os.PathError); !ok || err2.Err != syscall.EILSEQ {
+		t.Errorf("invalid UTF-8: want EILSEQ, have %v", err)
+	}
+}
+
+// -normalize-names only accepts "nfc" and "nfd"
+func TestNormalizeNamesInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir(test_helpers.TmpDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-init", "-extpass", "echo test",
+		"-scryptn=10", "-normalize-names=nfkc", dir)
+	err = cmd.Run()
+	exitCode := test_helpers.ExtractCmdExitCode(err)
+	if exitCode != exitcodes.Usage {
+		t.Errorf("want exit code %d, have %d", exitcodes.Usage, exitCode)
+	}
+}
+
+// With -encfs-quirks, new long names are refused but existing ones stay
+// accessible
+func TestEncfsQuirks(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	long1 := mnt + "/" + strings.Repeat("a", 200)
+	long2 := mnt + "/" + strings.Repeat("b", 200)
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	err := ioutil.WriteFile(long1, []byte("foo"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-encfs-quirks")
+	defer test_helpers.UnmountPanic(mnt)
+	_, err = ioutil.ReadFile(long1)
+	if err != nil {
+		t.Error(err)
+	}
+	err = ioutil.WriteFile(long2, nil, 0600)
+	if err2, ok := err.(*os.PathError); !ok || err2.Err != syscall.ENAMETOOLONG {
+		t.Errorf("want ENAMETOOLONG, have %v", err)
+	}
+	err = os.Rename(long1, long2)
+	if err2, ok := err.(*os.LinkError); !ok || err2.Err != syscall.ENAMETOOLONG {
+		t.Errorf("rename: want ENAMETOOLONG, have %v", err)
+	}
+	err = ioutil.WriteFile(mnt+"/short", nil, 0600)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// Test -export-manifest and -verify-manifest, including resuming an
+// interrupted export
+func TestManifest(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	os.Mkdir(mnt+"/dir", 0700)
+	for _, f := range []string{"a", "dir/b", "dir/c"} {
+		err := ioutil.WriteFile(mnt+"/"+f, []byte(f), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Symlink("a", mnt+"/link")
+	test_helpers.UnmountPanic(mnt)
+	manifest := dir + ".manifest"
+	run := func(args ...string) int {
+		args = append([]string{"-q", "-extpass", "echo test"}, args...)
+		cmd := exec.Command(test_helpers.GocryptfsBinary, append(args, dir)...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		return test_helpers.ExtractCmdExitCode(cmd.Run())
+	}
+	if rc := run("-export-manifest", manifest); rc != 0 {
+		t.Fatalf("export failed with exit code %d", rc)
+	}
+	if rc := run("-verify-manifest", manifest); rc != 0 {
+		t.Fatalf("verify failed with exit code %d", rc)
+	}
+	// Simulate an interrupted export: keep the header, three records and part
+	// of the fourth
+	content, err := ioutil.ReadFile(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+	partial := strings.Join(lines[:4], "") + lines[4][:10]
+	err = ioutil.WriteFile(manifest+".2", []byte(partial), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc := run("-verify-manifest", manifest+".2"); rc != exitcodes.Other {
+		t.Errorf("verifying an incomplete manifest: want exit code %d, have %d", exitcodes.Other, rc)
+	}
+	if rc := run("-export-manifest", manifest+".2"); rc != 0 {
+		t.Fatalf("resume failed with exit code %d", rc)
+	}
+	if rc := run("-verify-manifest", manifest+".2"); rc != 0 {
+		t.Fatalf("verify after resume failed with exit code %d", rc)
+	}
+	// Change the content of a file without changing its size
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	err = ioutil.WriteFile(mnt+"/dir/b", []byte("X"), 0600)
+	test_helpers.UnmountPanic(mnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc := run("-verify-manifest", manifest); rc != exitcodes.ManifestDrift {
+		t.Errorf("want exit code %d, have %d", exitcodes.ManifestDrift, rc)
+	}
+}
+
+// With -no-longname, names that do not fit into the backing filesystem are
+// rejected and no gocryptfs.longname.* files are created
+func TestNoLongname(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-no-longname")
+	_, c, err := configfile.LoadAndDecrypt(dir+"/"+configfile.ConfDefaultName, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagNoLongNames) || c.IsFeatureFlagSet(configfile.FlagLongNames) {
+		t.Errorf("wrong feature flags: %v", c.FeatureFlags)
+	}
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	// 100 bytes encrypt to 150 bytes, which fits
+	short := mnt + "/" + strings.Repeat("s", 100)
+	err = ioutil.WriteFile(short, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := mnt + "/" + strings.Repeat("l", 200)
+	isENAMETOOLONG := func(err error) bool {
+		switch e := err.(type) {
+		case *os.PathError:
+			return e.Err == syscall.ENAMETOOLONG
+		case *os.LinkError:
+			return e.Err == syscall.ENAMETOOLONG
+		case *os.SyscallError:
+			return e.Err == syscall.ENAMETOOLONG
+		}
+		return false
+	}
+	if err = ioutil.WriteFile(long, nil, 0600); !isENAMETOOLONG(err) {
+		t.Errorf("create: want ENAMETOOLONG, have %v", err)
+	}
+	if err = os.Mkdir(long, 0700); !isENAMETOOLONG(err) {
+		t.Errorf("mkdir: want ENAMETOOLONG, have %v", err)
+	}
+	if err = os.Symlink("x", long); !isENAMETOOLONG(err) {
+		t.Errorf("symlink: want ENAMETOOLONG, have %v", err)
+	}
+	if err = os.Link(short, long); !isENAMETOOLONG(err) {
+		t.Errorf("link: want ENAMETOOLONG, have %v", err)
+	}
+	if err = os.Rename(short, long); !isENAMETOOLONG(err) {
+		t.Errorf("rename: want ENAMETOOLONG, have %v", err)
+	}
+	if err = syscall.Mkfifo(long, 0600); err != syscall.ENAMETOOLONG {
+		t.Errorf("mknod: want ENAMETOOLONG, have %v", err)
+	}
+	cipherEntries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range cipherEntries {
+		if strings.HasPrefix(e.Name(), "gocryptfs.longname.") {
+			t.Errorf("found longname file %q", e.Name())
+		}
+	}
+}
+
+// TestRoReadonlyCipherdir checks that "-ro" works when CIPHERDIR is not
+// writeable and that nothing in CIPHERDIR is changed.
+func TestRoReadonlyCipherdir(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	err := os.Mkdir(mnt+"/dir", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(mnt+"/dir/file", []byte("hello"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	// Make CIPHERDIR read-only and record its state
+	chmodWalk := func(set os.FileMode) string {
+		var out string
+		filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				t.Fatal(err)
+			}
+			os.Chmod(path, fi.Mode().Perm()&0555|set)
+			out += fmt.Sprintf("%s %d %v\n", path, fi.Size(), fi.ModTime())
+			return nil
+		})
+		return out
+	}
+	before := chmodWalk(0)
+	defer chmodWalk(0200)
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-ro")
+	defer test_helpers.UnmountPanic(mnt)
+	content, err := ioutil.ReadFile(mnt + "/dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "hello" {
+		t.Errorf("wrong content: %q", content)
+	}
+	err = ioutil.WriteFile(mnt+"/dir/file2", nil, 0600)
+	if err == nil {
+		t.Errorf("creating a file on a read-only mount should have failed")
+	}
+	if after := chmodWalk(0); after != before {
+		t.Errorf("CIPHERDIR was modified:\n%s\n%s", before, after)
+	}
+}
+
+// TestMountLock checks that a CIPHERDIR cannot be mounted read-write twice
+func TestMountLock(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt1 := dir + ".mnt1"
+	mnt2 := dir + ".mnt2"
+	test_helpers.MountOrFatal(t, dir, mnt1, "-extpass=echo test")
+	// The lock file is hidden
+	_, err := os.Stat(mnt1 + "/gocryptfs.mnt.lock")
+	if !os.IsNotExist(err) {
+		t.Errorf("lock file should not be visible: %v", err)
+	}
+	err = test_helpers.Mount(dir, mnt2, false, "-extpass=echo test", "-wpanic=false")
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.CipherdirLocked {
+		test_helpers.UnmountPanic(mnt2)
+		t.Errorf("second mount: want exit code %d, have %d", exitcodes.CipherdirLocked, exitCode)
+	}
+	// Read-only and forced mounts are allowed
+	for _, opt := range []string{"-ro", "-force"} {
+		test_helpers.MountOrFatal(t, dir, mnt2, "-extpass=echo test", opt)
+		test_helpers.UnmountPanic(mnt2)
+	}
+	// The lock is released on unmount
+	test_helpers.UnmountPanic(mnt1)
+	test_helpers.MountOrFatal(t, dir, mnt2, "-extpass=echo test")
+	test_helpers.UnmountPanic(mnt2)
+}
+
+// TestRekeyMaster checks that "-rekey-master" creates a copy with a different
+// master key, and that running it again resumes the copy.
+func TestRekeyMaster(t *testing.T) {
+	src := test_helpers.InitFS(t)
+	mnt := src + ".mnt"
+	test_helpers.MountOrFatal(t, src, mnt, "-extpass=echo test")
+	err := os.Mkdir(mnt+"/dir", 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(mnt+"/dir/file", []byte("hello"), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("dir/file", mnt+"/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	dst := src + ".rekeyed"
+	rekey := func() {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-rekey-master", "-extpass=echo test", src, dst)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err := cmd.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	rekey()
+	key1, _, err := configfile.LoadAndDecrypt(src+"/"+configfile.ConfDefaultName, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, _, err := configfile.LoadAndDecrypt(dst+"/"+configfile.ConfDefaultName, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(key1, key2) {
+		t.Errorf("master key was not changed")
+	}
+	// Simulate an interrupted run
+	test_helpers.MountOrFatal(t, dst, mnt, "-extpass=echo test")
+	err = os.Truncate(mnt+"/dir/file", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	rekey()
+	test_helpers.MountOrFatal(t, dst, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	content, err := ioutil.ReadFile(mnt + "/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "hello" {
+		t.Errorf("wrong content: %q", content)
+	}
+	fi, err := os.Stat(mnt + "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0750 {
+		t.Errorf("wrong permissions: %o", fi.Mode().Perm())
+	}
+}
+
+// TestBurnAfterReading checks that a marked file is deleted after a complete
+// read once all handles are closed, and that partial reads keep it.
+func TestBurnAfterReading(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-burn-after-reading")
+	defer test_helpers.UnmountPanic(mnt)
+	secret := mnt + "/secret"
+	other := mnt + "/other"
+	content := bytes.Repeat([]byte("x"), 100000)
+	for _, fn := range []string{secret, other} {
+		err := ioutil.WriteFile(fn, content, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := xattr.LSet(secret, "user.burn-after-reading", []byte("1"))
+	if err != nil {
+		t.Skipf("xattrs not supported: %v", err)
+	}
+	// Unmarked files are not affected
+	if _, err = ioutil.ReadFile(other); err != nil {
+		t.Fatal(err)
+	}
+	if !test_helpers.VerifyExistence(other) {
+		t.Errorf("unmarked file was deleted")
+	}
+	// A partial read does not trigger the deletion
+	f1, err := os.Open(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	if _, err = f1.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	f1.Close()
+	if !test_helpers.VerifyExistence(secret) {
+		t.Fatalf("file was deleted after a partial read")
+	}
+	// A complete read deletes it once the last handle is closed
+	f1, err = os.Open(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2, err := os.Open(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f1)
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("read failed: %v", err)
+	}
+	f1.Close()
+	if !test_helpers.VerifyExistence(secret) {
+		t.Errorf("file was deleted while still open")
+	}
+	f2.Close()
+	// Release is asynchronous
+	for i := 0; i < 20 && test_helpers.VerifyExistence(secret); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if test_helpers.VerifyExistence(secret) {
+		t.Errorf("file was not deleted after a complete read")
+	}
+}
+
+// TestLockDir checks that files in a directory locked with -lock-dir can only
+// be listed and read with -unlock-dir, and cannot be moved out of it.
+func TestLockDir(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	err := os.Mkdir(mnt+"/private", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-lock-dir", "private", "-extpass=echo test",
+		"-dir-extpass=echo secret", "-scryptn=10", dir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-unlock-dir=private",
+		"-dir-extpass=echo secret")
+	if d, _ := ioutil.ReadDir(mnt + "/private"); len(d) != 0 {
+		t.Errorf("key slot is visible: %v", d)
+	}
+	err = ioutil.WriteFile(mnt+"/private/file", []byte("hello"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(mnt+"/private/file", mnt+"/file")
+	if err == nil || err.(*os.LinkError).Err != syscall.EXDEV {
+		t.Errorf("moving out of a locked dir should fail with EXDEV, got %v", err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	// Without -unlock-dir, the content is not accessible
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	_, err = ioutil.ReadFile(mnt + "/private/file")
+	if !os.IsPermission(err) {
+		t.Errorf("reading a file in a locked dir should fail with EACCES, got %v", err)
+	}
+	_, err = ioutil.ReadDir(mnt + "/private")
+	if !os.IsPermission(err) {
+		t.Errorf("listing a locked dir should fail with EACCES, got %v", err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	// Wrong directory password
+	err = test_helpers.Mount(dir, mnt, false, "-extpass=echo test", "-unlock-dir=private",
+		"-dir-extpass=echo wrong")
+	exitCode := test_helpers.ExtractCmdExitCode(err)
+	if exitCode != exitcodes.PasswordIncorrect {
+		t.Errorf("want exit code %d, got %d", exitcodes.PasswordIncorrect, exitCode)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-unlock-dir=private",
+		"-dir-extpass=echo secret")
+	defer test_helpers.UnmountPanic(mnt)
+	content, err := ioutil.ReadFile(mnt + "/private/file")
+	if err != nil || string(content) != "hello" {
+		t.Errorf("read failed: %v %q", err, content)
+	}
+}
+
+// TestNoPrealloc checks that files are written and grow correctly with
+// -no-prealloc.
+func TestNoPrealloc(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-no-prealloc")
+	defer test_helpers.UnmountPanic(mnt)
+	fn := mnt + "/file"
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var want []byte
+	// Appending writes of different sizes, crossing block boundaries
+	for _, n := range []int{1, 4095, 5000, 131072, 3} {
+		buf := bytes.Repeat([]byte{byte(n)}, n)
+		if _, err = f.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, buf...)
+	}
+	// A write after a hole
+	if _, err = f.WriteAt([]byte("x"), int64(len(want))+10000); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, make([]byte, 10000)...)
+	want = append(want, 'x')
+	got, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("content mismatch: got %d bytes, want %d", len(got), len(want))
+	}
+}
+
+// TestImport checks that a tree imported with -import mounts and reads back
+// identically.
+func TestImport(t *testing.T) {
+	src := test_helpers.TmpDir + "/TestImport.src"
+	if err := os.MkdirAll(src+"/dir/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[string][]byte)
+	for i := 0; i < 50; i++ {
+		path := fmt.Sprintf("dir/file%d", i)
+		content := bytes.Repeat([]byte{byte(i)}, i*1000)
+		want[path] = content
+		if err := ioutil.WriteFile(src+"/"+path, content, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want["dir/sub/empty"] = []byte{}
+	if err := ioutil.WriteFile(src+"/dir/sub/empty", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("dir/file1", src+"/link"); err != nil {
+		t.Fatal(err)
+	}
+	dir := test_helpers.InitFS(t)
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-import", "-workers=3", "-extpass=echo test", src, dir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	for path, content := range want {
+		got, err := ioutil.ReadFile(mnt + "/" + path)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("%q: content differs", path)
+		}
+	}
+	fi, err := os.Stat(mnt + "/dir/file3")
+	if err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("wrong permissions: %v %v", fi, err)
+	}
+	if target, err := os.Readlink(mnt + "/link"); err != nil || target != "dir/file1" {
+		t.Errorf("wrong symlink: %q %v", target, err)
+	}
+}
+
+// TestTar checks that "-tar" writes the decrypted tree, including hard
+// links, symlinks and xattrs, and that it fails on a corrupted file.
+func TestTar(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-plaintextnames")
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	content := bytes.Repeat([]byte("abcdefgh"), 10000)
+	if err := os.Mkdir(mnt+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(mnt+"/dir/file", content, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(mnt+"/dir/file", mnt+"/hardlink"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("dir/file", mnt+"/symlink"); err != nil {
+		t.Fatal(err)
+	}
+	if err := xattr.Set(mnt+"/dir/file", "user.foo", []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-tar", "-extpass=echo test", dir)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(&out)
+	seen := make(map[string]*tar.Header)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[hdr.Name] = hdr
+		if hdr.Name == "dir/file" {
+			data, err := ioutil.ReadAll(tr)
+			if err != nil || !bytes.Equal(data, content) {
+				t.Errorf("dir/file: wrong content, err=%v", err)
+			}
+		}
+	}
+	if h := seen["dir/"]; h == nil || h.Typeflag != tar.TypeDir || h.Mode != 0700 {
+		t.Errorf("dir: wrong header %v", h)
+	}
+	if h := seen["dir/file"]; h == nil || h.Mode != 0640 || h.PAXRecords["SCHILY.xattr.user.foo"] != "bar" {
+		t.Errorf("dir/file: wrong header %v", h)
+	}
+	if h := seen["hardlink"]; h == nil || h.Typeflag != tar.TypeLink || h.Linkname != "dir/file" {
+		t.Errorf("hardlink: wrong header %v", h)
+	}
+	if h := seen["symlink"]; h == nil || h.Typeflag != tar.TypeSymlink || h.Linkname != "dir/file" {
+		t.Errorf("symlink: wrong header %v", h)
+	}
+
+	// Corrupt the second block
+	f, err := os.OpenFile(dir+"/dir/file", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("XXXX"), 5000)
+	f.Close()
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-tar", "-extpass=echo test", dir)
+	out.Reset()
+	cmd.Stdout = &out
+	err = cmd.Run()
+	if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.TarIncomplete {
+		t.Errorf("want exit code %d, got %d", exitcodes.TarIncomplete, code)
+	}
+	// Reading the archive must fail instead of hitting a clean end
+	tr = tar.NewReader(&out)
+	for {
+		_, err = tr.Next()
+		if err == nil {
+			_, err = io.Copy(ioutil.Discard, tr)
+		}
+		if err == io.EOF {
+			t.Fatal("archive of a corrupt filesystem should not end cleanly")
+		}
+		if err != nil {
+			break
+		}
+	}
+}
+
+// TestDirMtime checks that the mtime of a directory changes when a file is
+// created, but not when it is read or when the filesystem is mounted.
+func TestDirMtime(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	old := time.Unix(1000000000, 0)
+	// Mounting creates gocryptfs.mnt.lock in the root directory
+	os.Remove(dir + "/gocryptfs.mnt.lock")
+	if err := os.Chtimes(dir, old, old); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	mtime := func(path string) time.Time {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.ModTime()
+	}
+	if m := mtime(mnt); !m.Equal(old) {
+		t.Errorf("mounting changed the root mtime to %v", m)
+	}
+	if err := os.Mkdir(mnt+"/d", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(mnt+"/d/f", []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(mnt+"/d", old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadFile(mnt + "/d/f"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadDir(mnt + "/d"); err != nil {
+		t.Fatal(err)
+	}
+	if m := mtime(mnt + "/d"); !m.Equal(old) {
+		t.Errorf("reading changed the mtime to %v", m)
+	}
+	if err := ioutil.WriteFile(mnt+"/d/g", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if m := mtime(mnt + "/d"); !m.After(old) {
+		t.Errorf("creating a file did not change the mtime: %v", m)
+	}
+}
+
+// TestStrictAtime checks that a read updates the atime of the backing file with
+// -strict-atime, and that it cannot be combined with noatime.
+func TestStrictAtime(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-plaintextnames")
+	mnt := dir + ".mnt"
+	err := test_helpers.Mount(dir, mnt, false, "-extpass=echo test", "-strict-atime", "-ko=noatime")
+	if exitcodes.Usage != test_helpers.ExtractCmdExitCode(err) {
+		t.Errorf("-strict-atime -ko=noatime should fail with a usage error, got %v", err)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-strict-atime")
+	defer test_helpers.UnmountPanic(mnt)
+	if err = ioutil.WriteFile(mnt+"/file", []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// atime is newer than mtime and less than a day old, so "relatime" on
+	// the backing filesystem would not update it
+	old := time.Now().Add(-time.Minute)
+	if err = os.Chtimes(dir+"/file", old, old.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ioutil.ReadFile(mnt + "/file"); err != nil {
+		t.Fatal(err)
+	}
+	var st syscall.Stat_t
+	if err = syscall.Stat(dir+"/file", &st); err != nil {
+		t.Fatal(err)
+	}
+	if atime := time.Unix(st.Atim.Unix()); !atime.After(old) {
+		t.Errorf("atime did not advance: %v", atime)
+	}
+}
+
+// Test that -name-suffix presents stored names with the suffix and strips
+// it again on create.
+func TestNameSuffix(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	if err := ioutil.WriteFile(mnt+"/report", []byte("1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(mnt+"/old.pdf", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-name-suffix=.pdf")
+	names, err := ioutil.ReadDir(mnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have := make(map[string]bool)
+	for _, fi := range names {
+		have[fi.Name()] = true
+	}
+	if !have["report.pdf"] || !have["old.pdf.pdf"] || len(have) != 2 {
+		t.Errorf("wrong names: %v", have)
+	}
+	if _, err = os.Stat(mnt + "/report"); !os.IsNotExist(err) {
+		t.Errorf("lookup without the suffix: want ENOENT, got %v", err)
+	}
+	if err = ioutil.WriteFile(mnt+"/new", nil, 0600); err == nil {
+		t.Error("creating a name without the suffix should fail")
+	}
+	if err = os.Mkdir(mnt+"/dir.pdf", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(mnt+"/dir.pdf/new.pdf", []byte("3"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	if content, err := ioutil.ReadFile(mnt + "/dir/new"); err != nil || string(content) != "3" {
+		t.Errorf("dir/new: %q %v", content, err)
+	}
+}
+
+// Test that a failing -premount-cmd aborts the mount, and that
+// -postmount-cmd runs once the mount is ready.
+func TestMountHooks(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	err := test_helpers.Mount(dir, mnt, false, "-extpass=echo test", "-premount-cmd=test \"$1\" = "+mnt+" || exit 0; exit 3")
+	if exitcodes.PremountCmd != test_helpers.ExtractCmdExitCode(err) {
+		t.Errorf("failing -premount-cmd: want exit code %d, got %v", exitcodes.PremountCmd, err)
+	}
+	if err = test_helpers.UnmountErr(mnt); err == nil {
+		t.Error("the filesystem was mounted despite the failing -premount-cmd")
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-premount-cmd=true",
+		"-postmount-cmd=printf %s \"$GOCRYPTFS_CIPHERDIR\" > \"$1\"/hook")
+	defer test_helpers.UnmountPanic(mnt)
+	// The hook runs in the background
+	var content []byte
+	for i := 0; i < 50; i++ {
+		if content, err = ioutil.ReadFile(mnt + "/hook"); err == nil && len(content) > 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if string(content) != dir {
+		t.Errorf("-postmount-cmd: got %q %v", content, err)
+	}
+}
+
+// readFlatDir returns the names and contents of the files in "dir"
+func readFlatDir(t *testing.T, dir string) map[string]string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]string)
+	for _, e := range entries {
+		content, err := ioutil.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m[e.Name()] = string(content)
+	}
+	return m
+}
+
+// Test that -init -deterministic with the same seed creates identical
+// CIPHERDIRs, and that a different seed gives a different master key.
+func TestInitDeterministic(t *testing.T) {
+	seed := "-seed=00112233445566778899aabbccddeeff"
+	dir1 := test_helpers.InitFS(t, "-deterministic", seed)
+	dir2 := test_helpers.InitFS(t, "-deterministic", seed)
+	dir3 := test_helpers.InitFS(t, "-deterministic", "-seed=ff")
+	c1 := readFlatDir(t, dir1)
+	c2 := readFlatDir(t, dir2)
+	if len(c1) != 2 || len(c1) != len(c2) {
+		t.Fatalf("unexpected files: %v %v", c1, c2)
+	}
+	for name, content := range c1 {
+		if c2[name] != content {
+			t.Errorf("%s differs:\n%q\n%q", name, content, c2[name])
+		}
+	}
+	if _, _, err := configfile.LoadAndDecrypt(dir1+"/"+configfile.ConfDefaultName, testPw); err != nil {
+		t.Fatal(err)
+	}
+	if readFlatDir(t, dir3)[configfile.ConfDefaultName] == c1[configfile.ConfDefaultName] {
+		t.Error("different seeds gave the same config file")
+	}
+	// A seed alone is a usage error
+	dir := test_helpers.InitFS(t)
+	os.Mkdir(dir+".new", 0700)
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-init", "-extpass", "echo test", seed, dir+".new")
+	err := cmd.Run()
+	if exitcodes.Usage != test_helpers.ExtractCmdExitCode(err) {
+		t.Errorf("-seed without -deterministic: want exit code %d, got %v", exitcodes.Usage, err)
+	}
+}
+
+// Test that "-min-scrypt-n" refuses weak config files and that "-passwd"
+// can raise the cost
+func TestMinScryptN(t *testing.T) {
+	cDir := test_helpers.InitFS(t) // -scryptn=10, N=1024
+	pDir := cDir + ".mnt"
+	if err := os.Mkdir(pDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-min-scrypt-n=2048", "-extpass", "echo test", cDir, pDir)
+	out, err := cmd.CombinedOutput()
+	if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.KDFPolicy {
+		t.Errorf("want exit code %d, got %d", exitcodes.KDFPolicy, code)
+	}
+	if !strings.Contains(string(out), "scrypt N=1024") {
+		t.Errorf("the error message does not name the weak parameter: %q", out)
+	}
+	// At the minimum is fine
+	test_helpers.MountOrFatal(t, cDir, pDir, "-min-scrypt-n=1024", "-extpass", "echo test")
+	test_helpers.UnmountPanic(pDir)
+	// Re-key to the policy
+	testPasswd(t, cDir, "-min-scrypt-n=2048")
+	cf, err := configfile.Load(cDir + "/gocryptfs.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.ScryptObject.N != 2048 {
+		t.Errorf("-passwd did not raise N: %d", cf.ScryptObject.N)
+	}
+	test_helpers.MountOrFatal(t, cDir, pDir, "-min-scrypt-n=2048", "-extpass", "echo newpasswd")
+	test_helpers.UnmountPanic(pDir)
+	// Invalid values
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-min-scrypt-n=1000", "-extpass", "echo newpasswd", cDir, pDir)
+	err = cmd.Run()
+	if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.Usage {
+		t.Errorf("-min-scrypt-n=1000: want exit code %d, got %d", exitcodes.Usage, code)
+	}
+}
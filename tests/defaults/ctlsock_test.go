@@ -2,6 +2,7 @@ package defaults
 
 import (
 	"os"
+	"path/filepath"
 	"syscall"
 	"testing"
 
@@ -74,6 +75,13 @@ func TestCtlSockDecrypt(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		// ...and that CipherPath points to it
+		if want := filepath.Join(cDir, cPath); response.CipherPath != want {
+			t.Errorf("CipherPath: want %q, got %q", want, response.CipherPath)
+		}
+		if _, err = os.Stat(response.CipherPath); err != nil {
+			t.Error(err)
+		}
 		// Decrypt the path through the ctlsock and see if we get the original path
 		req = ctlsock.RequestStruct{
 			DecryptPath: cPath,
@@ -96,3 +104,66 @@ func TestCtlSockDecryptCrash(t *testing.T) {
 	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
 	defer test_helpers.UnmountPanic(pDir)
 }
+
+func TestCtlSockOpenFiles(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	req := ctlsock.RequestStruct{
+		OpenFiles: true,
+	}
+	response := test_helpers.QueryCtlSock(t, sock, req)
+	if response.ErrNo != 0 || len(response.OpenFiles) != 0 {
+		t.Fatalf("expected an empty list, got %+v", response)
+	}
+	f1, err := os.Create(pDir + "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2, err := os.Open(pDir + "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response = test_helpers.QueryCtlSock(t, sock, req)
+	want := ctlsock.OpenFile{Path: "foo", Count: 2, Writers: 1}
+	if len(response.OpenFiles) != 1 || response.OpenFiles[0] != want {
+		t.Errorf("want=%+v have=%+v", want, response)
+	}
+	f1.Close()
+	f2.Close()
+	response = test_helpers.QueryCtlSock(t, sock, req)
+	if len(response.OpenFiles) != 0 {
+		t.Errorf("file still listed after close: %+v", response)
+	}
+	// Mixing OpenFiles with a path operation is an error
+	req.EncryptPath = "foo"
+	response = test_helpers.QueryCtlSock(t, sock, req)
+	if response.ErrNo == 0 {
+		t.Errorf("ambiguous request was accepted: %+v", response)
+	}
+}
+
+// TestCtlSockStatus checks that the mount ID survives a remount
+func TestCtlSockStatus(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	req := ctlsock.RequestStruct{
+		Status: true,
+	}
+	var ids []string
+	for i := 0; i < 2; i++ {
+		test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+		response := test_helpers.QueryCtlSock(t, sock, req)
+		test_helpers.UnmountPanic(pDir)
+		if response.ErrNo != 0 || response.Status == nil || response.Status.MountID == "" {
+			t.Fatalf("got an error reply: %+v", response)
+		}
+		ids = append(ids, response.Status.MountID)
+	}
+	if ids[0] != ids[1] {
+		t.Errorf("mount ID changed on remount: %q -> %q", ids[0], ids[1])
+	}
+}
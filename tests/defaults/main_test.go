@@ -10,8 +10,10 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"syscall"
 	"testing"
 
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/tests/test_helpers"
 )
 
@@ -257,3 +259,28 @@ func TestCpWarnings(t *testing.T) {
 		t.Fatalf("Got warnings from cp -a:\n%s", string(out))
 	}
 }
+
+// Files opened with O_DIRECT must work like any other file, see
+// mangleOpenFlags.
+func TestODirect(t *testing.T) {
+	fn := test_helpers.DefaultPlainDir + "/TestODirect"
+	fd, err := syscall.Open(fn, syscall.O_CREAT|syscall.O_RDWR|syscallcompat.O_DIRECT, 0600)
+	if err == syscall.EINVAL {
+		t.Skip("kernel does not support O_DIRECT on FUSE")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	content := bytes.Repeat([]byte("x"), 4096)
+	if _, err = syscall.Pwrite(fd, content, 4096); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4096)
+	if _, err = syscall.Pread(fd, buf, 4096); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, content) {
+		t.Error("content mismatch")
+	}
+}
@@ -129,3 +129,37 @@ func BenchmarkCreate4kB(t *testing.B) {
 func BenchmarkCreate10kB(t *testing.B) {
 	createFiles(t, t.N, 10*1024)
 }
+
+// BenchmarkLsLong does what "ls -l" does: list a directory with 1000 files
+// and lstat() every entry. With READDIRPLUS, the attributes come with the
+// directory listing and OpenDir prefetches them from the backing directory.
+func BenchmarkLsLong(t *testing.B) {
+	dir := test_helpers.DefaultPlainDir + "/BenchmarkLsLong"
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err = os.Mkdir(dir, 0777); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err = ioutil.WriteFile(fmt.Sprintf("%s/%d", dir, i), nil, 0666); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	t.ResetTimer()
+	for i := 0; i < t.N; i++ {
+		f, err := os.Open(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range names {
+			if _, err = os.Lstat(dir + "/" + n); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
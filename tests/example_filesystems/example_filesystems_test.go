@@ -14,6 +14,7 @@ import (
 	"syscall"
 	"testing"
 
+	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
 	"github.com/rfjakob/gocryptfs/tests/test_helpers"
 )
@@ -145,6 +146,38 @@ func TestExampleFSv07PlaintextNames(t *testing.T) {
 	test_helpers.UnmountPanic(pDir)
 }
 
+// "-migrate" adds the LongNames flag to the v0.7 filesystem, which must stay
+// mountable with the same password and master key. The v0.5 filesystem
+// cannot be migrated.
+func TestExampleFSv07Migrate(t *testing.T) {
+	cDir := tmpFsPath + "v0.7-migrate"
+	pDir := test_helpers.TmpDir + "/v0.7-migrate"
+	if err := exec.Command("cp", "-a", tmpFsPath+"v0.7", cDir).Run(); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, cDir, pDir, "-migrate", "-extpass", "echo test", opensslOpt)
+	checkExampleFS(t, pDir, true)
+	test_helpers.UnmountPanic(pDir)
+	cf, err := configfile.Load(cDir + "/gocryptfs.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsFeatureFlagSet(configfile.FlagLongNames) {
+		t.Error("LongNames flag has not been added")
+	}
+	pDir = pDir + ".2"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-masterkey",
+		"ed7f6d83-40cce86c-0e7d79c2-a9438710-575221bf-30a0eb60-2821fa8f-7f3123bf",
+		"-raw64=false", "-hkdf=false", opensslOpt)
+	checkExampleFS(t, pDir, true)
+	test_helpers.UnmountPanic(pDir)
+
+	err = test_helpers.Mount(tmpFsPath+"v0.5", pDir+".3", false, "-migrate", "-extpass", "echo test", opensslOpt)
+	if err == nil {
+		t.Errorf("Migrating the v0.5 filesystem should fail")
+	}
+}
+
 // Test example_filesystems/v0.9
 // (gocryptfs v0.9 introduced long file name support)
 func TestExampleFSv09(t *testing.T) {
@@ -2,10 +2,12 @@ package fsck
 
 import (
 	"encoding/base64"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"runtime"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -124,3 +126,129 @@ func TestTerabyteFile(t *testing.T) {
 	cmd.Wait()
 	timer.Stop()
 }
+
+// TestOrphanedLongName checks that fsck reports a longname .name file that
+// has no content file, deletes it only with -fix, and that this does not
+// count as an error.
+func TestOrphanedLongName(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	orphan := cDir + "/gocryptfs.longname.QhUr5d9FHerwEs--muUs6_80cy6JRp89c1otLwp92Cs.name"
+	err := ioutil.WriteFile(orphan, []byte("dummy"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-extpass", "echo test", cDir)
+	outBin, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Log(string(outBin))
+		t.Errorf("fsck failed: %v", err)
+	}
+	if !strings.Contains(string(outBin), "orphaned") {
+		t.Errorf("orphaned .name file was not reported: %s", outBin)
+	}
+	if _, err := os.Stat(orphan); err != nil {
+		t.Errorf("orphaned .name file was deleted without -fix: %v", err)
+	}
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-fix", "-extpass", "echo test", cDir)
+	outBin, err = cmd.CombinedOutput()
+	if err != nil {
+		t.Log(string(outBin))
+		t.Errorf("fsck -fix failed: %v", err)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("orphaned .name file was not deleted: %v", err)
+	}
+}
+
+// TestFsckState checks that "-fsck-state" records clean checks only.
+func TestFsckState(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	state := cDir + ".fsck-state"
+	defer os.Remove(state)
+	fsck := func() int {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-extpass", "echo test", "-fsck-state", state, cDir)
+		outBin, err := cmd.CombinedOutput()
+		t.Log(string(outBin))
+		return test_helpers.ExtractCmdExitCode(err)
+	}
+	if code := fsck(); code != 0 {
+		t.Fatalf("fsck failed with exit code %d", code)
+	}
+	content, err := ioutil.ReadFile(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t1, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A corrupt diriv is always found, and is not recorded as a clean check
+	if err = os.Chmod(cDir+"/gocryptfs.diriv", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(cDir+"/gocryptfs.diriv", make([]byte, 16), 0400); err != nil {
+		t.Fatal(err)
+	}
+	if code := fsck(); code != exitcodes.DirIVCorrupt {
+		t.Errorf("wrong exit code, have=%d want=%d", code, exitcodes.DirIVCorrupt)
+	}
+	content2, _ := ioutil.ReadFile(state)
+	if string(content2) != string(content) {
+		t.Errorf("state file changed after a failed check: %q", content2)
+	}
+	if t1.After(time.Now()) {
+		t.Errorf("state time %v is in the future", t1)
+	}
+}
+
+// mkdirDeep creates a chain of "depth" directories named "d" in "dir".
+// Uses mkdirat so that the path length does not matter.
+func mkdirDeep(t *testing.T, dir string, depth int) {
+	fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < depth; i++ {
+		if err = syscall.Mkdirat(fd, "d", 0700); err != nil {
+			t.Fatal(err)
+		}
+		next, err := syscall.Openat(fd, "d", syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+		syscall.Close(fd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fd = next
+	}
+	syscall.Close(fd)
+}
+
+// TestMaxDepth checks that fsck does not descend into a pathologically
+// deep directory tree further than "-max-depth".
+func TestMaxDepth(t *testing.T) {
+	cDir := test_helpers.InitFS(t, "-plaintextnames")
+	mkdirDeep(t, cDir, 1500)
+	fsck := func(extraArgs ...string) (string, int) {
+		args := append([]string{"-fsck", "-extpass", "echo test"}, extraArgs...)
+		cmd := exec.Command(test_helpers.GocryptfsBinary, append(args, cDir)...)
+		out, err := cmd.CombinedOutput()
+		// The paths are very long, only look at the end of each line
+		lines := strings.Split(string(out), "\n")
+		for i, l := range lines {
+			if len(l) > 100 {
+				lines[i] = "..." + l[len(l)-100:]
+			}
+		}
+		return strings.Join(lines, "\n"), test_helpers.ExtractCmdExitCode(err)
+	}
+	out, code := fsck()
+	if code != exitcodes.FsckErrors || !strings.Contains(out, "more than 1024 levels deep") {
+		t.Errorf("default -max-depth: exit code %d, output:\n%s", code, out)
+	}
+	out, code = fsck("-max-depth=10")
+	if code != exitcodes.FsckErrors || !strings.Contains(out, "more than 10 levels deep") {
+		t.Errorf("-max-depth=10: exit code %d, output:\n%s", code, out)
+	}
+	if out, code = fsck("-max-depth=2000"); code != 0 {
+		t.Errorf("-max-depth=2000: exit code %d, output:\n%s", code, out)
+	}
+}
@@ -18,10 +18,15 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
 	"syscall"
 	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
 
 	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
@@ -399,6 +404,119 @@ func TestFileHoles(t *testing.T) {
 	}
 }
 
+// TestMmap checks that a read-only shared mapping sees the same bytes as
+// read(2). FUSE turns page faults into normal READ requests, so this mostly
+// checks that reads at page-aligned offsets across block boundaries work.
+func TestMmap(t *testing.T) {
+	fn := test_helpers.DefaultPlainDir + "/TestMmap"
+	// 3.5 blocks of non-repeating data, with a hole in the middle
+	content := make([]byte, 4096*3+2048)
+	for i := range content {
+		content[i] = byte(i * 7 / 13)
+	}
+	for i := 4000; i < 8200; i++ {
+		content[i] = 0
+	}
+	if err := ioutil.WriteFile(fn, content[:4000], 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(fn, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt(content[8200:], 8200); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	f, err = os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	m, err := syscall.Mmap(int(f.Fd()), 0, len(content), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Munmap(m)
+	// Read the end first, so the pages are not faulted in sequentially
+	for _, off := range []int{len(content) - 100, 4090, 0, 8190} {
+		if !bytes.Equal(m[off:off+10], content[off:off+10]) {
+			t.Errorf("offset %d: mmap content differs from what was written", off)
+		}
+	}
+	buf, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(m, buf) {
+		t.Errorf("mmap content differs from read(2)")
+	}
+}
+
+// SEEK_END must land at the plaintext size, which must match what stat
+// reports, also at and around block boundaries.
+func TestSeekEnd(t *testing.T) {
+	for _, size := range []int{1, 4095, 4096, 4097, 2*4096 - 1, 2 * 4096, 2*4096 + 1} {
+		fn := fmt.Sprintf("%s/TestSeekEnd.%d", test_helpers.DefaultPlainDir, size)
+		if err := ioutil.WriteFile(fn, make([]byte, size), 0600); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		end, err := f.Seek(0, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if end != int64(size) || fi.Size() != int64(size) {
+			t.Errorf("size %d: SEEK_END=%d, stat size=%d", size, end, fi.Size())
+		}
+		// The last byte is readable, nothing after it
+		buf := make([]byte, 2)
+		n, _ := f.ReadAt(buf, end-1)
+		if n != 1 {
+			t.Errorf("size %d: read %d bytes at the last byte, want 1", size, n)
+		}
+		f.Close()
+		syscall.Unlink(fn)
+	}
+}
+
+// TestMmapWrite checks that writes through a writable shared mapping end up
+// in the file.
+func TestMmapWrite(t *testing.T) {
+	fn := test_helpers.DefaultPlainDir + "/TestMmapWrite"
+	if err := ioutil.WriteFile(fn, make([]byte, 3*4096), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(fn, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	m, err := syscall.Mmap(int(f.Fd()), 0, 3*4096, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(m[4090:], "across the block boundary")
+	if err = unix.Msync(m, unix.MS_SYNC); err != nil {
+		t.Error(err)
+	}
+	syscall.Munmap(m)
+	buf := make([]byte, 25)
+	if _, err = f.ReadAt(buf, 4090); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "across the block boundary" {
+		t.Errorf("wrong content after msync: %q", buf)
+	}
+}
+
 // sContains - does the slice of strings "haystack" contain "needle"?
 func sContains(haystack []string, needle string) bool {
 	for _, element := range haystack {
@@ -540,6 +658,94 @@ func TestDirOverwrite(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	if test_helpers.VerifyExistence(dir1) {
+		t.Errorf("%q still exists after rename", dir1)
+	}
+	if !test_helpers.VerifyExistence(dir2) {
+		t.Errorf("%q is gone after rename", dir2)
+	}
+}
+
+// Overwriting a non-empty directory must fail with ENOTEMPTY and leave both
+// directories alone
+func TestDirOverwriteNonempty(t *testing.T) {
+	dir1 := test_helpers.DefaultPlainDir + "/DirOverwriteNonempty1"
+	dir2 := test_helpers.DefaultPlainDir + "/DirOverwriteNonempty2"
+	err := os.Mkdir(dir1, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(dir2, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(dir2+"/file", nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Rename(dir1, dir2)
+	if err != syscall.ENOTEMPTY && err != syscall.EEXIST {
+		t.Fatalf("want ENOTEMPTY or EEXIST, got %v", err)
+	}
+	if !test_helpers.VerifyExistence(dir1) || !test_helpers.VerifyExistence(dir2+"/file") {
+		t.Errorf("failed rename has modified the directories")
+	}
+}
+
+// Overwrite an empty directory with a long name with another directory with
+// a long name. The .name file of the target must survive, and the .name file
+// of the source must be deleted.
+func TestDirOverwriteLongNames(t *testing.T) {
+	if testcase.plaintextnames {
+		t.Skip("test only makes sense with encrypted names")
+	}
+	fi, err := ioutil.ReadDir(test_helpers.DefaultCipherDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cnt1 := len(fi)
+	wd := test_helpers.DefaultPlainDir + "/"
+	n255x := string(bytes.Repeat([]byte("x"), 255))
+	n255y := string(bytes.Repeat([]byte("y"), 255))
+	err = os.Mkdir(wd+n255x, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(wd+n255y, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(wd+n255x+"/file", []byte("content"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Rename(wd+n255x, wd+n255y)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if test_helpers.VerifyExistence(wd + n255x) {
+		t.Errorf("n255x still exists after rename")
+	}
+	if !test_helpers.VerifyExistence(wd + n255y + "/file") {
+		t.Errorf("n255y/file does not exist after rename")
+	}
+	err = syscall.Unlink(wd + n255y + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Rmdir(wd + n255y)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Check for orphaned files
+	fi, err = ioutil.ReadDir(test_helpers.DefaultCipherDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cnt2 := len(fi)
+	if cnt1 != cnt2 {
+		t.Errorf("Leftover files, cnt1=%d cnt2=%d", cnt1, cnt2)
+	}
 }
 
 func TestLongNames(t *testing.T) {
@@ -682,6 +888,132 @@ func TestLongLink(t *testing.T) {
 	}
 }
 
+// Hard links from and to long names, also across directories. Each new link
+// with a long name needs its own .name file.
+func TestLongLinkDirs(t *testing.T) {
+	wd := test_helpers.DefaultPlainDir + "/TestLongLinkDirs/"
+	n255x := string(bytes.Repeat([]byte("x"), 255))
+	n255y := string(bytes.Repeat([]byte("y"), 255))
+	for _, d := range []string{"a", "b", n255x} {
+		err := os.MkdirAll(wd+d, 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := ioutil.WriteFile(wd+"a/"+n255x, []byte("content"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := []string{
+		// long -> long, other dir
+		"b/" + n255x,
+		// long -> long, same dir
+		"a/" + n255y,
+		// long -> short
+		"b/short",
+		// long -> long, in a dir with a long name
+		n255x + "/" + n255y,
+	}
+	for _, l := range links {
+		err = os.Link(wd+"a/"+n255x, wd+l)
+		if err != nil {
+			t.Fatalf("%q: %v", l, err)
+		}
+	}
+	// Link to an existing long name must fail and leave the existing file alone
+	err = os.Link(wd+"b/short", wd+"a/"+n255y)
+	if err == nil {
+		t.Errorf("linking to an existing name should have failed")
+	}
+	for _, l := range append(links, "a/"+n255x) {
+		content, err := ioutil.ReadFile(wd + l)
+		if err != nil {
+			t.Errorf("%q: %v", l, err)
+			continue
+		}
+		if string(content) != "content" {
+			t.Errorf("%q: wrong content %q", l, content)
+		}
+		var st syscall.Stat_t
+		syscall.Stat(wd+l, &st)
+		if uint64(st.Nlink) != uint64(len(links)+1) {
+			t.Errorf("%q: wrong link count %d", l, st.Nlink)
+		}
+	}
+	// Deleting the original must not affect the links
+	err = syscall.Unlink(wd + "a/" + n255x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range links {
+		if !test_helpers.VerifyExistence(wd + l) {
+			t.Errorf("%q is gone after deleting the original", l)
+		}
+	}
+}
+
+// A .name file without content, as left behind by an interrupted operation,
+// must not prevent creating a hard link with this name.
+func TestLongLinkOrphan(t *testing.T) {
+	if testcase.plaintextnames {
+		t.Skip("test only makes sense with encrypted names")
+	}
+	wd := test_helpers.DefaultPlainDir + "/TestLongLinkOrphan/"
+	cDir := test_helpers.DefaultCipherDir + "/"
+	// Find out the ciphertext name of our directory by the listing diff
+	before, err := ioutil.ReadDir(cDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(wd, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := ioutil.ReadDir(cDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, fi := range before {
+		seen[fi.Name()] = true
+	}
+	for _, fi := range after {
+		if !seen[fi.Name()] {
+			cDir += fi.Name() + "/"
+		}
+	}
+	n255x := string(bytes.Repeat([]byte("x"), 255))
+	err = ioutil.WriteFile(wd+n255x, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Delete the content file, leaving the .name file behind
+	matches, err := filepath.Glob(cDir + "gocryptfs.longname.*")
+	if err != nil || len(matches) != 2 {
+		t.Fatalf("expected two files, have %v, err=%v", matches, err)
+	}
+	for _, m := range matches {
+		if !strings.HasSuffix(m, ".name") {
+			err = syscall.Unlink(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	err = ioutil.WriteFile(wd+"target", []byte("content"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Link(wd+"target", wd+n255x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(wd + n255x)
+	if err != nil || string(content) != "content" {
+		t.Errorf("content=%q err=%v", content, err)
+	}
+}
+
 func TestLchown(t *testing.T) {
 	name := test_helpers.DefaultPlainDir + "/symlink"
 	err := os.Symlink("/target/does/not/exist", name)
@@ -810,6 +1142,113 @@ func TestUtimesNanoFd(t *testing.T) {
 	doTestUtimesNano(t, procPath)
 }
 
+const _UTIME_NOW = ((1 << 30) - 1)
+
+// backingStat returns the stat data of the backing file of "plainPath",
+// found by its inode number.
+func backingStat(t *testing.T, plainPath string) (st syscall.Stat_t) {
+	var plainSt syscall.Stat_t
+	if err := syscall.Stat(plainPath, &plainSt); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	filepath.Walk(test_helpers.DefaultCipherDir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && !found && fi.Sys().(*syscall.Stat_t).Ino == plainSt.Ino {
+			st = *fi.Sys().(*syscall.Stat_t)
+			found = true
+		}
+		return nil
+	})
+	if !found {
+		t.Fatalf("backing file of %q not found", plainPath)
+	}
+	return st
+}
+
+// TestUtimesNanoNow checks UTIME_NOW and UTIME_OMIT, alone and mixed, by
+// path and by fd, on the plaintext and on the backing file.
+func TestUtimesNanoNow(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		t.Skipf("darwin does not support UTIME_NOW and UTIME_OMIT")
+	}
+	path := test_helpers.DefaultPlainDir + "/utimesnanonow"
+	if err := ioutil.WriteFile(path, []byte("foobar"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := [2]syscall.Timespec{{Sec: 10, Nsec: 11}, {Sec: 20, Nsec: 21}}
+	omit := syscall.Timespec{Nsec: _UTIME_OMIT}
+	now := syscall.Timespec{Nsec: _UTIME_NOW}
+	testcases := []struct {
+		name string
+		in   [2]syscall.Timespec
+		// Is the new atime / mtime "now"? Otherwise the old value must be
+		// kept (omit), or "in" must be set (explicit).
+		aNow, mNow bool
+	}{
+		{"omit atime, set mtime", [2]syscall.Timespec{omit, {Sec: 30, Nsec: 31}}, false, false},
+		{"now atime, omit mtime", [2]syscall.Timespec{now, omit}, true, false},
+		{"omit atime, now mtime", [2]syscall.Timespec{omit, now}, false, true},
+		{"both now", [2]syscall.Timespec{now, now}, true, true},
+		{"both explicit", [2]syscall.Timespec{{Sec: 40, Nsec: 41}, {Sec: 50, Nsec: 51}}, false, false},
+	}
+	// check verifies the timestamps for testcase "i". "t0" is the time just
+	// before the call.
+	check := func(i int, st syscall.Stat_t, t0 syscall.Timespec, where string) {
+		tc := testcases[i]
+		have := extractAtimeMtime(st)
+		for j, isNow := range []bool{tc.aNow, tc.mNow} {
+			want := tc.in[j]
+			if want.Nsec == _UTIME_OMIT {
+				want = old[j]
+			}
+			if isNow {
+				// The kernel uses a coarse clock, allow it to lag behind
+				if have[j].Sec < t0.Sec-1 {
+					t.Errorf("%s, %s: timestamp %d: want now (%d), have %d", tc.name, where, j, t0.Sec, have[j].Sec)
+				}
+			} else if !compareTimespec(want, have[j]) {
+				t.Errorf("%s, %s: timestamp %d: want=%+v, have=%+v", tc.name, where, j, want, have[j])
+			}
+		}
+	}
+	for _, byFd := range []bool{false, true} {
+		for i, tc := range testcases {
+			if err := syscall.UtimesNano(path, old[:]); err != nil {
+				t.Fatal(err)
+			}
+			t0 := syscall.NsecToTimespec(time.Now().UnixNano())
+			ts := []unix.Timespec{
+				{Sec: tc.in[0].Sec, Nsec: tc.in[0].Nsec},
+				{Sec: tc.in[1].Sec, Nsec: tc.in[1].Nsec},
+			}
+			var err error
+			if byFd {
+				f, err2 := os.Open(path)
+				if err2 != nil {
+					t.Fatal(err2)
+				}
+				err = unix.UtimesNanoAt(unix.AT_FDCWD, fmt.Sprintf("/proc/self/fd/%d", f.Fd()), ts, 0)
+				f.Close()
+			} else {
+				err = unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, 0)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var st syscall.Stat_t
+			if err = syscall.Stat(path, &st); err != nil {
+				t.Fatal(err)
+			}
+			where := "path"
+			if byFd {
+				where = "fd"
+			}
+			check(i, st, t0, where)
+			check(i, backingStat(t, path), t0, where+", backing file")
+		}
+	}
+}
+
 // Make sure the Mknod call works by creating a fifo (named pipe)
 func TestMkfifo(t *testing.T) {
 	path := test_helpers.DefaultPlainDir + "/fifo1"
@@ -828,6 +1267,48 @@ func TestMkfifo(t *testing.T) {
 	}
 }
 
+// TestFifoPoll writes to a fifo inside the mount and checks that poll(2)
+// reports read readiness only when there is data. Reads, writes and polls
+// on fifos are handled by the kernel's pipe implementation and never reach
+// gocryptfs, but make sure this keeps working.
+func TestFifoPoll(t *testing.T) {
+	path := test_helpers.DefaultPlainDir + "/TestFifoPoll"
+	err := syscall.Mkfifo(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Unlink(path)
+	r, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	w, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	fds := []unix.PollFd{{Fd: int32(r.Fd()), Events: unix.POLLIN}}
+	n, err := unix.Poll(fds, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("empty fifo is readable: revents=%#x", fds[0].Revents)
+	}
+	_, err = w.Write([]byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = unix.Poll(fds, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || fds[0].Revents&unix.POLLIN == 0 {
+		t.Errorf("fifo should be readable after write: n=%d revents=%#x", n, fds[0].Revents)
+	}
+}
+
 // TestMagicNames verifies that "magic" names are handled correctly
 // https://github.com/rfjakob/gocryptfs/issues/174
 func TestMagicNames(t *testing.T) {
@@ -915,3 +1396,41 @@ func TestChmod(t *testing.T) {
 		}
 	}
 }
+
+// The nlink of a directory must be 2 plus the number of subdirectories.
+// "find" relies on this to skip the stat() calls in leaf directories, and
+// would miss subdirectories if the count was too low.
+func TestDirNlink(t *testing.T) {
+	dir := test_helpers.DefaultPlainDir + "/TestDirNlink"
+	subdirs := []string{"a", "b", "c", "c/d", "c/d/e"}
+	for _, d := range subdirs {
+		err := os.MkdirAll(dir+"/"+d, 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Regular files must not count
+	err := ioutil.WriteFile(dir+"/file", nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]uint64{"": 5, "a": 2, "c": 3, "c/d": 3, "c/d/e": 2}
+	for d, n := range want {
+		var st syscall.Stat_t
+		err = syscall.Stat(dir+"/"+d, &st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uint64(st.Nlink) != n {
+			t.Errorf("%q: nlink=%d, want %d", d, st.Nlink, n)
+		}
+	}
+	out, err := exec.Command("find", dir, "-type", "d").CombinedOutput()
+	if err != nil {
+		t.Fatalf("find failed: %v, output: %s", err, out)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != len(subdirs)+1 {
+		t.Errorf("find found %d dirs, want %d:\n%s", len(lines), len(subdirs)+1, out)
+	}
+}
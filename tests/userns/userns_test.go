@@ -0,0 +1,98 @@
+package userns
+
+// Mounting inside an unprivileged user namespace, where gocryptfs mounts
+// without fusermount.
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// runInUserns runs the shell script "script" as root of a new user and mount
+// namespace, with our uid and gid mapped to 0.
+func runInUserns(t *testing.T, script string) string {
+	cmd := exec.Command("/bin/sh", "-e", "-c", script)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+	}
+	out, err := cmd.CombinedOutput()
+	if perr, ok := err.(*os.PathError); ok && (perr.Err == syscall.EPERM || perr.Err == syscall.EINVAL) {
+		t.Skipf("cannot create a user namespace: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	return string(out)
+}
+
+func TestMountInUserns(t *testing.T) {
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		t.Skip(err)
+	}
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	if err := os.Mkdir(pDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	gocryptfs, err := filepath.Abs(test_helpers.GocryptfsBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := fmt.Sprintf(`
+		%[1]s -q -extpass "echo test" %[2]s %[3]s
+		echo hello > %[3]s/file
+		mkdir %[3]s/dir
+		stat -c "plain %%n %%u:%%g" %[3]s/file %[3]s/dir
+		stat -c "cipher %%u:%%g" %[2]s/* | sort -u
+		umount %[3]s
+	`, gocryptfs, cDir, pDir)
+	out := runInUserns(t, script)
+	for _, want := range []string{
+		"plain " + pDir + "/file 0:0",
+		"plain " + pDir + "/dir 0:0",
+		"cipher 0:0",
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("missing %q in output:\n%s", want, out)
+		}
+	}
+	// Outside of the namespace, the files belong to us
+	var st syscall.Stat_t
+	matches, _ := filepath.Glob(cDir + "/*")
+	for _, m := range matches {
+		if err = syscall.Lstat(m, &st); err != nil {
+			t.Fatal(err)
+		}
+		if int(st.Uid) != os.Getuid() || int(st.Gid) != os.Getgid() {
+			t.Errorf("%s: owner %d:%d, want %d:%d", m, st.Uid, st.Gid, os.Getuid(), os.Getgid())
+		}
+	}
+}
+
+// -force_owner must name ids that exist in the namespace
+func TestForceOwnerUnmapped(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	if err := os.Mkdir(pDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	gocryptfs, err := filepath.Abs(test_helpers.GocryptfsBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := fmt.Sprintf(`%s -q -extpass "echo test" -force_owner 1234:1234 %s %s || echo "exit code $?"`,
+		gocryptfs, cDir, pDir)
+	out := runInUserns(t, script)
+	if !strings.Contains(out, "exit code 1\n") || !strings.Contains(out, "not mapped") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+}
@@ -232,3 +232,50 @@ func TestBase64XattrRead(t *testing.T) {
 		}
 	}
 }
+
+// With -preserve-xattr-on-rename, overwriting a file via rename must keep the
+// xattrs of the overwritten file, unless the incoming file has its own value.
+func TestXattrPreserveOnRename(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-preserve-xattr-on-rename")
+	defer test_helpers.UnmountPanic(mnt)
+	orig := mnt + "/orig"
+	tmp := mnt + "/tmp"
+	for _, fn := range []string{orig, tmp} {
+		err := ioutil.WriteFile(fn, []byte(fn), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := xattr.LSet(orig, "user.onlyorig", []byte("orig1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = xattr.LSet(orig, "user.both", []byte("orig2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = xattr.LSet(tmp, "user.both", []byte("tmp2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(tmp, orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"user.onlyorig": "orig1",
+		"user.both":     "tmp2",
+	}
+	for attr, val := range want {
+		have, err := xattr.LGet(orig, attr)
+		if err != nil {
+			t.Errorf("%s: %v", attr, err)
+			continue
+		}
+		if string(have) != val {
+			t.Errorf("%s: want=%q have=%q", attr, val, have)
+		}
+	}
+}
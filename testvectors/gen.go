@@ -0,0 +1,202 @@
+// +build ignore
+
+// gen.go writes vectors.go. Run "go generate" in this directory.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/testvectors"
+)
+
+// seq returns n bytes counting up from "start"
+func seq(start byte, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = start + byte(i)
+	}
+	return b
+}
+
+var masterKey = seq(0, cryptocore.KeyLen)
+
+// nameMax is NAME_MAX. Longer encrypted names are stored as long names.
+const nameMax = 255
+
+// blockAD returns the associated data of a content block, see
+// testvectors.ContentVector
+func blockAD(blockNo uint64, fileID []byte) []byte {
+	ad := make([]byte, 8, 8+len(fileID))
+	binary.BigEndian.PutUint64(ad, blockNo)
+	return append(ad, fileID...)
+}
+
+func genContent() (out []testvectors.ContentVector) {
+	combos := []struct {
+		name    string
+		backend cryptocore.AEADTypeEnum
+		ivBits  int
+		hkdf    bool
+	}{
+		{"AES-GCM-128 HKDF", cryptocore.BackendGoGCM, 128, true},
+		{"AES-GCM-128", cryptocore.BackendGoGCM, 128, false},
+		{"AES-GCM-96", cryptocore.BackendGoGCM, 96, false},
+		{"AES-SIV HKDF", cryptocore.BackendAESSIV, 128, true},
+	}
+	header := &contentenc.FileHeader{Version: contentenc.CurrentVersion, ID: seq(0x20, 16)}
+	plaintexts := [][]byte{
+		[]byte("gocryptfs test vector, block #0"),
+		[]byte("block #1"),
+	}
+	for _, c := range combos {
+		cCore := cryptocore.New(masterKey, c.backend, c.ivBits, c.hkdf, false)
+		cEnc := contentenc.New(cCore, contentenc.DefaultBS, false)
+		cipher := "AES-GCM"
+		if c.backend == cryptocore.BackendAESSIV {
+			cipher = "AES-SIV"
+		}
+		for blockNo, p := range plaintexts {
+			nonce := seq(0x40+byte(blockNo)*0x10, c.ivBits/8)
+			ct := cCore.AEADCipher.Seal(nonce, nonce, p, blockAD(uint64(blockNo), header.ID))
+			// Make sure the vector matches what gocryptfs reads
+			if p2, err := cEnc.DecryptBlock(ct, uint64(blockNo), header.ID); err != nil || !bytes.Equal(p, p2) {
+				log.Fatalf("%s: DecryptBlock failed: %v", c.name, err)
+			}
+			out = append(out, testvectors.ContentVector{
+				Name:       fmt.Sprintf("%s block #%d", c.name, blockNo),
+				Cipher:     cipher,
+				IVBits:     c.ivBits,
+				HKDF:       c.hkdf,
+				MasterKey:  hex.EncodeToString(masterKey),
+				Header:     hex.EncodeToString(header.Pack()),
+				BlockNo:    uint64(blockNo),
+				Nonce:      hex.EncodeToString(nonce),
+				Plaintext:  hex.EncodeToString(p),
+				Ciphertext: hex.EncodeToString(ct),
+			})
+		}
+	}
+	return out
+}
+
+func genNames() (out []testvectors.NameVector) {
+	combos := []struct {
+		name  string
+		hkdf  bool
+		raw64 bool
+	}{
+		{"HKDF Raw64", true, true},
+		{"HKDF", true, false},
+		{"no HKDF", false, false},
+	}
+	dirIV := seq(0x60, nametransform.DirIVLen)
+	names := []string{"foo", "Name with spaces and ümlauts", strings.Repeat("long name ", 20)}
+	for _, c := range combos {
+		cCore := cryptocore.New(masterKey, cryptocore.BackendGoGCM, 128, c.hkdf, false)
+		nt := nametransform.New(cCore.EMECipher, true, c.raw64)
+		for i, p := range names {
+			cName := nt.EncryptName(p, dirIV)
+			v := testvectors.NameVector{
+				Name:       fmt.Sprintf("%s name #%d", c.name, i),
+				HKDF:       c.hkdf,
+				Raw64:      c.raw64,
+				MasterKey:  hex.EncodeToString(masterKey),
+				DirIV:      hex.EncodeToString(dirIV),
+				Plaintext:  p,
+				Ciphertext: cName,
+			}
+			if len(cName) > nameMax {
+				v.Ciphertext = nt.HashLongName(cName)
+				v.LongName = cName
+			}
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func genConfigs() (out []testvectors.ConfigVector) {
+	dir, err := ioutil.TempDir("", "gen-testvectors")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	const password = "test"
+	combos := []struct {
+		name string
+		args configfile.CreateArgs
+	}{
+		{"default", configfile.CreateArgs{}},
+		{"AES-SIV", configfile.CreateArgs{AESSIV: true}},
+		{"PlaintextNames", configfile.CreateArgs{PlaintextNames: true}},
+	}
+	for _, c := range combos {
+		args := c.args
+		args.Filename = filepath.Join(dir, "gocryptfs.conf")
+		args.Password = []byte(password)
+		args.LogN = 10
+		args.Creator = "gocryptfs testvectors"
+		os.Remove(args.Filename)
+		if err := configfile.Create(&args); err != nil {
+			log.Fatal(err)
+		}
+		mk, _, err := configfile.LoadAndDecrypt(args.Filename, args.Password)
+		if err != nil {
+			log.Fatal(err)
+		}
+		js, err := ioutil.ReadFile(args.Filename)
+		if err != nil {
+			log.Fatal(err)
+		}
+		out = append(out, testvectors.ConfigVector{
+			Name:      c.name,
+			Password:  password,
+			Config:    string(js),
+			MasterKey: hex.EncodeToString(mk),
+		})
+	}
+	return out
+}
+
+func main() {
+	var b bytes.Buffer
+	b.WriteString("// Code generated by gen.go. DO NOT EDIT.\n\npackage testvectors\n\n")
+	b.WriteString("// Content contains encrypted file content blocks\nvar Content = []ContentVector{\n")
+	for _, v := range genContent() {
+		fmt.Fprintf(&b, "\t{\n\t\tName: %q,\n\t\tCipher: %q,\n\t\tIVBits: %d,\n\t\tHKDF: %v,\n\t\tMasterKey: %q,\n"+
+			"\t\tHeader: %q,\n\t\tBlockNo: %d,\n\t\tNonce: %q,\n\t\tPlaintext: %q,\n\t\tCiphertext: %q,\n\t},\n",
+			v.Name, v.Cipher, v.IVBits, v.HKDF, v.MasterKey, v.Header, v.BlockNo, v.Nonce, v.Plaintext, v.Ciphertext)
+	}
+	b.WriteString("}\n\n// Names contains encrypted file names\nvar Names = []NameVector{\n")
+	for _, v := range genNames() {
+		fmt.Fprintf(&b, "\t{\n\t\tName: %q,\n\t\tHKDF: %v,\n\t\tRaw64: %v,\n\t\tMasterKey: %q,\n\t\tDirIV: %q,\n"+
+			"\t\tPlaintext: %q,\n\t\tCiphertext: %q,\n\t\tLongName: %q,\n\t},\n",
+			v.Name, v.HKDF, v.Raw64, v.MasterKey, v.DirIV, v.Plaintext, v.Ciphertext, v.LongName)
+	}
+	b.WriteString("}\n\n// Configs contains config files and their master keys\nvar Configs = []ConfigVector{\n")
+	for _, v := range genConfigs() {
+		fmt.Fprintf(&b, "\t{\n\t\tName: %q,\n\t\tPassword: %q,\n\t\tMasterKey: %q,\n\t\tConfig: `%s`,\n\t},\n",
+			v.Name, v.Password, v.MasterKey, v.Config)
+	}
+	b.WriteString("}\n")
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile("vectors.go", src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,68 @@
+// Package testvectors contains test vectors for the gocryptfs on-disk
+// format: encrypted file contents, encrypted file names and config files
+// with their wrapped master keys. They were generated by gocryptfs itself
+// and are checked against the current implementation by "go test", so a
+// change that breaks compatibility with existing filesystems fails loudly.
+//
+// Other implementations can use them to check byte-exact compatibility.
+// All binary values are hex-encoded.
+//
+// The vectors are generated by gen.go. Content and name vectors are
+// deterministic. Config vectors get a new random master key and salt every
+// time, so only regenerate them when the config format changes.
+package testvectors
+
+//go:generate go run gen.go
+
+// ContentVector is one encrypted file content block
+type ContentVector struct {
+	Name string
+	// Cipher is "AES-GCM" or "AES-SIV"
+	Cipher string
+	// IVBits is the length of the per-block nonce. 96 bits is only used by
+	// filesystems created before gocryptfs v0.7 (no "GCMIV128" feature flag).
+	IVBits int
+	// HKDF is true if the content key is derived from the master key with
+	// HKDF ("HKDF" feature flag)
+	HKDF      bool
+	MasterKey string
+	// Header is the file header: version (uint16, big endian) and file ID
+	Header  string
+	BlockNo uint64
+	Nonce   string
+	// Plaintext of the block. Blocks are 4096 bytes except for the last
+	// block of a file, the vectors use short blocks to stay readable.
+	Plaintext string
+	// Ciphertext is the block as stored on disk: nonce, ciphertext, tag.
+	// The associated data is BlockNo (uint64, big endian) followed by the
+	// file ID.
+	Ciphertext string
+}
+
+// NameVector is one encrypted file name
+type NameVector struct {
+	Name string
+	// HKDF is true if the name key is derived from the master key with HKDF
+	HKDF bool
+	// Raw64 is true for unpadded base64 ("Raw64" feature flag)
+	Raw64     bool
+	MasterKey string
+	// DirIV is the content of the gocryptfs.diriv file of the directory
+	DirIV     string
+	Plaintext string
+	// Ciphertext is the name as stored on disk. For long names, this is the
+	// "gocryptfs.longname.*" name.
+	Ciphertext string
+	// LongName is the content of the "gocryptfs.longname.*.name" file, the
+	// full encrypted name. Empty for short names.
+	LongName string
+}
+
+// ConfigVector is a config file and the master key it decrypts to
+type ConfigVector struct {
+	Name     string
+	Password string
+	// Config is the content of gocryptfs.conf
+	Config    string
+	MasterKey string
+}
@@ -0,0 +1,113 @@
+package testvectors
+
+// Checks the test vectors against the current implementation. If one of
+// these tests fails, the on-disk format has changed, and gocryptfs can no
+// longer read existing filesystems. Do not regenerate the vectors to make
+// the failure go away.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestContent(t *testing.T) {
+	for _, v := range Content {
+		backends := []cryptocore.AEADTypeEnum{cryptocore.BackendAESSIV}
+		if v.Cipher == "AES-GCM" {
+			backends = []cryptocore.AEADTypeEnum{cryptocore.BackendGoGCM}
+			if v.IVBits == 128 && !stupidgcm.BuiltWithoutOpenssl {
+				backends = append(backends, cryptocore.BackendOpenSSL)
+			}
+		}
+		header, err := contentenc.ParseHeader(unhex(t, v.Header))
+		if err != nil {
+			t.Fatalf("%s: %v", v.Name, err)
+		}
+		for _, b := range backends {
+			cCore := cryptocore.New(unhex(t, v.MasterKey), b, v.IVBits, v.HKDF, false)
+			cEnc := contentenc.New(cCore, contentenc.DefaultBS, false)
+			ciphertext := unhex(t, v.Ciphertext)
+			plaintext := unhex(t, v.Plaintext)
+			p, err := cEnc.DecryptBlock(ciphertext, v.BlockNo, header.ID)
+			if err != nil || !bytes.Equal(p, plaintext) {
+				t.Errorf("FORMAT CHANGE: %s (backend %d): decryption failed: %v", v.Name, b, err)
+				continue
+			}
+			nonce := unhex(t, v.Nonce)
+			ad := make([]byte, 8, 8+len(header.ID))
+			binary.BigEndian.PutUint64(ad, v.BlockNo)
+			ad = append(ad, header.ID...)
+			c := cCore.AEADCipher.Seal(nonce, nonce, plaintext, ad)
+			if !bytes.Equal(c, ciphertext) {
+				t.Errorf("FORMAT CHANGE: %s (backend %d): ciphertext mismatch: %x", v.Name, b, c)
+			}
+		}
+	}
+}
+
+func TestNames(t *testing.T) {
+	for _, v := range Names {
+		cCore := cryptocore.New(unhex(t, v.MasterKey), cryptocore.BackendGoGCM, 128, v.HKDF, false)
+		nt := nametransform.New(cCore.EMECipher, true, v.Raw64)
+		dirIV := unhex(t, v.DirIV)
+		cName := nt.EncryptName(v.Plaintext, dirIV)
+		if v.LongName != "" {
+			if cName != v.LongName {
+				t.Errorf("FORMAT CHANGE: %s: long name mismatch: %q", v.Name, cName)
+			}
+			cName = nt.HashLongName(cName)
+		}
+		if cName != v.Ciphertext {
+			t.Errorf("FORMAT CHANGE: %s: ciphertext mismatch: %q", v.Name, cName)
+		}
+		encrypted := v.Ciphertext
+		if v.LongName != "" {
+			encrypted = v.LongName
+		}
+		p, err := nt.DecryptName(encrypted, dirIV)
+		if err != nil || p != v.Plaintext {
+			t.Errorf("FORMAT CHANGE: %s: decryption failed: %q %v", v.Name, p, err)
+		}
+	}
+}
+
+func TestConfigs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestConfigs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for i, v := range Configs {
+		path := filepath.Join(dir, v.Name+".conf")
+		if err = ioutil.WriteFile(path, []byte(v.Config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		mk, _, err := configfile.LoadAndDecrypt(path, []byte(v.Password))
+		if err != nil {
+			t.Errorf("FORMAT CHANGE: config #%d %s: %v", i, v.Name, err)
+			continue
+		}
+		if !bytes.Equal(mk, unhex(t, v.MasterKey)) {
+			t.Errorf("FORMAT CHANGE: config #%d %s: wrong master key %x", i, v.Name, mk)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// validateTmpdir checks that "dir" is a writeable directory on the same
+// filesystem as each of the directories in "targets". Temporary files are
+// renamed into the targets, which only works within one filesystem.
+func validateTmpdir(dir string, targets ...string) error {
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return fmt.Errorf("%q is not a directory", dir)
+	}
+	f, err := ioutil.TempFile(dir, ".gocryptfs.tmpdir-check.")
+	if err != nil {
+		return fmt.Errorf("%q is not writeable: %v", dir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	for _, t := range targets {
+		var stT syscall.Stat_t
+		if err := syscall.Stat(t, &stT); err != nil {
+			return err
+		}
+		if stT.Dev != st.Dev {
+			return fmt.Errorf("%q is not on the same filesystem as %q", dir, t)
+		}
+	}
+	return nil
+}
+
+// checkTmpdir validates "-tmpdir" and sets it up for the config file writes.
+// Calls os.Exit on errors.
+func checkTmpdir(args *argContainer) {
+	var err error
+	args.tmpdir, err = filepath.Abs(args.tmpdir)
+	if err == nil {
+		err = validateTmpdir(args.tmpdir, args.cipherdir, filepath.Dir(args.config))
+	}
+	if err != nil {
+		tlog.Fatal.Printf("Invalid \"-tmpdir\" setting: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	configfile.TmpDir = args.tmpdir
+}
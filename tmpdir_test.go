@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestValidateTmpdir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestValidateTmpdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = os.Mkdir(dir+"/tmp", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(dir+"/file", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = validateTmpdir(dir+"/tmp", dir); err != nil {
+		t.Error(err)
+	}
+	if validateTmpdir(dir+"/file", dir) == nil {
+		t.Error("a file was accepted as tmpdir")
+	}
+	if validateTmpdir(dir+"/nonexisting", dir) == nil {
+		t.Error("a nonexisting directory was accepted as tmpdir")
+	}
+	// /proc is never on the same filesystem as the test directory
+	if _, err = os.Stat("/proc/self"); err == nil && validateTmpdir(dir+"/tmp", "/proc") == nil {
+		t.Error("a different filesystem was accepted")
+	}
+	if os.Getuid() != 0 {
+		os.Chmod(dir+"/tmp", 0500)
+		defer os.Chmod(dir+"/tmp", 0700)
+		if validateTmpdir(dir+"/tmp", dir) == nil {
+			t.Error("a read-only directory was accepted as tmpdir")
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend_union"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// initUnionFS handles "-lowerdir". It unlocks the lower CIPHERDIR, which
+// has its own config file and password, and stacks "upper" on top of it.
+func initUnionFS(args *argContainer, upper pathfs.FileSystem, wipeUpper func()) (pathfs.FileSystem, func()) {
+	lowerArgs := *args
+	lowerArgs.cipherdir = args.lowerdir
+	lowerArgs.config = filepath.Join(args.lowerdir, configfile.ConfDefaultName)
+	lowerArgs._configCustom = false
+	// "-ctl-listen" serves the upper filesystem only. Do not start a second
+	// server on the same listener that would expose the lower one.
+	lowerArgs.ctllisten = ""
+	lowerArgs._ctlListenFd = nil
+	lowerArgs._ctlToken = ""
+	// The lower layer is never written to. Options that write on read, or
+	// that apply to the upper CIPHERDIR only, are cleared.
+	lowerArgs.ro = true
+	lowerArgs.burnafterreading = false
+	lowerArgs.strictatime = false
+	lowerArgs.unlockdir = nil
+	lowerArgs.snapshot = false
+	lowerArgs.flushinterval = 0
+	lowerArgs.scrubinterval = 0
+	tlog.Info.Printf("Unlocking lowerdir %s", args.lowerdir)
+	lower, wipeLower := initFuseFrontend(&lowerArgs)
+	u := fusefrontend_union.NewFS(lower, upper)
+	return u, func() {
+		wipeLower()
+		wipeUpper()
+	}
+}
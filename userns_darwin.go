@@ -0,0 +1,15 @@
+package main
+
+// User namespaces are Linux-only
+
+func isFusermountHelper() bool {
+	return false
+}
+
+func setupUsernsMount() {}
+
+func checkNamespaceOwner(uid, gid uint32) {}
+
+func fusermountHelper(argv []string) int {
+	return 1
+}
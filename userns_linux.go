@@ -0,0 +1,202 @@
+package main
+
+// Mounting inside a user namespace.
+//
+// go-fuse mounts and unmounts through the setuid "fusermount" helper. Setuid
+// binaries do not gain privileges inside a user namespace, so fusermount
+// cannot mount there. Root in a user namespace that owns its mount namespace
+// can mount FUSE filesystems itself, though (Linux 4.18 and later). In this
+// case, gocryptfs puts itself first in PATH under the name "fusermount" and
+// does the work of the helper: mount(2) /dev/fuse, and pass the file
+// descriptor back to go-fuse.
+//
+// The kernel translates the uids and gids of FUSE requests and replies
+// through the id map of the namespace that mounted the filesystem, so the
+// owners of the files are the same as in CIPHERDIR as seen from inside the
+// namespace.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// fusermountName is the name of the helper that go-fuse runs
+const fusermountName = "fusermount"
+
+// isFusermountHelper returns true if we have been started as the
+// fusermount replacement set up by setupUsernsMount
+func isFusermountHelper() bool {
+	return filepath.Base(os.Args[0]) == fusermountName
+}
+
+// setupUsernsMount makes go-fuse mount through gocryptfs itself if we run as
+// root in a user namespace. Calls os.Exit on errors.
+func setupUsernsMount() {
+	if os.Geteuid() != 0 || !syscallcompat.InUserNamespace() {
+		return
+	}
+	tlog.Debug.Printf("running in a user namespace, mounting without fusermount")
+	self, err := os.Executable()
+	if err == nil {
+		var dir string
+		dir, err = ioutil.TempDir("", "gocryptfs-userns.")
+		if err == nil {
+			exitcodes.AtExit(func() { os.RemoveAll(dir) })
+			err = os.Symlink(self, filepath.Join(dir, fusermountName))
+			os.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+		}
+	}
+	if err != nil {
+		tlog.Fatal.Printf("user namespace: cannot set up the mount helper: %v", err)
+		os.Exit(exitcodes.FuseNewServer)
+	}
+}
+
+// checkNamespaceOwner exits with a usage error if "-force_owner" names ids
+// that are not mapped into our user namespace. The kernel would show them
+// as the overflow id (usually 65534).
+func checkNamespaceOwner(uid, gid uint32) {
+	if !syscallcompat.InUserNamespace() {
+		return
+	}
+	uidMap, err1 := syscallcompat.ReadIDMap("/proc/self/uid_map")
+	gidMap, err2 := syscallcompat.ReadIDMap("/proc/self/gid_map")
+	if err1 != nil || err2 != nil {
+		tlog.Warn.Printf("force_owner: cannot read the id maps: %v %v", err1, err2)
+		return
+	}
+	if !uidMap.Contains(uid) || !gidMap.Contains(gid) {
+		tlog.Fatal.Printf("force_owner: %d:%d is not mapped into this user namespace", uid, gid)
+		os.Exit(exitcodes.Usage)
+	}
+}
+
+// fusermountHelper implements the parts of fusermount that go-fuse and
+// gocryptfs use:
+//
+//	fusermount MOUNTPOINT -o OPTIONS    (file descriptor passed on $_FUSE_COMMFD)
+//	fusermount -u [-z] MOUNTPOINT
+//
+// Returns the exit code.
+func fusermountHelper(argv []string) int {
+	var unmount, lazy bool
+	var opts, mountpoint string
+	for i := 0; i < len(argv); i++ {
+		switch argv[i] {
+		case "-u":
+			unmount = true
+		case "-z":
+			lazy = true
+		case "-q":
+		case "-o":
+			if i+1 < len(argv) {
+				i++
+				opts = argv[i]
+			}
+		default:
+			mountpoint = argv[i]
+		}
+	}
+	if mountpoint == "" {
+		fmt.Fprintf(os.Stderr, "%s: missing mountpoint\n", fusermountName)
+		return 1
+	}
+	var err error
+	if unmount {
+		flags := 0
+		if lazy {
+			flags = syscall.MNT_DETACH
+		}
+		err = syscall.Unmount(mountpoint, flags)
+	} else {
+		err = fusermountMount(mountpoint, opts)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s: %v\n", fusermountName, mountpoint, err)
+		return 1
+	}
+	return 0
+}
+
+// fusermountMount mounts /dev/fuse on "mountpoint" and sends the file
+// descriptor to the socket in $_FUSE_COMMFD.
+func fusermountMount(mountpoint string, opts string) error {
+	commfd, err := strconv.Atoi(os.Getenv("_FUSE_COMMFD"))
+	if err != nil {
+		return fmt.Errorf("invalid _FUSE_COMMFD: %v", err)
+	}
+	var st syscall.Stat_t
+	if err = syscall.Stat(mountpoint, &st); err != nil {
+		return err
+	}
+	fd, err := syscall.Open("/dev/fuse", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	source, fstype, flags, data := fuseMountArgs(opts)
+	data = append([]string{
+		fmt.Sprintf("fd=%d", fd),
+		fmt.Sprintf("rootmode=%o", st.Mode&syscall.S_IFMT),
+		fmt.Sprintf("user_id=%d", os.Getuid()),
+		fmt.Sprintf("group_id=%d", os.Getgid()),
+	}, data...)
+	err = syscall.Mount(source, mountpoint, fstype, flags, strings.Join(data, ","))
+	if err == syscall.EPERM {
+		return fmt.Errorf("%v. Mounting inside a user namespace needs a mount namespace "+
+			"that is owned by it, like with \"unshare -Urm\"", err)
+	} else if err != nil {
+		return err
+	}
+	err = syscall.Sendmsg(commfd, []byte{0}, syscall.UnixRights(fd), nil, 0)
+	if err != nil {
+		syscall.Unmount(mountpoint, syscall.MNT_DETACH)
+	}
+	return err
+}
+
+// fuseMountArgs splits the fusermount options "opts" into the arguments
+// of mount(2). Like fusermount, it defaults to "nosuid" and "nodev".
+func fuseMountArgs(opts string) (source string, fstype string, flags uintptr, data []string) {
+	source = "gocryptfs"
+	fstype = "fuse"
+	flags = syscall.MS_NOSUID | syscall.MS_NODEV
+	bits := map[string]uintptr{
+		"ro":     syscall.MS_RDONLY,
+		"nosuid": syscall.MS_NOSUID,
+		"nodev":  syscall.MS_NODEV,
+		"noexec": syscall.MS_NOEXEC,
+	}
+	clear := map[string]uintptr{
+		"rw":   syscall.MS_RDONLY,
+		"suid": syscall.MS_NOSUID,
+		"dev":  syscall.MS_NODEV,
+		"exec": syscall.MS_NOEXEC,
+	}
+	for _, o := range strings.Split(opts, ",") {
+		switch {
+		case o == "" || o == "nonempty":
+			// "nonempty" is a check done by fusermount, mount(2) does not care
+		case bits[o] != 0:
+			flags |= bits[o]
+		case clear[o] != 0:
+			flags &^= clear[o]
+		case strings.HasPrefix(o, "fsname="):
+			source = strings.TrimPrefix(o, "fsname=")
+		case strings.HasPrefix(o, "subtype="):
+			fstype = "fuse." + strings.TrimPrefix(o, "subtype=")
+		default:
+			data = append(data, o)
+		}
+	}
+	return source, fstype, flags, data
+}